@@ -0,0 +1,134 @@
+// Package tlsconfig provides the TLS listeners of the metaserver and the
+// relay. Certificates are reloaded when their files change, so renewed
+// certificates are used without restarting the servers.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes
+const kDefaultCheckInterval = 10 * time.Second
+
+// CertificateReloader serves a certificate and loads it again when its
+// certificate or key file changed.
+type CertificateReloader struct {
+	certFile, keyFile string
+
+	// Minimum time between two checks of the files
+	checkInterval time.Duration
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	// The modification times of the files the certificate was loaded from
+	certModTime, keyModTime time.Time
+	lastCheck               time.Time
+}
+
+// NewCertificateReloader loads the certificate from the given PEM files.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		checkInterval: kDefaultCheckInterval,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// load reads the files. Has to be called with the mutex held or before the
+// reloader is shared.
+func (r *CertificateReloader) load() error {
+	certModTime, err := modTime(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyModTime, err := modTime(r.keyFile)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.certificate = &certificate
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+	return nil
+}
+
+// reloadIfChangedLocked loads the files again if they changed since the last
+// time. Keeps the old certificate if loading fails, e.g. because only one of
+// the files has been replaced yet.
+func (r *CertificateReloader) reloadIfChangedLocked() {
+	now := time.Now()
+	if now.Sub(r.lastCheck) < r.checkInterval {
+		return
+	}
+	r.lastCheck = now
+	certModTime, err := modTime(r.certFile)
+	if err != nil {
+		log.Printf("Unable to check certificate %v: %v", r.certFile, err)
+		return
+	}
+	keyModTime, err := modTime(r.keyFile)
+	if err != nil {
+		log.Printf("Unable to check certificate key %v: %v", r.keyFile, err)
+		return
+	}
+	if certModTime.Equal(r.certModTime) && keyModTime.Equal(r.keyModTime) {
+		return
+	}
+	if err := r.load(); err != nil {
+		log.Printf("Unable to reload certificate %v: %v", r.certFile, err)
+		return
+	}
+	log.Printf("Reloaded certificate %v", r.certFile)
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reloadIfChangedLocked()
+	return r.certificate, nil
+}
+
+// Config returns a server configuration using the certificate.
+func (r *CertificateReloader) Config() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// Listen listens on the given address for TLS connections using the given
+// certificate and key files.
+func Listen(address, certFile, keyFile string) (net.Listener, error) {
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", address, reloader.Config())
+}
+
+// IsTLS returns whether the connection is secured by TLS.
+func IsTLS(conn interface{}) bool {
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
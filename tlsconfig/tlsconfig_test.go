@@ -0,0 +1,126 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type TLSSuite struct{}
+
+var _ = Suite(&TLSSuite{})
+
+func writeCertificate(c *C, dir string) (string, string) {
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	c.Assert(WriteSelfSignedCertificate(certFile, keyFile, "localhost", "127.0.0.1"), IsNil)
+	return certFile, keyFile
+}
+
+// touch pretends that the file has been changed later, since the files might
+// be written within the resolution of the modification time.
+func touch(c *C, path string, age time.Duration) {
+	when := time.Now().Add(age)
+	c.Assert(os.Chtimes(path, when, when), IsNil)
+}
+
+// handshake connects to the listener and returns the certificate it presents.
+func handshake(c *C, ln net.Listener) *x509.Certificate {
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func (s *TLSSuite) TestServesCertificate(c *C) {
+	certFile, keyFile := writeCertificate(c, c.MkDir())
+	ln, err := Listen("127.0.0.1:0", certFile, keyFile)
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	pem, err := ioutil.ReadFile(certFile)
+	c.Assert(err, IsNil)
+	roots := x509.NewCertPool()
+	c.Assert(roots.AppendCertsFromPEM(pem), Equals, true)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(IsTLS(conn), Equals, true)
+	data, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+}
+
+func (s *TLSSuite) TestReloadsChangedCertificate(c *C) {
+	dir := c.MkDir()
+	certFile, keyFile := writeCertificate(c, dir)
+	touch(c, certFile, -time.Hour)
+	touch(c, keyFile, -time.Hour)
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	c.Assert(err, IsNil)
+	reloader.checkInterval = 0
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", reloader.Config())
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	first := handshake(c, ln)
+	c.Assert(handshake(c, ln).SerialNumber, DeepEquals, first.SerialNumber)
+
+	// A half written update keeps the old certificate
+	c.Assert(ioutil.WriteFile(keyFile, []byte("garbage"), 0600), IsNil)
+	touch(c, keyFile, -time.Minute)
+	c.Assert(handshake(c, ln).SerialNumber, DeepEquals, first.SerialNumber)
+
+	writeCertificate(c, dir)
+	touch(c, certFile, 0)
+	touch(c, keyFile, 0)
+	c.Assert(handshake(c, ln).SerialNumber, Not(DeepEquals), first.SerialNumber)
+}
+
+func (s *TLSSuite) TestChecksFilesOnlyAfterInterval(c *C) {
+	dir := c.MkDir()
+	certFile, keyFile := writeCertificate(c, dir)
+	touch(c, certFile, -time.Hour)
+	touch(c, keyFile, -time.Hour)
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	c.Assert(err, IsNil)
+	first, err := reloader.GetCertificate(nil)
+	c.Assert(err, IsNil)
+
+	writeCertificate(c, dir)
+	got, err := reloader.GetCertificate(nil)
+	c.Assert(err, IsNil)
+	c.Assert(got, Equals, first)
+}
+
+func (s *TLSSuite) TestMissingFiles(c *C) {
+	dir := c.MkDir()
+	_, err := NewCertificateReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	c.Assert(err, NotNil)
+	_, err = Listen("127.0.0.1:0", filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	c.Assert(err, NotNil)
+}
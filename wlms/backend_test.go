@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	. "gopkg.in/check.v1"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// A game history, session history or tournament store
+type backend interface {
+	Close()
+}
+
+// backendTest checks that all backends of a store behave the same.
+type backendTest struct {
+	newInMemory func() backend
+	// Opens the file, creating it if necessary
+	openSqlite func(file string) (backend, error)
+	// Connects with the MySQL driver, see checkMySql
+	openMySql func() (backend, error)
+	// Fills the store and checks its queries. Closes the store.
+	check func(c *C, b backend)
+	// Checks what is left of check after the SQLite file has been opened
+	// again
+	reopened func(c *C, b backend)
+	// Calls every method of the store without looking at the results
+	use func(c *C, b backend)
+}
+
+func (t backendTest) checkInMemory(c *C) {
+	t.check(c, t.newInMemory())
+}
+
+func (t backendTest) checkSqlite(c *C) {
+	skipWithoutSqlite(c)
+	file := filepath.Join(c.MkDir(), "history.db")
+	b, err := t.openSqlite(file)
+	c.Assert(err, IsNil)
+	t.check(c, b)
+
+	b, err = t.openSqlite(file)
+	c.Assert(err, IsNil)
+	defer b.Close()
+	t.reopened(c, b)
+}
+
+// checkMySql lets the store create its tables and use them with a driver
+// that only records the statements. They have to work with MySQL.
+func (t backendTest) checkMySql(c *C) {
+	mySqlDriver = "wlms_sqltext"
+	defer func() {
+		mySqlDriver = "mymysql"
+	}()
+	sqlText.take()
+	b, err := t.openMySql()
+	c.Assert(err, IsNil)
+	t.use(c, b)
+	b.Close()
+	statements := sqlText.take()
+	c.Assert(statements, Not(HasLen), 0)
+	for _, statement := range statements {
+		for _, unsupported := range mySqlUnsupported {
+			c.Check(unsupported.MatchString(statement), Equals, false,
+				Commentf("%q in %q", unsupported.String(), statement))
+		}
+	}
+}
+
+// skipWithoutSqlite skips tests of the SQLite backend if the driver has not
+// been built in, see sqlite.go.
+func skipWithoutSqlite(c *C) {
+	if !sqliteSupported {
+		c.Skip("built without -tags sqlite")
+	}
+}
+
+// SQLite syntax MySQL does not understand
+var mySqlUnsupported = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bAUTOINCREMENT\b`),
+	regexp.MustCompile(`(?i)\bCREATE\s+INDEX\s+IF\s+NOT\s+EXISTS\b`),
+	regexp.MustCompile(`(?i)\bINSERT\s+OR\b`),
+	regexp.MustCompile(`(?i)\bON\s+CONFLICT\b`),
+	regexp.MustCompile(`(?i)\bRETURNING\b`),
+	// Keys need a length for these
+	regexp.MustCompile(`(?i)\b(TEXT|BLOB)\s+(NOT\s+NULL\s+)?(PRIMARY\s+KEY|UNIQUE)\b`),
+	// Strings are quoted with ' and names with `
+	regexp.MustCompile(`"`),
+}
+
+var sqlText = &sqlTextDriver{}
+
+func init() {
+	sql.Register("wlms_sqltext", sqlText)
+}
+
+// sqlTextDriver records the statements instead of running them. Queries have
+// no rows. The number of arguments is checked against the placeholders.
+type sqlTextDriver struct {
+	mutex      sync.Mutex
+	statements []string
+}
+
+// take returns the statements recorded since the last call.
+func (d *sqlTextDriver) take() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	statements := d.statements
+	d.statements = nil
+	return statements
+}
+
+func (d *sqlTextDriver) Open(name string) (driver.Conn, error) {
+	return sqlTextConn{d}, nil
+}
+
+type sqlTextConn struct {
+	d *sqlTextDriver
+}
+
+func (conn sqlTextConn) Prepare(query string) (driver.Stmt, error) {
+	conn.d.mutex.Lock()
+	conn.d.statements = append(conn.d.statements, query)
+	conn.d.mutex.Unlock()
+	return sqlTextStmt{query}, nil
+}
+
+func (conn sqlTextConn) Close() error {
+	return nil
+}
+
+func (conn sqlTextConn) Begin() (driver.Tx, error) {
+	return conn, nil
+}
+
+func (conn sqlTextConn) Commit() error {
+	return nil
+}
+
+func (conn sqlTextConn) Rollback() error {
+	return nil
+}
+
+type sqlTextStmt struct {
+	query string
+}
+
+func (s sqlTextStmt) Close() error {
+	return nil
+}
+
+func (s sqlTextStmt) NumInput() int {
+	return strings.Count(s.query, "?")
+}
+
+func (s sqlTextStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return sqlTextResult{}, nil
+}
+
+func (s sqlTextStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return sqlTextRows{}, nil
+}
+
+type sqlTextResult struct{}
+
+func (r sqlTextResult) LastInsertId() (int64, error) {
+	return 1, nil
+}
+
+func (r sqlTextResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+type sqlTextRows struct{}
+
+func (r sqlTextRows) Columns() []string {
+	return nil
+}
+
+func (r sqlTextRows) Close() error {
+	return nil
+}
+
+func (r sqlTextRows) Next(dest []driver.Value) error {
+	return io.EOF
+}
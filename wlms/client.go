@@ -2,11 +2,14 @@ package main
 
 import (
 	"fmt"
+	"github.com/widelands/widelands-metaserver/tlsconfig"
 	"github.com/widelands/widelands-metaserver/wlms/packet"
 	"log"
 	"net"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -51,11 +54,22 @@ const (
 	BUILD19 int = 0
 	BUILD20 int = 5
 	BUILD21 int = 6
+	// Supports TLS and is told about the TLS ports
+	BUILD22 int = 7
+	// Sends and receives the metadata of games
+	BUILD23 int = 8
+	// Can restrict who may join their games
+	BUILD24 int = 9
+	// Reports game results, is told the ratings of registered users and can
+	// use the matchmaking queue
+	BUILD25 int = 10
+	// Can ask for only its friends with CLIENTS
+	BUILD26 int = 11
 )
 
 func isSupportedVersion(version int) bool {
 	switch version {
-	case BUILD19, BUILD20, BUILD21:
+	case BUILD19, BUILD20, BUILD21, BUILD22, BUILD23, BUILD24, BUILD25, BUILD26:
 		return true
 	}
 	return false
@@ -68,6 +82,16 @@ type Client struct {
 	// We always read one whole packet and send it over this to the consumer.
 	dataStream chan *packet.Packet
 
+	// Packets waiting to be written to conn by the writing loop.
+	outgoing chan []byte
+
+	// Closed to make the writing loop send the remaining packets and close conn.
+	closing     chan bool
+	closingOnce *sync.Once
+
+	// Set when outgoing overflowed. Further packets are dropped.
+	sendQueueFull bool
+
 	// the current connection state.
 	state State
 
@@ -100,6 +124,12 @@ type Client struct {
 	// The game we are currently in. nil if not in game.
 	game *Game
 
+	// The friends of the registered user for the CLIENTS filter. nil until
+	// they have been read, see withFriends. The version counts the changes,
+	// so friends that were read before one are not kept.
+	friends        map[string]bool
+	friendsVersion int
+
 	// Various state variables needed for fulfilling the protocol.
 	startToPingTimer *time.Timer
 	timeoutTimer     *time.Timer
@@ -113,6 +143,18 @@ type Client struct {
 	// Wether the client has been announced in the chat and is returned
 	// in client lists
 	wasAnnounced bool
+
+	// Whether the client asked not to be listed on the website
+	hiddenFromWeb bool
+
+	// The id of the session in the session history. 0 if there is none.
+	session int64
+
+	// When the connection to the client has been lost or closed
+	disconnected time.Time
+
+	// The rating of a registered user
+	rating int
 }
 
 const ANNOUNCE_DELAY time.Duration = 3
@@ -130,7 +172,7 @@ type InvalidPacketError struct{}
 func (c Client) State() State {
 	return c.state
 }
-func (c *Client) setState(s State, server Server) {
+func (c *Client) setState(s State, server *Server) {
 	need_broadcast := false
 	switch s {
 	case HANDSHAKE, RECENTLY_DISCONNECTED:
@@ -174,7 +216,11 @@ func (client *Client) setGame(game *Game, server *Server) {
 
 	if game != nil {
 		client.game = game
-		game.AddPlayer(client.Name())
+		if !game.GotJoinToken(client.Name()) {
+			// Users with a join token are added once the relay reports them
+			game.AddPlayer(client.Name())
+		}
+		server.matchQueue.Remove(client)
 	}
 	server.BroadcastToConnectedClients("CLIENTS_UPDATE")
 }
@@ -187,17 +233,24 @@ func (c *Client) TimeLastMessage() time.Time {
 	return c.timeLastMessage
 }
 
-func (client *Client) Disconnect(server Server) {
-	client.conn.Close()
+func (client *Client) Disconnect(server *Server) {
+	if client.conn != nil {
+		client.closeConnection()
+	}
+	if client.state != RECENTLY_DISCONNECTED {
+		client.disconnected = time.Now()
+	}
 	client.setState(RECENTLY_DISCONNECTED, server)
 }
 
-func (client *Client) Announce(server Server) {
+func (client *Client) Announce(server *Server) {
 	time.Sleep(ANNOUNCE_DELAY * time.Second)
-	client.AnnounceNow(server)
+	server.call(func() {
+		client.AnnounceNow(server)
+	})
 }
 
-func (client *Client) AnnounceNow(server Server) {
+func (client *Client) AnnounceNow(server *Server) {
 	if client.wasAnnounced && !server.HasClientObject(client) {
 		// Client was connected but is no longer. Send "removed" messages
 		server.BroadcastToIrcFromUser(client.Name()+" has left the lobby", client.Name())
@@ -212,110 +265,185 @@ func (client *Client) AnnounceNow(server Server) {
 	// All other cases: Nothing to do, it was only a short connect/disconnect
 }
 
+// SendPacket queues the packet for sending. A client that does not keep up
+// with reading its packets is disconnected, so it can not stall the server.
 func (client *Client) SendPacket(data ...interface{}) {
-	if client.conn != nil {
-		_, err := client.conn.Write(packet.New(data...))
+	if client.conn == nil || client.sendQueueFull {
+		return
+	}
+	select {
+	case client.outgoing <- packet.New(data...):
+	default:
+		log.Printf("Warning: Send queue of client %v is full. Will disconnect", client.Name())
+		client.sendQueueFull = true
+		// The client notices this when its reading loop ends
+		client.conn.Close()
+	}
+}
+
+// closeConnection makes the writing loop close the connection once all queued
+// packets have been sent.
+func (client *Client) closeConnection() {
+	client.closingOnce.Do(func() {
+		close(client.closing)
+	})
+}
+
+// writingLoop writes the queued packets to the connection. If a write takes
+// longer than the write timeout of the server, the connection is closed.
+func (client *Client) writingLoop(server *Server) {
+	failed := false
+	write := func(data []byte) {
+		if failed {
+			return
+		}
+		deadline := time.AfterFunc(server.ClientWriteTimeout(), func() {
+			log.Printf("Warning: Timeout while sending data to %v", client.conn.RemoteAddr())
+			client.conn.Close()
+		})
+		_, err := client.conn.Write(data)
+		deadline.Stop()
 		if err != nil {
-			log.Printf("Warning: Error while sending data to client %v: %v", client.Name(), err)
+			log.Printf("Warning: Error while sending data to %v: %v", client.conn.RemoteAddr(), err)
+			failed = true
+		}
+	}
+	for {
+		select {
+		case data := <-client.outgoing:
+			write(data)
+		case <-client.closing:
+			for {
+				select {
+				case data := <-client.outgoing:
+					write(data)
+				default:
+					client.conn.Close()
+					return
+				}
+			}
 		}
 	}
 }
 
 func DealWithNewConnection(conn ReadWriteCloserWithIp, server *Server) {
-	client := newClient(conn)
-	go client.readingLoop(*server)
+	client := newClient(conn, server.ClientSendQueueSize())
+	go client.readingLoop()
+	go client.writingLoop(server)
 
 	defer func() {
+		// Stop the writing loop if that did not happen already
+		client.closeConnection()
 		time.AfterFunc(server.ClientForgetTimeout(), func() {
-			if server.HasClient(client.Name()) == client {
-				client.setGame(nil, server)
-				server.RemoveClient(client)
-			}
+			server.post(func() {
+				if server.HasClient(client.Name()) == client {
+					client.setGame(nil, server)
+					server.RemoveClient(client, "CONNECTION_LOST")
+				}
+			})
 		})
 	}()
 
-	client.startToPingTimer.Reset(server.PingCycleTime())
-	client.timeoutTimer.Reset(server.ClientSendingTimeout())
-	client.waitingForPong = false
+	resetTimer(client.startToPingTimer, server.PingCycleTime())
+	resetTimer(client.timeoutTimer, server.ClientSendingTimeout())
 
+	// Everything that touches the state of the server is done on its main loop.
 	for {
+		done := false
+		var handled bool
 		select {
 		case pkg, ok := <-client.dataStream:
-			if !ok {
-				if client.state != RECENTLY_DISCONNECTED {
-					log.Printf("Empty data stream for client %v. Will disconnect", client.Name())
-					client.failedPong(server)
-				}
-				// Else the receive failed due to a Disconnect() which is fine
-				return
-			}
-			client.waitingForPong = false
-			client.startToPingTimer.Reset(server.PingCycleTime())
-			client.timeoutTimer.Reset(server.ClientSendingTimeout())
-
-			if client.pendingLogin != nil {
-				log.Printf("Dealing with pending login for client %v, new client is %v", client.Name(), client.pendingLogin.Name())
-				if client.pendingLogin.replaceCandidates == nil {
-					// legacy path
-					client.pendingLogin.SendPacket("ERROR", "RELOGIN", "CONNECTION_STILL_ALIVE")
-					client.pendingLogin.Disconnect(*server)
+			handled = server.call(func() {
+				done = client.handlePacket(server, pkg, ok)
+			})
+
+		case <-client.timeoutTimer.C:
+			handled = server.call(func() {
+				log.Printf("Timeout of client %v", client.userName)
+				client.SendPacket("DISCONNECT", "CLIENT_TIMEOUT")
+				client.Disconnect(server)
+			})
+
+		case <-client.startToPingTimer.C:
+			handled = server.call(func() {
+				if !client.waitingForPong {
+					client.restartPingLoop(server.PingCycleTime())
 				} else {
-					// replaceCandidates might be an empty list but won't be nil
-					client.pendingLogin.checkCandidates(server)
+					log.Printf("Client %v failed to PONG. Will disconnect", client.Name())
+					client.failedPong(server)
 				}
-				client.pendingLogin = nil
-			}
+			})
+		}
+		if done || !handled {
+			return
+		}
+	}
+}
 
-			cmdName, err := pkg.ReadString()
-			if err != nil {
-				client.Disconnect(*server)
-				return
-			}
+// handlePacket deals with a packet received from the client. ok is false if
+// the connection has been closed. Returns whether the client is done.
+func (client *Client) handlePacket(server *Server, pkg *packet.Packet, ok bool) bool {
+	if !ok {
+		if client.state != RECENTLY_DISCONNECTED {
+			log.Printf("Empty data stream for client %v. Will disconnect", client.Name())
+			client.failedPong(server)
+		}
+		// Else the receive failed due to a Disconnect() which is fine
+		return true
+	}
+	client.waitingForPong = false
+	resetTimer(client.startToPingTimer, server.PingCycleTime())
+	resetTimer(client.timeoutTimer, server.ClientSendingTimeout())
 
-			client.timeLastMessage = time.Now()
-			handlerFunc := reflect.ValueOf(client).MethodByName(strings.Join([]string{"Handle_", cmdName}, ""))
-			pkgErr := CmdError(InvalidPacketError{})
-			if handlerFunc.IsValid() {
-				handlerFunc := handlerFunc.Interface().(func(*Server, *packet.Packet) CmdError)
-				pkgErr = handlerFunc(server, pkg)
-			}
-			if pkgErr != nil {
-				switch pkgErr := pkgErr.(type) {
-				case CmdPacketError:
-					log.Printf("Error while handling command %v for client %v: %v", cmdName, client.Name(), pkgErr.What)
-					client.SendPacket("ERROR", cmdName, pkgErr.What)
-				case CriticalCmdPacketError:
-					log.Printf("Critical error while handling command %v for client %v: %v", cmdName, client.Name(), pkgErr.What)
-					client.SendPacket("ERROR", cmdName, pkgErr.What)
-					client.Disconnect(*server)
-				case InvalidPacketError:
-					log.Printf("Error while handling invalid command %v from client %v", cmdName, client.Name())
-					client.SendPacket("ERROR", "GARBAGE_RECEIVED", "INVALID_CMD")
-					client.Disconnect(*server)
-				default:
-					log.Fatal("Unknown error type returned by handler function")
-				}
-			}
+	if client.pendingLogin != nil {
+		log.Printf("Dealing with pending login for client %v, new client is %v", client.Name(), client.pendingLogin.Name())
+		if client.pendingLogin.replaceCandidates == nil {
+			// legacy path
+			client.pendingLogin.SendPacket("ERROR", "RELOGIN", "CONNECTION_STILL_ALIVE")
+			client.pendingLogin.Disconnect(server)
+		} else {
+			// replaceCandidates might be an empty list but won't be nil
+			client.pendingLogin.checkCandidates(server)
+		}
+		client.pendingLogin = nil
+	}
 
-		case <-client.timeoutTimer.C:
-			log.Printf("Timeout of client %v", client.userName)
-			client.SendPacket("DISCONNECT", "CLIENT_TIMEOUT")
-			client.Disconnect(*server)
+	cmdName, err := pkg.ReadString()
+	if err != nil {
+		client.Disconnect(server)
+		return true
+	}
 
-		case <-client.startToPingTimer.C:
-			if !client.waitingForPong {
-				client.restartPingLoop(server.PingCycleTime())
-			} else {
-				log.Printf("Client %v failed to PONG. Will disconnect", client.Name())
-				client.failedPong(server)
-			}
+	client.timeLastMessage = time.Now()
+	handlerFunc := reflect.ValueOf(client).MethodByName(strings.Join([]string{"Handle_", cmdName}, ""))
+	pkgErr := CmdError(InvalidPacketError{})
+	if handlerFunc.IsValid() {
+		handlerFunc := handlerFunc.Interface().(func(*Server, *packet.Packet) CmdError)
+		pkgErr = handlerFunc(server, pkg)
+	}
+	if pkgErr != nil {
+		switch pkgErr := pkgErr.(type) {
+		case CmdPacketError:
+			log.Printf("Error while handling command %v for client %v: %v", cmdName, client.Name(), pkgErr.What)
+			client.SendPacket("ERROR", cmdName, pkgErr.What)
+		case CriticalCmdPacketError:
+			log.Printf("Critical error while handling command %v for client %v: %v", cmdName, client.Name(), pkgErr.What)
+			client.SendPacket("ERROR", cmdName, pkgErr.What)
+			client.Disconnect(server)
+		case InvalidPacketError:
+			log.Printf("Error while handling invalid command %v from client %v", cmdName, client.Name())
+			client.SendPacket("ERROR", "GARBAGE_RECEIVED", "INVALID_CMD")
+			client.Disconnect(server)
+		default:
+			log.Fatal("Unknown error type returned by handler function")
 		}
 	}
+	return false
 }
 
 func (client *Client) failedPong(server *Server) {
 	client.SendPacket("DISCONNECT", "CLIENT_TIMEOUT")
-	client.Disconnect(*server)
+	client.Disconnect(server)
 	if client.pendingLogin != nil {
 		if client.pendingLogin.replaceCandidates == nil {
 			// legacy path
@@ -326,16 +454,19 @@ func (client *Client) failedPong(server *Server) {
 			pending := client.pendingLogin
 			pending.userName = client.userName
 			pending.game = client.game
-			server.RemoveClient(client)
+			server.RemoveClient(client, "REPLACED")
 			pending.loginDone(server)
 		}
 	}
 }
 
-func newClient(r ReadWriteCloserWithIp) *Client {
+func newClient(r ReadWriteCloserWithIp, sendQueueSize int) *Client {
 	client := &Client{
 		conn:              r,
 		dataStream:        make(chan *packet.Packet, 10),
+		outgoing:          make(chan []byte, sendQueueSize),
+		closing:           make(chan bool),
+		closingOnce:       &sync.Once{},
 		state:             HANDSHAKE,
 		permissions:       UNREGISTERED,
 		startToPingTimer:  time.NewTimer(time.Hour * 1),
@@ -358,7 +489,7 @@ func NewIRCClient(nick string) *Client {
 	return client
 }
 
-func (client *Client) readingLoop(server Server) {
+func (client *Client) readingLoop() {
 	defer close(client.dataStream)
 	for {
 		pkg, err := packet.Read(client.conn)
@@ -369,12 +500,24 @@ func (client *Client) readingLoop(server Server) {
 	}
 }
 
+// resetTimer restarts the timer. A tick that has not been received yet is
+// dropped, so a timer that expired while a packet was handled does not fire.
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
 func (client *Client) restartPingLoop(pingCycleTime time.Duration) {
 	if client.state == CONNECTED {
 		client.SendPacket("PING")
 		client.waitingForPong = true
 	}
-	client.startToPingTimer.Reset(pingCycleTime)
+	resetTimer(client.startToPingTimer, pingCycleTime)
 }
 
 func (client Client) remoteIp() string {
@@ -387,11 +530,14 @@ func (client Client) remoteIp() string {
 
 func (newClient *Client) successfulRelogin(server *Server, oldClient *Client) {
 	// legacy function
-	server.RemoveClient(oldClient)
+	// The session goes on with the new connection
+	newClient.session, oldClient.session = oldClient.session, 0
+	server.RemoveClient(oldClient, "RELOGIN")
+	newClient.loadRating(server)
 
 	newClient.SendPacket("RELOGIN")
 	server.AddClient(newClient)
-	newClient.setState(CONNECTED, *server)
+	newClient.setState(CONNECTED, server)
 }
 
 func (client *Client) Handle_CHAT(server *Server, pkg *packet.Packet) CmdError {
@@ -399,13 +545,17 @@ func (client *Client) Handle_CHAT(server *Server, pkg *packet.Packet) CmdError {
 	if err := pkg.Unpack(&message, &receiver); err != nil {
 		return CmdPacketError{err.Error()}
 	}
+	message = server.ValidationPolicy().FilterChatMessage(message)
 
 	if len(receiver) == 0 {
 		if !client.wasAnnounced {
-			client.AnnounceNow(*server)
+			client.AnnounceNow(server)
 		}
 		server.BroadcastToConnectedClients("CHAT", client.Name(), message, "public")
 		server.BroadcastToIrc(client.Name() + ": " + message)
+		if !client.hiddenFromWeb {
+			server.feed.AddChat(client.Name(), message)
+		}
 	} else {
 		recv_client := server.HasClient(receiver)
 		recv_client_irc := server.HasIRCClient(receiver)
@@ -434,6 +584,46 @@ func (client *Client) Handle_CMD(server *Server, pkg *packet.Packet) CmdError {
 		return CmdPacketError{err.Error()}
 	}
 
+	// Commands everybody may use
+	switch cmd {
+	case "seen":
+		client.SendPacket("CHAT", "", lastSeen(server, params), "system")
+		return nil
+	case "tournament":
+		return client.tournamentCmd(server, params)
+	case "friend":
+		return client.friendCmd(server, params)
+	case "friends":
+		return client.friendsCmd(server)
+	case "leaderboard":
+		n := kLeaderboardShown
+		if params != "" {
+			var err error
+			if n, err = strconv.Atoi(params); err != nil || n <= 0 || n > kLeaderboardMax {
+				return CmdPacketError{"INVALID_CMD_PARAMETERS"}
+			}
+		}
+		var leaders []PlayerRating
+		var err error
+		server.async(func() {
+			leaders, err = server.UserDb().Leaderboard(n)
+		}, func() {
+			if err != nil {
+				log.Printf("Unable to read the leaderboard: %v", err)
+				client.SendPacket("CHAT", "", "Unable to read the leaderboard.", "system")
+				return
+			}
+			if len(leaders) == 0 {
+				client.SendPacket("CHAT", "", "Nobody has played a rated game yet.", "system")
+				return
+			}
+			for i, leader := range leaders {
+				client.SendPacket("CHAT", "", fmt.Sprintf("%d. %s: %d (%d games)", i+1, leader.Name, leader.Rating, leader.Games), "system")
+			}
+		})
+		return nil
+	}
+
 	if client.permissions != SUPERUSER {
 		return CmdPacketError{"DEFICIENT_PERMISSION"}
 	}
@@ -443,17 +633,18 @@ func (client *Client) Handle_CMD(server *Server, pkg *packet.Packet) CmdError {
 		recv_client := server.HasClient(params)
 		if recv_client != nil && recv_client.permissions != SUPERUSER {
 			server.AddKickedClient(recv_client)
-			recv_client.Disconnect(*server)
-			server.RemoveClient(recv_client)
+			recv_client.Disconnect(server)
+			server.RemoveClient(recv_client, "KICKED")
 			client.SendPacket("CHAT", "", "Kicked the user for 5 minutes.", "system")
 			return nil
 		}
 		game := server.HasGame(params)
 		if game != nil {
 			if game.UsesRelay() {
-				server.RelayRemoveGame(params)
+				// Nothing depends on the answer of the relay
+				go server.RelayRemoveGame(params)
 			}
-			server.RemoveGame(game)
+			server.RemoveGame(game, "KICKED")
 			return nil
 		}
 		if recv_client != nil && recv_client.permissions == SUPERUSER {
@@ -477,8 +668,8 @@ func (client *Client) Handle_CMD(server *Server, pkg *packet.Packet) CmdError {
 				return nil
 			}
 			server.AddBannedClient(recv_client)
-			recv_client.Disconnect(*server)
-			server.RemoveClient(recv_client)
+			recv_client.Disconnect(server)
+			server.RemoveClient(recv_client, "BANNED")
 			client.SendPacket("CHAT", "", "Banning the IP of the user for 24 hours.", "system")
 			return nil
 		}
@@ -491,6 +682,75 @@ func (client *Client) Handle_CMD(server *Server, pkg *packet.Packet) CmdError {
 			client.SendPacket("ERROR", "CMD", "NO_SUCH_USER")
 			return nil
 		}
+	case "record":
+		game := server.HasGame(params)
+		if game == nil || !game.UsesRelay() {
+			client.SendPacket("CHAT", "", "There is no game on the relay with this name.", "system")
+			return nil
+		}
+		var recording bool
+		server.async(func() {
+			recording = server.RelayRecordGame(params)
+		}, func() {
+			if recording {
+				client.SendPacket("CHAT", "", "Recording the game.", "system")
+			} else {
+				client.SendPacket("CHAT", "", "Unable to record the game.", "system")
+			}
+		})
+	case "games":
+		games, err := server.GameHistory().PlayerGames(params, kHistoryGamesShown)
+		if err != nil {
+			log.Printf("Unable to read the games of %v from the history: %v", params, err)
+			client.SendPacket("CHAT", "", "Unable to read the history.", "system")
+			return nil
+		}
+		if len(games) == 0 {
+			client.SendPacket("CHAT", "", "The player has not played any games.", "system")
+			return nil
+		}
+		for _, game := range games {
+			client.SendPacket("CHAT", "", formatGameRecord(game), "system")
+		}
+	case "gamestats":
+		days := 7
+		if params != "" {
+			var err error
+			if days, err = strconv.Atoi(params); err != nil || days <= 0 {
+				return CmdPacketError{"INVALID_CMD_PARAMETERS"}
+			}
+		}
+		now := time.Now()
+		stats, err := server.GameHistory().Statistics(now.AddDate(0, 0, -days), now)
+		if err != nil {
+			log.Printf("Unable to read the statistics from the history: %v", err)
+			client.SendPacket("CHAT", "", "Unable to read the history.", "system")
+			return nil
+		}
+		client.SendPacket("CHAT", "", fmt.Sprintf("%d games in the last %d days, %d started, lasting %v on average.",
+			stats.NrGames, days, stats.NrStartedGames, stats.AverageDuration.Round(time.Minute)), "system")
+		for _, day := range stats.GamesPerDay {
+			client.SendPacket("CHAT", "", fmt.Sprintf("%s: %d games", day.Day.Format("2006-01-02"), day.NrGames), "system")
+		}
+	case "userstats":
+		days := 7
+		if params != "" {
+			var err error
+			if days, err = strconv.Atoi(params); err != nil || days <= 0 {
+				return CmdPacketError{"INVALID_CMD_PARAMETERS"}
+			}
+		}
+		now := time.Now()
+		stats, err := server.SessionHistory().Statistics(now.AddDate(0, 0, -days), now)
+		if err != nil {
+			log.Printf("Unable to read the statistics from the session history: %v", err)
+			client.SendPacket("CHAT", "", "Unable to read the history.", "system")
+			return nil
+		}
+		client.SendPacket("CHAT", "", fmt.Sprintf("%d sessions of %d users from %d addresses in the last %d days.",
+			stats.NrSessions, stats.UniqueUsers, stats.UniqueAddresses, days), "system")
+		client.SendPacket("CHAT", "", fmt.Sprintf("At most %d users were online at the same time, first at %s.",
+			stats.PeakConcurrency, stats.PeakTime.UTC().Format("2006-01-02 15:04")), "system")
 	case "warn":
 		parts := strings.SplitN(params, " ", 2)
 		if len(parts) != 2 {
@@ -517,6 +777,163 @@ func (client *Client) Handle_CMD(server *Server, pkg *packet.Packet) CmdError {
 	return nil
 }
 
+// Number of games shown by "CMD games"
+const kHistoryGamesShown = 10
+
+// formatGameRecord describes a game of the history for an admin.
+func formatGameRecord(game GameRecord) string {
+	played := "not started"
+	if !game.Started.IsZero() {
+		played = "played " + game.Duration().Round(time.Minute).String()
+	}
+	return fmt.Sprintf("%s '%s' (%s) hosted by %s with %s, %s, %s",
+		game.Opened.UTC().Format("2006-01-02 15:04"), game.Name, game.BuildId, game.Host,
+		strings.Join(game.Players, ", "), played, game.EndReason)
+}
+
+// lastSeen tells when the user has last been in the lobby.
+func lastSeen(server *Server, name string) string {
+	other := server.HasClient(name)
+	if other != nil && other.State() == CONNECTED {
+		return fmt.Sprintf("%s is online.", name)
+	}
+	session, found, err := server.SessionHistory().LastSession(name)
+	if err != nil {
+		log.Printf("Unable to read the last session of %v from the history: %v", name, err)
+		return "Unable to read the history."
+	}
+	if !found {
+		return fmt.Sprintf("%s has not been seen.", name)
+	}
+	seen := session.Ended
+	if seen.IsZero() {
+		// The client lost its connection and might come back
+		seen = session.Started
+		if other != nil && !other.disconnected.IsZero() {
+			seen = other.disconnected
+		}
+	}
+	return fmt.Sprintf("%s was last seen at %s.", name, seen.UTC().Format("2006-01-02 15:04 UTC"))
+}
+
+// loadRating looks up the rating of a registered user outside the main loop.
+// The other clients are told once it is known.
+func (c *Client) loadRating(server *Server) {
+	if c.permissions != REGISTERED && c.permissions != SUPERUSER {
+		return
+	}
+	name := c.userName
+	var rating PlayerRating
+	server.async(func() {
+		rating = server.UserDb().Rating(name)
+	}, func() {
+		if c.userName != name || c.permissions == UNREGISTERED {
+			return
+		}
+		c.rating = rating.Rating
+		if c.wasAnnounced {
+			server.BroadcastToConnectedClients("CLIENTS_UPDATE")
+		}
+	})
+}
+
+// Handle_GAME_RESULT takes the result of a relay game from one of its
+// registered players. The game is rated once all registered players of the
+// result have reported the same, or with the reports that arrived until some
+// time after the game has been closed if a player that lost is among them.
+func (client *Client) Handle_GAME_RESULT(server *Server, pkg *packet.Packet) CmdError {
+	var gameName string
+	if err := pkg.Unpack(&gameName); err != nil {
+		return CmdPacketError{err.Error()}
+	}
+	result, err := readGameResult(pkg)
+	if err != nil {
+		return CmdPacketError{err.Error()}
+	}
+	if client.protocolVersion < BUILD25 {
+		return CmdPacketError{"UNSUPPORTED_PROTOCOL"}
+	}
+	if client.permissions != REGISTERED && client.permissions != SUPERUSER {
+		return CmdPacketError{"DEFICIENT_PERMISSION"}
+	}
+	game := server.HasGame(gameName)
+	if finished := server.finishedGames[gameName]; finished != nil && (game == nil || !game.HasStarted()) {
+		// A new game with the same name might have been opened meanwhile
+		game = finished
+	}
+	if game == nil || !game.UsesRelay() {
+		return CmdPacketError{"NO_SUCH_GAME"}
+	}
+	if !game.HasStarted() {
+		return CmdPacketError{"GAME_NOT_STARTED"}
+	}
+	if game.IsRated() {
+		return CmdPacketError{"ALREADY_RATED"}
+	}
+	if _, ok := result[client.Name()]; !ok {
+		return CmdPacketError{"NOT_A_PARTICIPANT"}
+	}
+	var registered []string
+	places := make(map[int]bool)
+	for name, place := range result {
+		if !game.HasParticipant(name) {
+			return CmdPacketError{"NOT_A_PARTICIPANT"}
+		}
+		if server.UserDb().ContainsName(name) {
+			registered = append(registered, name)
+			places[place] = true
+		}
+	}
+	// At least two registered players have to play against each other
+	if len(places) < 2 {
+		return CmdPacketError{"NOT_RATED"}
+	}
+	if game.ReportResult(client.Name(), result, registered) {
+		server.rateGame(game, result)
+	}
+	return nil
+}
+
+// Handle_MATCH_QUEUE puts the client in the matchmaking queue. It asks for a
+// team size and the largest difference of ratings it accepts, or zero for any.
+func (client *Client) Handle_MATCH_QUEUE(server *Server, pkg *packet.Packet) CmdError {
+	var teamSize, maxRatingDifference int
+	if err := pkg.Unpack(&teamSize, &maxRatingDifference); err != nil {
+		return CmdPacketError{err.Error()}
+	}
+	if client.protocolVersion < BUILD25 {
+		return CmdPacketError{"UNSUPPORTED_PROTOCOL"}
+	}
+	if teamSize < 1 || teamSize > kMaxMatchTeamSize || maxRatingDifference < 0 {
+		return CmdPacketError{"INVALID_PREFERENCES"}
+	}
+	if client.game != nil {
+		return CmdPacketError{"IN_GAME"}
+	}
+	server.matchQueue.Add(&MatchRequest{client, teamSize, maxRatingDifference})
+	server.startMatches()
+	return nil
+}
+
+// Handle_MATCH_LEAVE takes the client out of the matchmaking queue.
+func (client *Client) Handle_MATCH_LEAVE(server *Server, pkg *packet.Packet) CmdError {
+	if !server.matchQueue.Remove(client) {
+		return CmdPacketError{"NOT_QUEUED"}
+	}
+	return nil
+}
+
+// Handle_WEB_LISTING lets the client opt out of being listed on the website.
+// Its public chat messages are not shown there either.
+func (client *Client) Handle_WEB_LISTING(server *Server, pkg *packet.Packet) CmdError {
+	var listed bool
+	if err := pkg.Unpack(&listed); err != nil {
+		return CmdPacketError{err.Error()}
+	}
+	client.hiddenFromWeb = !listed
+	return nil
+}
+
 func (client *Client) Handle_MOTD(server *Server, pkg *packet.Packet) CmdError {
 	var message string
 	if err := pkg.Unpack(&message); err != nil {
@@ -554,8 +971,8 @@ func (client *Client) Handle_DISCONNECT(server *Server, pkg *packet.Packet) CmdE
 
 	client.setGame(nil, server)
 
-	client.Disconnect(*server)
-	server.RemoveClient(client)
+	client.Disconnect(server)
+	server.RemoveClient(client, "LEFT")
 	return nil
 }
 
@@ -579,6 +996,7 @@ func (c *Client) Handle_LOGIN(server *Server, pkg *packet.Packet) CmdError {
 	if !isSupportedVersion(c.protocolVersion) {
 		return CriticalCmdPacketError{"UNSUPPORTED_PROTOCOL"}
 	}
+	c.advertiseTLS(server)
 
 	if isRegisteredOnServer || c.protocolVersion >= BUILD20 {
 		nonce, err := pkg.ReadString()
@@ -588,6 +1006,11 @@ func (c *Client) Handle_LOGIN(server *Server, pkg *packet.Packet) CmdError {
 		c.nonce = nonce
 	}
 
+	// Registered names have been checked when the account was created
+	if !isRegisteredOnServer && !server.ValidationPolicy().IsValidUserName(c.userName) {
+		return CriticalCmdPacketError{"INVALID_NAME"}
+	}
+
 	// Check if the user has been banned
 	if server.IsBannedClient(c) {
 		if c.protocolVersion < BUILD21 {
@@ -629,6 +1052,7 @@ func (c *Client) Handle_CHECK_PWD(server *Server, pkg *packet.Packet) CmdError {
 	if c.protocolVersion < BUILD21 {
 		return CriticalCmdPacketError{"UNSUPPORTED_PROTOCOL"}
 	}
+	c.advertiseTLS(server)
 
 	// Check if registered. If it is, check credentials. If invalid, abort.
 	if !server.UserDb().ContainsName(c.userName) {
@@ -640,6 +1064,17 @@ func (c *Client) Handle_CHECK_PWD(server *Server, pkg *packet.Packet) CmdError {
 	return nil
 }
 
+// advertiseTLS tells clients that are connected without TLS on which port
+// they can reconnect with TLS before sending their password.
+func (c *Client) advertiseTLS(server *Server) {
+	if c.protocolVersion < BUILD22 || tlsconfig.IsTLS(c.conn) {
+		return
+	}
+	if port := server.TLSPort(); port != 0 {
+		c.SendPacket("TLS", port)
+	}
+}
+
 func (c *Client) sendChallenge(server *Server) {
 	// The nonce is empty when using challenge-response. Use it to store the response
 	var challenge string
@@ -647,7 +1082,7 @@ func (c *Client) sendChallenge(server *Server) {
 	challenge, c.expectedResponse, success = server.UserDb().GenerateChallengeResponsePairFromUsername(c.userName)
 	if !success {
 		// Should not happen, but who knows
-		c.Disconnect(*server)
+		c.Disconnect(server)
 		return
 	}
 	c.SendPacket("PWD_CHALLENGE", challenge)
@@ -673,7 +1108,7 @@ func (c *Client) Handle_PWD_CHALLENGE(server *Server, pkg *packet.Packet) CmdErr
 		c.SendPacket("PWD_OK", c.userName, permissions.String())
 	default:
 		c.SendPacket("ERROR", "PWD_CHALLENGE", "Invalid connection state")
-		c.Disconnect(*server)
+		c.Disconnect(server)
 	}
 	return nil
 }
@@ -713,7 +1148,7 @@ func (c *Client) loginDone(server *Server) CmdError {
 	if c.state != HANDSHAKE {
 		log.Printf("Told to finish login of client %v but client already is logged in. Disconnecting.", c.Name())
 		c.SendPacket("ERROR", "LOGIN", "ALREADY_LOGGED_IN")
-		c.Disconnect(*server)
+		c.Disconnect(server)
 		return nil
 	}
 
@@ -732,13 +1167,17 @@ func (c *Client) loginDone(server *Server) CmdError {
 		c.SendPacket("CHAT", "", "For reporting bugs, visit:", "system")
 		c.SendPacket("CHAT", "", "https://www.widelands.org/wiki/ReportingBugs/", "system")
 	}
+	c.loadRating(server)
 	server.AddClient(c)
-	c.setState(CONNECTED, *server)
+	c.setState(CONNECTED, server)
+	server.startSession(c)
 
 	if len(server.Motd()) != 0 {
 		c.SendPacket("CHAT", "", server.Motd(), "system")
 	}
 	c.replaceCandidates = nil
+	server.friendLoggedIn(c)
+	server.scheduleTournamentGames()
 	return nil
 
 }
@@ -747,7 +1186,7 @@ func (c *Client) checkCandidates(server *Server) {
 	if c.state != HANDSHAKE {
 		log.Printf("Told to check candidates for client %v but client already is logged in. Disconnecting.", c.Name())
 		c.SendPacket("ERROR", "LOGIN", "ALREADY_LOGGED_IN")
-		c.Disconnect(*server)
+		c.Disconnect(server)
 		return
 	}
 	log.Printf("Client %v checks for client to replace, %v found", c.userName, len(c.replaceCandidates))
@@ -772,7 +1211,7 @@ func (c *Client) checkCandidates(server *Server) {
 		// Already known as offline
 		c.userName = oldClient.userName
 		c.game = oldClient.game
-		server.RemoveClient(oldClient)
+		server.RemoveClient(oldClient, "REPLACED")
 		c.loginDone(server)
 	} else {
 		// Start a fast ping and check whether the client is still active
@@ -792,12 +1231,17 @@ func (c *Client) findUnconnectedName(server *Server) {
 			// This code should never be reached but there is an unreproduced bug where this loop
 			// looped forever. See https://github.com/widelands/widelands-metaserver/issues/38
 			log.Printf("ERROR: Tried to find an unused name for client %v but failed 1000 times. This should not happen", baseName)
-			c.Disconnect(*server)
+			c.Disconnect(server)
 			return
 		}
-		// Generate new name
+		// Generate new name, shortened to stay a valid user name
 		nameIndex++
-		c.userName = fmt.Sprintf("%s%d", baseName, nameIndex)
+		suffix := strconv.Itoa(nameIndex)
+		base := []rune(baseName)
+		if keep := server.ValidationPolicy().MaxNameLength - len(suffix); keep >= 0 && len(base) > keep {
+			base = base[:keep]
+		}
+		c.userName = string(base) + suffix
 
 		if server.UserDb().ContainsName(c.userName) {
 			continue
@@ -869,6 +1313,7 @@ func (client *Client) Handle_RELOGIN(server *Server, pkg *packet.Packet) CmdErro
 	client.buildId = oldClient.buildId
 	client.game = oldClient.game
 	client.nonce = oldClient.nonce
+	client.hiddenFromWeb = oldClient.hiddenFromWeb
 
 	log.Printf("Client %v wants to reconnect.\n", client.Name())
 	if oldClient.state == RECENTLY_DISCONNECTED {
@@ -886,15 +1331,31 @@ func (client *Client) Handle_RELOGIN(server *Server, pkg *packet.Packet) CmdErro
 
 func (client *Client) Handle_GAME_OPEN(server *Server, pkg *packet.Packet) CmdError {
 	var gameName string
+	var metadata GameMetadata
+	var access GameAccess
 	if client.protocolVersion == BUILD19 {
-		var maxPlayer int
-		if err := pkg.Unpack(&gameName, &maxPlayer); err != nil {
+		if err := pkg.Unpack(&gameName, &metadata.MaxPlayers); err != nil {
 			return CmdPacketError{err.Error()}
 		}
 	} else {
 		if err := pkg.Unpack(&gameName); err != nil {
 			return CmdPacketError{err.Error()}
 		}
+		if client.protocolVersion >= BUILD23 {
+			var err error
+			if metadata, err = readGameMetadata(server, pkg); err != nil {
+				return CmdPacketError{err.Error()}
+			}
+		}
+		if client.protocolVersion >= BUILD24 {
+			var err error
+			if access, err = readGameAccess(pkg); err != nil {
+				return CmdPacketError{err.Error()}
+			}
+		}
+	}
+	if !server.ValidationPolicy().IsValidGameName(gameName) {
+		return CmdPacketError{"INVALID_NAME"}
 	}
 	if server.HasGame(gameName) != nil {
 		return CmdPacketError{"GAME_EXISTS"}
@@ -903,43 +1364,49 @@ func (client *Client) Handle_GAME_OPEN(server *Server, pkg *packet.Packet) CmdEr
 	if client.protocolVersion == BUILD19 {
 		// Client does not support the relay server. Let him host his game
 		log.Printf("Starting new game '%v' on computer of host %v", gameName, client.Name())
-		client.setGame(NewGame(client.userName, client.buildId, server, gameName, false /* do not use relay */), server)
+		client.setGame(NewGame(client.userName, client.buildId, server, gameName, false /* do not use relay */, metadata, access), server)
 	} else {
 		// Client does support the relay server. Start a game there
-		log.Printf("Starting new game '%v' on relay for host %v", gameName, client.Name())
-		var challenge, response string
-		var success bool
-		if client.permissions == REGISTERED || client.permissions == SUPERUSER {
-			challenge, response, success = server.UserDb().GenerateChallengeResponsePairFromUsername(client.userName)
-		} else {
-			challenge, response, success = GenerateChallengeResponsePairFromSecret(client.nonce)
-		}
-		if !success {
-			// Should not happen
-			log.Printf("Error: Failed to generate challenge/response for client %v when opening game on relay", client.userName)
-			client.Disconnect(*server)
-			return nil
-		}
-		created := server.RelayCreateGame(gameName, response)
-		if !created {
-			// Not good. Should not happen
-			return CmdPacketError{"RELAY_ERROR"}
-		}
-		game := NewGame(client.userName, client.buildId, server, gameName, true /* use relay */)
-		ips := server.GetRelayAddresses()
-		// Send that IP address version first the client is using
-		if client.conn.RemoteAddr().(*net.TCPAddr).IP.To4() != nil {
-			client.SendPacket("GAME_OPEN", challenge, ips.ipv4, true, ips.ipv6)
-		} else {
-			client.SendPacket("GAME_OPEN", challenge, ips.ipv6, true, ips.ipv4)
+		game, challenge, err := client.openRelayGame(server, gameName, metadata, access)
+		if game == nil {
+			return err
 		}
+		client.sendRelayAddresses(server, "GAME_OPEN", challenge)
 		client.setGame(game, server)
 	}
 
 	log.Printf("Client %v hosts game '%v'", client.userName, gameName)
+	server.friendOpenedGame(client, client.game)
 	return nil
 }
 
+// openRelayGame creates a game on the relay hosted by the client. Returns the
+// game and the challenge the host has to answer to the relay. The game is nil
+// on errors. If the error is nil as well, the client has been disconnected.
+func (client *Client) openRelayGame(server *Server, gameName string, metadata GameMetadata, access GameAccess) (*Game, string, CmdError) {
+	log.Printf("Starting new game '%v' on relay for host %v", gameName, client.Name())
+	var challenge, response string
+	var success bool
+	if client.permissions == REGISTERED || client.permissions == SUPERUSER {
+		challenge, response, success = server.UserDb().GenerateChallengeResponsePairFromUsername(client.userName)
+	} else {
+		challenge, response, success = GenerateChallengeResponsePairFromSecret(client.nonce)
+	}
+	if !success {
+		// Should not happen
+		log.Printf("Error: Failed to generate challenge/response for client %v when opening game on relay", client.userName)
+		client.Disconnect(server)
+		return nil, "", nil
+	}
+	created := server.RelayCreateGame(gameName, response, access.Restricted())
+	if !created {
+		// Not good. Should not happen
+		return nil, "", CmdPacketError{"RELAY_ERROR"}
+	}
+	game := NewGame(client.userName, client.buildId, server, gameName, true /* use relay */, metadata, access)
+	return game, challenge, nil
+}
+
 func (client *Client) Handle_GAME_CONNECT(server *Server, pkg *packet.Packet) CmdError {
 	gameName, err := pkg.ReadString()
 	if err != nil {
@@ -950,6 +1417,46 @@ func (client *Client) Handle_GAME_CONNECT(server *Server, pkg *packet.Packet) Cm
 	if game == nil {
 		return CmdPacketError{"NO_SUCH_GAME"}
 	}
+	if game.IsFull() {
+		return CmdPacketError{"GAME_FULL"}
+	}
+	var password string
+	if client.protocolVersion >= BUILD24 {
+		if err := pkg.Unpack(&password); err != nil {
+			return CmdPacketError{err.Error()}
+		}
+	}
+	if game.IsBanned(client.userName) {
+		return CmdPacketError{"BANNED"}
+	}
+	if game.HasBans() && game.UsesRelay() && client.protocolVersion < BUILD24 {
+		// The client can not present a join token to the relay
+		return CmdPacketError{"UNSUPPORTED_PROTOCOL"}
+	}
+	if access := game.Access(); access.Restricted() && client.userName != game.Host() {
+		if client.protocolVersion < BUILD24 {
+			// The client can not present a join token to the relay
+			return CmdPacketError{"UNSUPPORTED_PROTOCOL"}
+		}
+		if reason := access.Allows(client.userName, password); reason != "" {
+			log.Printf("Client %v is not allowed to join game '%v': %v", client.userName, game.Name(), reason)
+			return CmdPacketError{reason}
+		}
+	}
+	// The token lets the client join a restricted game on the relay and tells
+	// us who the client is when the relay refers to it. A client connecting
+	// again gets the token it has not used yet.
+	var joinToken string
+	if client.protocolVersion >= BUILD24 && game.UsesRelay() {
+		joinToken = game.UnusedJoinToken(client.userName)
+		if joinToken == "" {
+			joinToken = newJoinToken()
+			if !server.RelayAddJoinToken(game.Name(), joinToken) {
+				return CmdPacketError{"RELAY_ERROR"}
+			}
+			game.AddJoinToken(joinToken, client.userName)
+		}
+	}
 
 	log.Printf("Client %v joined game '%v'", client.userName, game.Name())
 	if client.protocolVersion == BUILD19 {
@@ -963,18 +1470,51 @@ func (client *Client) Handle_GAME_CONNECT(server *Server, pkg *packet.Packet) Cm
 		client.SendPacket("GAME_CONNECT", host.remoteIp())
 	} else {
 		// Newer client which possibly supports two IPs and uses the relay
-		ips := server.GetRelayAddresses()
-		// Send that IP address version first the client is using
-		if client.conn.RemoteAddr().(*net.TCPAddr).IP.To4() != nil {
-			client.SendPacket("GAME_CONNECT", ips.ipv4, true, ips.ipv6)
+		if client.protocolVersion >= BUILD24 {
+			client.sendRelayAddresses(server, "GAME_CONNECT", joinToken)
 		} else {
-			client.SendPacket("GAME_CONNECT", ips.ipv6, true, ips.ipv4)
+			client.sendRelayAddresses(server, "GAME_CONNECT")
 		}
 	}
 	client.setGame(game, server)
 	return nil
 }
 
+// sendRelayAddresses sends the command with the given data followed by the
+// addresses of the relay. Clients supporting TLS get the TLS port of the
+// relay as well, which is zero if it has none.
+func (client *Client) sendRelayAddresses(server *Server, command string, data ...interface{}) {
+	ips := server.GetRelayAddresses()
+	data = append([]interface{}{command}, data...)
+	// Send that IP address version first the client is using
+	if client.conn.RemoteAddr().(*net.TCPAddr).IP.To4() != nil {
+		data = append(data, ips.ipv4, true, ips.ipv6)
+	} else {
+		data = append(data, ips.ipv6, true, ips.ipv4)
+	}
+	if client.protocolVersion >= BUILD22 {
+		data = append(data, server.RelayTLSPort())
+	}
+	client.SendPacket(data...)
+}
+
+// Handle_GAME_UPDATE replaces the metadata of the game hosted by the client,
+// e.g. after the host selected another map.
+func (client *Client) Handle_GAME_UPDATE(server *Server, pkg *packet.Packet) CmdError {
+	if client.protocolVersion < BUILD23 {
+		return CmdPacketError{"UNSUPPORTED_PROTOCOL"}
+	}
+	if client.game == nil || client.game.Host() != client.userName {
+		return CmdPacketError{"NOT_HOSTING"}
+	}
+	metadata, err := readGameMetadata(server, pkg)
+	if err != nil {
+		return CmdPacketError{err.Error()}
+	}
+	client.game.SetMetadata(server, metadata)
+	return nil
+}
+
 func (client *Client) Handle_GAME_START(server *Server, pkg *packet.Packet) CmdError {
 	if client.game == nil {
 		return InvalidPacketError{}
@@ -985,21 +1525,53 @@ func (client *Client) Handle_GAME_START(server *Server, pkg *packet.Packet) CmdE
 	}
 
 	client.SendPacket("GAME_START")
-	client.game.SetState(*server, RUNNING)
+	client.game.SetState(server, RUNNING)
 	return nil
 }
 
 func (client *Client) Handle_GAME_DISCONNECT(server *Server, pkg *packet.Packet) CmdError {
 	client.setGame(nil, server)
+	server.scheduleTournamentGames()
 	return nil
 }
 
 func (client *Client) Handle_CLIENTS(server *Server, pkg *packet.Packet) CmdError {
+	// BUILD26 clients ask for everybody with an empty filter or for only
+	// their friends with "friends"
+	var friends map[string]bool
+	if client.protocolVersion >= BUILD26 {
+		var filter string
+		if err := pkg.Unpack(&filter); err != nil {
+			return CmdPacketError{err.Error()}
+		}
+		switch filter {
+		case "":
+		case "friends":
+			if client.permissions == REGISTERED || client.permissions == SUPERUSER {
+				client.withFriends(server, func(friends map[string]bool) {
+					client.sendClients(server, friends)
+				})
+				return nil
+			}
+			friends = make(map[string]bool)
+		default:
+			return CmdPacketError{"INVALID_FILTER"}
+		}
+	}
+	client.sendClients(server, friends)
+	return nil
+}
+
+// sendClients sends the list of the clients in the lobby. If friends is not
+// nil, only they are listed.
+func (client *Client) sendClients(server *Server, friends map[string]bool) {
 	var nrClients int = 0
 	nFields := 4
-	if client.protocolVersion < BUILD20 {
+	if client.protocolVersion < BUILD20 || client.protocolVersion >= BUILD25 {
 		nFields = 5
 	}
+	// The number of clients is filled in once all clients have been counted
+	data := []interface{}{"CLIENTS", 0}
 	server.ForeachActiveClient(func(otherClient *Client) {
 		// Hide IRC users in the lobby of build19 clients. They would appear
 		// at the top of the player list, confusing the user
@@ -1010,53 +1582,51 @@ func (client *Client) Handle_CLIENTS(server *Server, pkg *packet.Packet) CmdErro
 		if !otherClient.wasAnnounced && otherClient != client {
 			return
 		}
-		nrClients++
-	})
-	data := make([]interface{}, 2+nrClients*nFields)
-
-	data[0] = "CLIENTS"
-	data[1] = nrClients
-	n := 2
-	server.ForeachActiveClient(func(otherClient *Client) {
-		if client.protocolVersion == BUILD19 && otherClient.permissions == IRC {
-			return
-		}
-		if !otherClient.wasAnnounced && otherClient != client {
+		// Unregistered users might use the name of a friend
+		if friends != nil && (!friends[otherClient.userName] || otherClient.permissions == UNREGISTERED || otherClient.permissions == IRC) {
 			return
 		}
-		data[n+0] = otherClient.userName
-		data[n+1] = otherClient.buildId
+		gameName := ""
 		if otherClient.game != nil {
-			data[n+2] = otherClient.game.Name()
-		} else {
-			data[n+2] = ""
+			gameName = otherClient.game.Name()
 		}
-		data[n+3] = otherClient.permissions.String()
-		if client.protocolVersion < 4 {
-			data[n+4] = ""
+		data = append(data, otherClient.userName, otherClient.buildId, gameName, otherClient.permissions.String())
+		if client.protocolVersion >= BUILD25 {
+			// Only registered users are rated
+			rating := ""
+			if otherClient.permissions == REGISTERED || otherClient.permissions == SUPERUSER {
+				rating = strconv.Itoa(otherClient.rating)
+			}
+			data = append(data, rating)
+		} else if nFields == 5 {
+			data = append(data, "")
 		}
-		n += nFields
+		nrClients++
 	})
+	data[1] = nrClients
 	client.SendPacket(data...)
-	return nil
 }
 
-func (client *Client) Handle_GAMES(server *Server, pkg *packet.Packet) CmdError {
-	nrGames := server.NrGames()
-	data := make([]interface{}, 2+nrGames*3)
-
+// versionsMatch returns whether clients of the two builds can play together.
+func versionsMatch(buildId, otherBuildId string) bool {
+	// Its the same version? Of course that works
+	if buildId == otherBuildId {
+		return true
+	}
+	// It might work if both are development clients
 	isReleaseBuild := func(b string) bool {
 		return strings.HasPrefix(b, "build-")
 	}
-	releaseClient := isReleaseBuild(client.buildId)
-	versionsMatch := func(game *Game) bool {
-		// Its the same version? Of course that works
-		if (game.BuildId() == client.buildId) {
-			return true
-		}
-		// It might work if both are development clients
-		return !releaseClient && !isReleaseBuild(game.BuildId())
+	return !isReleaseBuild(buildId) && !isReleaseBuild(otherBuildId)
+}
+
+func (client *Client) Handle_GAMES(server *Server, pkg *packet.Packet) CmdError {
+	nrGames := server.NrGames()
+	nFields := 3
+	if client.protocolVersion >= BUILD23 {
+		nFields = 10
 	}
+	data := make([]interface{}, 2+nrGames*nFields)
 
 	data[0] = "GAMES"
 	data[1] = nrGames
@@ -1067,7 +1637,7 @@ func (client *Client) Handle_GAMES(server *Server, pkg *packet.Packet) CmdError
 		if client.protocolVersion == BUILD19 {
 			data[n+2] = !game.UsesRelay() && game.State() == CONNECTABLE && game.BuildId() == client.buildId
 		} else {
-			if !game.UsesRelay() || !versionsMatch(game) {
+			if !game.UsesRelay() || !versionsMatch(client.buildId, game.BuildId()) {
 				data[n+2] = "CLOSED"
 			} else if game.State() == CONNECTABLE {
 				data[n+2] = "SETUP"
@@ -1078,7 +1648,17 @@ func (client *Client) Handle_GAMES(server *Server, pkg *packet.Packet) CmdError
 				data[n+2] = "CLOSED"
 			}
 		}
-		n += 3
+		if nFields == 10 {
+			m := game.Metadata()
+			data[n+3] = m.MapName
+			data[n+4] = m.MaxPlayers
+			data[n+5] = game.NrPlayers()
+			data[n+6] = m.HasPassword
+			data[n+7] = m.Description
+			data[n+8] = m.WinCondition
+			data[n+9] = m.Tribes
+		}
+		n += nFields
 	})
 	client.SendPacket(data...)
 	return nil
@@ -5,17 +5,9 @@ import (
 	. "gopkg.in/check.v1"
 	"io"
 	"net"
+	"sync/atomic"
 )
 
-type FakeAddr struct{}
-
-func (a FakeAddr) Network() string {
-	return "TestingNetwork"
-}
-func (a FakeAddr) String() string {
-	return "192.168.0.0:1234"
-}
-
 type FakeConn struct {
 	Packets         chan *packet.Packet
 	sendData_Reader *io.PipeReader
@@ -23,11 +15,12 @@ type FakeConn struct {
 	recvData_Reader *io.PipeReader
 	recvData_Writer *io.PipeWriter
 
-	gotClosed *bool
+	gotClosed *int32
+	stalled   *int32
 }
 
 func NewFakeConn(c *C) FakeConn {
-	f := FakeConn{Packets: make(chan *packet.Packet, 20), gotClosed: new(bool)}
+	f := FakeConn{Packets: make(chan *packet.Packet, 20), gotClosed: new(int32), stalled: new(int32)}
 	f.sendData_Reader, f.sendData_Writer = io.Pipe()
 	f.recvData_Reader, f.recvData_Writer = io.Pipe()
 	go f.readPackets()
@@ -35,7 +28,7 @@ func NewFakeConn(c *C) FakeConn {
 }
 
 func (f FakeConn) readPackets() {
-	for {
+	for atomic.LoadInt32(f.stalled) == 0 {
 		pkg, err := packet.Read(f.ServerReader())
 		if err != nil {
 			break
@@ -44,6 +37,12 @@ func (f FakeConn) readPackets() {
 	}
 }
 
+// Stall makes the connection stop reading what the server sends, like a client
+// that hangs. Writes of the server will block from then on.
+func (f FakeConn) Stall() {
+	atomic.StoreInt32(f.stalled, 1)
+}
+
 func (f FakeConn) ServerWriter() io.Writer {
 	return f.sendData_Writer
 }
@@ -53,7 +52,7 @@ func (f FakeConn) ServerReader() io.Reader {
 }
 
 func (f FakeConn) GotClosed() bool {
-	return *f.gotClosed
+	return atomic.LoadInt32(f.gotClosed) != 0
 }
 
 func (f FakeConn) Read(b []byte) (int, error) {
@@ -70,10 +69,10 @@ func (f FakeConn) Close() error {
 	f.sendData_Writer.Close()
 	f.recvData_Reader.Close()
 	f.recvData_Writer.Close()
-	*f.gotClosed = true
+	atomic.StoreInt32(f.gotClosed, 1)
 	return nil
 }
 
 func (f FakeConn) RemoteAddr() net.Addr {
-	return FakeAddr{}
+	return &net.TCPAddr{IP: net.ParseIP("192.168.0.0"), Port: 1234}
 }
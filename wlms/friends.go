@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// friendCmd handles "CMD friend <action> <name>" of registered users, where
+// the action is "request", "accept" or "remove". The database is changed
+// outside the main loop.
+func (client *Client) friendCmd(server *Server, params string) CmdError {
+	if client.permissions != REGISTERED && client.permissions != SUPERUSER {
+		return CmdPacketError{"DEFICIENT_PERMISSION"}
+	}
+	action, name := params, ""
+	if i := strings.Index(params, " "); i >= 0 {
+		action, name = params[:i], params[i+1:]
+	}
+	if name == "" || name == client.Name() {
+		return CmdPacketError{"INVALID_CMD_PARAMETERS"}
+	}
+	if action != "request" && action != "accept" && action != "remove" {
+		return CmdPacketError{"INVALID_CMD_PARAMETERS"}
+	}
+	self := client.Name()
+	var outcome, failure string
+	var err error
+	server.async(func() {
+		outcome, failure, err = changeFriendship(server.UserDb(), action, self, name)
+	}, func() {
+		if err != nil {
+			client.friendsUnavailable(err)
+			return
+		}
+		if failure != "" {
+			log.Printf("Error while handling command CMD for client %v: %v", self, failure)
+			client.SendPacket("ERROR", "CMD", failure)
+			return
+		}
+		other := server.HasClient(name)
+		if other != nil && other.permissions == UNREGISTERED {
+			other = nil
+		}
+		switch outcome {
+		case "requested":
+			client.SendPacket("CHAT", "", fmt.Sprintf("Asked %s to be your friend.", name), "system")
+			if other != nil {
+				other.SendPacket("CHAT", "", fmt.Sprintf("%s would like to be your friend.", self), "system")
+			}
+		case "accepted":
+			server.friendsChanged(self, name)
+			client.SendPacket("CHAT", "", fmt.Sprintf("You and %s are friends now.", name), "system")
+			if other != nil {
+				other.SendPacket("CHAT", "", fmt.Sprintf("You and %s are friends now.", self), "system")
+			}
+		case "removed":
+			server.friendsChanged(self, name)
+			client.SendPacket("CHAT", "", fmt.Sprintf("%s is no longer your friend.", name), "system")
+		}
+	})
+	return nil
+}
+
+// changeFriendship does the action of "CMD friend" for the user name and the
+// other user in the database. Returns what has been done, "requested",
+// "accepted" or "removed", or the error to send to the client.
+func changeFriendship(db UserDb, action, name, other string) (string, string, error) {
+	if !db.ContainsName(other) {
+		return "", "NO_SUCH_USER", nil
+	}
+	friends, err := db.Friends(name)
+	if err != nil {
+		return "", "", err
+	}
+	requests, err := db.FriendRequests(name)
+	if err != nil {
+		return "", "", err
+	}
+	theirRequests, err := db.FriendRequests(other)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch action {
+	case "request":
+		if containsName(friends, other) {
+			return "", "ALREADY_FRIENDS", nil
+		}
+		if containsName(theirRequests, name) {
+			return "", "ALREADY_REQUESTED", nil
+		}
+		// Asking somebody who has asked already is the same as accepting
+		if !containsName(requests, other) {
+			return "requested", "", db.RequestFriend(name, other)
+		}
+		fallthrough
+	case "accept":
+		if !containsName(requests, other) {
+			return "", "NO_SUCH_REQUEST", nil
+		}
+		return "accepted", "", db.AcceptFriend(name, other)
+	case "remove":
+		if !containsName(friends, other) && !containsName(requests, other) && !containsName(theirRequests, name) {
+			return "", "NOT_FRIENDS", nil
+		}
+		return "removed", "", db.RemoveFriend(name, other)
+	}
+	return "", "INVALID_CMD_PARAMETERS", nil
+}
+
+// withFriends calls f on the main loop with the friends of the registered
+// user. They are read outside the main loop once and kept until
+// friendsChanged.
+func (client *Client) withFriends(server *Server, f func(map[string]bool)) {
+	if client.friends != nil {
+		f(client.friends)
+		return
+	}
+	name := client.Name()
+	version := client.friendsVersion
+	var names []string
+	var err error
+	server.async(func() {
+		names, err = server.UserDb().Friends(name)
+	}, func() {
+		if err != nil {
+			log.Printf("Unable to read the friends of %v: %v", name, err)
+			f(map[string]bool{})
+			return
+		}
+		friends := make(map[string]bool)
+		for _, name := range names {
+			friends[name] = true
+		}
+		// They might have changed while they were read
+		if client.friendsVersion == version {
+			client.friends = friends
+		}
+		f(friends)
+	})
+}
+
+// friendsChanged makes the clients of the users read their friends again.
+func (s *Server) friendsChanged(names ...string) {
+	for _, name := range names {
+		if client := s.HasClient(name); client != nil {
+			client.friends = nil
+			client.friendsVersion++
+		}
+	}
+}
+
+func (client *Client) friendsUnavailable(err error) CmdError {
+	log.Printf("Unable to access the friends of %v: %v", client.Name(), err)
+	client.SendPacket("CHAT", "", "Unable to access your friends.", "system")
+	return nil
+}
+
+// friendsCmd handles "CMD friends", which lists the friends of a registered
+// user, where they are and who waits for the user to accept their request.
+func (client *Client) friendsCmd(server *Server) CmdError {
+	if client.permissions != REGISTERED && client.permissions != SUPERUSER {
+		return CmdPacketError{"DEFICIENT_PERMISSION"}
+	}
+	name := client.Name()
+	var friends, requests []string
+	var err error
+	server.async(func() {
+		if friends, err = server.UserDb().Friends(name); err == nil {
+			requests, err = server.UserDb().FriendRequests(name)
+		}
+	}, func() {
+		if err != nil {
+			client.friendsUnavailable(err)
+			return
+		}
+		if len(friends) == 0 && len(requests) == 0 {
+			client.SendPacket("CHAT", "", "You have not added any friends yet.", "system")
+			return
+		}
+		for _, friend := range friends {
+			status := "offline"
+			if other := server.HasClient(friend); other != nil && other.permissions != UNREGISTERED {
+				status = "online"
+				if other.Game() != nil {
+					status = fmt.Sprintf("in the game %s", other.Game().Name())
+				}
+			}
+			client.SendPacket("CHAT", "", fmt.Sprintf("%s: %s", friend, status), "system")
+		}
+		if len(requests) > 0 {
+			client.SendPacket("CHAT", "", "Friend requests from: "+strings.Join(requests, ", "), "system")
+		}
+	})
+	return nil
+}
+
+// onlineFriends returns the clients of the given friends of a registered user
+// that are in the lobby.
+func (s *Server) onlineFriends(friends []string) []*Client {
+	var clients []*Client
+	for _, friend := range friends {
+		// Somebody else might use the name of an offline user
+		if client := s.HasClient(friend); client != nil && client.permissions != UNREGISTERED {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// friendLoggedIn tells the friends of the registered user that has logged in
+// about it and the user about open friend requests.
+func (s *Server) friendLoggedIn(client *Client) {
+	if client.permissions != REGISTERED && client.permissions != SUPERUSER {
+		return
+	}
+	name := client.Name()
+	var friends, requests []string
+	var friendsErr, requestsErr error
+	s.async(func() {
+		friends, friendsErr = s.UserDb().Friends(name)
+		requests, requestsErr = s.UserDb().FriendRequests(name)
+	}, func() {
+		if friendsErr != nil {
+			log.Printf("Unable to read the friends of %v: %v", name, friendsErr)
+		}
+		for _, friend := range s.onlineFriends(friends) {
+			friend.SendPacket("CHAT", "", fmt.Sprintf("Your friend %s is online.", name), "system")
+		}
+		if requestsErr != nil {
+			log.Printf("Unable to read the friend requests of %v: %v", name, requestsErr)
+			return
+		}
+		if len(requests) > 0 {
+			client.SendPacket("CHAT", "", "Friend requests from: "+strings.Join(requests, ", "), "system")
+		}
+	})
+}
+
+// friendOpenedGame tells the friends of the registered host about its new
+// game, unless they are not invited to it.
+func (s *Server) friendOpenedGame(client *Client, game *Game) {
+	if client.permissions != REGISTERED && client.permissions != SUPERUSER {
+		return
+	}
+	name := client.Name()
+	var friends []string
+	var err error
+	s.async(func() {
+		friends, err = s.UserDb().Friends(name)
+	}, func() {
+		if err != nil {
+			log.Printf("Unable to read the friends of %v: %v", name, err)
+			return
+		}
+		for _, friend := range s.onlineFriends(friends) {
+			if game.Access().Allows(friend.Name(), "") != "NOT_INVITED" {
+				friend.SendPacket("CHAT", "", fmt.Sprintf("Your friend %s has opened the game %s.", name, game.Name()), "system")
+			}
+		}
+	})
+}
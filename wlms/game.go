@@ -1,7 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/widelands/widelands-metaserver/wlms/packet"
 	"log"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -32,28 +39,133 @@ func (g GameState) String() string {
 
 type Game struct {
 	// The host is also listed in players.
-	host      string
-	players   map[string]bool
-	name      string
-	buildId   string
-	state     GameState
-	usesRelay bool // True if all network traffic passes through our relay server.
+	host             string
+	players          map[string]bool
+	name             string
+	buildId          string
+	state            GameState
+	usesRelay        bool // True if all network traffic passes through our relay server.
 	timeLastActivity time.Time
+	metadata         GameMetadata
+	access           GameAccess
+	// The users by the join tokens they got for the relay
+	joinTokens map[string]string
+	// The join tokens the relay has not reported to be used yet by their
+	// users. A user gets the same token again when connecting again.
+	unusedJoinTokens map[string]string
+	// Users the relay reports to be in the game. They stay players when
+	// they leave the game in the lobby, e.g. by losing their connection.
+	onRelay map[string]bool
+	// Users the host kicked and banned from the game
+	banned map[string]bool
+	// For the history of games
+	opened       time.Time
+	started      time.Time
+	participants map[string]bool
+	// The results reported by registered players and whether the game has
+	// been rated
+	results map[string]GameResult
+	rated   bool
+}
+
+// GameMetadata describes a game to the clients looking for one. Hosts
+// before BUILD23 only report the maximum number of players, and only if they
+// are build19 clients.
+type GameMetadata struct {
+	MapName string
+	// Zero if unknown
+	MaxPlayers  int
+	HasPassword bool
+	Description string
+	// The win condition and the comma-separated tribes of the players, as
+	// the host names them
+	WinCondition string
+	Tribes       string
+}
+
+// readGameMetadata reads the metadata sent by BUILD23 hosts with GAME_OPEN
+// and GAME_UPDATE.
+func readGameMetadata(server *Server, pkg *packet.Packet) (GameMetadata, error) {
+	var m GameMetadata
+	if err := pkg.Unpack(&m.MaxPlayers, &m.MapName, &m.HasPassword, &m.Description, &m.WinCondition, &m.Tribes); err != nil {
+		return m, err
+	}
+	if m.MaxPlayers < 0 {
+		return m, errors.New("INVALID_MAX_PLAYERS")
+	}
+	// The description is shown to everybody like a chat message
+	m.Description = server.ValidationPolicy().FilterChatMessage(m.Description)
+	return m, nil
+}
+
+// GameAccess restricts who may join a game. BUILD24 hosts can set a join
+// password, an invite list or both. Invited users do not need the password.
+type GameAccess struct {
+	JoinPassword string
+	Invited      []string
+}
+
+// readGameAccess reads the join password and the comma-separated invite list
+// sent by BUILD24 hosts with GAME_OPEN.
+func readGameAccess(pkg *packet.Packet) (GameAccess, error) {
+	var a GameAccess
+	var invited string
+	if err := pkg.Unpack(&a.JoinPassword, &invited); err != nil {
+		return a, err
+	}
+	for _, name := range strings.Split(invited, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			a.Invited = append(a.Invited, name)
+		}
+	}
+	return a, nil
+}
+
+// Restricted returns whether not everybody may join.
+func (a GameAccess) Restricted() bool {
+	return a.JoinPassword != "" || len(a.Invited) > 0
+}
+
+// Allows returns an empty string if the user may join with the given
+// password and the reason for refusing it otherwise.
+func (a GameAccess) Allows(userName, password string) string {
+	for _, name := range a.Invited {
+		if name == userName {
+			return ""
+		}
+	}
+	if a.JoinPassword == "" {
+		if len(a.Invited) > 0 {
+			return "NOT_INVITED"
+		}
+		return ""
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(a.JoinPassword)) != 1 {
+		return "WRONG_PASSWORD"
+	}
+	return ""
+}
+
+// newJoinToken creates the token that lets a client join a restricted game on
+// the relay.
+func newJoinToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Unable to create join token: %v", err)
+	}
+	return hex.EncodeToString(b)
 }
 
 type GamePinger struct {
 	C chan bool
 }
 
-func (game *Game) doPing(server *Server, host string, pingTimeout time.Duration) bool {
-	pinger := server.NewGamePinger(host, pingTimeout)
-	success, ok := <-pinger.C
-	result := success && ok
-
+// handlePingResult updates the state of the game after it has been pinged.
+func (game *Game) handlePingResult(server *Server, result bool) {
 	if result {
 		switch game.state {
 		case INITIAL_SETUP, NOT_CONNECTABLE:
-			game.SetState(*server, CONNECTABLE)
+			game.SetState(server, CONNECTABLE)
 		case CONNECTABLE, RUNNING:
 			// Do nothing
 		default:
@@ -62,11 +174,11 @@ func (game *Game) doPing(server *Server, host string, pingTimeout time.Duration)
 	} else {
 		switch game.state {
 		case INITIAL_SETUP:
-			game.SetState(*server, NOT_CONNECTABLE)
+			game.SetState(server, NOT_CONNECTABLE)
 		case NOT_CONNECTABLE:
 			// Do nothing.
 		case CONNECTABLE:
-			game.SetState(*server, NOT_CONNECTABLE)
+			game.SetState(server, NOT_CONNECTABLE)
 		case RUNNING:
 			// Do nothing
 		default:
@@ -79,13 +191,13 @@ func (game *Game) doPing(server *Server, host string, pingTimeout time.Duration)
 				// In that case, kick all players and remove the game
 				log.Printf("Removing unconnectable game '%v' of disconnected legacy player %v", game.Name(), game.Host())
 				game.RemovePlayer(game.Host(), server)
-				return result
 			}
 		}
 	}
-	return result
 }
 
+// pingCycle regularly checks whether the game can be reached. The pinging is
+// done outside of the main loop of the server, everything else on it.
 func (game *Game) pingCycle(server *Server) {
 	if game.usesRelay {
 		log.Fatalf("Error: Started pingCycle for game %v on relay", game.Name())
@@ -94,44 +206,66 @@ func (game *Game) pingCycle(server *Server) {
 	pingTimeout := server.GameInitialPingTimeout()
 	first_ping := true
 	for {
-		// This game is not even in our list anymore. Give up. If the game has no
-		// host anymore or it has disconnected, remove the game.
-		if server.HasGame(game.Name()) != game || len(game.players) == 0 {
-			return
-		}
-		host := server.HasClient(game.Host())
-		if host == nil {
+		var host *Client
+		var ip string
+		handled := server.call(func() {
+			// This game is not even in our list anymore. Give up. If the game has no
+			// host anymore or it has disconnected, remove the game.
+			if server.HasGame(game.Name()) != game || len(game.players) == 0 {
+				return
+			}
+			host = server.HasClient(game.Host())
+			if host != nil {
+				ip = host.remoteIp()
+			}
+		})
+		if !handled || host == nil {
 			return
 		}
 
-		connected := game.doPing(server, host.remoteIp(), pingTimeout)
-		if first_ping {
-			// On first ping, inform the client about the result
+		pinger := server.NewGamePinger(ip, pingTimeout)
+		success, ok := <-pinger.C
+		connected := success && ok
+
+		server.call(func() {
+			game.handlePingResult(server, connected)
+			if first_ping {
+				// On first ping, inform the client about the result
+				if connected {
+					host.SendPacket("GAME_OPEN")
+				} else {
+					host.SendPacket("ERROR", "GAME_OPEN", "GAME_TIMEOUT")
+				}
+			}
 			if connected {
-				host.SendPacket("GAME_OPEN")
-			} else {
-				host.SendPacket("ERROR", "GAME_OPEN", "GAME_TIMEOUT")
+				game.timeLastActivity = time.Now()
 			}
-			first_ping = false
-		}
-		if connected {
-			game.timeLastActivity = time.Now()
-		}
+		})
+		first_ping = false
 
 		pingTimeout = server.GamePingTimeout()
 		time.Sleep(server.GamePingTimeout())
 	}
 }
 
-func NewGame(host string, buildId string, server *Server, gameName string, shouldUseRelay bool) *Game {
+func NewGame(host string, buildId string, server *Server, gameName string, shouldUseRelay bool, metadata GameMetadata, access GameAccess) *Game {
 	game := &Game{
-		players:      make(map[string]bool),
-		host:         host,
-		buildId:      buildId,
-		name:         gameName,
-		state:        INITIAL_SETUP,
-		usesRelay:    shouldUseRelay,
+		players:          make(map[string]bool),
+		host:             host,
+		buildId:          buildId,
+		name:             gameName,
+		state:            INITIAL_SETUP,
+		usesRelay:        shouldUseRelay,
 		timeLastActivity: time.Now(),
+		metadata:         metadata,
+		access:           access,
+		joinTokens:       make(map[string]string),
+		unusedJoinTokens: make(map[string]string),
+		onRelay:          make(map[string]bool),
+		banned:           make(map[string]bool),
+		opened:           time.Now(),
+		participants:     make(map[string]bool),
+		results:          make(map[string]GameResult),
 	}
 	server.AddGame(game)
 
@@ -152,9 +286,12 @@ func (g Game) BuildId() string {
 func (g Game) State() GameState {
 	return g.state
 }
-func (g *Game) SetState(server Server, state GameState) {
+func (g *Game) SetState(server *Server, state GameState) {
 	if state != g.state {
 		g.state = state
+		if state == RUNNING && g.started.IsZero() {
+			g.started = time.Now()
+		}
 		server.BroadcastToConnectedClients("GAMES_UPDATE")
 		log.Printf("Game '%v' is now in state %v", g.Name(), g.state.String())
 	}
@@ -167,6 +304,7 @@ func (g Game) Host() string {
 func (g *Game) AddPlayer(userName string) {
 	g.timeLastActivity = time.Now()
 	g.players[userName] = true
+	g.participants[userName] = true
 }
 
 func (g *Game) RemovePlayer(userName string, server *Server) {
@@ -174,23 +312,200 @@ func (g *Game) RemovePlayer(userName string, server *Server) {
 	if userName == g.host {
 		if !g.usesRelay {
 			log.Printf("Host %v leaves self-hosted game '%v'. This ends the game", userName, g.name)
-			server.RemoveGame(g)
+			server.RemoveGame(g, "HOST_LEFT")
 		} else {
 			log.Printf("Host %v leaves game '%v' on relay", userName, g.name)
 		}
 		return
 	}
 
+	if g.onRelay[userName] {
+		return
+	}
 	if _, ok := g.players[userName]; ok {
 		log.Printf("Client %v leaves game '%v'", userName, g.name)
-		g.players[userName] = false
+		delete(g.players, userName)
 	}
 }
 
+// RelayPlayerConnected adds the user the relay reports to have joined.
+func (g *Game) RelayPlayerConnected(userName string) {
+	g.onRelay[userName] = true
+	g.AddPlayer(userName)
+}
+
+// RelayPlayerDisconnected removes the user the relay reports to have left.
+func (g *Game) RelayPlayerDisconnected(userName string, server *Server) {
+	delete(g.onRelay, userName)
+	g.RemovePlayer(userName, server)
+}
+
+// NrPlayers returns the number of players in the game, including the host.
 func (g Game) NrPlayers() int {
 	return len(g.players)
 }
 
+// IsFull returns whether no other player can join.
+func (g Game) IsFull() bool {
+	return g.metadata.MaxPlayers > 0 && g.NrPlayers() >= g.metadata.MaxPlayers
+}
+
+// Metadata returns the metadata of the game. Games with a join password are
+// always shown to have one.
+func (g Game) Metadata() GameMetadata {
+	m := g.metadata
+	if g.access.JoinPassword != "" {
+		m.HasPassword = true
+	}
+	return m
+}
+
+func (g Game) Access() GameAccess {
+	return g.access
+}
+
+func (g *Game) SetMetadata(server *Server, metadata GameMetadata) {
+	if metadata != g.metadata {
+		g.metadata = metadata
+		server.BroadcastToConnectedClients("GAMES_UPDATE")
+	}
+}
+
+// AddJoinToken remembers which user got the join token.
+func (g *Game) AddJoinToken(token, userName string) {
+	g.joinTokens[token] = userName
+	g.unusedJoinTokens[userName] = token
+}
+
+// UnusedJoinToken returns the join token the user got but has not used on
+// the relay yet or an empty string.
+func (g Game) UnusedJoinToken(userName string) string {
+	return g.unusedJoinTokens[userName]
+}
+
+// JoinTokenUsed is called when the relay reports that a client joined with
+// the token. The relay does not accept it again.
+func (g *Game) JoinTokenUsed(token string) {
+	if userName := g.joinTokens[token]; g.unusedJoinTokens[userName] == token {
+		delete(g.unusedJoinTokens, userName)
+	}
+}
+
+// ForgetJoinToken is called when the client that joined with the token has
+// left the game on the relay for good.
+func (g *Game) ForgetJoinToken(token string) {
+	g.JoinTokenUsed(token)
+	delete(g.joinTokens, token)
+}
+
+// GotJoinToken returns whether the user got a join token for the game.
+func (g Game) GotJoinToken(userName string) bool {
+	for _, user := range g.joinTokens {
+		if user == userName {
+			return true
+		}
+	}
+	return false
+}
+
+// UserOfJoinToken returns the user that got the join token or an empty string.
+func (g Game) UserOfJoinToken(token string) string {
+	return g.joinTokens[token]
+}
+
+// Ban keeps the user from joining the game again.
+func (g *Game) Ban(userName string) {
+	g.banned[userName] = true
+}
+
+func (g Game) IsBanned(userName string) bool {
+	return g.banned[userName]
+}
+
+// HasBans returns whether the host banned anybody from the game. The relay
+// only lets clients with a join token join it then.
+func (g Game) HasBans() bool {
+	return len(g.banned) > 0
+}
+
+// HasStarted returns whether the game has been running at some time.
+func (g Game) HasStarted() bool {
+	return !g.started.IsZero()
+}
+
+// HasParticipant returns whether the user has been in the game at some time.
+func (g Game) HasParticipant(userName string) bool {
+	return g.participants[userName]
+}
+
+// ReportResult remembers the result the user reported. Returns whether all
+// the given users have reported the same result, which makes the game rated.
+func (g *Game) ReportResult(userName string, result GameResult, reporters []string) bool {
+	g.results[userName] = result
+	for _, name := range reporters {
+		if reported, ok := g.results[name]; !ok || !reported.Equal(result) {
+			return false
+		}
+	}
+	g.rated = true
+	return true
+}
+
+// DecideResult rates the game with the result all reports that arrived
+// agree on. Since the other players did not report, a player might claim a
+// win on their own. So one of the reporters has to have lost. Returns false
+// if there is no such result.
+func (g *Game) DecideResult() (GameResult, bool) {
+	var result GameResult
+	for _, reported := range g.results {
+		if result == nil {
+			result = reported
+		} else if !reported.Equal(result) {
+			return nil, false
+		}
+	}
+	if result == nil {
+		return nil, false
+	}
+	best := 0
+	for _, place := range result {
+		if best == 0 || place < best {
+			best = place
+		}
+	}
+	for name := range g.results {
+		if result[name] > best {
+			g.rated = true
+			return result, true
+		}
+	}
+	return nil, false
+}
+
+func (g Game) IsRated() bool {
+	return g.rated
+}
+
+// Record describes the game for the history.
+func (g Game) Record(reason string, ended time.Time) GameRecord {
+	var players []string
+	for name := range g.participants {
+		players = append(players, name)
+	}
+	sort.Strings(players)
+	return GameRecord{
+		Name:      g.name,
+		Host:      g.host,
+		BuildId:   g.buildId,
+		UsesRelay: g.usesRelay,
+		Opened:    g.opened,
+		Started:   g.started,
+		Ended:     ended,
+		EndReason: reason,
+		Players:   players,
+	}
+}
+
 func (g Game) UsesRelay() bool {
 	return g.usesRelay
 }
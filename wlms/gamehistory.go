@@ -0,0 +1,378 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// GameRecord describes a game from GAME_OPEN until it has been removed.
+// Times have a resolution of seconds.
+type GameRecord struct {
+	Name      string
+	Host      string
+	BuildId   string
+	UsesRelay bool
+	Opened    time.Time
+	// Zero if the game has never been started
+	Started time.Time
+	Ended   time.Time
+	// How the game ended, see the arguments of Server.RemoveGame
+	EndReason string
+	// Everybody who joined the game, including the host. Sorted by name.
+	Players []string
+}
+
+// Duration returns how long the game has been played or zero if it has never
+// been started.
+func (r GameRecord) Duration() time.Duration {
+	if r.Started.IsZero() {
+		return 0
+	}
+	return r.Ended.Sub(r.Started)
+}
+
+// GameStatistics summarizes the games opened during some time.
+type GameStatistics struct {
+	NrGames        int
+	NrStartedGames int
+	// Average duration of the started games
+	AverageDuration time.Duration
+	// Days without games are left out
+	GamesPerDay []DayCount
+}
+
+// DayCount is the number of games opened on a day (UTC).
+type DayCount struct {
+	Day     time.Time
+	NrGames int
+}
+
+// GameHistory stores the games that have ended. It is only used on the main
+// loop of the server.
+type GameHistory interface {
+	AddGame(record GameRecord) error
+	// The latest games the player took part in, latest first
+	PlayerGames(name string, limit int) ([]GameRecord, error)
+	// About the games opened from from until before to
+	Statistics(from, to time.Time) (GameStatistics, error)
+	Close()
+}
+
+// HistorySettings configures where the history of games and sessions is
+// stored. The "mysql" backend uses the database of the users. The history is
+// only kept in memory without a backend.
+type HistorySettings struct {
+	// "sqlite" or "mysql"
+	Backend string
+	// The database file for the "sqlite" backend
+	File string
+	// The key to hash the IP addresses of sessions with. A random key is used
+	// if it is empty, so hashes can not be compared after a restart.
+	IPHashKey string
+}
+
+const kSecondsPerDay = 24 * 60 * 60
+
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// Most records kept by the in-memory histories. Older ones are forgotten.
+const kInMemoryHistorySize = 100000
+
+type InMemoryGameHistory struct {
+	games []GameRecord
+	// Most games kept
+	size int
+}
+
+func NewInMemoryGameHistory() *InMemoryGameHistory {
+	return &InMemoryGameHistory{size: kInMemoryHistorySize}
+}
+
+func (h *InMemoryGameHistory) AddGame(record GameRecord) error {
+	record.Opened = fromUnix(toUnix(record.Opened))
+	record.Started = fromUnix(toUnix(record.Started))
+	record.Ended = fromUnix(toUnix(record.Ended))
+	record.Players = append([]string(nil), record.Players...)
+	sort.Strings(record.Players)
+	h.games = append(h.games, record)
+	if len(h.games) > h.size {
+		h.games = h.games[len(h.games)-h.size:]
+	}
+	return nil
+}
+
+func (h *InMemoryGameHistory) PlayerGames(name string, limit int) ([]GameRecord, error) {
+	var games []GameRecord
+	for i := len(h.games) - 1; i >= 0; i-- {
+		for _, player := range h.games[i].Players {
+			if player == name {
+				games = append(games, h.games[i])
+				break
+			}
+		}
+	}
+	sort.SliceStable(games, func(i, j int) bool { return games[i].Opened.After(games[j].Opened) })
+	if len(games) > limit {
+		games = games[:limit]
+	}
+	return games, nil
+}
+
+func (h *InMemoryGameHistory) Statistics(from, to time.Time) (GameStatistics, error) {
+	var stats GameStatistics
+	var played time.Duration
+	perDay := make(map[int64]int)
+	for _, game := range h.games {
+		if game.Opened.Before(from) || !game.Opened.Before(to) {
+			continue
+		}
+		stats.NrGames++
+		if !game.Started.IsZero() {
+			stats.NrStartedGames++
+			played += game.Duration()
+		}
+		opened := game.Opened.Unix()
+		perDay[opened-opened%kSecondsPerDay]++
+	}
+	if stats.NrStartedGames > 0 {
+		stats.AverageDuration = played / time.Duration(stats.NrStartedGames)
+	}
+	for day, n := range perDay {
+		stats.GamesPerDay = append(stats.GamesPerDay, DayCount{time.Unix(day, 0).UTC(), n})
+	}
+	sort.Slice(stats.GamesPerDay, func(i, j int) bool { return stats.GamesPerDay[i].Day.Before(stats.GamesPerDay[j].Day) })
+	return stats, nil
+}
+
+func (h *InMemoryGameHistory) Close() {
+}
+
+// SqlGameHistory keeps the games in the tables wlms_games and
+// wlms_game_players, which are created if they do not exist.
+type SqlGameHistory struct {
+	db *sql.DB
+}
+
+var sqliteHistorySchema = []string{
+	`CREATE TABLE IF NOT EXISTS wlms_games (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name VARCHAR(255) NOT NULL,
+		host VARCHAR(255) NOT NULL,
+		build_id VARCHAR(255) NOT NULL,
+		uses_relay BOOLEAN NOT NULL,
+		opened BIGINT NOT NULL,
+		started BIGINT NOT NULL,
+		ended BIGINT NOT NULL,
+		end_reason VARCHAR(64) NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS wlms_games_opened ON wlms_games (opened)`,
+	`CREATE TABLE IF NOT EXISTS wlms_game_players (
+		game_id INTEGER NOT NULL,
+		player VARCHAR(255) NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS wlms_game_players_player ON wlms_game_players (player)`,
+}
+
+var mySqlHistorySchema = []string{
+	`CREATE TABLE IF NOT EXISTS wlms_games (
+		id INTEGER PRIMARY KEY AUTO_INCREMENT,
+		name VARCHAR(255) NOT NULL,
+		host VARCHAR(255) NOT NULL,
+		build_id VARCHAR(255) NOT NULL,
+		uses_relay BOOLEAN NOT NULL,
+		opened BIGINT NOT NULL,
+		started BIGINT NOT NULL,
+		ended BIGINT NOT NULL,
+		end_reason VARCHAR(64) NOT NULL,
+		INDEX (opened))`,
+	`CREATE TABLE IF NOT EXISTS wlms_game_players (
+		game_id INTEGER NOT NULL,
+		player VARCHAR(255) NOT NULL,
+		INDEX (player))`,
+}
+
+// openHistoryDb connects to the database and creates the tables of the schema.
+func openHistoryDb(driver, source string, schema []string) (*sql.DB, error) {
+	if driver == "sqlite3" && !sqliteSupported {
+		return nil, errors.New("the metaserver has been built without SQLite support, build it with \"-tags sqlite\"")
+	}
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// SQLite does not support concurrent writes
+		db.SetMaxOpenConns(1)
+	}
+	for _, statement := range schema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// sqliteSource is the data source of a sqlite database file. The game and
+// session histories may share the file, so they wait for each other.
+func sqliteSource(file string) string {
+	return "file:" + file + "?_busy_timeout=5000"
+}
+
+// The driver of the MySQL backends. Tests replace it to check the statements.
+var mySqlDriver = "mymysql"
+
+// mySqlSource is the data source of the database of the users, see
+// NewMySqlDatabase.
+func mySqlSource(database, user, password, table string) string {
+	return fmt.Sprintf("%s*%s/%s/%s", database, table, user, password)
+}
+
+// NewSqliteGameHistory opens the database file, creating it if necessary.
+func NewSqliteGameHistory(file string) (*SqlGameHistory, error) {
+	db, err := openHistoryDb("sqlite3", sqliteSource(file), sqliteHistorySchema)
+	if err != nil {
+		return nil, err
+	}
+	return &SqlGameHistory{db}, nil
+}
+
+// NewMySqlGameHistory connects to the database like NewMySqlDatabase.
+func NewMySqlGameHistory(database, user, password, table string) (*SqlGameHistory, error) {
+	db, err := openHistoryDb(mySqlDriver, mySqlSource(database, user, password, table), mySqlHistorySchema)
+	if err != nil {
+		return nil, err
+	}
+	return &SqlGameHistory{db}, nil
+}
+
+func (h *SqlGameHistory) AddGame(record GameRecord) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("insert into wlms_games (name, host, build_id, uses_relay, opened, started, ended, end_reason) values (?, ?, ?, ?, ?, ?, ?, ?)",
+		record.Name, record.Host, record.BuildId, record.UsesRelay, toUnix(record.Opened), toUnix(record.Started), toUnix(record.Ended), record.EndReason)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, player := range record.Players {
+		if _, err := tx.Exec("insert into wlms_game_players (game_id, player) values (?, ?)", id, player); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (h *SqlGameHistory) PlayerGames(name string, limit int) ([]GameRecord, error) {
+	rows, err := h.db.Query("select g.id, g.name, g.host, g.build_id, g.uses_relay, g.opened, g.started, g.ended, g.end_reason "+
+		"from wlms_games g join wlms_game_players p on p.game_id = g.id where p.player = ? "+
+		"order by g.opened desc, g.id desc limit ?", name, limit)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	var games []GameRecord
+	for rows.Next() {
+		var id, opened, started, ended int64
+		var g GameRecord
+		if err := rows.Scan(&id, &g.Name, &g.Host, &g.BuildId, &g.UsesRelay, &opened, &started, &ended, &g.EndReason); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		g.Opened, g.Started, g.Ended = fromUnix(opened), fromUnix(started), fromUnix(ended)
+		ids = append(ids, id)
+		games = append(games, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		if games[i].Players, err = h.players(id); err != nil {
+			return nil, err
+		}
+	}
+	return games, nil
+}
+
+func (h *SqlGameHistory) players(gameId int64) ([]string, error) {
+	rows, err := h.db.Query("select player from wlms_game_players where game_id = ? order by player", gameId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var players []string
+	for rows.Next() {
+		var player string
+		if err := rows.Scan(&player); err != nil {
+			return nil, err
+		}
+		players = append(players, player)
+	}
+	return players, rows.Err()
+}
+
+func (h *SqlGameHistory) Statistics(from, to time.Time) (GameStatistics, error) {
+	var stats GameStatistics
+	var average sql.NullFloat64
+	err := h.db.QueryRow("select count(*), count(case when started > 0 then 1 end), avg(case when started > 0 then ended - started end) "+
+		"from wlms_games where opened >= ? and opened < ?", from.Unix(), to.Unix()).Scan(&stats.NrGames, &stats.NrStartedGames, &average)
+	if err != nil {
+		return stats, err
+	}
+	if average.Valid {
+		stats.AverageDuration = time.Duration(average.Float64 * float64(time.Second))
+	}
+	rows, err := h.db.Query("select opened - opened % ? as day, count(*) from wlms_games "+
+		"where opened >= ? and opened < ? group by day order by day", kSecondsPerDay, from.Unix(), to.Unix())
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day int64
+		var n int
+		if err := rows.Scan(&day, &n); err != nil {
+			return stats, err
+		}
+		stats.GamesPerDay = append(stats.GamesPerDay, DayCount{time.Unix(day, 0).UTC(), n})
+	}
+	return stats, rows.Err()
+}
+
+func (h *SqlGameHistory) Close() {
+	if h.db != nil {
+		h.db.Close()
+		h.db = nil
+	}
+}
+
+// recordGame adds the game that has just ended to the history.
+func (s *Server) recordGame(game *Game, reason string) {
+	record := game.Record(reason, time.Now())
+	if err := s.GameHistory().AddGame(record); err != nil {
+		log.Printf("Unable to add game '%v' to the history: %v", game.Name(), err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type GameHistorySuite struct{}
+
+var _ = Suite(&GameHistorySuite{})
+
+// Noon on 2026-10-14 (UTC)
+var historyStart = time.Unix(1792000000-1792000000%kSecondsPerDay+12*60*60, 0)
+
+func historyTime(days, hours int) time.Time {
+	return historyStart.AddDate(0, 0, days).Add(time.Duration(hours) * time.Hour)
+}
+
+// checkGameHistory fills the history and checks its queries. All backends
+// have to behave the same.
+func checkGameHistory(c *C, h GameHistory) {
+	defer h.Close()
+	c.Assert(h.AddGame(GameRecord{
+		Name: "first", Host: "bert", BuildId: "build-23", UsesRelay: true,
+		Opened: historyTime(0, 0), Started: historyTime(0, 1), Ended: historyTime(0, 3),
+		EndReason: "CLOSED", Players: []string{"ernie", "bert"},
+	}), IsNil)
+	c.Assert(h.AddGame(GameRecord{
+		Name: "never started", Host: "ernie", BuildId: "build-19",
+		Opened: historyTime(0, 2), Ended: historyTime(0, 4),
+		EndReason: "HOST_LEFT", Players: []string{"ernie"},
+	}), IsNil)
+	c.Assert(h.AddGame(GameRecord{
+		Name: "second", Host: "ernie", BuildId: "build-23", UsesRelay: true,
+		Opened: historyTime(2, 0), Started: historyTime(2, 0), Ended: historyTime(2, 1),
+		EndReason: "CLOSED", Players: []string{"bert", "ernie", "oscar"},
+	}), IsNil)
+
+	games, err := h.PlayerGames("bert", 10)
+	c.Assert(err, IsNil)
+	c.Assert(games, HasLen, 2)
+	c.Assert(games[0].Name, Equals, "second")
+	c.Assert(games[0].Players, DeepEquals, []string{"bert", "ernie", "oscar"})
+	c.Assert(games[1].Name, Equals, "first")
+	c.Assert(games[1].Host, Equals, "bert")
+	c.Assert(games[1].BuildId, Equals, "build-23")
+	c.Assert(games[1].UsesRelay, Equals, true)
+	c.Assert(games[1].Opened.Equal(historyTime(0, 0)), Equals, true)
+	c.Assert(games[1].Duration(), Equals, 2*time.Hour)
+	c.Assert(games[1].EndReason, Equals, "CLOSED")
+	c.Assert(games[1].Players, DeepEquals, []string{"bert", "ernie"})
+
+	games, err = h.PlayerGames("ernie", 2)
+	c.Assert(err, IsNil)
+	c.Assert(games, HasLen, 2)
+	c.Assert(games[1].Name, Equals, "never started")
+	c.Assert(games[1].Started.IsZero(), Equals, true)
+	c.Assert(games[1].Duration(), Equals, time.Duration(0))
+	c.Assert(games[1].UsesRelay, Equals, false)
+
+	games, err = h.PlayerGames("grover", 10)
+	c.Assert(err, IsNil)
+	c.Assert(games, HasLen, 0)
+
+	stats, err := h.Statistics(historyTime(-1, 0), historyTime(3, 0))
+	c.Assert(err, IsNil)
+	c.Assert(stats.NrGames, Equals, 3)
+	c.Assert(stats.NrStartedGames, Equals, 2)
+	c.Assert(stats.AverageDuration, Equals, 90*time.Minute)
+	c.Assert(stats.GamesPerDay, HasLen, 2)
+	c.Assert(stats.GamesPerDay[0].Day.Equal(historyTime(0, -12)), Equals, true)
+	c.Assert(stats.GamesPerDay[0].NrGames, Equals, 2)
+	c.Assert(stats.GamesPerDay[1].Day.Equal(historyTime(2, -12)), Equals, true)
+	c.Assert(stats.GamesPerDay[1].NrGames, Equals, 1)
+
+	// The end of the range is not included
+	stats, err = h.Statistics(historyTime(0, 1), historyTime(2, 0))
+	c.Assert(err, IsNil)
+	c.Assert(stats.NrGames, Equals, 1)
+	c.Assert(stats.NrStartedGames, Equals, 0)
+	c.Assert(stats.AverageDuration, Equals, time.Duration(0))
+}
+
+var gameHistoryTest = backendTest{
+	newInMemory: func() backend {
+		return NewInMemoryGameHistory()
+	},
+	openSqlite: func(file string) (backend, error) {
+		h, err := NewSqliteGameHistory(file)
+		return h, err
+	},
+	openMySql: func() (backend, error) {
+		h, err := NewMySqlGameHistory("wlms", "wlms", "secret", "users")
+		return h, err
+	},
+	check: func(c *C, b backend) {
+		checkGameHistory(c, b.(GameHistory))
+	},
+	reopened: func(c *C, b backend) {
+		// The games are still there after opening the file again
+		games, err := b.(GameHistory).PlayerGames("oscar", 10)
+		c.Assert(err, IsNil)
+		c.Assert(games, HasLen, 1)
+	},
+	use: func(c *C, b backend) {
+		h := b.(GameHistory)
+		c.Assert(h.AddGame(GameRecord{Name: "first", Host: "bert", Players: []string{"bert", "ernie"}}), IsNil)
+		_, err := h.PlayerGames("bert", 10)
+		c.Assert(err, IsNil)
+		// The recorded statistics query has no row to sum up
+		_, err = h.Statistics(historyTime(-1, 0), historyTime(1, 0))
+		c.Assert(err, Equals, sql.ErrNoRows)
+	},
+}
+
+func (s *GameHistorySuite) TestInMemory(c *C) {
+	gameHistoryTest.checkInMemory(c)
+}
+
+func (s *GameHistorySuite) TestSqlite(c *C) {
+	gameHistoryTest.checkSqlite(c)
+}
+
+func (s *GameHistorySuite) TestMySqlStatements(c *C) {
+	gameHistoryTest.checkMySql(c)
+}
+
+func (s *GameHistorySuite) TestInMemoryForgetsOldGames(c *C) {
+	h := NewInMemoryGameHistory()
+	h.size = 2
+	for i := 0; i < 3; i++ {
+		c.Assert(h.AddGame(GameRecord{Name: "game", Host: "bert", Opened: historyTime(i, 0),
+			Ended: historyTime(i, 1), Players: []string{"bert"}}), IsNil)
+	}
+	games, err := h.PlayerGames("bert", 10)
+	c.Assert(err, IsNil)
+	c.Assert(games, HasLen, 2)
+	c.Assert(games[1].Opened.Equal(historyTime(1, 0)), Equals, true)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The public view of the lobby for the website. It lists the players that did
+// not opt out with WEB_LISTING, the open and running games and recent public
+// chat. The feed is served as JSON at /lobby.json. With ?since=<version> the
+// request waits until there is a newer version (long-polling). A simple page
+// showing the feed is served at /.
+
+const (
+	// How often the players and games are copied into the feed
+	kFeedUpdateInterval = 2 * time.Second
+
+	// How long a long-polling request waits for a change
+	kFeedPollTimeout = 30 * time.Second
+
+	// Number of public chat messages kept
+	kFeedChatSize = 50
+)
+
+// WebFeedSettings configures the public lobby feed. It is disabled without an
+// address.
+type WebFeedSettings struct {
+	Address string
+}
+
+func (w WebFeedSettings) Enabled() bool {
+	return w.Address != ""
+}
+
+type FeedClient struct {
+	Name       string `json:"name"`
+	BuildId    string `json:"build_id"`
+	Game       string `json:"game"`
+	Registered bool   `json:"registered"`
+}
+
+type FeedGame struct {
+	Name    string `json:"name"`
+	BuildId string `json:"build_id"`
+	// "SETUP" or "RUNNING"
+	State   string `json:"state"`
+	Map     string `json:"map"`
+	Players int    `json:"players"`
+	// Zero if unknown
+	MaxPlayers int  `json:"max_players"`
+	Password   bool `json:"password"`
+}
+
+type FeedChatMessage struct {
+	Time    time.Time `json:"time"`
+	Sender  string    `json:"sender"`
+	Message string    `json:"message"`
+}
+
+type LobbySnapshot struct {
+	// Increases with every change
+	Version uint64            `json:"version"`
+	Clients []FeedClient      `json:"clients"`
+	Games   []FeedGame        `json:"games"`
+	Chat    []FeedChatMessage `json:"chat"`
+}
+
+// LobbyFeed holds the latest public view of the lobby. It can be used from
+// all goroutines.
+type LobbyFeed struct {
+	mutex    sync.Mutex
+	snapshot LobbySnapshot
+	// Closed and replaced when the snapshot changes
+	changed chan struct{}
+}
+
+func NewLobbyFeed() *LobbyFeed {
+	return &LobbyFeed{
+		snapshot: LobbySnapshot{
+			Clients: []FeedClient{},
+			Games:   []FeedGame{},
+			Chat:    []FeedChatMessage{},
+		},
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *LobbyFeed) changedLocked() {
+	f.snapshot.Version++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// update replaces the players and games. Only counts as a change if they
+// differ from the previous ones.
+func (f *LobbyFeed) update(clients []FeedClient, games []FeedGame) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if reflect.DeepEqual(clients, f.snapshot.Clients) && reflect.DeepEqual(games, f.snapshot.Games) {
+		return
+	}
+	f.snapshot.Clients = clients
+	f.snapshot.Games = games
+	f.changedLocked()
+}
+
+// AddChat adds a public chat message and drops the oldest one if there are
+// too many.
+func (f *LobbyFeed) AddChat(sender, message string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	chat := append(f.snapshot.Chat, FeedChatMessage{time.Now(), sender, message})
+	if len(chat) > kFeedChatSize {
+		chat = append([]FeedChatMessage(nil), chat[len(chat)-kFeedChatSize:]...)
+	}
+	f.snapshot.Chat = chat
+	f.changedLocked()
+}
+
+// Snapshot returns the current view. The slices must not be modified.
+func (f *LobbyFeed) Snapshot() LobbySnapshot {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.snapshot
+}
+
+// Wait returns the view once it is newer than the given version, when the
+// timeout expires or when done is closed.
+func (f *LobbyFeed) Wait(version uint64, timeout time.Duration, done <-chan struct{}) LobbySnapshot {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		f.mutex.Lock()
+		snapshot, changed := f.snapshot, f.changed
+		f.mutex.Unlock()
+		if snapshot.Version > version {
+			return snapshot
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return snapshot
+		case <-done:
+			return snapshot
+		}
+	}
+}
+
+// updateLobbyFeed copies the listed players and games into the feed. Has to
+// be called on the main loop.
+func (s *Server) updateLobbyFeed() {
+	clients := []FeedClient{}
+	s.ForeachActiveClient(func(c *Client) {
+		if c.permissions == IRC || !c.wasAnnounced || c.hiddenFromWeb {
+			return
+		}
+		game := ""
+		if c.game != nil {
+			game = c.game.Name()
+		}
+		registered := c.permissions == REGISTERED || c.permissions == SUPERUSER
+		clients = append(clients, FeedClient{c.userName, c.buildId, game, registered})
+	})
+	games := []FeedGame{}
+	s.ForeachGame(func(g *Game) {
+		var state string
+		switch g.State() {
+		case CONNECTABLE:
+			state = "SETUP"
+		case RUNNING:
+			state = "RUNNING"
+		default:
+			return
+		}
+		m := g.Metadata()
+		games = append(games, FeedGame{g.Name(), g.BuildId(), state, m.MapName, g.NrPlayers(), m.MaxPlayers, m.HasPassword})
+	})
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	sort.Slice(games, func(i, j int) bool { return games[i].Name < games[j].Name })
+	s.feed.update(clients, games)
+}
+
+// publishLobbyFeed updates the feed regularly until the server has stopped.
+func (s *Server) publishLobbyFeed(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !s.call(s.updateLobbyFeed) {
+				return
+			}
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// NewLobbyFeedHandler serves the feed as JSON and the page showing it.
+func NewLobbyFeedHandler(feed *LobbyFeed, pollTimeout time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lobby.json", func(w http.ResponseWriter, r *http.Request) {
+		snapshot := feed.Snapshot()
+		if since := r.URL.Query().Get("since"); since != "" {
+			version, err := strconv.ParseUint(since, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid version", http.StatusBadRequest)
+				return
+			}
+			snapshot = feed.Wait(version, pollTimeout, r.Context().Done())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		// The website shows the feed from another origin
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+			log.Printf("Error while sending the lobby feed to %v: %v", r.RemoteAddr, err)
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(lobbyPage))
+	})
+	return mux
+}
+
+// The page fills in the feed with textContent, so names and chat can not
+// inject markup.
+const lobbyPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Widelands Lobby</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td, th { padding: 0.2em 1em 0.2em 0; text-align: left; }
+.time { color: #888; }
+</style>
+</head>
+<body>
+<h1>Widelands Lobby</h1>
+<h2>Players online</h2>
+<table><thead><tr><th>Name</th><th>Version</th><th>Game</th></tr></thead><tbody id="clients"></tbody></table>
+<h2>Games</h2>
+<table><thead><tr><th>Name</th><th>Version</th><th>Map</th><th>State</th><th>Players</th></tr></thead><tbody id="games"></tbody></table>
+<h2>Chat</h2>
+<table><tbody id="chat"></tbody></table>
+<script>
+function fill(id, rows) {
+	var body = document.getElementById(id);
+	body.textContent = "";
+	rows.forEach(function(cells) {
+		var tr = document.createElement("tr");
+		cells.forEach(function(cell) {
+			var td = document.createElement("td");
+			td.textContent = cell[0];
+			td.className = cell[1] || "";
+			tr.appendChild(td);
+		});
+		body.appendChild(tr);
+	});
+}
+function show(feed) {
+	fill("clients", feed.clients.map(function(c) { return [[c.name], [c.build_id], [c.game]]; }));
+	fill("games", feed.games.map(function(g) {
+		var players = g.max_players ? g.players + " / " + g.max_players : g.players;
+		return [[g.name + (g.password ? " (password)" : "")], [g.build_id], [g.map], [g.state == "SETUP" ? "Open" : "Running"], [players]];
+	}));
+	fill("chat", feed.chat.map(function(m) {
+		return [[new Date(m.time).toLocaleTimeString(), "time"], [m.sender], [m.message]];
+	}));
+}
+function poll(version) {
+	fetch("lobby.json" + (version === undefined ? "" : "?since=" + version))
+		.then(function(response) { return response.json(); })
+		.then(function(feed) { show(feed); poll(feed.version); })
+		.catch(function() { setTimeout(function() { poll(version); }, 5000); });
+}
+poll();
+</script>
+</body>
+</html>
+`
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 )
@@ -10,6 +11,49 @@ import (
 type Config struct {
 	Database, User, Password, Table, Backend, IRCServer, Nickname, Realname, Channel, Hostname string
 	UseTLS                                                                                     bool
+	Validation                                                                                 ValidationPolicy
+	TLS                                                                                        TLSSettings
+	WebSocket                                                                                  WebSocketSettings
+	WebFeed                                                                                    WebFeedSettings
+	History                                                                                    HistorySettings
+}
+
+// TLSSettings configures the TLS listener that is offered next to the
+// plaintext port. TLS is disabled without a certificate. The certificate is
+// reloaded when its files change.
+type TLSSettings struct {
+	// PEM files of the certificate and its key
+	Certificate, Key string
+	// The port to listen on
+	Port int
+	// The TLS port of the relay that is advertised to clients. Zero if the
+	// relay has none.
+	RelayPort int
+}
+
+func DefaultTLSSettings() TLSSettings {
+	return TLSSettings{Port: 7403}
+}
+
+// Ports of the plaintext lobby and of the RPC connection between the
+// metaserver and the relay
+var kReservedPorts = []int{7395, 7398, 7399}
+
+// Check rejects a TLS port that is used for something else already.
+func (t TLSSettings) Check() error {
+	if !t.Enabled() {
+		return nil
+	}
+	for _, port := range kReservedPorts {
+		if t.Port == port {
+			return fmt.Errorf("the TLS port %v is used by the metaserver or the relay already", port)
+		}
+	}
+	return nil
+}
+
+func (t TLSSettings) Enabled() bool {
+	return t.Certificate != ""
 }
 
 func (l *Config) ConfigFrom(path string) error {
@@ -28,11 +72,19 @@ func main() {
 	flag.Parse()
 
 	var db UserDb
+	var history GameHistory
+	var sessions SessionHistory
+	var tournaments TournamentStore
+	ipHashKey := randomIPHashKey()
 	var ircbridge IRCBridger
 	hostname := "localhost"
+	validation := DefaultValidationPolicy()
+	tls := DefaultTLSSettings()
+	var webSocket WebSocketSettings
+	var webFeed WebFeedSettings
 	if config != "" {
 		log.Println("Loading configuration")
-		var cfg Config
+		cfg := Config{Validation: validation, TLS: tls}
 		if err := cfg.ConfigFrom(config); err != nil {
 			log.Fatalf("Could not parse config file: %v", err)
 		}
@@ -41,14 +93,67 @@ func main() {
 		} else {
 			db = NewInMemoryDb()
 		}
+		switch cfg.History.Backend {
+		case "", "memory", "sqlite", "mysql":
+		default:
+			log.Fatalf("Unknown history backend %q", cfg.History.Backend)
+		}
+		var err error
+		switch cfg.History.Backend {
+		case "sqlite":
+			history, err = NewSqliteGameHistory(cfg.History.File)
+		case "mysql":
+			history, err = NewMySqlGameHistory(cfg.Database, cfg.User, cfg.Password, cfg.Table)
+		default:
+			history = NewInMemoryGameHistory()
+		}
+		if err != nil {
+			log.Fatalf("Could not open the game history: %v", err)
+		}
+		switch cfg.History.Backend {
+		case "sqlite":
+			sessions, err = NewSqliteSessionHistory(cfg.History.File)
+		case "mysql":
+			sessions, err = NewMySqlSessionHistory(cfg.Database, cfg.User, cfg.Password, cfg.Table)
+		default:
+			sessions = NewInMemorySessionHistory()
+		}
+		if err != nil {
+			log.Fatalf("Could not open the session history: %v", err)
+		}
+		switch cfg.History.Backend {
+		case "sqlite":
+			tournaments, err = NewSqliteTournamentStore(cfg.History.File)
+		case "mysql":
+			tournaments, err = NewMySqlTournamentStore(cfg.Database, cfg.User, cfg.Password, cfg.Table)
+		default:
+			tournaments = NewInMemoryTournamentStore()
+		}
+		if err != nil {
+			log.Fatalf("Could not open the tournaments: %v", err)
+		}
+		if cfg.History.IPHashKey != "" {
+			ipHashKey = []byte(cfg.History.IPHashKey)
+		}
 		ircbridge = NewIRCBridge(cfg.IRCServer, cfg.Realname, cfg.Nickname, cfg.Channel, cfg.UseTLS)
 
 		if cfg.Hostname != "" {
 			hostname = cfg.Hostname
 		}
+		validation = cfg.Validation
+		tls = cfg.TLS
+		webSocket = cfg.WebSocket
+		webFeed = cfg.WebFeed
+		if cfg.Nickname != "" {
+			// Nobody should be able to pretend being the IRC bot
+			validation.ReservedNames = append(validation.ReservedNames, cfg.Nickname)
+		}
 	} else {
 		log.Println("No configuration found, using in-memory database")
 		db = NewInMemoryDb()
+		history = NewInMemoryGameHistory()
+		sessions = NewInMemorySessionHistory()
+		tournaments = NewInMemoryTournamentStore()
 	}
 	mdb, ok := db.(*InMemoryUserDb)
 	if ok && testuser {
@@ -56,10 +161,13 @@ func main() {
 		mdb.AddUser("testuser", "test", REGISTERED)
 	}
 	defer db.Close()
+	defer history.Close()
+	defer sessions.Close()
+	defer tournaments.Close()
 	channels := NewIRCBridgerChannels()
 	if ircbridge != nil {
 		ircbridge.Connect(channels)
 	}
-	RunServer(db, channels, hostname)
+	RunServer(db, history, sessions, tournaments, ipHashKey, channels, hostname, validation, tls, webSocket, webFeed)
 
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Largest team size that can be asked for in the matchmaking queue
+const kMaxMatchTeamSize = 4
+
+// MatchRequest is a client waiting in the matchmaking queue.
+type MatchRequest struct {
+	client *Client
+	// Number of players per team, 1 for a 1v1. Matches are always between
+	// two teams.
+	teamSize int
+	// Largest accepted difference between the ratings of the players. Zero
+	// if any difference is fine.
+	maxRatingDifference int
+}
+
+// MatchQueue holds the clients looking for a game. It is owned by the main
+// loop of the server.
+type MatchQueue struct {
+	requests []*MatchRequest
+}
+
+func NewMatchQueue() *MatchQueue {
+	return &MatchQueue{}
+}
+
+// Add puts the client in the queue or replaces its preferences if it is
+// waiting already. It keeps its place in the queue then.
+func (q *MatchQueue) Add(request *MatchRequest) {
+	for i, r := range q.requests {
+		if r.client == request.client {
+			q.requests[i] = request
+			return
+		}
+	}
+	q.requests = append(q.requests, request)
+}
+
+// Remove takes the client out of the queue. Returns whether it was waiting.
+func (q *MatchQueue) Remove(client *Client) bool {
+	for i, r := range q.requests {
+		if r.client == client {
+			q.requests = append(q.requests[:i], q.requests[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *MatchQueue) Len() int {
+	return len(q.requests)
+}
+
+// matchRating is the rating used to find opponents. Unregistered users count
+// as new players.
+func (c *Client) matchRating() int {
+	if c.permissions == REGISTERED || c.permissions == SUPERUSER {
+		return c.rating
+	}
+	return kInitialRating
+}
+
+func (r *MatchRequest) accepts(other *MatchRequest) bool {
+	difference := r.client.matchRating() - other.client.matchRating()
+	if difference < 0 {
+		difference = -difference
+	}
+	return r.teamSize == other.teamSize &&
+		versionsMatch(r.client.buildId, other.client.buildId) &&
+		(r.maxRatingDifference == 0 || difference <= r.maxRatingDifference) &&
+		(other.maxRatingDifference == 0 || difference <= other.maxRatingDifference)
+}
+
+// FindMatch looks for enough players that accept each other, preferring those
+// that have waited longest. The players are taken out of the queue. Returns
+// nil if there is no match.
+func (q *MatchQueue) FindMatch() []*MatchRequest {
+	for i, first := range q.requests {
+		match := []*MatchRequest{first}
+		for _, candidate := range q.requests[i+1:] {
+			acceptsAll := true
+			for _, r := range match {
+				if !r.accepts(candidate) {
+					acceptsAll = false
+					break
+				}
+			}
+			if !acceptsAll {
+				continue
+			}
+			match = append(match, candidate)
+			if len(match) == 2*first.teamSize {
+				for _, r := range match {
+					q.Remove(r.client)
+				}
+				return match
+			}
+		}
+	}
+	return nil
+}
+
+// startMatches opens games for the players in the queue that can be matched.
+// Clients that lost their connection are dropped from the queue first.
+func (s *Server) startMatches() {
+	for _, r := range append([]*MatchRequest(nil), s.matchQueue.requests...) {
+		if r.client.State() != CONNECTED {
+			s.matchQueue.Remove(r.client)
+		}
+	}
+	for {
+		waiting := append([]*MatchRequest(nil), s.matchQueue.requests...)
+		match := s.matchQueue.FindMatch()
+		if match == nil {
+			return
+		}
+		if !s.startMatch(match) {
+			// Nobody loses their place. They are matched again when the
+			// queue changes next.
+			s.matchQueue.requests = waiting
+			return
+		}
+	}
+}
+
+// startMatch opens an invite-only game on the relay for the matched players.
+// The player that has waited longest hosts it. Returns whether the game could
+// be opened.
+func (s *Server) startMatch(match []*MatchRequest) bool {
+	s.matchesStarted++
+	gameName := fmt.Sprintf("Quick match %d", s.matchesStarted)
+	for s.HasGame(gameName) != nil {
+		s.matchesStarted++
+		gameName = fmt.Sprintf("Quick match %d", s.matchesStarted)
+	}
+	var players []*Client
+	var names []string
+	for _, r := range match {
+		players = append(players, r.client)
+		names = append(names, r.client.Name())
+	}
+	log.Printf("Matched %v in game '%v'", strings.Join(names, ", "), gameName)
+
+	description := fmt.Sprintf("%dv%d quick match", match[0].teamSize, match[0].teamSize)
+	return s.openMatchGame(gameName, players, description, "MATCH_QUEUE") != nil
+}
+
+// openMatchGame opens an invite-only game on the relay for the players. The
+// first one hosts it and the others are told how to join. Problems with the
+// relay are reported to the host as errors of errorCmd or, if it is empty, as
+// system messages. Returns nil if the game could not be opened.
+func (s *Server) openMatchGame(gameName string, players []*Client, description, errorCmd string) *Game {
+	host := players[0]
+	relayError := func() {
+		log.Printf("Unable to open game '%v' for a match", gameName)
+		if errorCmd == "" {
+			host.SendPacket("CHAT", "", fmt.Sprintf("The relay could not open the game %v.", gameName), "system")
+		} else {
+			host.SendPacket("ERROR", errorCmd, "RELAY_ERROR")
+		}
+	}
+	var names []string
+	for _, player := range players {
+		names = append(names, player.Name())
+	}
+	metadata := GameMetadata{MaxPlayers: len(players), Description: description}
+	game, challenge, _ := host.openRelayGame(s, gameName, metadata, GameAccess{Invited: names})
+	if game == nil {
+		relayError()
+		return nil
+	}
+	var joinTokens []string
+	for range players[1:] {
+		joinToken := newJoinToken()
+		if !s.RelayAddJoinToken(gameName, joinToken) {
+			// Nobody could play the match in the game
+			go s.RelayRemoveGame(gameName)
+			s.RemoveGame(game, "CLOSED")
+			relayError()
+			return nil
+		}
+		joinTokens = append(joinTokens, joinToken)
+	}
+	host.sendRelayAddresses(s, "MATCH_HOST", gameName, challenge)
+	host.setGame(game, s)
+	for i, player := range players[1:] {
+		game.AddJoinToken(joinTokens[i], player.Name())
+		player.sendRelayAddresses(s, "MATCH_JOIN", gameName, host.Name(), joinTokens[i])
+		player.setGame(game, s)
+	}
+	return game
+}
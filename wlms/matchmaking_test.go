@@ -0,0 +1,79 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type MatchmakingSuite struct{}
+
+var _ = Suite(&MatchmakingSuite{})
+
+func matchClient(name, buildId string, rating int) *Client {
+	client := &Client{userName: name, buildId: buildId, permissions: UNREGISTERED}
+	if rating != 0 {
+		client.permissions = REGISTERED
+		client.rating = rating
+	}
+	return client
+}
+
+func matchNames(match []*MatchRequest) []string {
+	var names []string
+	for _, r := range match {
+		names = append(names, r.client.Name())
+	}
+	return names
+}
+
+func (s *MatchmakingSuite) TestTeamSizesAreNotMixed(c *C) {
+	q := NewMatchQueue()
+	q.Add(&MatchRequest{matchClient("bert", "build-25", 0), 1, 0})
+	q.Add(&MatchRequest{matchClient("ernie", "build-25", 0), 2, 0})
+	q.Add(&MatchRequest{matchClient("oscar", "build-25", 0), 2, 0})
+	q.Add(&MatchRequest{matchClient("grover", "build-25", 0), 2, 0})
+	c.Assert(q.FindMatch(), IsNil)
+
+	elmo := matchClient("elmo", "build-25", 0)
+	q.Add(&MatchRequest{elmo, 1, 0})
+	c.Assert(matchNames(q.FindMatch()), DeepEquals, []string{"bert", "elmo"})
+	c.Assert(q.Len(), Equals, 3)
+	q.Add(&MatchRequest{matchClient("zoe", "build-25", 0), 2, 0})
+	c.Assert(matchNames(q.FindMatch()), DeepEquals, []string{"ernie", "oscar", "grover", "zoe"})
+	c.Assert(q.Len(), Equals, 0)
+}
+
+func (s *MatchmakingSuite) TestBuildsHaveToMatch(c *C) {
+	q := NewMatchQueue()
+	q.Add(&MatchRequest{matchClient("bert", "build-25", 0), 1, 0})
+	q.Add(&MatchRequest{matchClient("ernie", "build-24", 0), 1, 0})
+	q.Add(&MatchRequest{matchClient("oscar", "1.2~git26001", 0), 1, 0})
+	c.Assert(q.FindMatch(), IsNil)
+	// Development builds might work together
+	q.Add(&MatchRequest{matchClient("grover", "1.2~git26002", 0), 1, 0})
+	c.Assert(matchNames(q.FindMatch()), DeepEquals, []string{"oscar", "grover"})
+}
+
+func (s *MatchmakingSuite) TestRatingsHaveToBeClose(c *C) {
+	q := NewMatchQueue()
+	q.Add(&MatchRequest{matchClient("bert", "build-25", 1800), 1, 100})
+	q.Add(&MatchRequest{matchClient("ernie", "build-25", 1600), 1, 0})
+	// Unregistered players count as new players
+	q.Add(&MatchRequest{matchClient("oscar", "build-25", 0), 1, 50})
+	c.Assert(q.FindMatch(), IsNil)
+	q.Add(&MatchRequest{matchClient("grover", "build-25", 1750), 1, 0})
+	c.Assert(matchNames(q.FindMatch()), DeepEquals, []string{"bert", "grover"})
+}
+
+func (s *MatchmakingSuite) TestPreferencesCanBeChanged(c *C) {
+	q := NewMatchQueue()
+	bert := matchClient("bert", "build-25", 0)
+	q.Add(&MatchRequest{bert, 2, 0})
+	q.Add(&MatchRequest{matchClient("ernie", "build-25", 0), 1, 0})
+	q.Add(&MatchRequest{bert, 1, 0})
+	c.Assert(q.Len(), Equals, 2)
+	c.Assert(matchNames(q.FindMatch()), DeepEquals, []string{"bert", "ernie"})
+
+	q.Add(&MatchRequest{bert, 1, 0})
+	c.Assert(q.Remove(bert), Equals, true)
+	c.Assert(q.Remove(bert), Equals, false)
+}
@@ -0,0 +1,7 @@
+//go:build !sqlite
+// +build !sqlite
+
+package main
+
+// Without "-tags sqlite" the SQLite backend of the history is not available.
+const sqliteSupported = false
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/widelands/widelands-metaserver/wlms/packet"
+	"log"
+	"math"
+	"time"
+)
+
+// Registered users start with this rating
+const kInitialRating = 1500
+
+// How much a single game can change a rating
+const kRatingFactor = 32
+
+// PlayerRating is the ELO rating of a registered user.
+type PlayerRating struct {
+	Name   string
+	Rating int
+	// Number of rated games the user has played
+	Games int
+}
+
+// GameResult is the place of each player at the end of a game, starting at 1
+// for the winners. Players with the same place have played in a team or
+// drawn and are not rated against each other.
+type GameResult map[string]int
+
+// readGameResult reads the number of players and their names and places as
+// sent with GAME_RESULT.
+func readGameResult(pkg *packet.Packet) (GameResult, error) {
+	var n int
+	if err := pkg.Unpack(&n); err != nil {
+		return nil, err
+	}
+	if n < 2 {
+		return nil, errors.New("INVALID_RESULT")
+	}
+	result := make(GameResult)
+	for i := 0; i < n; i++ {
+		var name string
+		var place int
+		if err := pkg.Unpack(&name, &place); err != nil {
+			return nil, err
+		}
+		if _, ok := result[name]; ok || place < 1 {
+			return nil, errors.New("INVALID_RESULT")
+		}
+		result[name] = place
+	}
+	return result, nil
+}
+
+func (r GameResult) Equal(other GameResult) bool {
+	if len(r) != len(other) {
+		return false
+	}
+	for name, place := range r {
+		if otherPlace, ok := other[name]; !ok || otherPlace != place {
+			return false
+		}
+	}
+	return true
+}
+
+// updateRatings returns the new ratings of the players of the result. Every
+// player is rated against all players with another place, as if they had
+// played a game against each of them.
+func updateRatings(ratings []PlayerRating, result GameResult) []PlayerRating {
+	updated := make([]PlayerRating, len(ratings))
+	for i, player := range ratings {
+		var change float64
+		opponents := 0
+		for _, opponent := range ratings {
+			if result[opponent.Name] == result[player.Name] {
+				continue
+			}
+			expected := 1 / (1 + math.Pow(10, float64(opponent.Rating-player.Rating)/400))
+			score := 0.0
+			if result[player.Name] < result[opponent.Name] {
+				score = 1
+			}
+			change += score - expected
+			opponents++
+		}
+		updated[i] = player
+		if opponents > 0 {
+			updated[i].Rating += int(math.Round(kRatingFactor * change / float64(opponents)))
+			updated[i].Games++
+		}
+	}
+	return updated
+}
+
+// rateGame updates the ratings of the registered players of the result
+// outside the main loop. Then it tells those that are online about their new
+// rating and decides the tournament match played in the game, if any.
+func (s *Server) rateGame(game *Game, result GameResult) {
+	log.Printf("Rating game '%v' with result %v", game.Name(), result)
+	var updated []PlayerRating
+	var before []int
+	s.async(func() {
+		s.ratingUpdates.Lock()
+		defer s.ratingUpdates.Unlock()
+		var ratings []PlayerRating
+		for name := range result {
+			if s.UserDb().ContainsName(name) {
+				ratings = append(ratings, s.UserDb().Rating(name))
+			}
+		}
+		for i, rating := range updateRatings(ratings, result) {
+			if err := s.UserDb().SetRating(rating); err != nil {
+				log.Printf("Unable to store the rating of %v: %v", rating.Name, err)
+				continue
+			}
+			updated = append(updated, rating)
+			before = append(before, ratings[i].Rating)
+		}
+	}, func() {
+		for i, rating := range updated {
+			if client := s.HasClient(rating.Name); client != nil && client.Permissions() != UNREGISTERED {
+				client.rating = rating.Rating
+				client.SendPacket("CHAT", "", fmt.Sprintf("Your rating changed from %d to %d.", before[i], rating.Rating), "system")
+			}
+		}
+		s.BroadcastToConnectedClients("CLIENTS_UPDATE")
+		s.tournamentGameRated(game, result)
+	})
+}
+
+// waitForResult keeps the closed relay game for some time if it has been
+// played but not rated yet, since its players might still report the result.
+// The game is rated with the reports that arrived then if a player that
+// lost reported it.
+func (s *Server) waitForResult(game *Game) {
+	if !game.UsesRelay() || !game.HasStarted() || game.IsRated() {
+		return
+	}
+	s.finishedGames[game.Name()] = game
+	time.AfterFunc(s.ResultGracePeriod(), func() {
+		s.post(func() {
+			if s.finishedGames[game.Name()] != game {
+				return
+			}
+			delete(s.finishedGames, game.Name())
+			if game.IsRated() {
+				return
+			}
+			result, ok := game.DecideResult()
+			if !ok {
+				log.Printf("Not rating game '%v' since its players did not report the same result or no loser reported it", game.Name())
+				// Tournament matches are played again
+				s.scheduleTournamentGames()
+				return
+			}
+			s.rateGame(game, result)
+		})
+	})
+}
+
+// Number of players shown by "CMD leaderboard" if no other number is asked for
+const kLeaderboardShown = 10
+
+// Most players shown by "CMD leaderboard"
+const kLeaderboardMax = 50
@@ -0,0 +1,62 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type RatingSuite struct{}
+
+var _ = Suite(&RatingSuite{})
+
+func (s *RatingSuite) TestWinnerGainsWhatLoserLoses(c *C) {
+	ratings := updateRatings([]PlayerRating{{"bert", 1500, 0}, {"ernie", 1500, 3}}, GameResult{"bert": 1, "ernie": 2})
+	c.Assert(ratings, DeepEquals, []PlayerRating{{"bert", 1516, 1}, {"ernie", 1484, 4}})
+}
+
+func (s *RatingSuite) TestBeatingStrongerPlayersGainsMore(c *C) {
+	ratings := updateRatings([]PlayerRating{{"bert", 1400, 5}, {"ernie", 1800, 5}}, GameResult{"bert": 1, "ernie": 2})
+	c.Assert(ratings[0].Rating, Equals, 1429)
+	c.Assert(ratings[1].Rating, Equals, 1771)
+}
+
+func (s *RatingSuite) TestTeamsAreNotRatedAgainstEachOther(c *C) {
+	ratings := updateRatings([]PlayerRating{{"bert", 1500, 0}, {"ernie", 1500, 0}, {"oscar", 1500, 0}},
+		GameResult{"bert": 1, "ernie": 1, "oscar": 2})
+	c.Assert(ratings, DeepEquals, []PlayerRating{{"bert", 1516, 1}, {"ernie", 1516, 1}, {"oscar", 1484, 1}})
+
+	// Without opponents nothing changes
+	ratings = updateRatings([]PlayerRating{{"bert", 1500, 0}, {"ernie", 1500, 0}}, GameResult{"bert": 1, "ernie": 1})
+	c.Assert(ratings, DeepEquals, []PlayerRating{{"bert", 1500, 0}, {"ernie", 1500, 0}})
+}
+
+func (s *RatingSuite) TestFreeForAll(c *C) {
+	ratings := updateRatings([]PlayerRating{{"bert", 1500, 0}, {"ernie", 1500, 0}, {"oscar", 1500, 0}},
+		GameResult{"bert": 1, "ernie": 2, "oscar": 3})
+	c.Assert(ratings[0].Rating, Equals, 1516)
+	c.Assert(ratings[1].Rating, Equals, 1500)
+	c.Assert(ratings[2].Rating, Equals, 1484)
+}
+
+func (s *RatingSuite) TestLeaderboard(c *C) {
+	db := NewInMemoryDb()
+	db.AddUser("bert", "secret", REGISTERED)
+	db.AddUser("ernie", "secret", REGISTERED)
+	db.AddUser("oscar", "secret", SUPERUSER)
+	c.Assert(db.Rating("bert"), Equals, PlayerRating{"bert", kInitialRating, 0})
+
+	leaders, err := db.Leaderboard(10)
+	c.Assert(err, IsNil)
+	c.Assert(leaders, HasLen, 0)
+
+	c.Assert(db.SetRating(PlayerRating{"bert", 1484, 1}), IsNil)
+	c.Assert(db.SetRating(PlayerRating{"ernie", 1516, 1}), IsNil)
+	c.Assert(db.SetRating(PlayerRating{"grover", 1516, 1}), NotNil)
+	c.Assert(db.Rating("ernie"), Equals, PlayerRating{"ernie", 1516, 1})
+
+	leaders, err = db.Leaderboard(10)
+	c.Assert(err, IsNil)
+	c.Assert(leaders, DeepEquals, []PlayerRating{{"ernie", 1516, 1}, {"bert", 1484, 1}})
+	leaders, err = db.Leaderboard(1)
+	c.Assert(err, IsNil)
+	c.Assert(leaders, DeepEquals, []PlayerRating{{"ernie", 1516, 1}})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/list"
+)
+
+// ClientRegistry holds the clients known to the server. Clients are kept in
+// the order they have been added, which is also the order in which they are
+// listed to other clients, and are indexed by name and nonce.
+type ClientRegistry struct {
+	order    *list.List
+	elements map[*Client]*list.Element
+	// Lobby clients by name. There should be only one client per name, but
+	// more are tolerated so a bug can not corrupt the index.
+	byName map[string][]*Client
+	// IRC users by name. They might have the same name as a lobby client.
+	ircByName map[string]*Client
+	byNonce   map[string][]*Client
+}
+
+func NewClientRegistry() *ClientRegistry {
+	return &ClientRegistry{
+		order:     list.New(),
+		elements:  make(map[*Client]*list.Element),
+		byName:    make(map[string][]*Client),
+		ircByName: make(map[string]*Client),
+		byNonce:   make(map[string][]*Client),
+	}
+}
+
+// Add adds the client. The name and nonce of the client must not be changed
+// while it is part of the registry.
+func (r *ClientRegistry) Add(client *Client) {
+	if _, ok := r.elements[client]; ok {
+		return
+	}
+	r.elements[client] = r.order.PushBack(client)
+	if client.Permissions() == IRC {
+		if _, ok := r.ircByName[client.Name()]; !ok {
+			r.ircByName[client.Name()] = client
+		}
+	} else {
+		r.byName[client.Name()] = append(r.byName[client.Name()], client)
+	}
+	r.byNonce[client.Nonce()] = append(r.byNonce[client.Nonce()], client)
+}
+
+// Remove removes the client and returns whether it was part of the registry.
+func (r *ClientRegistry) Remove(client *Client) bool {
+	e, ok := r.elements[client]
+	if !ok {
+		return false
+	}
+	r.order.Remove(e)
+	delete(r.elements, client)
+	if client.Permissions() == IRC {
+		if r.ircByName[client.Name()] == client {
+			delete(r.ircByName, client.Name())
+			// Another IRC user with that name might still be around.
+			r.Foreach(func(other *Client) {
+				if other.Permissions() == IRC && other.Name() == client.Name() {
+					if _, ok := r.ircByName[other.Name()]; !ok {
+						r.ircByName[other.Name()] = other
+					}
+				}
+			})
+		}
+	} else {
+		removeFromIndex(r.byName, client.Name(), client)
+	}
+	removeFromIndex(r.byNonce, client.Nonce(), client)
+	return true
+}
+
+func removeFromIndex(index map[string][]*Client, key string, client *Client) {
+	clients := index[key]
+	for i, c := range clients {
+		if c == client {
+			clients = append(clients[:i:i], clients[i+1:]...)
+			break
+		}
+	}
+	if len(clients) == 0 {
+		delete(index, key)
+	} else {
+		index[key] = clients
+	}
+}
+
+func (r *ClientRegistry) Contains(client *Client) bool {
+	_, ok := r.elements[client]
+	return ok
+}
+
+// ByName returns the lobby client with the given name or nil.
+func (r *ClientRegistry) ByName(name string) *Client {
+	if clients := r.byName[name]; len(clients) > 0 {
+		return clients[0]
+	}
+	return nil
+}
+
+// CountByName returns how many lobby clients use the given name.
+func (r *ClientRegistry) CountByName(name string) int {
+	return len(r.byName[name])
+}
+
+// IRCByName returns the IRC user with the given name or nil.
+func (r *ClientRegistry) IRCByName(name string) *Client {
+	return r.ircByName[name]
+}
+
+// WithNonce returns all clients with the given nonce in the order they have
+// been added. The returned slice must not be modified.
+func (r *ClientRegistry) WithNonce(nonce string) []*Client {
+	return r.byNonce[nonce]
+}
+
+func (r *ClientRegistry) Len() int {
+	return r.order.Len()
+}
+
+// Foreach calls callback for every client. The callback may remove the client
+// it has been called with.
+func (r *ClientRegistry) Foreach(callback func(*Client)) {
+	for e := r.order.Front(); e != nil; {
+		next := e.Next()
+		callback(e.Value.(*Client))
+		e = next
+	}
+}
+
+// GameRegistry holds the open games in the order they have been opened and
+// indexes them by name. Game names are unique.
+type GameRegistry struct {
+	order  *list.List
+	byName map[string]*list.Element
+}
+
+func NewGameRegistry() *GameRegistry {
+	return &GameRegistry{
+		order:  list.New(),
+		byName: make(map[string]*list.Element),
+	}
+}
+
+// Add adds the game unless there already is a game with that name and
+// returns whether it has been added.
+func (r *GameRegistry) Add(game *Game) bool {
+	if _, ok := r.byName[game.Name()]; ok {
+		return false
+	}
+	r.byName[game.Name()] = r.order.PushBack(game)
+	return true
+}
+
+// Remove removes the game and returns whether it was part of the registry.
+func (r *GameRegistry) Remove(game *Game) bool {
+	e, ok := r.byName[game.Name()]
+	if !ok || e.Value.(*Game) != game {
+		return false
+	}
+	r.order.Remove(e)
+	delete(r.byName, game.Name())
+	return true
+}
+
+// ByName returns the game with the given name or nil.
+func (r *GameRegistry) ByName(name string) *Game {
+	if e, ok := r.byName[name]; ok {
+		return e.Value.(*Game)
+	}
+	return nil
+}
+
+func (r *GameRegistry) Len() int {
+	return r.order.Len()
+}
+
+// Foreach calls callback for every game. The callback may remove the game it
+// has been called with.
+func (r *GameRegistry) Foreach(callback func(*Game)) {
+	for e := r.order.Front(); e != nil; {
+		next := e.Next()
+		callback(e.Value.(*Game))
+		e = next
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type RegistrySuite struct{}
+
+var _ = Suite(&RegistrySuite{})
+
+func registryClient(name, nonce string, permissions Permissions) *Client {
+	return &Client{userName: name, nonce: nonce, permissions: permissions}
+}
+
+func registryNames(r *ClientRegistry) []string {
+	var names []string
+	r.Foreach(func(client *Client) {
+		names = append(names, client.Name())
+	})
+	return names
+}
+
+// checkRegistryIndexes checks that the indexes hold exactly the clients of
+// the registry.
+func checkRegistryIndexes(c *C, r *ClientRegistry) {
+	c.Assert(r.elements, HasLen, r.Len())
+	indexed := 0
+	r.Foreach(func(client *Client) {
+		c.Check(containsClient(r.byNonce[client.Nonce()], client), Equals, true)
+		if client.Permissions() == IRC {
+			c.Check(r.ircByName[client.Name()], NotNil)
+		} else {
+			c.Check(containsClient(r.byName[client.Name()], client), Equals, true)
+			indexed++
+		}
+	})
+	byName := 0
+	for name, clients := range r.byName {
+		c.Check(clients, Not(HasLen), 0)
+		for _, client := range clients {
+			c.Check(r.Contains(client), Equals, true)
+			c.Check(client.Name(), Equals, name)
+		}
+		byName += len(clients)
+	}
+	c.Check(byName, Equals, indexed)
+	for name, client := range r.ircByName {
+		c.Check(r.Contains(client), Equals, true)
+		c.Check(client.Name(), Equals, name)
+	}
+	byNonce := 0
+	for nonce, clients := range r.byNonce {
+		c.Check(clients, Not(HasLen), 0)
+		for _, client := range clients {
+			c.Check(r.Contains(client), Equals, true)
+			c.Check(client.Nonce(), Equals, nonce)
+		}
+		byNonce += len(clients)
+	}
+	c.Check(byNonce, Equals, r.Len())
+}
+
+func containsClient(clients []*Client, client *Client) bool {
+	for _, c := range clients {
+		if c == client {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *RegistrySuite) TestAddAndRemove(c *C) {
+	r := NewClientRegistry()
+	bert := registryClient("bert", "a", UNREGISTERED)
+	ernie := registryClient("ernie", "b", REGISTERED)
+	r.Add(bert)
+	r.Add(ernie)
+	r.Add(bert)
+	checkRegistryIndexes(c, r)
+	c.Assert(registryNames(r), DeepEquals, []string{"bert", "ernie"})
+	c.Assert(r.ByName("ernie"), Equals, ernie)
+	c.Assert(r.WithNonce("a"), DeepEquals, []*Client{bert})
+
+	c.Assert(r.Remove(bert), Equals, true)
+	c.Assert(r.Remove(bert), Equals, false)
+	checkRegistryIndexes(c, r)
+	c.Assert(r.Contains(bert), Equals, false)
+	c.Assert(r.ByName("bert"), IsNil)
+	c.Assert(r.WithNonce("a"), HasLen, 0)
+	c.Assert(r.Len(), Equals, 1)
+}
+
+func (s *RegistrySuite) TestRename(c *C) {
+	r := NewClientRegistry()
+	bert := registryClient("bert", "a", REGISTERED)
+	r.Add(bert)
+	r.Add(registryClient("ernie", "b", UNREGISTERED))
+
+	// The name may only change while the client is not in the registry
+	c.Assert(r.Remove(bert), Equals, true)
+	bert.userName = "bert1"
+	bert.nonce = "c"
+	r.Add(bert)
+	checkRegistryIndexes(c, r)
+	c.Assert(r.ByName("bert"), IsNil)
+	c.Assert(r.ByName("bert1"), Equals, bert)
+	c.Assert(r.WithNonce("a"), HasLen, 0)
+	c.Assert(r.WithNonce("c"), DeepEquals, []*Client{bert})
+	// Renamed clients are listed last
+	c.Assert(registryNames(r), DeepEquals, []string{"ernie", "bert1"})
+}
+
+func (s *RegistrySuite) TestRelogin(c *C) {
+	r := NewClientRegistry()
+	old := registryClient("bert", "a", UNREGISTERED)
+	r.Add(old)
+	r.Add(registryClient("ernie", "b", UNREGISTERED))
+
+	// The new client takes over the name and nonce before the old one is
+	// removed
+	client := registryClient("bert", "a", UNREGISTERED)
+	r.Add(client)
+	checkRegistryIndexes(c, r)
+	c.Assert(r.CountByName("bert"), Equals, 2)
+	c.Assert(r.ByName("bert"), Equals, old)
+	c.Assert(r.WithNonce("a"), DeepEquals, []*Client{old, client})
+
+	c.Assert(r.Remove(old), Equals, true)
+	checkRegistryIndexes(c, r)
+	c.Assert(r.CountByName("bert"), Equals, 1)
+	c.Assert(r.ByName("bert"), Equals, client)
+	c.Assert(r.WithNonce("a"), DeepEquals, []*Client{client})
+	c.Assert(registryNames(r), DeepEquals, []string{"ernie", "bert"})
+}
+
+func (s *RegistrySuite) TestIRCUsers(c *C) {
+	r := NewClientRegistry()
+	bert := registryClient("bert", "a", UNREGISTERED)
+	irc := registryClient("bert", "", IRC)
+	other := registryClient("bert", "", IRC)
+	r.Add(bert)
+	r.Add(irc)
+	r.Add(other)
+	checkRegistryIndexes(c, r)
+	c.Assert(r.ByName("bert"), Equals, bert)
+	c.Assert(r.CountByName("bert"), Equals, 1)
+	c.Assert(r.IRCByName("bert"), Equals, irc)
+
+	// Another IRC user with the name takes over the index
+	c.Assert(r.Remove(irc), Equals, true)
+	checkRegistryIndexes(c, r)
+	c.Assert(r.IRCByName("bert"), Equals, other)
+	c.Assert(r.ByName("bert"), Equals, bert)
+
+	c.Assert(r.Remove(other), Equals, true)
+	checkRegistryIndexes(c, r)
+	c.Assert(r.IRCByName("bert"), IsNil)
+	c.Assert(r.ByName("bert"), Equals, bert)
+}
+
+func (s *RegistrySuite) TestRemoveWhileIterating(c *C) {
+	r := NewClientRegistry()
+	for _, name := range []string{"bert", "ernie", "grover"} {
+		r.Add(registryClient(name, name, UNREGISTERED))
+	}
+	var visited []string
+	r.Foreach(func(client *Client) {
+		visited = append(visited, client.Name())
+		if client.Name() != "ernie" {
+			r.Remove(client)
+		}
+	})
+	c.Assert(visited, DeepEquals, []string{"bert", "ernie", "grover"})
+	checkRegistryIndexes(c, r)
+	c.Assert(registryNames(r), DeepEquals, []string{"ernie"})
+}
+
+func gameNames(r *GameRegistry) []string {
+	var names []string
+	r.Foreach(func(game *Game) {
+		names = append(names, game.Name())
+	})
+	return names
+}
+
+func (s *RegistrySuite) TestGames(c *C) {
+	r := NewGameRegistry()
+	first := &Game{name: "first"}
+	second := &Game{name: "second"}
+	c.Assert(r.Add(first), Equals, true)
+	c.Assert(r.Add(second), Equals, true)
+	// Names are unique
+	c.Assert(r.Add(&Game{name: "first"}), Equals, false)
+	c.Assert(r.Remove(&Game{name: "first"}), Equals, false)
+	c.Assert(r.Len(), Equals, 2)
+	c.Assert(r.ByName("first"), Equals, first)
+	c.Assert(gameNames(r), DeepEquals, []string{"first", "second"})
+
+	r.Foreach(func(game *Game) {
+		c.Assert(r.Remove(game), Equals, true)
+	})
+	c.Assert(r.Len(), Equals, 0)
+	c.Assert(r.ByName("first"), IsNil)
+	c.Assert(r.Remove(first), Equals, false)
+
+	// The name is free again
+	third := &Game{name: "first"}
+	c.Assert(r.Add(third), Equals, true)
+	c.Assert(r.ByName("first"), Equals, third)
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"container/list"
+	"fmt"
+	"github.com/widelands/widelands-metaserver/tlsconfig"
 	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -24,17 +28,42 @@ type BannedIP struct {
 	until time.Time
 }
 
+// The clients, games and banned IPs of the server are owned by mainLoop and
+// must only be accessed from there. Goroutines that want to access them pass
+// a function to call() or post(). The settings are guarded by a mutex and can
+// be accessed from everywhere.
 type Server struct {
-	acceptedConnections  chan ReadWriteCloserWithIp
-	shutdownServer       chan bool
-	serverHasShutdown    chan bool
-	clients              *list.List
-	games                *list.List
-	user_db              UserDb
+	acceptedConnections chan ReadWriteCloserWithIp
+	shutdownServer      chan bool
+	serverHasShutdown   chan bool
+	// Functions that should be run on the main loop
+	events chan func()
+	// Closed when the main loop has stopped
+	stopped chan struct{}
+
+	clients *ClientRegistry
+	games   *GameRegistry
+	user_db UserDb
+	irc     *IRCBridgerChannels
+	relay   relayinterface.Client
+	// The IP addresses of the wlnr instance
+	relay_address AddressPair
+
+	// A list of IPs that has been banned for some time
+	banned *list.List
+
+	settings             sync.RWMutex
 	motd                 string
 	clientSendingTimeout time.Duration
 	pingCycleTime        time.Duration
 
+	// Number of packets that can be queued for sending to a client before it
+	// gets disconnected.
+	clientSendQueueSize int
+
+	// Time a single write to a client may take before it gets disconnected.
+	clientWriteTimeout time.Duration
+
 	// Time in which a game has to respond to the first ping.
 	gameInitialPingTimeout time.Duration
 
@@ -43,63 +72,230 @@ type Server struct {
 
 	clientForgetTimeout time.Duration
 	gamePingerFactory   GamePingerFactory
-	irc                 *IRCBridgerChannels
-	relay               relayinterface.Client
-	// The IP addresses of the wlnr instance
-	relay_address AddressPair
 
-	// A list of IPs that has been banned for some time
-	banned *list.List
+	// Time the players of a relay game have to report its result after it
+	// has been closed.
+	resultGracePeriod time.Duration
+
+	// Which user and game names are accepted and how chat is filtered
+	validation ValidationPolicy
+
+	// The public view of the lobby for the website
+	feed *LobbyFeed
+
+	// Where ended games are kept
+	history GameHistory
+
+	// Relay games that have been closed recently by name, so their players
+	// can still report the result
+	finishedGames map[string]*Game
+
+	// The clients looking for a quick match and the number of matches that
+	// have been started
+	matchQueue     *MatchQueue
+	matchesStarted int
+
+	// Where the sessions of the users are kept and the key to hash their IP
+	// addresses with
+	sessions  SessionHistory
+	ipHashKey []byte
+
+	// Held while the ratings of a game are updated, so games rated at once
+	// do not overwrite each other's changes
+	ratingUpdates sync.Mutex
+
+	// The tournaments by name and where they are kept across restarts
+	tournaments     map[string]*Tournament
+	tournamentStore TournamentStore
+
+	// The ports of the TLS listeners of the metaserver and the relay that
+	// are advertised to clients. Zero if there is none.
+	tlsPort      int
+	relayTLSPort int
 }
 
 type GamePingerFactory interface {
 	New(ip string, timeout time.Duration) *GamePinger
 }
 
-func (s Server) ClientSendingTimeout() time.Duration {
+func (s *Server) ClientSendingTimeout() time.Duration {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
 	return s.clientSendingTimeout
 }
 
 func (s *Server) SetClientSendingTimeout(d time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
 	s.clientSendingTimeout = d
 }
 
-func (s Server) PingCycleTime() time.Duration {
+func (s *Server) ClientSendQueueSize() int {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.clientSendQueueSize
+}
+func (s *Server) SetClientSendQueueSize(v int) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.clientSendQueueSize = v
+}
+
+func (s *Server) ClientWriteTimeout() time.Duration {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.clientWriteTimeout
+}
+func (s *Server) SetClientWriteTimeout(v time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.clientWriteTimeout = v
+}
+
+func (s *Server) PingCycleTime() time.Duration {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
 	return s.pingCycleTime
 }
 func (s *Server) SetPingCycleTime(d time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
 	s.pingCycleTime = d
 }
 
-func (s Server) GamePingTimeout() time.Duration {
+func (s *Server) GamePingTimeout() time.Duration {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
 	return s.gamePingTimeout
 }
 func (s *Server) SetGamePingTimeout(v time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
 	s.gamePingTimeout = v
 }
 
-func (s Server) GameInitialPingTimeout() time.Duration {
+func (s *Server) GameInitialPingTimeout() time.Duration {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
 	return s.gameInitialPingTimeout
 }
 func (s *Server) SetGameInitialPingTimeout(v time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
 	s.gameInitialPingTimeout = v
 }
 
-func (s Server) ClientForgetTimeout() time.Duration {
+func (s *Server) ClientForgetTimeout() time.Duration {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
 	return s.clientForgetTimeout
 }
 func (s *Server) SetClientForgetTimeout(v time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
 	s.clientForgetTimeout = v
 }
 
-func (s Server) Motd() string {
+func (s *Server) ResultGracePeriod() time.Duration {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.resultGracePeriod
+}
+func (s *Server) SetResultGracePeriod(v time.Duration) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.resultGracePeriod = v
+}
+
+func (s *Server) Motd() string {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
 	return s.motd
 }
 func (s *Server) SetMotd(v string) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
 	s.motd = v
 }
 
-func (s Server) UserDb() UserDb {
+func (s *Server) TLSPort() int {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.tlsPort
+}
+func (s *Server) SetTLSPort(v int) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.tlsPort = v
+}
+
+func (s *Server) RelayTLSPort() int {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.relayTLSPort
+}
+func (s *Server) SetRelayTLSPort(v int) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.relayTLSPort = v
+}
+
+func (s *Server) ValidationPolicy() ValidationPolicy {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.validation
+}
+func (s *Server) SetValidationPolicy(v ValidationPolicy) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.validation = v
+}
+
+func (s *Server) GameHistory() GameHistory {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.history
+}
+func (s *Server) SetGameHistory(h GameHistory) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.history = h
+}
+
+func (s *Server) SessionHistory() SessionHistory {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.sessions
+}
+func (s *Server) SetSessionHistory(h SessionHistory) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.sessions = h
+}
+
+func (s *Server) TournamentStore() TournamentStore {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.tournamentStore
+}
+func (s *Server) SetTournamentStore(st TournamentStore) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.tournamentStore = st
+}
+
+func (s *Server) IPHashKey() []byte {
+	s.settings.RLock()
+	defer s.settings.RUnlock()
+	return s.ipHashKey
+}
+func (s *Server) SetIPHashKey(v []byte) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	s.ipHashKey = v
+}
+
+func (s *Server) UserDb() UserDb {
 	return s.user_db
 }
 
@@ -113,106 +309,114 @@ func (s *Server) WaitTillShutdown() {
 }
 
 func (s *Server) NewGamePinger(ip string, ping_timeout time.Duration) *GamePinger {
-	return s.gamePingerFactory.New(ip, ping_timeout)
+	s.settings.RLock()
+	factory := s.gamePingerFactory
+	s.settings.RUnlock()
+	return factory.New(ip, ping_timeout)
+}
+
+// call runs f on the main loop and waits till it is done. Returns false
+// without running f if the server has been shut down. Must not be called from
+// the main loop itself.
+func (s *Server) call(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case s.events <- func() {
+		f()
+		close(done)
+	}:
+		<-done
+		return true
+	case <-s.stopped:
+		return false
+	}
+}
+
+// post runs f on the main loop without waiting for it.
+func (s *Server) post(f func()) {
+	go s.call(f)
+}
+
+// async runs work outside the main loop and then done on it. Queries of the
+// user database and calls to the relay are done that way, so a slow one does
+// not stall every client. done is not run if the server has been shut down.
+func (s *Server) async(work func(), done func()) {
+	go func() {
+		work()
+		s.call(done)
+	}()
+}
+
+// accept lets the main loop deal with a new connection that did not come
+// through acceptedConnections. Returns false if the server has been shut down.
+func (s *Server) accept(conn ReadWriteCloserWithIp) bool {
+	return s.call(func() {
+		go DealWithNewConnection(conn, s)
+	})
 }
 
 func (s *Server) AddClient(client *Client) {
 	if client.Permissions() != IRC {
-		go client.Announce(*s)
+		go client.Announce(s)
 	}
-	s.clients.PushBack(client)
+	s.clients.Add(client)
 }
 
-func (s *Server) RemoveClient(client *Client) {
+// RemoveClient removes the client and ends its session. The reason tells why:
+// "LEFT" on its own, "CONNECTION_LOST", "REPLACED" by a new login with the
+// same nonce, "RELOGIN" of a build 19 client, "KICKED" or "BANNED" by an
+// admin, "IRC_LEFT" for IRC users or "SHUTDOWN" of the server.
+func (s *Server) RemoveClient(client *Client, reason string) {
 	// Sanity check: make sure this user is not in our list of clients more than
 	// once.
-	cntGame := 0
-	cntIRC := 0
-	for e := s.clients.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Client).Name() == client.Name() {
-			if e.Value.(*Client).Permissions() == IRC {
-				cntIRC++
-			} else {
-				cntGame++
-			}
-		}
-	}
-	if cntIRC > 1 {
-		log.Printf("Warning: IRC client %s is in the client list %d times", client.Name(), cntIRC)
-	}
-	if cntGame > 1 {
-		log.Printf("Warning: Game client %s is in the client list %d times", client.Name(), cntGame)
+	if client.Permissions() != IRC && s.clients.CountByName(client.Name()) > 1 {
+		log.Printf("Warning: Game client %s is in the client list %d times", client.Name(), s.clients.CountByName(client.Name()))
 	}
 
 	// Now remove the client for good if it is around.
-	for e := s.clients.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Client) == client {
-			if client.Permissions() != IRC {
-				log.Printf("Removing client %s", client.Name())
-				go client.Announce(*s)
-			}
-			s.clients.Remove(e)
-			break
-		}
+	if s.clients.Remove(client) && client.Permissions() != IRC {
+		log.Printf("Removing client %s", client.Name())
+		s.endSession(client, reason)
+		s.matchQueue.Remove(client)
+		go client.Announce(s)
 	}
 }
 
-func (s Server) HasClient(name string) *Client {
-	for e := s.clients.Front(); e != nil; e = e.Next() {
-		client := e.Value.(*Client)
-		if client.Name() == name && client.Permissions() != IRC {
-			return client
-		}
-	}
-	return nil
+func (s *Server) HasClient(name string) *Client {
+	return s.clients.ByName(name)
 }
 
-func (s Server) HasClientObject(c *Client) bool {
-	for e := s.clients.Front(); e != nil; e = e.Next() {
-		client := e.Value.(*Client)
-		if client == c {
-			return true
-		}
-	}
-	return false
+func (s *Server) HasClientObject(c *Client) bool {
+	return s.clients.Contains(c)
 }
 
-func (s Server) HasIRCClient(name string) *Client {
-	for e := s.clients.Front(); e != nil; e = e.Next() {
-		client := e.Value.(*Client)
-		if client.Name() == name && client.Permissions() == IRC {
-			return client
-		}
-	}
-	return nil
+func (s *Server) HasIRCClient(name string) *Client {
+	return s.clients.IRCByName(name)
 }
 
-func (s Server) FindClientsToReplace(nonce string, name string) []*Client {
+func (s *Server) FindClientsToReplace(nonce string, name string) []*Client {
 	res := make([]*Client, 0)
 	var best *Client = nil
 
 	// Assumptions: There is at most one client where nonce and name match,
 	// there may be multiple clients with the same nonce
-	for e := s.clients.Front(); e != nil; e = e.Next() {
-		client := e.Value.(*Client)
+	for _, client := range s.clients.WithNonce(nonce) {
 		if client.PendingLogin() != nil {
 			// If there already is a replacement pending for this client, there is no use adding
 			// it to this list. Either it will be replaced, or it is still active anyway
 			continue
 		}
-		if client.Nonce() == nonce {
-			// Nonce is the same so at least it is one connection of this player
-			if client.Name() == name {
-				// Even the wanted name? Great! Add it to the front of the list later on
-				best = client
+		// Nonce is the same so at least it is one connection of this player
+		if client.Name() == name {
+			// Even the wanted name? Great! Add it to the front of the list later on
+			best = client
+		} else {
+			// Put disconnected clients on the front, (potentially) active ones in the back
+			// This way, disconnected clients will be replaced first
+			if client.State() == RECENTLY_DISCONNECTED {
+				res = append([]*Client{client}, res...)
 			} else {
-				// Put disconnected clients on the front, (potentially) active ones in the back
-				// This way, disconnected clients will be replaced first
-				if client.State() == RECENTLY_DISCONNECTED {
-					res = append([]*Client{client}, res...)
-				} else {
-					res = append(res, client)
-				}
+				res = append(res, client)
 			}
 		}
 	}
@@ -224,39 +428,35 @@ func (s Server) FindClientsToReplace(nonce string, name string) []*Client {
 	return res
 }
 
-func (s Server) NrActiveClients() int {
+func (s *Server) NrActiveClients() int {
 	count := 0
-	for e := s.clients.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Client).State() == CONNECTED {
-			count++
-		}
-	}
+	s.ForeachActiveClient(func(*Client) {
+		count++
+	})
 	return count
 }
 
-func (s Server) ForeachActiveClient(callback func(*Client)) {
-	for e := s.clients.Front(); e != nil; e = e.Next() {
-		client := e.Value.(*Client)
-		if client.State() != CONNECTED {
-			continue
+func (s *Server) ForeachActiveClient(callback func(*Client)) {
+	s.clients.Foreach(func(client *Client) {
+		if client.State() == CONNECTED {
+			callback(client)
 		}
-		callback(client)
-	}
+	})
 }
 
-func (s Server) AddKickedClient(c *Client) {
+func (s *Server) AddKickedClient(c *Client) {
 	ip := c.conn.RemoteAddr().(*net.TCPAddr).IP.String()
 	log.Printf("Kicking IP %v for 5 minutes", ip)
 	s.banned.PushBack(&BannedIP{ip, time.Now().Add(5 * time.Minute)})
 }
 
-func (s Server) AddBannedClient(c *Client) {
+func (s *Server) AddBannedClient(c *Client) {
 	ip := c.conn.RemoteAddr().(*net.TCPAddr).IP.String()
 	log.Printf("Banning IP %v for 24 hours", ip)
 	s.banned.PushBack(&BannedIP{ip, time.Now().Add(24 * time.Hour)})
 }
 
-func (s Server) IsBannedClient(c *Client) bool {
+func (s *Server) IsBannedClient(c *Client) bool {
 	ip := c.conn.RemoteAddr().(*net.TCPAddr).IP.String()
 	now := time.Now()
 	for e := s.banned.Front(); e != nil; {
@@ -274,55 +474,50 @@ func (s Server) IsBannedClient(c *Client) bool {
 }
 
 func (s *Server) AddGame(game *Game) {
-	s.games.PushBack(game)
+	if !s.games.Add(game) {
+		log.Printf("Warning: Told to add game '%s' which is already listed", game.Name())
+		return
+	}
 	s.BroadcastToConnectedClients("GAMES_UPDATE")
 	s.BroadcastToIrc("A new game " + game.Name() + " was opened by " + game.Host())
 }
 
-func (s *Server) RemoveGame(game *Game) {
-	for e := s.games.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Game) == game {
-			log.Printf("Removing game '%s'", game.Name())
-			s.games.Remove(e)
-			s.BroadcastToConnectedClients("GAMES_UPDATE")
-		}
+// RemoveGame removes the game and adds it to the history. The reason tells how
+// the game ended: "CLOSED" by the relay, "HOST_LEFT" a self-hosted game,
+// "KICKED" by an admin, "TIMEOUT" after no activity or "SHUTDOWN" of the
+// server.
+func (s *Server) RemoveGame(game *Game, reason string) {
+	if s.games.Remove(game) {
+		log.Printf("Removing game '%s'", game.Name())
+		s.recordGame(game, reason)
+		s.waitForResult(game)
+		s.BroadcastToConnectedClients("GAMES_UPDATE")
 	}
 }
 
-func (s Server) HasGame(name string) *Game {
-	for e := s.games.Front(); e != nil; e = e.Next() {
-		game := e.Value.(*Game)
-		if game.Name() == name {
-			return game
-		}
-	}
-	return nil
+func (s *Server) HasGame(name string) *Game {
+	return s.games.ByName(name)
 }
 
-func (s Server) NrGames() int {
+func (s *Server) NrGames() int {
 	return s.games.Len()
 }
 
-func (s Server) ForeachGame(callback func(*Game)) {
-	for e := s.games.Front(); e != nil; e = e.Next() {
-		callback(e.Value.(*Game))
-	}
+func (s *Server) ForeachGame(callback func(*Game)) {
+	s.games.Foreach(callback)
 }
 
 func (s *Server) BroadcastToConnectedClients(data ...interface{}) {
-	for e := s.clients.Front(); e != nil; e = e.Next() {
-		client := e.Value.(*Client)
-		if client.State() == CONNECTED {
-			client.SendPacket(data...)
-		}
-	}
+	s.ForeachActiveClient(func(client *Client) {
+		client.SendPacket(data...)
+	})
 }
 
-func (s Server) BroadcastToIrc(message string) {
+func (s *Server) BroadcastToIrc(message string) {
 	s.BroadcastToIrcFromUser(message, "")
 }
 
-func (s Server) BroadcastToIrcFromUser(message, nick string) {
+func (s *Server) BroadcastToIrcFromUser(message, nick string) {
 	select {
 	case s.irc.messagesToIRC <- Message{
 		message: message,
@@ -333,25 +528,90 @@ func (s Server) BroadcastToIrcFromUser(message, nick string) {
 	}
 }
 
-func RunServer(db UserDb, irc *IRCBridgerChannels, hostname string) {
+func acceptConnections(ln net.Listener, C chan ReadWriteCloserWithIp) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		C <- conn
+	}
+}
+
+// listenForClients opens the plaintext port of the lobby and, if it is
+// enabled, the TLS port. Their connections are passed to C.
+func listenForClients(tls TLSSettings, C chan ReadWriteCloserWithIp) ([]net.Listener, error) {
+	if err := tls.Check(); err != nil {
+		return nil, err
+	}
 	ln, err := net.Listen("tcp", ":7395")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer ln.Close()
+	go acceptConnections(ln, C)
+	listeners := []net.Listener{ln}
 
-	C := make(chan ReadWriteCloserWithIp)
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				break
-			}
-			C <- conn
+	if tls.Enabled() {
+		tlsLn, err := tlsconfig.Listen(net.JoinHostPort("", fmt.Sprint(tls.Port)), tls.Certificate, tls.Key)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("unable to listen for TLS connections: %v", err)
 		}
-	}()
+		log.Printf("Accepting TLS connections on port %v", tls.Port)
+		go acceptConnections(tlsLn, C)
+		listeners = append(listeners, tlsLn)
+	}
+	return listeners, nil
+}
+
+func RunServer(db UserDb, history GameHistory, sessions SessionHistory, tournaments TournamentStore, ipHashKey []byte, irc *IRCBridgerChannels, hostname string, validation ValidationPolicy, tls TLSSettings, webSocket WebSocketSettings, webFeed WebFeedSettings) {
+	C := make(chan ReadWriteCloserWithIp)
+	listeners, err := listenForClients(tls, C)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, ln := range listeners {
+		defer ln.Close()
+	}
 
 	server := CreateServerUsing(C, db, irc, hostname)
+	if webSocket.Enabled() {
+		// Web pages served with https can only use secure WebSockets
+		var wsLn net.Listener
+		if tls.Enabled() {
+			wsLn, err = tlsconfig.Listen(webSocket.Address, tls.Certificate, tls.Key)
+		} else {
+			wsLn, err = net.Listen("tcp", webSocket.Address)
+		}
+		if err != nil {
+			log.Fatalf("Unable to listen for WebSocket connections: %v", err)
+		}
+		defer wsLn.Close()
+		log.Printf("Accepting WebSocket connections on %v", webSocket.Address)
+		go http.Serve(wsLn, NewWebSocketHandler(server.accept, webSocket))
+	}
+	server.SetValidationPolicy(validation)
+	server.SetGameHistory(history)
+	server.SetSessionHistory(sessions)
+	server.SetTournamentStore(tournaments)
+	server.SetIPHashKey(ipHashKey)
+	if err := server.LoadTournaments(); err != nil {
+		log.Fatalf("Unable to load the tournaments: %v", err)
+	}
+	if webFeed.Enabled() {
+		feedLn, err := net.Listen("tcp", webFeed.Address)
+		if err != nil {
+			log.Fatalf("Unable to listen for lobby feed requests: %v", err)
+		}
+		defer feedLn.Close()
+		log.Printf("Serving the lobby feed on %v", webFeed.Address)
+		go http.Serve(feedLn, NewLobbyFeedHandler(server.feed, kFeedPollTimeout))
+		go server.publishLobbyFeed(kFeedUpdateInterval)
+	}
+	if tls.Enabled() {
+		server.SetTLSPort(tls.Port)
+	}
+	server.SetRelayTLSPort(tls.RelayPort)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -400,11 +660,13 @@ func (gpf RealGamePingerFactory) New(ip string, timeout time.Duration) *GamePing
 }
 
 func (server *Server) InjectGamePingerFactory(gpf GamePingerFactory) {
+	server.settings.Lock()
+	defer server.settings.Unlock()
 	server.gamePingerFactory = gpf
 }
 
-func (server *Server) RelayCreateGame(name string, password string) bool {
-	if !server.relay.CreateGame(name, password) {
+func (server *Server) RelayCreateGame(name string, password string, restricted bool) bool {
+	if !server.relay.CreateGame(name, password, restricted) {
 		log.Println("ERROR: Unable to create a game on the relay server. This should not happen")
 		return false
 	} else {
@@ -414,7 +676,25 @@ func (server *Server) RelayCreateGame(name string, password string) bool {
 
 func (server *Server) RelayRemoveGame(name string) bool {
 	if !server.relay.RemoveGame(name) {
-		log.Println("ERROR: Told to remove game %s on relay but unable to do so.")
+		log.Printf("ERROR: Told to remove game %s on relay but unable to do so.", name)
+		return false
+	} else {
+		return true
+	}
+}
+
+func (server *Server) RelayAddJoinToken(name string, token string) bool {
+	if !server.relay.AddJoinToken(name, token) {
+		log.Printf("ERROR: Unable to add a join token for game %s on relay.", name)
+		return false
+	} else {
+		return true
+	}
+}
+
+func (server *Server) RelayRecordGame(name string) bool {
+	if !server.relay.RecordGame(name) {
+		log.Printf("ERROR: Told to record game %s on relay but unable to do so.", name)
 		return false
 	} else {
 		return true
@@ -423,48 +703,153 @@ func (server *Server) RelayRemoveGame(name string) bool {
 
 // The relay informs us that the game with the given name has been connected by the host
 func (server *Server) GameConnected(name string) {
+	server.call(func() {
+		server.gameConnected(name)
+	})
+}
+
+func (server *Server) gameConnected(name string) {
 	log.Printf("Relay notifies us that the host connected to its game '%s'", name)
 	game := server.HasGame(name)
 	if game == nil {
 		log.Printf(" Game '%s' is unknown, might already been closed", name)
 		return
 	}
-	game.SetState(*server, CONNECTABLE)
+	game.SetState(server, CONNECTABLE)
 }
 
 // The relay informs us that the game with the given name has been closed
 func (server *Server) GameClosed(name string) {
+	server.call(func() {
+		server.gameClosed(name)
+	})
+}
+
+func (server *Server) gameClosed(name string) {
 	log.Printf("Relay notifies us that the game '%s' has been closed", name)
 	game := server.HasGame(name)
 	if game == nil {
 		// The game might have already been deleted when the host has notified us about its end
 		return
 	}
-	server.RemoveGame(game)
+	server.RemoveGame(game, "CLOSED")
+	// Its players are free for their next tournament match now
+	var players []*Client
+	server.ForeachActiveClient(func(client *Client) {
+		if client.Game() == game {
+			players = append(players, client)
+		}
+	})
+	for _, client := range players {
+		client.setGame(nil, server)
+	}
+	server.scheduleTournamentGames()
+}
+
+// The relay informs us that the host of the game with the given name kicked
+// the client with the given join token
+func (server *Server) ClientKicked(name string, token string, ban bool) {
+	server.call(func() {
+		server.clientKicked(name, token, ban)
+	})
+}
+
+func (server *Server) clientKicked(name string, token string, ban bool) {
+	game := server.HasGame(name)
+	if game == nil {
+		return
+	}
+	userName := game.UserOfJoinToken(token)
+	if userName == "" {
+		log.Printf("Relay notifies us about a kicked client of game '%s' with an unknown join token", name)
+		return
+	}
+	log.Printf("Relay notifies us that the host of game '%s' kicked %s, ban=%v", name, userName, ban)
+	if ban {
+		game.Ban(userName)
+	}
+	game.ForgetJoinToken(token)
+	server.relayPlayerLeft(game, userName)
+}
+
+// The relay informs us that the client with the given join token joined the
+// game with the given name
+func (server *Server) ClientConnected(name string, token string) {
+	server.call(func() {
+		server.clientConnected(name, token)
+	})
+}
+
+func (server *Server) clientConnected(name string, token string) {
+	game := server.HasGame(name)
+	if game == nil {
+		return
+	}
+	userName := game.UserOfJoinToken(token)
+	if userName == "" {
+		log.Printf("Relay notifies us about a client of game '%s' with an unknown join token", name)
+		return
+	}
+	log.Printf("Relay notifies us that %s joined game '%s'", userName, name)
+	game.JoinTokenUsed(token)
+	game.RelayPlayerConnected(userName)
+}
+
+// The relay informs us that the client with the given join token left the
+// game with the given name
+func (server *Server) ClientDisconnected(name string, token string) {
+	server.call(func() {
+		server.clientDisconnected(name, token)
+	})
+}
+
+func (server *Server) clientDisconnected(name string, token string) {
+	game := server.HasGame(name)
+	if game == nil {
+		return
+	}
+	userName := game.UserOfJoinToken(token)
+	if userName == "" {
+		log.Printf("Relay notifies us about a client of game '%s' with an unknown join token", name)
+		return
+	}
+	log.Printf("Relay notifies us that %s left game '%s'", userName, name)
+	game.ForgetJoinToken(token)
+	server.relayPlayerLeft(game, userName)
+}
+
+// relayPlayerLeft removes the user from the game and, if the user is still in
+// it in the lobby, from there as well.
+func (server *Server) relayPlayerLeft(game *Game, userName string) {
+	game.RelayPlayerDisconnected(userName, server)
+	if client := server.HasClient(userName); client != nil && client.Game() == game {
+		client.setGame(nil, server)
+		server.scheduleTournamentGames()
+	}
 }
 
 // The current status has been requested over RPC
 func (s *Server) Status() *relayinterface.ServerStatus {
 	users := 0
 	clientsInGames := 0
-	for e := s.clients.Front(); e != nil; e = e.Next() {
-		c := e.Value.(*Client)
-		if c.State() == CONNECTED && c.Permissions() != IRC {
-			users++
-			if c.Game() != nil {
-				clientsInGames++
-			}
-		}
-	}
 	games := 0
 	openGames := 0
-	for e := s.games.Front(); e != nil; e = e.Next() {
-		g := e.Value.(*Game)
-		games++
-		if g.State() == CONNECTABLE {
-			openGames++
-		}
-	}
+	s.call(func() {
+		s.ForeachActiveClient(func(c *Client) {
+			if c.Permissions() != IRC {
+				users++
+				if c.Game() != nil {
+					clientsInGames++
+				}
+			}
+		})
+		s.ForeachGame(func(g *Game) {
+			games++
+			if g.State() == CONNECTABLE {
+				openGames++
+			}
+		})
+	})
 
 	return &relayinterface.ServerStatus{
 		NClients:        users,
@@ -479,22 +864,7 @@ func (server *Server) GetRelayAddresses() AddressPair {
 }
 
 func CreateServerUsing(acceptedConnections chan ReadWriteCloserWithIp, db UserDb, irc *IRCBridgerChannels, hostname string) *Server {
-	server := &Server{
-		acceptedConnections:    acceptedConnections,
-		shutdownServer:         make(chan bool),
-		serverHasShutdown:      make(chan bool),
-		clients:                list.New(),
-		games:                  list.New(),
-		user_db:                db,
-		gameInitialPingTimeout: time.Second * 10,
-		gamePingTimeout:        time.Second * 30,
-		pingCycleTime:          time.Second * 15,
-		clientSendingTimeout:   time.Minute * 2,
-		clientForgetTimeout:    time.Minute * 5,
-		irc:                    irc,
-		relay_address:          AddressPair{"", ""},
-		banned:                 list.New(),
-	}
+	server := newServer(acceptedConnections, db, irc)
 	// Get the IP addresses of our domain
 	ips, err := net.LookupIP(hostname)
 	if err != nil {
@@ -517,36 +887,52 @@ func CreateServerUsing(acceptedConnections chan ReadWriteCloserWithIp, db UserDb
 	log.Printf("Using %v and %v as IP addresses of the relay", server.relay_address.ipv4, server.relay_address.ipv6)
 
 	server.relay = relayinterface.NewClientRPC(server)
+	server.start()
+	return server
+}
 
+// newServer creates a server without connecting it to the network or the relay.
+// start() has to be called once the remaining fields are set up.
+func newServer(acceptedConnections chan ReadWriteCloserWithIp, db UserDb, irc *IRCBridgerChannels) *Server {
+	server := &Server{
+		acceptedConnections:    acceptedConnections,
+		shutdownServer:         make(chan bool),
+		serverHasShutdown:      make(chan bool),
+		events:                 make(chan func()),
+		stopped:                make(chan struct{}),
+		clients:                NewClientRegistry(),
+		games:                  NewGameRegistry(),
+		user_db:                db,
+		gameInitialPingTimeout: time.Second * 10,
+		gamePingTimeout:        time.Second * 30,
+		pingCycleTime:          time.Second * 15,
+		clientSendingTimeout:   time.Minute * 2,
+		clientSendQueueSize:    500,
+		clientWriteTimeout:     time.Second * 30,
+		clientForgetTimeout:    time.Minute * 5,
+		resultGracePeriod:      time.Minute * 5,
+		irc:                    irc,
+		relay_address:          AddressPair{"", ""},
+		banned:                 list.New(),
+		validation:             DefaultValidationPolicy(),
+		feed:                   NewLobbyFeed(),
+		history:                NewInMemoryGameHistory(),
+		finishedGames:          make(map[string]*Game),
+		matchQueue:             NewMatchQueue(),
+		sessions:               NewInMemorySessionHistory(),
+		tournaments:            make(map[string]*Tournament),
+		tournamentStore:        NewInMemoryTournamentStore(),
+		ipHashKey:              randomIPHashKey(),
+	}
 	server.gamePingerFactory = RealGamePingerFactory{server}
-	go func() {
-		for {
-			select {
-			case m := <-irc.messagesFromIRC:
-				server.BroadcastToConnectedClients("CHAT", "<IRC> "+m.nick, m.message, "public")
-			case nick := <-irc.clientsJoiningIRC:
-				old_client := server.HasIRCClient(nick)
-				if old_client != nil {
-					// Should not happen
-					log.Printf("Warning: Told to add IRC client %v which is already listed", nick)
-					break
-				}
-				client := NewIRCClient(nick)
-				server.AddClient(client)
-				server.BroadcastToConnectedClients("CLIENTS_UPDATE")
-			case nick := <-irc.clientsLeavingIRC:
-				client := server.HasIRCClient(nick)
-				if client != nil {
-					server.RemoveClient(client)
-					server.BroadcastToConnectedClients("CLIENTS_UPDATE")
-				}
-			}
-		}
-	}()
-	go server.mainLoop()
 	return server
 }
 
+// start runs the main loop which handles new connections and IRC traffic.
+func (server *Server) start() {
+	go server.mainLoop()
+}
+
 func (s *Server) mainLoop() {
 	defer s.relay.CloseConnection()
 	// Remove (non-IRC) clients and games that are older than this time.
@@ -566,13 +952,39 @@ func (s *Server) mainLoop() {
 			}
 			// The client will register itself if it feels the need.
 			go DealWithNewConnection(conn, s)
-		case <-s.shutdownServer:
-			for s.clients.Len() > 0 {
-				e := s.clients.Front()
-				e.Value.(*Client).Disconnect(*s)
-				s.clients.Remove(e)
+		case f := <-s.events:
+			f()
+		case m := <-s.irc.messagesFromIRC:
+			message := s.ValidationPolicy().FilterChatMessage(m.message)
+			s.BroadcastToConnectedClients("CHAT", "<IRC> "+m.nick, message, "public")
+			s.feed.AddChat("<IRC> "+m.nick, message)
+		case nick := <-s.irc.clientsJoiningIRC:
+			old_client := s.HasIRCClient(nick)
+			if old_client != nil {
+				// Should not happen
+				log.Printf("Warning: Told to add IRC client %v which is already listed", nick)
+				break
 			}
+			client := NewIRCClient(nick)
+			s.AddClient(client)
+			s.BroadcastToConnectedClients("CLIENTS_UPDATE")
+		case nick := <-s.irc.clientsLeavingIRC:
+			client := s.HasIRCClient(nick)
+			if client != nil {
+				s.RemoveClient(client, "IRC_LEFT")
+				s.BroadcastToConnectedClients("CLIENTS_UPDATE")
+			}
+		case <-s.shutdownServer:
+			s.ForeachGame(func(game *Game) {
+				s.recordGame(game, "SHUTDOWN")
+			})
+			s.clients.Foreach(func(client *Client) {
+				s.endSession(client, "SHUTDOWN")
+				client.Disconnect(s)
+				s.clients.Remove(client)
+			})
 			close(s.acceptedConnections)
+			close(s.stopped)
 			s.serverHasShutdown <- true
 			return
 		case <-cleanupTicker.C:
@@ -588,18 +1000,17 @@ func (s *Server) mainLoop() {
 						log.Printf("Warning: Removing relay game %v, last change at %v",
 							game.Name(), game.TimeLastActivity().Format(timeFormatString))
 					}
-					s.RemoveGame(game)
+					s.RemoveGame(game, "TIMEOUT")
 				}
 			})
-			for e := s.clients.Front(); e != nil; e = e.Next() {
-				client := e.Value.(*Client)
+			s.clients.Foreach(func(client *Client) {
 				if client.Permissions() != IRC && client.TimeLastMessage().Before(removeBefore) {
 					log.Printf("Warning: Removing client %v, last activity at %v",
 						client.Name(), client.TimeLastMessage().Format(timeFormatString))
 					client.SendPacket("DISCONNECT", "CLIENT_TIMEOUT")
-					client.Disconnect(*s)
+					client.Disconnect(s)
 				}
-			}
+			})
 		}
 	}
 }
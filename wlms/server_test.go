@@ -1,9 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/widelands/widelands-metaserver/tlsconfig"
 	"github.com/widelands/widelands-metaserver/wlms/packet"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
 	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -24,7 +41,13 @@ func SendPacket(f FakeConn, data ...interface{}) {
 	f.ServerWriter().Write(packet.New(data...))
 }
 
+// ExpectClosed checks that the server closes the connection. The connection
+// might be closed right after the last packet has been received, so this waits
+// a little while.
 func ExpectClosed(c *C, f FakeConn) {
+	for i := 0; i < 20 && !f.GotClosed(); i++ {
+		time.Sleep(time.Millisecond)
+	}
 	c.Assert(f.GotClosed(), Equals, true)
 }
 
@@ -41,31 +64,255 @@ func SetupServer(c *C, nClients int) (*Server, []FakeConn) {
 		acceptingConnections <- cons[i]
 	}
 
-	//irc := NewIRCBridge("chat.freenode.net:7000", "wltest", "wltest", "#widelands-test", true)
-	toIrc := make(chan Message, 100)
-	fromIrc := make(chan Message, 100)
-	//irc.Connect(toIrc, fromIrc)
-	return CreateServerUsing(acceptingConnections, db, fromIrc, toIrc), cons
+	server := newServer(acceptingConnections, db, NewIRCBridgerChannels())
+	server.relay = &FakeRelay{}
+	server.relay_address = AddressPair{"192.168.0.1", "fe80::1"}
+	server.start()
+	return server, cons
+}
+
+// FakeRelay is used on the main loop of the server. Only RecordGame and
+// RemoveGame are called outside it, and the games that are recorded are read
+// once the server has replied.
+type FakeRelay struct {
+	recorded   []string
+	restricted []string
+	joinTokens []string
+	// Refuses to create games if set
+	broken bool
+	// Refuses to add join tokens if set
+	noJoinTokens bool
+}
+
+func (r *FakeRelay) CreateGame(name string, password string, restricted bool) bool {
+	if r.broken {
+		return false
+	}
+	if restricted {
+		r.restricted = append(r.restricted, name)
+	}
+	return true
+}
+
+func (r *FakeRelay) AddJoinToken(name string, token string) bool {
+	if r.noJoinTokens {
+		return false
+	}
+	r.joinTokens = append(r.joinTokens, token)
+	return true
+}
+
+// ConnectOnRelay lets the relay report that all clients that got a join
+// token for the game joined it.
+func ConnectOnRelay(server *Server, gameName string) {
+	var tokens []string
+	server.call(func() {
+		tokens = server.relay.(*FakeRelay).joinTokens
+	})
+	for _, token := range tokens {
+		server.ClientConnected(gameName, token)
+	}
+}
+
+func (r *FakeRelay) RemoveGame(name string) bool {
+	return true
+}
+
+func (r *FakeRelay) RecordGame(name string) bool {
+	r.recorded = append(r.recorded, name)
+	return true
+}
+
+func (r *FakeRelay) CloseConnection() {
+}
+
+// RPCRelay answers the RPC calls of the metaserver like the relay does and
+// notifies the metaserver over RPC as well.
+type RPCRelay struct {
+	mutex sync.Mutex
+	games map[string]bool
+	rpc   relayinterface.Server
+}
+
+func NewRPCRelay() *RPCRelay {
+	r := &RPCRelay{games: make(map[string]bool)}
+	r.rpc = relayinterface.NewServerRPC(r)
+	return r
+}
+
+func (r *RPCRelay) CreateGame(name string, password string, restricted bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.games[name] {
+		return false
+	}
+	r.games[name] = true
+	return true
+}
+
+func (r *RPCRelay) AddJoinToken(name string, token string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.games[name]
+}
+
+// RemoveGame tells the metaserver that the game has been closed without
+// waiting for it, like the relay does.
+func (r *RPCRelay) RemoveGame(name string) bool {
+	r.mutex.Lock()
+	found := r.games[name]
+	delete(r.games, name)
+	r.mutex.Unlock()
+	if found {
+		go r.rpc.GameClosed(name)
+	}
+	return found
+}
+
+func (r *RPCRelay) RecordGame(name string) bool {
+	return true
+}
+
+func (r *RPCRelay) HasGame(name string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.games[name]
+}
+
+func (r *RPCRelay) Close() {
+	r.rpc.CloseConnection()
+}
+
+// SetupServerWithRPCRelay starts a server that accepts connections on the
+// ports of the lobby and talks to the relay over RPC, as RunServer does. The
+// returned function shuts both down and frees their ports.
+func SetupServerWithRPCRelay(c *C, tls TLSSettings) (*Server, *RPCRelay, func()) {
+	relay := NewRPCRelay()
+	C := make(chan ReadWriteCloserWithIp)
+	listeners, err := listenForClients(tls, C)
+	c.Assert(err, IsNil)
+	db := NewInMemoryDb()
+	db.AddUser("SirVer", "123456", SUPERUSER)
+	server := newServer(C, db, NewIRCBridgerChannels())
+	server.relay_address = AddressPair{"127.0.0.1", "::1"}
+	server.relay = relayinterface.NewClientRPC(server)
+	c.Assert(server.relay, NotNil)
+	server.start()
+	return server, relay, func() {
+		ExpectServerToShutdownCleanly(c, server)
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		relay.Close()
+	}
+}
+
+// DialLobby connects to the lobby, using TLS on the given port if it is not
+// zero.
+func DialLobby(c *C, tlsPort int) net.Conn {
+	var conn net.Conn
+	var err error
+	if tlsPort != 0 {
+		conn, err = tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tlsPort), &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = net.Dial("tcp", "127.0.0.1:7395")
+	}
+	c.Assert(err, IsNil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// ReadPacketSkippingUpdates reads from a real connection until a packet
+// arrives that is not an update and checks it.
+func ReadPacketSkippingUpdates(c *C, conn net.Conn, expected ...interface{}) {
+	for {
+		pkg, err := packet.Read(conn)
+		c.Assert(err, IsNil)
+		if len(pkg.RawData) == 1 && (pkg.RawData[0] == "GAMES_UPDATE" || pkg.RawData[0] == "CLIENTS_UPDATE") {
+			continue
+		}
+		checkPacket(c, pkg, expected...)
+		return
+	}
+}
+
+// ReadPacketSkippingOthers reads from a real connection until a packet with
+// the expected command arrives and checks it.
+func ReadPacketSkippingOthers(c *C, conn net.Conn, expected ...interface{}) {
+	for {
+		pkg, err := packet.Read(conn)
+		c.Assert(err, IsNil)
+		if len(pkg.RawData) > 0 && pkg.RawData[0] == expected[0] {
+			checkPacket(c, pkg, expected...)
+			return
+		}
+	}
 }
 
 type Matching string
 
 func ExpectPacket(c *C, f FakeConn, expected ...interface{}) {
-	timer := time.NewTimer(20 * time.Millisecond)
+	timer := time.NewTimer(100 * time.Millisecond)
 	select {
 	case packet := <-f.Packets:
-		c.Check(len(packet.RawData), Equals, len(expected))
-		for i := 0; i < len(packet.RawData); i += 1 {
-			switch expect := expected[i].(type) {
-			case Matching:
-				c.Check(packet.RawData[i], Matches, string(expect))
+		checkPacket(c, packet, expected...)
+	case <-timer.C:
+		c.Errorf("No packet arrived, though we expected one.")
+	}
+}
+
+// ExpectPacketSkippingPings is like ExpectPacket, but answers and skips any
+// PING that arrives before the expected packet.
+func ExpectPacketSkippingPings(c *C, f FakeConn, expected ...interface{}) {
+	timer := time.NewTimer(100 * time.Millisecond)
+	for {
+		select {
+		case packet := <-f.Packets:
+			if len(packet.RawData) == 1 && packet.RawData[0] == "PING" {
+				SendPacket(f, "PONG")
 				continue
-			default:
-				c.Check(packet.RawData[i], Equals, expected[i])
 			}
+			checkPacket(c, packet, expected...)
+			return
+		case <-timer.C:
+			c.Errorf("No packet arrived, though we expected one.")
+			return
+		}
+	}
+}
+
+// ExpectPacketSkippingUpdates is like ExpectPacket, but skips any
+// GAMES_UPDATE and CLIENTS_UPDATE that arrive before the expected packet.
+func ExpectPacketSkippingUpdates(c *C, f FakeConn, expected ...interface{}) {
+	timer := time.NewTimer(100 * time.Millisecond)
+	for {
+		select {
+		case packet := <-f.Packets:
+			if len(packet.RawData) == 1 && (packet.RawData[0] == "GAMES_UPDATE" || packet.RawData[0] == "CLIENTS_UPDATE") {
+				continue
+			}
+			checkPacket(c, packet, expected...)
+			return
+		case <-timer.C:
+			c.Errorf("No packet arrived, though we expected one.")
+			return
+		}
+	}
+}
+
+func checkPacket(c *C, pkg *packet.Packet, expected ...interface{}) {
+	if !c.Check(len(pkg.RawData), Equals, len(expected)) {
+		c.Logf("Got packet %v", pkg.RawData)
+		return
+	}
+	for i := 0; i < len(pkg.RawData); i += 1 {
+		switch expect := expected[i].(type) {
+		case Matching:
+			c.Check(pkg.RawData[i], Matches, string(expect))
+			continue
+		default:
+			c.Check(pkg.RawData[i], Equals, expected[i])
 		}
-	case <-timer.C:
-		c.Errorf("No packet arrived, though we expected one.")
 	}
 }
 
@@ -75,25 +322,62 @@ func ExpectPacketForAll(c *C, clients []FakeConn, expected ...interface{}) {
 	}
 }
 
+// ExpectWelcome consumes the packets a build19 client receives after a
+// successful login. The CLIENTS_UPDATE announcing the new client is only
+// sent after ANNOUNCE_DELAY and not expected here.
+func ExpectWelcome(c *C, f FakeConn, name, permissions string) {
+	ExpectPacket(c, f, "LOGIN", name, permissions)
+	ExpectPacket(c, f, "CHAT", "", "Welcome on the Widelands Metaserver!", "system")
+	ExpectPacket(c, f, "TIME", Matching("\\d+"))
+	ExpectPacket(c, f, "CHAT", "", "Our forums can be found at:", "system")
+	ExpectPacket(c, f, "CHAT", "", "https://www.widelands.org/forum/", "system")
+	ExpectPacket(c, f, "CHAT", "", "For reporting bugs, visit:", "system")
+	ExpectPacket(c, f, "CHAT", "", "https://www.widelands.org/wiki/ReportingBugs/", "system")
+	// The client is added to the server after the welcome has been sent.
+	time.Sleep(5 * time.Millisecond)
+}
+
 func ExpectLoginAsUnregisteredWorks(c *C, f FakeConn, name string) {
 	SendPacket(f, "LOGIN", 0, name, "build-16", false)
+	ExpectWelcome(c, f, name, "UNREGISTERED")
+}
+
+// ExpectLoginWithNonceWorks logs in an unregistered build20 client. Other than
+// build19 clients, these identify themselves with a nonce.
+func ExpectLoginWithNonceWorks(c *C, f FakeConn, name, nonce string) {
+	SendPacket(f, "LOGIN", BUILD20, name, "build-20", false, nonce)
 	ExpectPacket(c, f, "LOGIN", name, "UNREGISTERED")
 	ExpectPacket(c, f, "TIME", Matching("\\d+"))
-	ExpectPacket(c, f, "CLIENTS_UPDATE")
+	time.Sleep(5 * time.Millisecond)
 }
 
 func ExpectLoginAsOttoWorks(c *C, f FakeConn) {
 	SendPacket(f, "LOGIN", 0, "otto", "build-17", true, "ottoiscool")
-	ExpectPacket(c, f, "LOGIN", "otto", "REGISTERED")
-	ExpectPacket(c, f, "TIME", Matching("\\d+"))
-	ExpectPacket(c, f, "CLIENTS_UPDATE")
+	ExpectWelcome(c, f, "otto", "REGISTERED")
 }
 
 func ExpectLoginAsSirVerWorks(c *C, f FakeConn) {
 	SendPacket(f, "LOGIN", 0, "SirVer", "build-18", true, "123456")
-	ExpectPacket(c, f, "LOGIN", "SirVer", "SUPERUSER")
-	ExpectPacket(c, f, "TIME", Matching("\\d+"))
-	ExpectPacket(c, f, "CLIENTS_UPDATE")
+	ExpectWelcome(c, f, "SirVer", "SUPERUSER")
+}
+
+// MarkAnnounced lists the given clients in CLIENTS replies without waiting
+// for ANNOUNCE_DELAY.
+func MarkAnnounced(server *Server, names ...string) {
+	server.call(func() {
+		for _, name := range names {
+			server.HasClient(name).wasAnnounced = true
+		}
+	})
+}
+
+// NrActiveClients returns the number of connected clients of a running server.
+func NrActiveClients(server *Server) int {
+	n := 0
+	server.call(func() {
+		n = server.NrActiveClients()
+	})
+	return n
 }
 
 func ExpectServerToShutdownCleanly(c *C, server *Server) {
@@ -158,13 +442,11 @@ func (s *EndToEndSuite) TestLoginAnonymouslyWorks(c *C) {
 
 	SendPacket(clients[0], "LOGIN", 0, "testuser", "build-16", false)
 
-	ExpectPacket(c, clients[0], "LOGIN", "testuser", "UNREGISTERED")
-	ExpectPacket(c, clients[0], "TIME", Matching("\\d+"))
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
+	ExpectWelcome(c, clients[0], "testuser", "UNREGISTERED")
 	clients[0].Close()
 
 	time.Sleep(5 * time.Millisecond)
-	c.Assert(server.NrActiveClients(), Equals, 0)
+	c.Assert(NrActiveClients(server), Equals, 0)
 
 	ExpectServerToShutdownCleanly(c, server)
 	ExpectClosed(c, clients[0])
@@ -173,11 +455,11 @@ func (s *EndToEndSuite) TestLoginAnonymouslyWorks(c *C) {
 func (s *EndToEndSuite) TestLoginUnknownProtocol(c *C) {
 	server, clients := SetupServer(c, 1)
 
-	SendPacket(clients[0], "LOGIN", 10, "testuser", "build-16", false)
+	SendPacket(clients[0], "LOGIN", 12, "testuser", "build-16", false)
 	ExpectPacket(c, clients[0], "ERROR", "LOGIN", "UNSUPPORTED_PROTOCOL")
 
 	time.Sleep(5 * time.Millisecond)
-	c.Assert(server.NrActiveClients(), Equals, 0)
+	c.Assert(NrActiveClients(server), Equals, 0)
 
 	ExpectServerToShutdownCleanly(c, server)
 }
@@ -186,9 +468,7 @@ func (s *EndToEndSuite) TestLoginWithKnownUserName(c *C) {
 	server, clients := SetupServer(c, 1)
 
 	SendPacket(clients[0], "LOGIN", 0, "SirVer", "build-18", false)
-	ExpectPacket(c, clients[0], "LOGIN", "SirVer1", "UNREGISTERED")
-	ExpectPacket(c, clients[0], "TIME", Matching("\\d+"))
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
+	ExpectWelcome(c, clients[0], "SirVer1", "UNREGISTERED")
 
 	ExpectServerToShutdownCleanly(c, server)
 }
@@ -198,12 +478,21 @@ func (s *EndToEndSuite) TestLoginOneWasAlreadyThere(c *C) {
 
 	ExpectLoginAsUnregisteredWorks(c, clients[0], "testuser")
 
-	SendPacket(clients[1], "LOGIN", 0, "testuser", "build-16", false)
+	// Another player (different nonce) wants the same name.
+	SendPacket(clients[1], "LOGIN", BUILD20, "testuser", "build-20", false, "othernonce")
 	ExpectPacket(c, clients[1], "LOGIN", "testuser1", "UNREGISTERED")
-	ExpectPacket(c, clients[1], "TIME", Matching("\\d+"))
-	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
 
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestLoginLongNameWasAlreadyThere(c *C) {
+	server, clients := SetupServer(c, 2)
+
+	ExpectLoginWithNonceWorks(c, clients[0], "abcdefghijklmnopqrstuvwxyz0123", "nonce")
+
+	// The new name is not longer than the longest valid name
+	SendPacket(clients[1], "LOGIN", BUILD20, "abcdefghijklmnopqrstuvwxyz0123", "build-20", false, "othernonce")
+	ExpectPacket(c, clients[1], "LOGIN", "abcdefghijklmnopqrstuvwxyz0121", "UNREGISTERED")
 
 	ExpectServerToShutdownCleanly(c, server)
 }
@@ -212,16 +501,10 @@ func (s *EndToEndSuite) TestRegisteredUserCorrectPassword(c *C) {
 	server, clients := SetupServer(c, 2)
 
 	SendPacket(clients[0], "LOGIN", 0, "SirVer", "build-18", true, "123456")
-	ExpectPacket(c, clients[0], "LOGIN", "SirVer", "SUPERUSER")
-	ExpectPacket(c, clients[0], "TIME", Matching("\\d+"))
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
+	ExpectWelcome(c, clients[0], "SirVer", "SUPERUSER")
 
 	SendPacket(clients[1], "LOGIN", 0, "otto", "build-17", true, "ottoiscool")
-	ExpectPacket(c, clients[1], "LOGIN", "otto", "REGISTERED")
-	ExpectPacket(c, clients[1], "TIME", Matching("\\d+"))
-	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
-
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
+	ExpectWelcome(c, clients[1], "otto", "REGISTERED")
 
 	ExpectServerToShutdownCleanly(c, server)
 }
@@ -231,8 +514,11 @@ func (s *EndToEndSuite) TestRegisteredUserAlreadyLoggedIn(c *C) {
 
 	ExpectLoginAsSirVerWorks(c, clients[0])
 
+	// The old connection is still alive, so the new one gets another name.
 	SendPacket(clients[1], "LOGIN", 0, "SirVer", "build-18", true, "123456")
-	ExpectPacket(c, clients[1], "ERROR", "LOGIN", "ALREADY_LOGGED_IN")
+	ExpectPacket(c, clients[0], "PING")
+	SendPacket(clients[0], "PONG")
+	ExpectWelcome(c, clients[1], "SirVer1", "UNREGISTERED")
 
 	ExpectServerToShutdownCleanly(c, server)
 }
@@ -252,7 +538,7 @@ func (e *EndToEndSuite) TestReloginPingAndReply(c *C) {
 	ExpectPacket(c, clients[1], "ERROR", "RELOGIN", "CONNECTION_STILL_ALIVE")
 	ExpectClosed(c, clients[1])
 
-	c.Assert(server.NrActiveClients(), Equals, 1)
+	c.Assert(NrActiveClients(server), Equals, 1)
 	ExpectServerToShutdownCleanly(c, server)
 }
 
@@ -264,6 +550,9 @@ func (e *EndToEndSuite) TestReloginForNonAnonymous(c *C) {
 
 	SendPacket(clients[1], "RELOGIN", 0, "otto", "build-17", true, "ottoiscool")
 	ExpectPacket(c, clients[0], "PING")
+	// The timeout of the old connection is already running, keep the new one
+	// from timing out.
+	server.SetPingCycleTime(time.Hour)
 
 	time.Sleep(6 * time.Millisecond)
 
@@ -273,22 +562,23 @@ func (e *EndToEndSuite) TestReloginForNonAnonymous(c *C) {
 	ExpectPacket(c, clients[1], "RELOGIN")
 	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
 
-	c.Assert(server.NrActiveClients(), Equals, 1)
+	c.Assert(NrActiveClients(server), Equals, 1)
 	ExpectServerToShutdownCleanly(c, server)
 }
 
 func (e *EndToEndSuite) TestReloginPingAndNoReply(c *C) {
 	server, clients := SetupServer(c, 3)
-	server.SetPingCycleTime(5 * time.Millisecond)
 
 	ExpectLoginAsUnregisteredWorks(c, clients[0], "bert")
-	ExpectLoginAsUnregisteredWorks(c, clients[2], "ernie")
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
+	ExpectLoginWithNonceWorks(c, clients[2], "ernie", "ernienonce")
+	server.SetPingCycleTime(5 * time.Millisecond)
 
 	SendPacket(clients[1], "RELOGIN", 0, "bert", "build-16", false)
 
 	time.Sleep(2 * time.Millisecond)
 	ExpectPacket(c, clients[0], "PING")
+	// The timeout of bert is already running, keep ernie from timing out.
+	server.SetPingCycleTime(time.Hour)
 
 	SendPacket(clients[2], "PONG")
 	time.Sleep(6 * time.Millisecond) // No reply for client 0
@@ -300,9 +590,9 @@ func (e *EndToEndSuite) TestReloginPingAndNoReply(c *C) {
 	ExpectPacket(c, clients[1], "RELOGIN")
 	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
 
-	ExpectPacket(c, clients[2], "CLIENTS_UPDATE")
+	ExpectPacketSkippingPings(c, clients[2], "CLIENTS_UPDATE")
 
-	c.Assert(server.NrActiveClients(), Equals, 2)
+	c.Assert(NrActiveClients(server), Equals, 2)
 	ExpectServerToShutdownCleanly(c, server)
 }
 
@@ -313,7 +603,7 @@ func (e *EndToEndSuite) TestReloginNotLoggedIn(c *C) {
 	ExpectPacket(c, clients[0], "ERROR", "RELOGIN", "NOT_LOGGED_IN")
 	ExpectClosed(c, clients[0])
 
-	c.Assert(server.NrActiveClients(), Equals, 0)
+	c.Assert(NrActiveClients(server), Equals, 0)
 	ExpectServerToShutdownCleanly(c, server)
 }
 
@@ -348,7 +638,7 @@ func (e *EndToEndSuite) TestReloginWrongInformations(c *C) {
 	ExpectPacket(c, clients[6], "ERROR", "RELOGIN", "WRONG_INFORMATION")
 	ExpectClosed(c, clients[6])
 
-	c.Assert(server.NrActiveClients(), Equals, 2)
+	c.Assert(NrActiveClients(server), Equals, 2)
 	ExpectServerToShutdownCleanly(c, server)
 }
 
@@ -385,9 +675,6 @@ func (e *EndToEndSuite) TestRelogWhileInGame(c *C) {
 
 	// Connection was terminated for old user
 	ExpectPacket(c, clients[0], "DISCONNECT", "CLIENT_TIMEOUT")
-
-	// Make sure we see the one player getting disconnected.
-	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
 	ExpectPacket(c, clients[1], "PING")
 	SendPacket(clients[1], "PONG")
 
@@ -397,6 +684,7 @@ func (e *EndToEndSuite) TestRelogWhileInGame(c *C) {
 	ExpectPacket(c, clients[2], "CLIENTS_UPDATE")
 	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
 
+	MarkAnnounced(server, "bert")
 	SendPacket(clients[1], "CLIENTS")
 	ExpectPacket(c, clients[1], "CLIENTS", "2",
 		"otto", "build-17", "my cool game", "REGISTERED", "",
@@ -411,25 +699,23 @@ func (e *EndToEndSuite) TestRelogWhileInGameRealWorldExample(c *C) {
 	server.SetPingCycleTime(20 * time.Millisecond)
 	server.SetGamePingTimeout(10 * time.Millisecond)
 
+	SendPacket(clients[0], "GAME_OPEN", "my cool game", 8)
+	ExpectPacketForAll(c, clients[:2], "GAMES_UPDATE")
+	ExpectPacketForAll(c, clients[:2], "CLIENTS_UPDATE")
+
 	// The game never replies.
 	for i := 0; i < 50; i++ {
 		pinger.C <- false
 	}
-
-	SendPacket(clients[0], "GAME_OPEN", "my cool game", 8)
 	ExpectPacketForAll(c, clients[:2], "GAMES_UPDATE")
-	ExpectPacketForAll(c, clients[:2], "CLIENTS_UPDATE")
 	ExpectPacket(c, clients[0], "ERROR", "GAME_OPEN", "GAME_TIMEOUT")
 
 	SendPacket(clients[1], "GAME_CONNECT", "my cool game")
 	ExpectPacket(c, clients[1], "GAME_CONNECT", "192.168.0.0")
-	ExpectPacketForAll(c, clients[:2], "GAMES_UPDATE")
 	ExpectPacketForAll(c, clients[:2], "CLIENTS_UPDATE")
 
 	SendPacket(clients[0], "GAME_START")
 	ExpectPacket(c, clients[0], "GAME_START")
-	// One for not being connectable, one for game starting.
-	ExpectPacketForAll(c, clients[:2], "GAMES_UPDATE")
 	ExpectPacketForAll(c, clients[:2], "GAMES_UPDATE")
 
 	// Syncronize ping timers.
@@ -442,10 +728,8 @@ func (e *EndToEndSuite) TestRelogWhileInGameRealWorldExample(c *C) {
 	SendPacket(clients[1], "PONG")
 	time.Sleep(21 * time.Millisecond)
 
-	// Make sure we see the one player getting disconnected.
 	ExpectPacket(c, clients[0], "DISCONNECT", "CLIENT_TIMEOUT")
 	ExpectPacket(c, clients[1], "PING")
-	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
 	SendPacket(clients[1], "PONG")
 	ExpectClosed(c, clients[0])
 
@@ -464,11 +748,8 @@ func (e *EndToEndSuite) TestRelogWhileInGameRealWorldExample(c *C) {
 	SendPacket(clients[1], "PONG")
 	time.Sleep(21 * time.Millisecond)
 
-	// Make sure we see the one player getting disconnected.
 	ExpectPacket(c, clients[2], "DISCONNECT", "CLIENT_TIMEOUT")
-
 	ExpectPacket(c, clients[1], "PING")
-	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
 	SendPacket(clients[1], "PONG")
 	ExpectClosed(c, clients[2])
 
@@ -477,24 +758,17 @@ func (e *EndToEndSuite) TestRelogWhileInGameRealWorldExample(c *C) {
 	ExpectPacket(c, clients[1], "CLIENTS", "1",
 		"otto", "build-17", "my cool game", "REGISTERED", "")
 
-	// Let's ping a few times.
-	time.Sleep(21 * time.Millisecond)
-	ExpectPacket(c, clients[1], "PING")
-	SendPacket(clients[1], "PONG")
-
-	// By now the clients should be forgotten and the game deleted.
-	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
-
-	time.Sleep(21 * time.Millisecond)
-	ExpectPacket(c, clients[1], "PING")
-	SendPacket(clients[1], "PONG")
+	// By now the host should be forgotten and the game deleted.
+	time.Sleep(30 * time.Millisecond)
+	ExpectPacketSkippingPings(c, clients[1], "GAMES_UPDATE")
+	ExpectPacketSkippingPings(c, clients[1], "CLIENTS_UPDATE")
 
 	SendPacket(clients[1], "CLIENTS")
-	ExpectPacket(c, clients[1], "CLIENTS", "1",
+	ExpectPacketSkippingPings(c, clients[1], "CLIENTS", "1",
 		"otto", "build-17", "my cool game", "REGISTERED", "")
 
 	SendPacket(clients[1], "GAMES")
-	ExpectPacket(c, clients[1], "GAMES", "0")
+	ExpectPacketSkippingPings(c, clients[1], "GAMES", "0")
 
 	ExpectServerToShutdownCleanly(c, server)
 }
@@ -507,13 +781,12 @@ func (e *EndToEndSuite) TestDisconnect(c *C) {
 	ExpectLoginAsUnregisteredWorks(c, clients[0], "bert")
 	ExpectLoginAsOttoWorks(c, clients[1])
 
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
 	SendPacket(clients[0], "DISCONNECT", "Gotta fly now!")
 	clients[0].Close()
 
-	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
-
-	c.Assert(server.NrActiveClients(), Equals, 1)
+	// The other clients are told about this after ANNOUNCE_DELAY.
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(NrActiveClients(server), Equals, 1)
 	ExpectServerToShutdownCleanly(c, server)
 }
 
@@ -523,145 +796,893 @@ func (e *EndToEndSuite) TestChat(c *C) {
 	server, clients := SetupServer(c, 2)
 
 	ExpectLoginAsUnregisteredWorks(c, clients[0], "bert")
-	ExpectLoginAsUnregisteredWorks(c, clients[1], "ernie")
-
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
+	ExpectLoginWithNonceWorks(c, clients[1], "ernie", "ernienonce")
 
-	// Send public messages.
+	// Send public messages. Chatting announces the client right away.
 	SendPacket(clients[0], "CHAT", "hello there", "")
+	ExpectPacketForAll(c, clients, "CLIENTS_UPDATE")
 	ExpectPacket(c, clients[0], "CHAT", "bert", "hello there", "public")
 	ExpectPacket(c, clients[1], "CHAT", "bert", "hello there", "public")
+	// Escaping of rich text is up to the receiving client.
 	SendPacket(clients[0], "CHAT", "hello <rt>there</rt>\nhow<rtdoyoudo", "")
-	ExpectPacket(c, clients[0], "CHAT", "bert", "hello &lt;rt>there&lt;/rt>\nhow&lt;rtdoyoudo", "public")
-	ExpectPacket(c, clients[1], "CHAT", "bert", "hello &lt;rt>there&lt;/rt>\nhow&lt;rtdoyoudo", "public")
+	ExpectPacket(c, clients[0], "CHAT", "bert", "hello <rt>there</rt>\nhow<rtdoyoudo", "public")
+	ExpectPacket(c, clients[1], "CHAT", "bert", "hello <rt>there</rt>\nhow<rtdoyoudo", "public")
 
 	// Send private messages.
 	SendPacket(clients[0], "CHAT", "hello there", "ernie")
 	SendPacket(clients[0], "CHAT", "hello <rt>there</rt>\nhow<rtdoyoudo", "ernie")
 	ExpectPacket(c, clients[1], "CHAT", "bert", "hello there", "private")
-	ExpectPacket(c, clients[1], "CHAT", "bert", "hello &lt;rt>there&lt;/rt>\nhow&lt;rtdoyoudo", "private")
+	ExpectPacket(c, clients[1], "CHAT", "bert", "hello <rt>there</rt>\nhow<rtdoyoudo", "private")
 
 	ExpectServerToShutdownCleanly(c, server)
 }
 
 // }}}
-// Test Faulty Communication {{{
-func (e *EndToEndSuite) TestUnknownPacket(c *C) {
-	server, clients := SetupServer(c, 1)
-	SendPacket(clients[0], "BLUMBAQUATSCH")
-	ExpectPacket(c, clients[0], "ERROR", "GARBAGE_RECEIVED", "INVALID_CMD")
+// Test Validation {{{
+func (e *EndToEndSuite) TestLoginWithInvalidName(c *C) {
+	server, clients := SetupServer(c, 5)
+
+	for i, name := range []string{"", "bad\x01name", strings.Repeat("x", 31), "Admin", "two words"} {
+		SendPacket(clients[i], "LOGIN", BUILD20, name, "build-20", false, "nonce")
+		ExpectPacket(c, clients[i], "ERROR", "LOGIN", "INVALID_NAME")
+	}
 
 	time.Sleep(5 * time.Millisecond)
-	ExpectClosed(c, clients[0])
+	for _, client := range clients {
+		ExpectClosed(c, client)
+	}
+	c.Assert(NrActiveClients(server), Equals, 0)
 
 	ExpectServerToShutdownCleanly(c, server)
 }
 
-func (e *EndToEndSuite) TestWrongArgumentsInPacket(c *C) {
-	server, clients := SetupServer(c, 1)
-	SendPacket(clients[0], "LOGIN", "hi")
-	ExpectPacket(c, clients[0], "ERROR", "LOGIN", "Invalid integer: 'hi'")
+func (e *EndToEndSuite) TestLoginWithBlockedName(c *C) {
+	server, clients := SetupServer(c, 2)
+	policy := DefaultValidationPolicy()
+	policy.Blocklist = []string{"darn"}
+	server.SetValidationPolicy(policy)
 
-	time.Sleep(5 * time.Millisecond)
-	ExpectClosed(c, clients[0])
+	SendPacket(clients[0], "LOGIN", BUILD20, "xDaRnx", "build-20", false, "nonce")
+	ExpectPacket(c, clients[0], "ERROR", "LOGIN", "INVALID_NAME")
+
+	// Registered names are managed by the website and not checked.
+	SendPacket(clients[1], "LOGIN", 0, "otto", "build-17", true, "ottoiscool")
+	ExpectWelcome(c, clients[1], "otto", "REGISTERED")
 
 	ExpectServerToShutdownCleanly(c, server)
 }
 
-func (s *EndToEndSuite) TestClientCanTimeout(c *C) {
+func (e *EndToEndSuite) TestOpenGameWithInvalidName(c *C) {
 	server, clients := SetupServer(c, 1)
+	ExpectLoginAsUnregisteredWorks(c, clients[0], "bert")
 
-	server.SetClientSendingTimeout(1 * time.Millisecond)
+	SendPacket(clients[0], "GAME_OPEN", "my\ngame", 8)
+	ExpectPacket(c, clients[0], "ERROR", "GAME_OPEN", "INVALID_NAME")
+	SendPacket(clients[0], "GAME_OPEN", "  ", 8)
+	ExpectPacket(c, clients[0], "ERROR", "GAME_OPEN", "INVALID_NAME")
+	SendPacket(clients[0], "GAME_OPEN", strings.Repeat("x", 61), 8)
+	ExpectPacket(c, clients[0], "ERROR", "GAME_OPEN", "INVALID_NAME")
+	server.call(func() {
+		c.Check(server.NrGames(), Equals, 0)
+	})
 
-	ExpectLoginAsUnregisteredWorks(c, clients[0], "testuser")
+	ExpectServerToShutdownCleanly(c, server)
+}
 
-	time.Sleep(5 * time.Millisecond)
-	ExpectPacket(c, clients[0], "DISCONNECT", "CLIENT_TIMEOUT")
-	time.Sleep(5 * time.Millisecond)
+func (e *EndToEndSuite) TestChatFilter(c *C) {
+	server, clients := SetupServer(c, 2)
+	policy := DefaultValidationPolicy()
+	policy.Blocklist = []string{"darn"}
+	policy.FilterChat = true
+	server.SetValidationPolicy(policy)
 
-	ExpectClosed(c, clients[0])
-	c.Assert(server.NrActiveClients(), Equals, 0)
+	ExpectLoginAsUnregisteredWorks(c, clients[0], "bert")
+	ExpectLoginWithNonceWorks(c, clients[1], "ernie", "ernienonce")
+
+	SendPacket(clients[0], "CHAT", "Darn it, darnit", "")
+	ExpectPacketForAll(c, clients, "CLIENTS_UPDATE")
+	ExpectPacketForAll(c, clients, "CHAT", "bert", "**** it, ****it", "public")
+
+	SendPacket(clients[0], "CHAT", "DARN", "ernie")
+	ExpectPacket(c, clients[1], "CHAT", "bert", "****", "private")
 
 	ExpectServerToShutdownCleanly(c, server)
 }
 
+func (s *EndToEndSuite) TestValidationPolicy(c *C) {
+	policy := DefaultValidationPolicy()
+	c.Assert(policy.IsValidUserName("SirVer"), Equals, true)
+	c.Assert(policy.IsValidUserName("Müller_2.0"), Equals, true)
+	c.Assert(policy.IsValidUserName("<script>"), Equals, false)
+	c.Assert(policy.IsValidUserName("\xff"), Equals, false)
+	c.Assert(policy.IsValidGameName("Bert's game (4 players)"), Equals, true)
+	c.Assert(policy.IsValidGameName("tab\tgame"), Equals, false)
+	c.Assert(policy.FilterChatMessage("darn"), Equals, "darn")
+}
+
 // }}}
-// Test Pinging {{{
-func (s *EndToEndSuite) TestRegularPingCycle(c *C) {
-	server, clients := SetupServer(c, 1)
+// Test Concurrency {{{
+// Run with -race to make sure that the server state is only touched by one
+// goroutine at a time.
+func (e *EndToEndSuite) TestConcurrentTraffic(c *C) {
+	const nClients = 10
+	server, clients := SetupServer(c, nClients)
+
+	stopDraining := make(chan bool)
+	for _, client := range clients {
+		go func(f FakeConn) {
+			for {
+				select {
+				case <-f.Packets:
+				case <-stopDraining:
+					return
+				}
+			}
+		}(client)
+	}
 
-	server.SetPingCycleTime(5 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, f FakeConn) {
+			defer wg.Done()
+			name := fmt.Sprintf("user%d", i)
+			SendPacket(f, "LOGIN", BUILD20, name, "build-20", false, name+"nonce")
+			SendPacket(f, "CHAT", "hello there", "")
+			SendPacket(f, "CHAT", "hello you", fmt.Sprintf("user%d", (i+1)%nClients))
+			SendPacket(f, "GAME_OPEN", name+"'s game")
+			SendPacket(f, "CLIENTS")
+			SendPacket(f, "GAMES")
+		}(i, client)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < nClients; i++ {
+			nick := fmt.Sprintf("ircuser%d", i)
+			server.irc.clientsJoiningIRC <- nick
+			server.irc.messagesFromIRC <- Message{"hello lobby", nick}
+			server.GameConnected(fmt.Sprintf("user%d's game", i))
+			server.Status()
+			server.irc.clientsLeavingIRC <- nick
+		}
+	}()
+	wg.Wait()
+
+	// Wait till the server has dealt with all packets.
+	nGames := 0
+	for i := 0; i < 100 && nGames != nClients; i++ {
+		time.Sleep(time.Millisecond)
+		server.call(func() {
+			nGames = server.NrGames()
+		})
+	}
+	c.Check(nGames, Equals, nClients)
+	c.Check(NrActiveClients(server), Equals, nClients)
+	close(stopDraining)
 
-	ExpectLoginAsUnregisteredWorks(c, clients[0], "testuser")
+	ExpectServerToShutdownCleanly(c, server)
+}
 
-	// Regular Ping cycle
-	time.Sleep(6 * time.Millisecond)
-	ExpectPacket(c, clients[0], "PING")
-	SendPacket(clients[0], "PONG")
-	time.Sleep(6 * time.Millisecond)
-	ExpectPacket(c, clients[0], "PING")
+// }}}
+// Test Admin Commands {{{
+func (e *EndToEndSuite) TestRecordGame(c *C) {
+	server, clients := SetupServer(c, 3)
+	ExpectLoginWithNonceWorks(c, clients[0], "bert", "bertnonce")
+	ExpectLoginAsSirVerWorks(c, clients[1])
+	ExpectLoginAsUnregisteredWorks(c, clients[2], "ernie")
+	MarkAnnounced(server, "bert", "SirVer", "ernie")
 
-	// Regular packages are as good as a Pong.
-	SendPacket(clients[0], "CHAT", "hello there", "")
-	ExpectPacket(c, clients[0], "CHAT", "testuser", "hello there", "public")
-	time.Sleep(6 * time.Millisecond)
-	ExpectPacket(c, clients[0], "PING")
-	SendPacket(clients[0], "CHAT", "hello there", "")
-	ExpectPacket(c, clients[0], "CHAT", "testuser", "hello there", "public")
-	time.Sleep(6 * time.Millisecond)
-	ExpectPacket(c, clients[0], "PING")
+	SendPacket(clients[0], "GAME_OPEN", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1")
 
-	// Timeout
-	time.Sleep(15 * time.Millisecond)
-	ExpectPacket(c, clients[0], "DISCONNECT", "CLIENT_TIMEOUT")
-	time.Sleep(1 * time.Millisecond)
-	ExpectClosed(c, clients[0])
+	SendPacket(clients[2], "CMD", "record", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[2], "ERROR", "CMD", "DEFICIENT_PERMISSION")
 
-	c.Assert(server.NrActiveClients(), Equals, 0)
+	SendPacket(clients[1], "CMD", "record", "no such game")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "There is no game on the relay with this name.", "system")
+	SendPacket(clients[1], "CMD", "record", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "Recording the game.", "system")
+
+	var recorded []string
+	server.call(func() {
+		recorded = server.relay.(*FakeRelay).recorded
+	})
+	c.Assert(recorded, DeepEquals, []string{"my cool game"})
 
 	ExpectServerToShutdownCleanly(c, server)
 }
 
-// }}}
-// Test Motd {{{
-func (s *EndToEndSuite) TestMotd(c *C) {
+func (e *EndToEndSuite) TestGameHistory(c *C) {
 	server, clients := SetupServer(c, 3)
+	ExpectLoginWithNonceWorks(c, clients[0], "bert", "bertnonce")
+	ExpectLoginAsSirVerWorks(c, clients[1])
+	ExpectLoginWithNonceWorks(c, clients[2], "ernie", "ernienonce")
+	MarkAnnounced(server, "bert", "SirVer", "ernie")
+
+	SendPacket(clients[0], "GAME_OPEN", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1")
+	server.GameConnected("my cool game")
+	SendPacket(clients[2], "GAME_CONNECT", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[2], "GAME_CONNECT", "192.168.0.1", "true", "fe80::1")
+	SendPacket(clients[0], "GAME_START")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_START")
+	server.GameClosed("my cool game")
+
+	SendPacket(clients[2], "CMD", "games", "bert")
+	ExpectPacketSkippingUpdates(c, clients[2], "ERROR", "CMD", "DEFICIENT_PERMISSION")
+	SendPacket(clients[1], "CMD", "games", "ernie")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "",
+		Matching(`\d{4}-\d\d-\d\d \d\d:\d\d 'my cool game' \(build-20\) hosted by bert with bert, ernie, played 0s, CLOSED`), "system")
+	SendPacket(clients[1], "CMD", "games", "grover")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "The player has not played any games.", "system")
+
+	SendPacket(clients[1], "CMD", "gamestats", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "1 games in the last 7 days, 1 started, lasting 0s on average.", "system")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", Matching(`\d{4}-\d\d-\d\d: 1 games`), "system")
+	SendPacket(clients[1], "CMD", "gamestats", "soon")
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "CMD", "INVALID_CMD_PARAMETERS")
 
-	ExpectLoginAsSirVerWorks(c, clients[0])
-	ExpectLoginAsOttoWorks(c, clients[1])
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
+	ExpectServerToShutdownCleanly(c, server)
+}
 
-	// Check Superuser setting motd.
-	SendPacket(clients[0], "MOTD", "Schnulz is cool!")
-	ExpectPacket(c, clients[0], "CHAT", "", "Schnulz is cool!", "system")
-	ExpectPacket(c, clients[1], "CHAT", "", "Schnulz is cool!", "system")
+func (e *EndToEndSuite) TestOpenGamesAreRecordedOnShutdown(c *C) {
+	server, clients := SetupServer(c, 1)
+	history := NewInMemoryGameHistory()
+	server.SetGameHistory(history)
+	ExpectLoginWithNonceWorks(c, clients[0], "bert", "bertnonce")
+	MarkAnnounced(server, "bert")
+	SendPacket(clients[0], "GAME_OPEN", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1")
 
-	// Check normal user setting motd.
-	SendPacket(clients[1], "MOTD", "Schnulz is cool!")
-	ExpectPacket(c, clients[1], "ERROR", "MOTD", "DEFICIENT_PERMISSION")
-	// This will not close your connection.
+	ExpectServerToShutdownCleanly(c, server)
+	games, err := history.PlayerGames("bert", 10)
+	c.Assert(err, IsNil)
+	c.Assert(games, HasLen, 1)
+	c.Assert(games[0].EndReason, Equals, "SHUTDOWN")
+	c.Assert(games[0].Started.IsZero(), Equals, true)
+}
 
-	// Login and you'll receive a motd.
-	ExpectLoginAsUnregisteredWorks(c, clients[2], "bert")
-	ExpectPacket(c, clients[2], "CHAT", "", "Schnulz is cool!", "system")
+func (e *EndToEndSuite) TestSeen(c *C) {
+	server, clients := SetupServer(c, 3)
+	ExpectLoginWithNonceWorks(c, clients[0], "bert", "bertnonce")
+	ExpectLoginWithNonceWorks(c, clients[1], "ernie", "ernienonce")
+	ExpectLoginAsOttoWorks(c, clients[2])
 
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
-	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
+	SendPacket(clients[1], "CMD", "seen", "bert")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "bert is online.", "system")
+	SendPacket(clients[1], "CMD", "seen", "grover")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "grover has not been seen.", "system")
+
+	SendPacket(clients[0], "DISCONNECT", "NORMAL")
+	ExpectClosed(c, clients[0])
+	SendPacket(clients[1], "CMD", "seen", "bert")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", Matching(`bert was last seen at \d{4}-\d\d-\d\d \d\d:\d\d UTC\.`), "system")
+
+	var session SessionRecord
+	server.call(func() {
+		session, _, _ = server.SessionHistory().LastSession("bert")
+	})
+	c.Assert(session.Registered, Equals, false)
+	c.Assert(session.BuildId, Equals, "build-20")
+	c.Assert(session.ProtocolVersion, Equals, BUILD20)
+	c.Assert(session.IPHash, Equals, hashIp(server.IPHashKey(), "192.168.0.0"))
+	c.Assert(session.DisconnectReason, Equals, "LEFT")
 
 	ExpectServerToShutdownCleanly(c, server)
+	session, _, _ = server.SessionHistory().LastSession("otto")
+	c.Assert(session.Registered, Equals, true)
+	c.Assert(session.DisconnectReason, Equals, "SHUTDOWN")
 }
 
-// }}}
-// Test Announcement  {{{
-func (s *EndToEndSuite) TestAnnouncement(c *C) {
+func (e *EndToEndSuite) TestUserStats(c *C) {
 	server, clients := SetupServer(c, 3)
+	ExpectLoginWithNonceWorks(c, clients[0], "bert", "bertnonce")
+	ExpectLoginAsSirVerWorks(c, clients[1])
+	ExpectLoginWithNonceWorks(c, clients[2], "ernie", "ernienonce")
+	MarkAnnounced(server, "bert", "SirVer", "ernie")
+
+	SendPacket(clients[0], "CMD", "userstats", "")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "CMD", "DEFICIENT_PERMISSION")
+	SendPacket(clients[1], "CMD", "userstats", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "3 sessions of 3 users from 1 addresses in the last 7 days.", "system")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "",
+		Matching(`At most 3 users were online at the same time, first at \d{4}-\d\d-\d\d \d\d:\d\d\.`), "system")
+	SendPacket(clients[1], "CMD", "userstats", "-1")
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "CMD", "INVALID_CMD_PARAMETERS")
+
+	SendPacket(clients[1], "CMD", "kick", "ernie")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "Kicked the user for 5 minutes.", "system")
+	var session SessionRecord
+	server.call(func() {
+		session, _, _ = server.SessionHistory().LastSession("ernie")
+	})
+	c.Assert(session.DisconnectReason, Equals, "KICKED")
 
-	ExpectLoginAsSirVerWorks(c, clients[0])
-	ExpectLoginAsOttoWorks(c, clients[1])
-	ExpectLoginAsUnregisteredWorks(c, clients[2], "bert")
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test TLS {{{
+func (e *EndToEndSuite) TestTLSIsAdvertised(c *C) {
+	server, clients := SetupServer(c, 3)
+	server.SetTLSPort(7403)
+	server.SetRelayTLSPort(7400)
+
+	SendPacket(clients[0], "LOGIN", BUILD22, "bert", "build-22", false, "bertnonce")
+	ExpectPacket(c, clients[0], "TLS", "7403")
+	ExpectPacket(c, clients[0], "LOGIN", "bert", "UNREGISTERED")
+	ExpectPacket(c, clients[0], "TIME", Matching("\\d+"))
+	ExpectLoginWithNonceWorks(c, clients[1], "ernie", "ernienonce")
+	SendPacket(clients[2], "CHECK_PWD", BUILD22, "otto", "build-22")
+	ExpectPacket(c, clients[2], "TLS", "7403")
+	ExpectPacket(c, clients[2], "PWD_CHALLENGE", Matching(".+"))
+	MarkAnnounced(server, "bert", "ernie")
+
+	// Only newer clients learn about the TLS port of the relay
+	SendPacket(clients[0], "GAME_OPEN", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "7400")
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", "192.168.0.1", "true", "fe80::1")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (e *EndToEndSuite) TestLoginOverTLS(c *C) {
+	server, _ := SetupServer(c, 0)
+	dir := c.MkDir()
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	c.Assert(tlsconfig.WriteSelfSignedCertificate(certFile, keyFile, "127.0.0.1"), IsNil)
+	ln, err := tlsconfig.Listen("127.0.0.1:0", certFile, keyFile)
+	c.Assert(err, IsNil)
+	go acceptConnections(ln, server.acceptedConnections)
+	server.SetTLSPort(ln.Addr().(*net.TCPAddr).Port)
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.Write(packet.New("LOGIN", BUILD22, "bert", "build-22", false, "bertnonce"))
+	// Clients connected with TLS are not told about it
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	pkg, err := packet.Read(conn)
+	c.Assert(err, IsNil)
+	checkPacket(c, pkg, "LOGIN", "bert", "UNREGISTERED")
+	pkg, err = packet.Read(conn)
+	c.Assert(err, IsNil)
+	checkPacket(c, pkg, "TIME", Matching("\\d+"))
+
+	ln.Close()
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (e *EndToEndSuite) TestLobbyWithTLSAndRelay(c *C) {
+	dir := c.MkDir()
+	settings := DefaultTLSSettings()
+	settings.Certificate, settings.Key = dir+"/cert.pem", dir+"/key.pem"
+	c.Assert(tlsconfig.WriteSelfSignedCertificate(settings.Certificate, settings.Key, "127.0.0.1"), IsNil)
+	// The lobby and the relay both work with the default port
+	server, relay, shutdown := SetupServerWithRPCRelay(c, settings)
+	server.SetTLSPort(settings.Port)
+
+	conn := DialLobby(c, settings.Port)
+	defer conn.Close()
+	conn.Write(packet.New("LOGIN", BUILD22, "bert", "build-22", false, "bertnonce"))
+	ReadPacketSkippingUpdates(c, conn, "LOGIN", "bert", "UNREGISTERED")
+	ReadPacketSkippingUpdates(c, conn, "TIME", Matching("\\d+"))
+	conn.Write(packet.New("GAME_OPEN", "my cool game"))
+	ReadPacketSkippingUpdates(c, conn, "GAME_OPEN", Matching(".+"), "127.0.0.1", "true", "::1", "0")
+	c.Assert(relay.HasGame("my cool game"), Equals, true)
+
+	conn.Write(packet.New("DISCONNECT", "NORMAL"))
+	shutdown()
+}
+
+func (e *EndToEndSuite) TestKickRelayGame(c *C) {
+	_, relay, shutdown := SetupServerWithRPCRelay(c, TLSSettings{})
+	host := DialLobby(c, 0)
+	defer host.Close()
+	host.Write(packet.New("LOGIN", BUILD22, "bert", "build-22", false, "bertnonce"))
+	ReadPacketSkippingUpdates(c, host, "LOGIN", "bert", "UNREGISTERED")
+	ReadPacketSkippingUpdates(c, host, "TIME", Matching("\\d+"))
+	host.Write(packet.New("GAME_OPEN", "my cool game"))
+	ReadPacketSkippingUpdates(c, host, "GAME_OPEN", Matching(".+"), "127.0.0.1", "true", "::1", "0")
+
+	admin := DialLobby(c, 0)
+	defer admin.Close()
+	admin.Write(packet.New("LOGIN", 0, "SirVer", "build-18", true, "123456"))
+	ReadPacketSkippingUpdates(c, admin, "LOGIN", "SirVer", "SUPERUSER")
+	admin.Write(packet.New("CMD", "kick", "my cool game"))
+	// The lobby does not wait for the relay telling it that the game is closed
+	admin.Write(packet.New("GAMES"))
+	ReadPacketSkippingOthers(c, admin, "GAMES", "0")
+	// Nor for the relay removing it
+	for i := 0; i < 100 && relay.HasGame("my cool game"); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(relay.HasGame("my cool game"), Equals, false)
+
+	host.Write(packet.New("DISCONNECT", "NORMAL"))
+	admin.Write(packet.New("DISCONNECT", "NORMAL"))
+	shutdown()
+}
+
+func (e *EndToEndSuite) TestTLSPortMustBeFree(c *C) {
+	settings := DefaultTLSSettings()
+	settings.Certificate, settings.Key = "cert.pem", "key.pem"
+	for _, port := range []int{7395, 7398, 7399} {
+		settings.Port = port
+		_, err := listenForClients(settings, make(chan ReadWriteCloserWithIp))
+		c.Assert(err, ErrorMatches, fmt.Sprintf("the TLS port %d is used .*", port))
+	}
+}
+
+// }}}
+// Test WebSocket {{{
+// DialWebSocket connects to the gateway using the given subprotocol.
+func DialWebSocket(c *C, ts *httptest.Server, protocol string) *websocket.Conn {
+	dialer := websocket.Dialer{Subprotocols: []string{protocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	c.Assert(err, IsNil)
+	c.Assert(conn.Subprotocol(), Equals, protocol)
+	return conn
+}
+
+// ExpectWebSocketPacket reads binary messages until one is not an update.
+func ExpectWebSocketPacket(c *C, conn *websocket.Conn, expected ...interface{}) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		messageType, data, err := conn.ReadMessage()
+		c.Assert(err, IsNil)
+		c.Assert(messageType, Equals, websocket.BinaryMessage)
+		pkg, err := packet.Read(bytes.NewReader(data))
+		c.Assert(err, IsNil)
+		if len(pkg.RawData) == 1 && (pkg.RawData[0] == "GAMES_UPDATE" || pkg.RawData[0] == "CLIENTS_UPDATE") {
+			continue
+		}
+		checkPacket(c, pkg, expected...)
+		return
+	}
+}
+
+// ExpectWebSocketClosed reads until the server closes the connection.
+func ExpectWebSocketClosed(c *C, conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			c.Assert(err, Not(ErrorMatches), ".*timeout.*")
+			return
+		}
+	}
+}
+
+func (e *EndToEndSuite) TestWebSocketGateway(c *C) {
+	server, clients := SetupServer(c, 1)
+	ts := httptest.NewServer(NewWebSocketHandler(server.accept, WebSocketSettings{}))
+	defer ts.Close()
+
+	conn := DialWebSocket(c, ts, kWebSocketProtocol)
+	defer conn.Close()
+	conn.WriteMessage(websocket.BinaryMessage, packet.New("LOGIN", BUILD20, "bert", "build-20", false, "bertnonce"))
+	ExpectWebSocketPacket(c, conn, "LOGIN", "bert", "UNREGISTERED")
+	ExpectWebSocketPacket(c, conn, "TIME", Matching("\\d+"))
+	ExpectLoginWithNonceWorks(c, clients[0], "ernie", "ernienonce")
+	MarkAnnounced(server, "bert", "ernie")
+
+	// A packet may be split across messages
+	chat := packet.New("CHAT", "hello from the web", "")
+	conn.WriteMessage(websocket.BinaryMessage, chat[:5])
+	conn.WriteMessage(websocket.BinaryMessage, chat[5:])
+	ExpectChatSkippingOthers(c, clients[0], "bert", "hello from the web")
+	ExpectWebSocketPacket(c, conn, "CHAT", "bert", "hello from the web", "public")
+	SendPacket(clients[0], "CHAT", "hello from the game", "")
+	ExpectWebSocketPacket(c, conn, "CHAT", "ernie", "hello from the game", "public")
+
+	// Text messages are refused with the binary protocol
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	ExpectWebSocketClosed(c, conn)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (e *EndToEndSuite) TestWebSocketJSON(c *C) {
+	server, _ := SetupServer(c, 0)
+	ts := httptest.NewServer(NewWebSocketHandler(server.accept, WebSocketSettings{}))
+	defer ts.Close()
+
+	conn := DialWebSocket(c, ts, kWebSocketJSONProtocol)
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte(`["LOGIN", "5", "bert", "build-20", "false", "bertnonce"]`))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var fields []string
+	c.Assert(conn.ReadJSON(&fields), IsNil)
+	c.Assert(fields, DeepEquals, []string{"LOGIN", "bert", "UNREGISTERED"})
+	c.Assert(conn.ReadJSON(&fields), IsNil)
+	c.Assert(fields[0], Equals, "TIME")
+
+	// Anything but an array of strings ends the connection
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"command": "CHAT"}`))
+	ExpectWebSocketClosed(c, conn)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (e *EndToEndSuite) TestWebSocketAfterShutdown(c *C) {
+	server, _ := SetupServer(c, 0)
+	ts := httptest.NewServer(NewWebSocketHandler(server.accept, WebSocketSettings{}))
+	defer ts.Close()
+	ExpectServerToShutdownCleanly(c, server)
+
+	conn := DialWebSocket(c, ts, kWebSocketProtocol)
+	defer conn.Close()
+	ExpectWebSocketClosed(c, conn)
+}
+
+func (e *EndToEndSuite) TestWebSocketOrigins(c *C) {
+	server, _ := SetupServer(c, 0)
+	settings := WebSocketSettings{AllowedOrigins: []string{"https://www.widelands.org"}}
+	ts := httptest.NewServer(NewWebSocketHandler(server.accept, settings))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	_, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://example.com"}})
+	c.Assert(err, NotNil)
+	c.Assert(response.StatusCode, Equals, http.StatusForbidden)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://www.widelands.org/lobby/"}})
+	c.Assert(err, IsNil)
+	conn.Close()
+	// Tools that are not browsers do not send an origin
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	c.Assert(err, IsNil)
+	conn.Close()
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (e *EndToEndSuite) TestWebSocketForwardedFor(c *C) {
+	server, _ := SetupServer(c, 0)
+	url := func(ts *httptest.Server) string {
+		return "ws" + strings.TrimPrefix(ts.URL, "http")
+	}
+	remoteIp := func(name string) string {
+		var ip string
+		server.call(func() {
+			ip = server.HasClient(name).remoteIp()
+		})
+		return ip
+	}
+	login := func(conn *websocket.Conn, name string) {
+		conn.WriteMessage(websocket.BinaryMessage, packet.New("LOGIN", BUILD20, name, "build-20", false, name+"nonce"))
+		ExpectWebSocketPacket(c, conn, "LOGIN", name, "UNREGISTERED")
+		ExpectWebSocketPacket(c, conn, "TIME", Matching("\\d+"))
+	}
+	header := http.Header{"X-Forwarded-For": {"192.0.2.1, 198.51.100.2", "127.0.0.2"}}
+
+	// The header is ignored unless it comes from a trusted proxy
+	ts := httptest.NewServer(NewWebSocketHandler(server.accept, WebSocketSettings{}))
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(url(ts), header)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	login(conn, "bert")
+	c.Assert(remoteIp("bert"), Equals, "127.0.0.1")
+
+	// Clients may add addresses in front of those of the proxies
+	settings := WebSocketSettings{TrustedProxies: []string{"127.0.0.1", "127.0.0.0/8"}}
+	proxied := httptest.NewServer(NewWebSocketHandler(server.accept, settings))
+	defer proxied.Close()
+	conn, _, err = websocket.DefaultDialer.Dial(url(proxied), header)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	login(conn, "ernie")
+	c.Assert(remoteIp("ernie"), Equals, "198.51.100.2")
+
+	// Without the header, the client is the proxy
+	conn, _, err = websocket.DefaultDialer.Dial(url(proxied), nil)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	login(conn, "grover")
+	c.Assert(remoteIp("grover"), Equals, "127.0.0.1")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test Lobby Feed {{{
+// GetLobbyFeed requests the feed and decodes it.
+func GetLobbyFeed(c *C, url string) LobbySnapshot {
+	response, err := http.Get(url)
+	c.Assert(err, IsNil)
+	defer response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusOK)
+	var snapshot LobbySnapshot
+	c.Assert(json.NewDecoder(response.Body).Decode(&snapshot), IsNil)
+	return snapshot
+}
+
+func (e *EndToEndSuite) TestLobbyFeed(c *C) {
+	server, clients := SetupServer(c, 3)
+	ts := httptest.NewServer(NewLobbyFeedHandler(server.feed, time.Second))
+	defer ts.Close()
+	ExpectLoginWithNonceWorks(c, clients[0], "bert", "bertnonce")
+	ExpectLoginAsOttoWorks(c, clients[1])
+	ExpectLoginWithNonceWorks(c, clients[2], "ernie", "ernienonce")
+	MarkAnnounced(server, "bert", "otto", "ernie")
+	SendPacket(clients[2], "WEB_LISTING", false)
+
+	SendPacket(clients[0], "GAME_OPEN", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1")
+	// Not listed before the host is reachable
+	SendPacket(clients[1], "GAME_OPEN", "self-hosted game", 8)
+	server.GameConnected("my cool game")
+	// The messages are sent one after another since they are handled in the
+	// order they arrive
+	SendPacket(clients[0], "CHAT", "hello web", "")
+	ExpectChatSkippingOthers(c, clients[1], "bert", "hello web")
+	SendPacket(clients[2], "CHAT", "do not show me", "")
+	ExpectChatSkippingOthers(c, clients[1], "ernie", "do not show me")
+	SendPacket(clients[1], "CHAT", "whispered", "bert")
+	server.call(server.updateLobbyFeed)
+
+	feed := GetLobbyFeed(c, ts.URL+"/lobby.json")
+	c.Assert(feed.Clients, DeepEquals, []FeedClient{
+		{Name: "bert", BuildId: "build-20", Game: "my cool game"},
+		{Name: "otto", BuildId: "build-17", Game: "self-hosted game", Registered: true},
+	})
+	c.Assert(feed.Games, DeepEquals, []FeedGame{{Name: "my cool game", BuildId: "build-20", State: "SETUP", Players: 1}})
+	c.Assert(feed.Chat, HasLen, 1)
+	c.Assert(feed.Chat[0].Sender, Equals, "bert")
+	c.Assert(feed.Chat[0].Message, Equals, "hello web")
+
+	// Nothing changed
+	server.call(server.updateLobbyFeed)
+	c.Assert(GetLobbyFeed(c, ts.URL+"/lobby.json").Version, Equals, feed.Version)
+
+	response, err := http.Get(ts.URL + "/")
+	c.Assert(err, IsNil)
+	page, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(page), "lobby.json"), Equals, true)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (e *EndToEndSuite) TestLobbyFeedLongPolling(c *C) {
+	server, clients := SetupServer(c, 1)
+	ts := httptest.NewServer(NewLobbyFeedHandler(server.feed, time.Second))
+	defer ts.Close()
+	ExpectLoginWithNonceWorks(c, clients[0], "bert", "bertnonce")
+	MarkAnnounced(server, "bert")
+	server.call(server.updateLobbyFeed)
+	feed := GetLobbyFeed(c, ts.URL+"/lobby.json")
+	c.Assert(feed.Clients, HasLen, 1)
+
+	// Waits for the next change
+	polled := make(chan LobbySnapshot)
+	go func() {
+		polled <- GetLobbyFeed(c, fmt.Sprintf("%v/lobby.json?since=%v", ts.URL, feed.Version))
+	}()
+	select {
+	case <-polled:
+		c.Fatal("Got the feed although it did not change")
+	case <-time.After(50 * time.Millisecond):
+	}
+	SendPacket(clients[0], "CHAT", "hello web", "")
+	select {
+	case newer := <-polled:
+		c.Assert(newer.Version > feed.Version, Equals, true)
+		c.Assert(newer.Chat, HasLen, 1)
+	case <-time.After(time.Second):
+		c.Fatal("The change did not end the long-polling request")
+	}
+
+	// Older versions are answered right away
+	c.Assert(GetLobbyFeed(c, ts.URL+"/lobby.json?since=0").Version > feed.Version, Equals, true)
+	response, err := http.Get(ts.URL + "/lobby.json?since=latest")
+	c.Assert(err, IsNil)
+	response.Body.Close()
+	c.Assert(response.StatusCode, Equals, http.StatusBadRequest)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (e *EndToEndSuite) TestLobbyFeedKeepsRecentChat(c *C) {
+	feed := NewLobbyFeed()
+	for i := 0; i < kFeedChatSize+5; i++ {
+		feed.AddChat("bert", fmt.Sprint(i))
+	}
+	chat := feed.Snapshot().Chat
+	c.Assert(chat, HasLen, kFeedChatSize)
+	c.Assert(chat[0].Message, Equals, "5")
+	c.Assert(chat[kFeedChatSize-1].Message, Equals, fmt.Sprint(kFeedChatSize+4))
+}
+
+// }}}
+// Test Send Queues {{{
+// ExpectChatSkippingOthers waits for the given public chat message and skips
+// all other packets that arrive in between.
+func ExpectChatSkippingOthers(c *C, f FakeConn, sender, message string) {
+	timer := time.NewTimer(time.Second)
+	for {
+		select {
+		case pkg := <-f.Packets:
+			if pkg.RawData[0] != "CHAT" {
+				continue
+			}
+			checkPacket(c, pkg, "CHAT", sender, message, "public")
+			return
+		case <-timer.C:
+			c.Fatalf("Chat message %q did not arrive.", message)
+		}
+	}
+}
+
+func (e *EndToEndSuite) TestStalledClientDoesNotBlockOthers(c *C) {
+	server, _ := SetupServer(c, 0)
+	server.SetClientSendQueueSize(10)
+	clients := []FakeConn{NewFakeConn(c), NewFakeConn(c)}
+	for _, client := range clients {
+		server.acceptedConnections <- client
+	}
+
+	ExpectLoginWithNonceWorks(c, clients[0], "bert", "bertnonce")
+	ExpectLoginWithNonceWorks(c, clients[1], "ernie", "ernienonce")
+	MarkAnnounced(server, "bert", "ernie")
+
+	clients[0].Stall()
+	for i := 0; i < 30; i++ {
+		message := fmt.Sprintf("hello %d", i)
+		SendPacket(clients[1], "CHAT", message, "")
+		ExpectChatSkippingOthers(c, clients[1], "ernie", message)
+	}
+
+	ExpectClosed(c, clients[0])
+	c.Assert(clients[1].GotClosed(), Equals, false)
+	for i := 0; i < 20 && NrActiveClients(server) != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(NrActiveClients(server), Equals, 1)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (e *EndToEndSuite) TestWriteTimeout(c *C) {
+	server, _ := SetupServer(c, 0)
+	server.SetClientWriteTimeout(10 * time.Millisecond)
+	client := NewFakeConn(c)
+	server.acceptedConnections <- client
+
+	ExpectLoginWithNonceWorks(c, client, "bert", "bertnonce")
+
+	client.Stall()
+	// The first answer might still be read by the stalled connection.
+	SendPacket(client, "CLIENTS")
+	SendPacket(client, "CLIENTS")
+
+	time.Sleep(15 * time.Millisecond)
+	ExpectClosed(c, client)
+	for i := 0; i < 20 && NrActiveClients(server) != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(NrActiveClients(server), Equals, 0)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test Faulty Communication {{{
+func (e *EndToEndSuite) TestUnknownPacket(c *C) {
+	server, clients := SetupServer(c, 1)
+	SendPacket(clients[0], "BLUMBAQUATSCH")
+	ExpectPacket(c, clients[0], "ERROR", "GARBAGE_RECEIVED", "INVALID_CMD")
+
+	time.Sleep(5 * time.Millisecond)
+	ExpectClosed(c, clients[0])
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (e *EndToEndSuite) TestWrongArgumentsInPacket(c *C) {
+	server, clients := SetupServer(c, 1)
+	SendPacket(clients[0], "LOGIN", "hi")
+	ExpectPacket(c, clients[0], "ERROR", "LOGIN", "Invalid integer: 'hi'")
+
+	time.Sleep(5 * time.Millisecond)
+	ExpectClosed(c, clients[0])
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestClientCanTimeout(c *C) {
+	server, clients := SetupServer(c, 1)
+
+	server.SetClientSendingTimeout(1 * time.Millisecond)
+
+	ExpectLoginAsUnregisteredWorks(c, clients[0], "testuser")
+
+	time.Sleep(5 * time.Millisecond)
+	ExpectPacket(c, clients[0], "DISCONNECT", "CLIENT_TIMEOUT")
+	time.Sleep(5 * time.Millisecond)
+
+	ExpectClosed(c, clients[0])
+	c.Assert(NrActiveClients(server), Equals, 0)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test Pinging {{{
+func (s *EndToEndSuite) TestRegularPingCycle(c *C) {
+	server, clients := SetupServer(c, 1)
+
+	ExpectLoginAsUnregisteredWorks(c, clients[0], "testuser")
+
+	// Regular Ping cycle. Any packet restarts the ping timer.
+	server.SetPingCycleTime(20 * time.Millisecond)
+	SendPacket(clients[0], "PONG")
+	time.Sleep(25 * time.Millisecond)
+	ExpectPacket(c, clients[0], "PING")
+	SendPacket(clients[0], "PONG")
+	time.Sleep(25 * time.Millisecond)
+	ExpectPacket(c, clients[0], "PING")
+
+	// Regular packages are as good as a Pong.
+	SendPacket(clients[0], "CHAT", "hello there", "")
 	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
-	ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
+	ExpectPacket(c, clients[0], "CHAT", "testuser", "hello there", "public")
+	time.Sleep(25 * time.Millisecond)
+	ExpectPacket(c, clients[0], "PING")
+	SendPacket(clients[0], "CHAT", "hello there", "")
+	ExpectPacket(c, clients[0], "CHAT", "testuser", "hello there", "public")
+	time.Sleep(25 * time.Millisecond)
+	ExpectPacket(c, clients[0], "PING")
+
+	// Timeout
+	time.Sleep(60 * time.Millisecond)
+	ExpectPacket(c, clients[0], "DISCONNECT", "CLIENT_TIMEOUT")
+	time.Sleep(1 * time.Millisecond)
+	ExpectClosed(c, clients[0])
+
+	c.Assert(NrActiveClients(server), Equals, 0)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test Motd {{{
+func (s *EndToEndSuite) TestMotd(c *C) {
+	server, clients := SetupServer(c, 3)
+
+	ExpectLoginAsSirVerWorks(c, clients[0])
+	ExpectLoginAsOttoWorks(c, clients[1])
+
+	// Check Superuser setting motd.
+	SendPacket(clients[0], "MOTD", "Schnulz is cool!")
+	ExpectPacket(c, clients[0], "CHAT", "", "Schnulz is cool!", "system")
+	ExpectPacket(c, clients[1], "CHAT", "", "Schnulz is cool!", "system")
+
+	// Check normal user setting motd.
+	SendPacket(clients[1], "MOTD", "Schnulz is cool!")
+	ExpectPacket(c, clients[1], "ERROR", "MOTD", "DEFICIENT_PERMISSION")
+	// This will not close your connection.
+
+	// Login and you'll receive a motd.
+	ExpectLoginAsUnregisteredWorks(c, clients[2], "bert")
+	ExpectPacket(c, clients[2], "CHAT", "", "Schnulz is cool!", "system")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test Announcement  {{{
+func (s *EndToEndSuite) TestAnnouncement(c *C) {
+	server, clients := SetupServer(c, 3)
+
+	ExpectLoginAsSirVerWorks(c, clients[0])
+	ExpectLoginAsOttoWorks(c, clients[1])
+	ExpectLoginAsUnregisteredWorks(c, clients[2], "bert")
 
 	// Check Superuser announcing.
 	SendPacket(clients[0], "ANNOUNCEMENT", "Schnulz is cool!")
@@ -683,7 +1704,7 @@ type FakeGamePingerFactory struct {
 	pinger GamePinger
 }
 
-func (f FakeGamePingerFactory) New(client *Client, timeout time.Duration) *GamePinger {
+func (f FakeGamePingerFactory) New(ip string, timeout time.Duration) *GamePinger {
 	return &f.pinger
 }
 
@@ -699,13 +1720,11 @@ func gameTestSetup(c *C, loginThirdConnection bool) (*Server, []FakeConn, GamePi
 
 	ExpectLoginAsUnregisteredWorks(c, clients[0], "bert")
 	ExpectLoginAsOttoWorks(c, clients[1])
-
-	ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
+	MarkAnnounced(server, "bert", "otto")
 
 	if loginThirdConnection {
 		ExpectLoginAsSirVerWorks(c, clients[2])
-		ExpectPacket(c, clients[0], "CLIENTS_UPDATE")
-		ExpectPacket(c, clients[1], "CLIENTS_UPDATE")
+		MarkAnnounced(server, "SirVer")
 	}
 
 	return server, clients, pinger
@@ -726,8 +1745,8 @@ func (s *EndToEndSuite) TestCreateGameAndPingReply(c *C) {
 
 	pinger.C <- true
 
-	ExpectPacket(c, clients[0], "GAME_OPEN")
 	ExpectPacketForAll(c, clients, "GAMES_UPDATE")
+	ExpectPacket(c, clients[0], "GAME_OPEN")
 
 	SendPacket(clients[1], "CLIENTS")
 	ExpectPacket(c, clients[1], "CLIENTS", "3",
@@ -750,8 +1769,8 @@ func (s *EndToEndSuite) TestCreateGameAndNoConnection(c *C) {
 	// No reply to game ping.
 	time.Sleep(6 * time.Millisecond)
 
-	ExpectPacket(c, clients[0], "ERROR", "GAME_OPEN", "GAME_TIMEOUT")
 	ExpectPacketForAll(c, clients, "GAMES_UPDATE")
+	ExpectPacket(c, clients[0], "ERROR", "GAME_OPEN", "GAME_TIMEOUT")
 
 	SendPacket(clients[2], "CLIENTS")
 	SendPacket(clients[2], "GAMES")
@@ -777,8 +1796,8 @@ func (s *EndToEndSuite) TestCreateGameTwicePrePing(c *C) {
 
 	pinger.C <- true
 
-	ExpectPacket(c, clients[0], "GAME_OPEN")
 	ExpectPacketForAll(c, clients, "GAMES_UPDATE")
+	ExpectPacket(c, clients[0], "GAME_OPEN")
 
 	SendPacket(clients[2], "CLIENTS")
 	ExpectPacket(c, clients[2], "CLIENTS", "3",
@@ -798,8 +1817,8 @@ func (s *EndToEndSuite) TestCreateGameTwicePostPing(c *C) {
 
 	pinger.C <- true
 
-	ExpectPacket(c, clients[0], "GAME_OPEN")
 	ExpectPacketForAll(c, clients, "GAMES_UPDATE")
+	ExpectPacket(c, clients[0], "GAME_OPEN")
 
 	SendPacket(clients[1], "GAME_OPEN", "my cool game", 12)
 	ExpectPacket(c, clients[1], "ERROR", "GAME_OPEN", "GAME_EXISTS")
@@ -823,8 +1842,8 @@ func (s *EndToEndSuite) TestCreateGameAndNoFirstPingReply(c *C) {
 	time.Sleep(6 * time.Millisecond)
 	pinger.C <- false
 
-	ExpectPacket(c, clients[0], "ERROR", "GAME_OPEN", "GAME_TIMEOUT")
 	ExpectPacketForAll(c, clients, "GAMES_UPDATE")
+	ExpectPacket(c, clients[0], "ERROR", "GAME_OPEN", "GAME_TIMEOUT")
 
 	SendPacket(clients[2], "CLIENTS")
 	ExpectPacket(c, clients[2], "CLIENTS", "3",
@@ -848,8 +1867,8 @@ func (s *EndToEndSuite) TestCreateGameAndNoSecondPingReply(c *C) {
 
 	pinger.C <- true
 
-	ExpectPacket(c, clients[0], "GAME_OPEN")
 	ExpectPacketForAll(c, clients, "GAMES_UPDATE")
+	ExpectPacket(c, clients[0], "GAME_OPEN")
 
 	pinger.C <- false
 
@@ -861,8 +1880,10 @@ func (s *EndToEndSuite) TestCreateGameAndNoSecondPingReply(c *C) {
 		"otto", "build-17", "", "REGISTERED", "",
 		"SirVer", "build-18", "", "SUPERUSER", "")
 
+	// The host is still connected, so the game is only listed as closed.
 	SendPacket(clients[2], "GAMES")
-	ExpectPacket(c, clients[2], "GAMES", "0")
+	ExpectPacket(c, clients[2], "GAMES", "1",
+		"my cool game", "build-16", "false")
 
 	ExpectServerToShutdownCleanly(c, server)
 }
@@ -906,6 +1927,55 @@ func (s *EndToEndSuite) TestJoinFullGame(c *C) {
 	ExpectServerToShutdownCleanly(c, server)
 }
 
+// ExpectLoginWithMetadataWorks logs in an unregistered client that supports
+// game metadata.
+func ExpectLoginWithMetadataWorks(c *C, f FakeConn, name string) {
+	SendPacket(f, "LOGIN", BUILD23, name, "build-23", false, name+"nonce")
+	ExpectPacket(c, f, "LOGIN", name, "UNREGISTERED")
+	ExpectPacket(c, f, "TIME", Matching("\\d+"))
+	time.Sleep(5 * time.Millisecond)
+}
+
+func (s *EndToEndSuite) TestGameMetadata(c *C) {
+	server, clients := SetupServer(c, 4)
+	ExpectLoginWithMetadataWorks(c, clients[0], "bert")
+	ExpectLoginWithMetadataWorks(c, clients[1], "ernie")
+	ExpectLoginWithNonceWorks(c, clients[2], "oscar", "oscarnonce")
+	ExpectLoginWithMetadataWorks(c, clients[3], "grover")
+	MarkAnnounced(server, "bert", "ernie", "oscar", "grover")
+
+	SendPacket(clients[0], "GAME_OPEN", "my cool game", 2, "Crater", true, "Beginners welcome", "Autocrat", "barbarians,empire")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	server.GameConnected("my cool game")
+
+	SendPacket(clients[1], "GAMES")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAMES", "1", "my cool game", "build-23", "SETUP",
+		"Crater", "2", "1", "true", "Beginners welcome", "Autocrat", "barbarians,empire")
+	// Older clients get the old format
+	SendPacket(clients[2], "GAMES")
+	ExpectPacketSkippingUpdates(c, clients[2], "GAMES", "1", "my cool game", "build-23", "CLOSED")
+
+	// Only the host can change the metadata
+	SendPacket(clients[1], "GAME_UPDATE", 4, "Fellowships", false, "", "Territorial Lord", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "GAME_UPDATE", "NOT_HOSTING")
+	SendPacket(clients[0], "GAME_UPDATE", 2, "Fellowships", false, "", "Territorial Lord", "atlanteans")
+	SendPacket(clients[0], "GAME_UPDATE", -1, "Fellowships", false, "", "Territorial Lord", "atlanteans")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "GAME_UPDATE", "INVALID_MAX_PLAYERS")
+	SendPacket(clients[2], "GAME_UPDATE", 2, "Fellowships", false, "", "Territorial Lord", "atlanteans")
+	ExpectPacketSkippingUpdates(c, clients[2], "ERROR", "GAME_UPDATE", "UNSUPPORTED_PROTOCOL")
+
+	// The second player fills the game
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", "192.168.0.1", "true", "fe80::1", "0")
+	SendPacket(clients[3], "GAMES")
+	ExpectPacketSkippingUpdates(c, clients[3], "GAMES", "1", "my cool game", "build-23", "SETUP",
+		"Fellowships", "2", "2", "false", "", "Territorial Lord", "atlanteans")
+	SendPacket(clients[3], "GAME_CONNECT", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[3], "ERROR", "GAME_CONNECT", "GAME_FULL")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
 func (s *EndToEndSuite) TestJoinNonexistingGame(c *C) {
 	server, clients, _ := gameTestSetup(c, true)
 
@@ -933,8 +2003,8 @@ func (s *EndToEndSuite) TestStartGame(c *C) {
 	ExpectPacketForAll(c, clients, "CLIENTS_UPDATE")
 
 	pinger.C <- true
-	ExpectPacket(c, clients[0], "GAME_OPEN")
 	ExpectPacketForAll(c, clients, "GAMES_UPDATE")
+	ExpectPacket(c, clients[0], "GAME_OPEN")
 
 	SendPacket(clients[1], "GAME_CONNECT", "my cool game")
 	ExpectPacket(c, clients[1], "GAME_CONNECT", "192.168.0.0")
@@ -945,7 +2015,6 @@ func (s *EndToEndSuite) TestStartGame(c *C) {
 	ExpectPacket(c, clients[2], "ERROR", "GARBAGE_RECEIVED", "INVALID_CMD")
 	ExpectClosed(c, clients[2])
 	clients = clients[:2]
-	ExpectPacketForAll(c, clients, "CLIENTS_UPDATE")
 
 	// Try starting without being a host.
 	SendPacket(clients[1], "GAME_START")
@@ -1028,16 +2097,950 @@ func (s *EndToEndSuite) TestGameLeavingNotInGame(c *C) {
 	ExpectServerToShutdownCleanly(c, server)
 }
 
-func (s *EndToEndSuite) TestIRCBridge(c *C) {
-	var ircbridge = NewIRCBridge("chat.freenode.net:7000", "IRCTest", "IRCTest", "widelands-test", true)
-	messagesToIrc := make(chan Message, 50)
-	messagesToLobby := make(chan Message, 50)
-	ircbridge.Connect(messagesToIrc, messagesToLobby)
-	messagesToIrc <- Message{
-		nick:    "Test",
-		message: "Hello",
+// }}}
+// Test Restricted Games {{{
+// ExpectLoginWithAccessWorks logs in an unregistered client that can restrict
+// who may join its games.
+func ExpectLoginWithAccessWorks(c *C, f FakeConn, name string) {
+	SendPacket(f, "LOGIN", BUILD24, name, "build-24", false, name+"nonce")
+	ExpectPacket(c, f, "LOGIN", name, "UNREGISTERED")
+	ExpectPacket(c, f, "TIME", Matching("\\d+"))
+	time.Sleep(5 * time.Millisecond)
+}
+
+func (s *EndToEndSuite) TestGameWithJoinPassword(c *C) {
+	server, clients := SetupServer(c, 4)
+	ExpectLoginWithAccessWorks(c, clients[0], "bert")
+	ExpectLoginWithAccessWorks(c, clients[1], "ernie")
+	ExpectLoginWithMetadataWorks(c, clients[2], "oscar")
+	ExpectLoginWithAccessWorks(c, clients[3], "grover")
+	MarkAnnounced(server, "bert", "ernie", "oscar", "grover")
+
+	SendPacket(clients[0], "GAME_OPEN", "my cool game", 4, "Crater", false, "", "Autocrat", "", "secret", "")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	server.GameConnected("my cool game")
+
+	// Everybody sees that the game needs a password
+	SendPacket(clients[3], "GAMES")
+	ExpectPacketSkippingUpdates(c, clients[3], "GAMES", "1", "my cool game", "build-24", "SETUP",
+		"Crater", "4", "1", "true", "", "Autocrat", "")
+
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game", "wrong")
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "GAME_CONNECT", "WRONG_PASSWORD")
+	// Older clients can not present a join token to the relay
+	SendPacket(clients[2], "GAME_CONNECT", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[2], "ERROR", "GAME_CONNECT", "UNSUPPORTED_PROTOCOL")
+
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game", "secret")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	var restricted, tokens []string
+	server.call(func() {
+		restricted = server.relay.(*FakeRelay).restricted
+		tokens = server.relay.(*FakeRelay).joinTokens
+	})
+	c.Assert(restricted, DeepEquals, []string{"my cool game"})
+	c.Assert(tokens, HasLen, 1)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestInviteOnlyGame(c *C) {
+	server, clients := SetupServer(c, 4)
+	ExpectLoginWithAccessWorks(c, clients[0], "bert")
+	ExpectLoginWithAccessWorks(c, clients[1], "ernie")
+	ExpectLoginWithAccessWorks(c, clients[2], "oscar")
+	ExpectLoginWithAccessWorks(c, clients[3], "grover")
+	MarkAnnounced(server, "bert", "ernie", "oscar", "grover")
+
+	SendPacket(clients[0], "GAME_OPEN", "my cool game", 4, "Crater", false, "", "Autocrat", "", "", "ernie, grover")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	server.GameConnected("my cool game")
+
+	SendPacket(clients[2], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[2], "ERROR", "GAME_CONNECT", "NOT_INVITED")
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	SendPacket(clients[3], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[3], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+
+	// Every client gets its own token
+	var tokens []string
+	server.call(func() {
+		tokens = server.relay.(*FakeRelay).joinTokens
+	})
+	c.Assert(tokens, HasLen, 2)
+	c.Assert(tokens[0], Not(Equals), tokens[1])
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestOpenGameWithAccessSupport(c *C) {
+	server, clients := SetupServer(c, 2)
+	ExpectLoginWithAccessWorks(c, clients[0], "bert")
+	ExpectLoginWithAccessWorks(c, clients[1], "ernie")
+	MarkAnnounced(server, "bert", "ernie")
+
+	SendPacket(clients[0], "GAME_OPEN", "my cool game", 4, "Crater", false, "", "Autocrat", "", "", "")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	server.GameConnected("my cool game")
+
+	// Everybody may join. The token only tells who the client is
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	var restricted, tokens []string
+	server.call(func() {
+		restricted = server.relay.(*FakeRelay).restricted
+		tokens = server.relay.(*FakeRelay).joinTokens
+	})
+	c.Assert(restricted, HasLen, 0)
+	c.Assert(tokens, HasLen, 1)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test Kicking {{{
+func (s *EndToEndSuite) TestKickedClientsLeaveTheGame(c *C) {
+	server, clients := SetupServer(c, 4)
+	ExpectLoginWithAccessWorks(c, clients[0], "bert")
+	ExpectLoginWithAccessWorks(c, clients[1], "ernie")
+	ExpectLoginWithAccessWorks(c, clients[2], "grover")
+	ExpectLoginWithNonceWorks(c, clients[3], "oscar", "oscarnonce")
+	MarkAnnounced(server, "bert", "ernie", "grover", "oscar")
+
+	SendPacket(clients[0], "GAME_OPEN", "my cool game", 4, "Crater", false, "", "Autocrat", "", "", "")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	server.GameConnected("my cool game")
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	SendPacket(clients[2], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[2], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	var tokens []string
+	server.call(func() {
+		tokens = server.relay.(*FakeRelay).joinTokens
+	})
+	c.Assert(tokens, HasLen, 2)
+
+	inGame := func(name string) bool {
+		var result bool
+		server.call(func() {
+			result = server.HasClient(name).Game() != nil
+		})
+		return result
+	}
+
+	// Unknown tokens are ignored
+	server.ClientKicked("my cool game", "unknown", true)
+	c.Assert(inGame("ernie"), Equals, true)
+
+	// A banned client may not join again
+	server.ClientKicked("my cool game", tokens[0], true)
+	c.Assert(inGame("ernie"), Equals, false)
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "GAME_CONNECT", "BANNED")
+	// The relay requires a join token after a ban, which old clients can
+	// not present
+	SendPacket(clients[3], "GAME_CONNECT", "my cool game")
+	ExpectPacketSkippingUpdates(c, clients[3], "ERROR", "GAME_CONNECT", "UNSUPPORTED_PROTOCOL")
+
+	// A kicked client may
+	server.ClientKicked("my cool game", tokens[1], false)
+	c.Assert(inGame("grover"), Equals, false)
+	SendPacket(clients[2], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[2], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	c.Assert(inGame("grover"), Equals, true)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestRelayReportsPlayers(c *C) {
+	server, clients := SetupServer(c, 3)
+	ExpectLoginWithAccessWorks(c, clients[0], "bert")
+	ExpectLoginWithAccessWorks(c, clients[1], "ernie")
+	ExpectLoginWithAccessWorks(c, clients[2], "grover")
+	MarkAnnounced(server, "bert", "ernie", "grover")
+
+	SendPacket(clients[0], "GAME_OPEN", "my cool game", 4, "Crater", false, "", "Autocrat", "", "", "")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	server.GameConnected("my cool game")
+	nrPlayers := func() int {
+		var n int
+		server.call(func() {
+			n = server.HasGame("my cool game").NrPlayers()
+		})
+		return n
+	}
+
+	// Players are only counted once the relay reports them
+	SendPacket(clients[2], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[2], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	c.Assert(nrPlayers(), Equals, 1)
+	SendPacket(clients[2], "GAME_DISCONNECT")
+	SendPacket(clients[2], "CLIENTS")
+	ExpectPacketSkippingUpdates(c, clients[2], "CLIENTS", "3", "bert", "build-24", "my cool game", "UNREGISTERED",
+		"ernie", "build-24", "", "UNREGISTERED", "grover", "build-24", "", "UNREGISTERED")
+	c.Assert(nrPlayers(), Equals, 1)
+
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	var tokens []string
+	server.call(func() {
+		tokens = server.relay.(*FakeRelay).joinTokens
+	})
+	c.Assert(tokens, HasLen, 2)
+	server.ClientConnected("my cool game", tokens[1])
+	c.Assert(nrPlayers(), Equals, 2)
+
+	// Leaving in the lobby does not matter while the relay reports the
+	// player in the game
+	SendPacket(clients[1], "GAME_DISCONNECT")
+	SendPacket(clients[1], "CLIENTS")
+	ExpectPacketSkippingUpdates(c, clients[1], "CLIENTS", "3", "bert", "build-24", "my cool game", "UNREGISTERED",
+		"ernie", "build-24", "", "UNREGISTERED", "grover", "build-24", "", "UNREGISTERED")
+	c.Assert(nrPlayers(), Equals, 2)
+	server.ClientDisconnected("my cool game", tokens[1])
+	c.Assert(nrPlayers(), Equals, 1)
+
+	// The relay also removes players from the game in the lobby
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	server.call(func() {
+		tokens = server.relay.(*FakeRelay).joinTokens
+	})
+	server.ClientConnected("my cool game", tokens[2])
+	server.ClientDisconnected("my cool game", tokens[2])
+	c.Assert(nrPlayers(), Equals, 1)
+	server.call(func() {
+		c.Check(server.HasClient("ernie").Game(), IsNil)
+	})
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestJoinTokensAreReused(c *C) {
+	server, clients := SetupServer(c, 2)
+	ExpectLoginWithAccessWorks(c, clients[0], "bert")
+	ExpectLoginWithAccessWorks(c, clients[1], "ernie")
+	MarkAnnounced(server, "bert", "ernie")
+
+	SendPacket(clients[0], "GAME_OPEN", "my cool game", 4, "Crater", false, "", "Autocrat", "", "", "")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	server.GameConnected("my cool game")
+	tokens := func() []string {
+		var t []string
+		server.call(func() {
+			t = server.relay.(*FakeRelay).joinTokens
+		})
+		return t
+	}
+
+	// Connecting again before joining on the relay gives the same token
+	for i := 0; i < 3; i++ {
+		SendPacket(clients[1], "GAME_CONNECT", "my cool game", "")
+		ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+		SendPacket(clients[1], "GAME_DISCONNECT")
+	}
+	c.Assert(tokens(), HasLen, 1)
+
+	// A used token is forgotten once the client left on the relay
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	first := tokens()[0]
+	server.ClientConnected("my cool game", first)
+	server.ClientDisconnected("my cool game", first)
+	server.call(func() {
+		c.Check(server.HasGame("my cool game").UserOfJoinToken(first), Equals, "")
+	})
+	SendPacket(clients[1], "GAME_CONNECT", "my cool game", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	c.Assert(tokens(), HasLen, 2)
+	second := tokens()[1]
+	server.call(func() {
+		c.Check(server.HasGame("my cool game").UserOfJoinToken(second), Equals, "ernie")
+	})
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test Ratings {{{
+// ExpectLoginAsRegisteredWorks logs in a registered BUILD25 client with the
+// challenge-response login.
+func ExpectLoginAsRegisteredWorks(c *C, f FakeConn, name, password, permissions string) {
+	expectRegisteredLoginWorks(c, f, BUILD25, "build-25", name, password, permissions)
+}
+
+func expectRegisteredLoginWorks(c *C, f FakeConn, version int, buildId, name, password, permissions string) {
+	SendPacket(f, "LOGIN", version, name, buildId, true, "")
+	var challenge string
+	select {
+	case pkg := <-f.Packets:
+		c.Assert(pkg.RawData, HasLen, 2)
+		c.Assert(pkg.RawData[0], Equals, "PWD_CHALLENGE")
+		challenge = pkg.RawData[1]
+	case <-time.After(100 * time.Millisecond):
+		c.Fatalf("No challenge arrived.")
+	}
+	passwordHash := sha1.Sum([]byte(password))
+	response := sha1.Sum([]byte(challenge + hex.EncodeToString(passwordHash[:])))
+	SendPacket(f, "PWD_CHALLENGE", hex.EncodeToString(response[:]))
+	ExpectPacket(c, f, "LOGIN", name, permissions)
+	ExpectPacket(c, f, "TIME", Matching("\\d+"))
+	time.Sleep(5 * time.Millisecond)
+}
+
+func ExpectLoginWithRatingsWorks(c *C, f FakeConn, name string) {
+	SendPacket(f, "LOGIN", BUILD25, name, "build-25", false, name+"nonce")
+	ExpectPacket(c, f, "LOGIN", name, "UNREGISTERED")
+	ExpectPacket(c, f, "TIME", Matching("\\d+"))
+	time.Sleep(5 * time.Millisecond)
+}
+
+// setupRatedGame lets otto host a running relay game SirVer and bert have
+// joined.
+func setupRatedGame(c *C) (*Server, []FakeConn) {
+	server, clients := SetupServer(c, 3)
+	ExpectLoginAsRegisteredWorks(c, clients[0], "otto", "ottoiscool", "REGISTERED")
+	ExpectLoginAsRegisteredWorks(c, clients[1], "SirVer", "123456", "SUPERUSER")
+	ExpectLoginWithRatingsWorks(c, clients[2], "bert")
+	MarkAnnounced(server, "otto", "SirVer", "bert")
+
+	SendPacket(clients[0], "GAME_OPEN", "my cool game", 4, "Crater", false, "", "Autocrat", "", "", "")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	server.GameConnected("my cool game")
+	for _, client := range clients[1:] {
+		SendPacket(client, "GAME_CONNECT", "my cool game", "")
+		ExpectPacketSkippingUpdates(c, client, "GAME_CONNECT", Matching("[0-9a-f]{32}"), "192.168.0.1", "true", "fe80::1", "0")
+	}
+	ConnectOnRelay(server, "my cool game")
+	SendPacket(clients[0], "GAME_START")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_START")
+	return server, clients
+}
+
+func (s *EndToEndSuite) TestGameResultUpdatesRatings(c *C) {
+	server, clients := setupRatedGame(c)
+
+	SendPacket(clients[2], "CLIENTS")
+	ExpectPacketSkippingUpdates(c, clients[2], "CLIENTS", "3",
+		"otto", "build-25", "my cool game", "REGISTERED", "1500",
+		"SirVer", "build-25", "my cool game", "SUPERUSER", "1500",
+		"bert", "build-25", "my cool game", "UNREGISTERED", "")
+
+	// The game is rated once all registered players agree
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 3, "otto", 1, "SirVer", 2, "bert", 3)
+	SendPacket(clients[1], "GAME_RESULT", "my cool game", 3, "otto", 2, "SirVer", 1, "bert", 3)
+	SendPacket(clients[1], "GAME_RESULT", "my cool game", 3, "otto", 1, "SirVer", 2, "bert", 3)
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "Your rating changed from 1500 to 1516.", "system")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "Your rating changed from 1500 to 1484.", "system")
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 3, "otto", 1, "SirVer", 2, "bert", 3)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "GAME_RESULT", "ALREADY_RATED")
+
+	SendPacket(clients[2], "CLIENTS")
+	ExpectPacketSkippingUpdates(c, clients[2], "CLIENTS", "3",
+		"otto", "build-25", "my cool game", "REGISTERED", "1516",
+		"SirVer", "build-25", "my cool game", "SUPERUSER", "1484",
+		"bert", "build-25", "my cool game", "UNREGISTERED", "")
+
+	SendPacket(clients[2], "CMD", "leaderboard", "")
+	ExpectPacketSkippingUpdates(c, clients[2], "CHAT", "", "1. otto: 1516 (1 games)", "system")
+	ExpectPacketSkippingUpdates(c, clients[2], "CHAT", "", "2. SirVer: 1484 (1 games)", "system")
+	SendPacket(clients[2], "CMD", "leaderboard", "1000")
+	ExpectPacketSkippingUpdates(c, clients[2], "ERROR", "CMD", "INVALID_CMD_PARAMETERS")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestGameResultAfterTheGameEnded(c *C) {
+	server, clients := setupRatedGame(c)
+
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 2, "otto", 1, "SirVer", 2)
+	server.GameClosed("my cool game")
+	SendPacket(clients[1], "GAME_RESULT", "my cool game", 2, "otto", 1, "SirVer", 2)
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "Your rating changed from 1500 to 1516.", "system")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "Your rating changed from 1500 to 1484.", "system")
+	SendPacket(clients[1], "GAME_RESULT", "my cool game", 2, "otto", 1, "SirVer", 2)
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "GAME_RESULT", "ALREADY_RATED")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestGameResultIsDecidedAfterGracePeriod(c *C) {
+	server, clients := setupRatedGame(c)
+	server.SetResultGracePeriod(20 * time.Millisecond)
+
+	// otto does not report the result, so SirVer's report counts
+	SendPacket(clients[1], "GAME_RESULT", "my cool game", 2, "otto", 1, "SirVer", 2)
+	server.GameClosed("my cool game")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "Your rating changed from 1500 to 1516.", "system")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "Your rating changed from 1500 to 1484.", "system")
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 2, "otto", 2, "SirVer", 1)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "GAME_RESULT", "NO_SUCH_GAME")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestOnlyWinnersReportingIsNotRated(c *C) {
+	server, clients := setupRatedGame(c)
+	server.SetResultGracePeriod(20 * time.Millisecond)
+
+	// SirVer does not report the result, maybe since they crashed
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 2, "otto", 1, "SirVer", 2)
+	server.GameClosed("my cool game")
+	time.Sleep(50 * time.Millisecond)
+	SendPacket(clients[2], "CMD", "leaderboard", "")
+	ExpectPacketSkippingUpdates(c, clients[2], "CHAT", "", "Nobody has played a rated game yet.", "system")
+	SendPacket(clients[1], "GAME_RESULT", "my cool game", 2, "otto", 1, "SirVer", 2)
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "GAME_RESULT", "NO_SUCH_GAME")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestDifferentGameResultsAreNotRated(c *C) {
+	server, clients := setupRatedGame(c)
+	server.SetResultGracePeriod(20 * time.Millisecond)
+
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 2, "otto", 1, "SirVer", 2)
+	SendPacket(clients[1], "GAME_RESULT", "my cool game", 2, "otto", 2, "SirVer", 1)
+	server.GameClosed("my cool game")
+	time.Sleep(50 * time.Millisecond)
+	SendPacket(clients[2], "CMD", "leaderboard", "")
+	ExpectPacketSkippingUpdates(c, clients[2], "CHAT", "", "Nobody has played a rated game yet.", "system")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestGameResultNeedsBuild25(c *C) {
+	server, clients := SetupServer(c, 1)
+	expectRegisteredLoginWorks(c, clients[0], BUILD24, "build-24", "otto", "ottoiscool", "REGISTERED")
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 2, "otto", 1, "SirVer", 2)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "GAME_RESULT", "UNSUPPORTED_PROTOCOL")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestInvalidGameResults(c *C) {
+	server, clients := setupRatedGame(c)
+
+	SendPacket(clients[2], "GAME_RESULT", "my cool game", 2, "otto", 1, "bert", 2)
+	ExpectPacketSkippingUpdates(c, clients[2], "ERROR", "GAME_RESULT", "DEFICIENT_PERMISSION")
+	SendPacket(clients[0], "GAME_RESULT", "other game", 2, "otto", 1, "SirVer", 2)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "GAME_RESULT", "NO_SUCH_GAME")
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 2, "otto", 1, "grover", 2)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "GAME_RESULT", "NOT_A_PARTICIPANT")
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 2, "SirVer", 1, "bert", 2)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "GAME_RESULT", "NOT_A_PARTICIPANT")
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 2, "otto", 1, "otto", 2)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "GAME_RESULT", "INVALID_RESULT")
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 1, "otto", 1)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "GAME_RESULT", "INVALID_RESULT")
+	// Only one registered player can not be rated
+	SendPacket(clients[0], "GAME_RESULT", "my cool game", 2, "otto", 1, "bert", 2)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "GAME_RESULT", "NOT_RATED")
+
+	SendPacket(clients[2], "CMD", "leaderboard", "")
+	ExpectPacketSkippingUpdates(c, clients[2], "CHAT", "", "Nobody has played a rated game yet.", "system")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// slowUserDb reads the leaderboard only once it is released.
+type slowUserDb struct {
+	*InMemoryUserDb
+	release chan struct{}
+}
+
+func (db slowUserDb) Leaderboard(limit int) ([]PlayerRating, error) {
+	<-db.release
+	return db.InMemoryUserDb.Leaderboard(limit)
+}
+
+func (s *EndToEndSuite) TestSlowUserDbDoesNotStallTheLobby(c *C) {
+	server, clients := SetupServer(c, 2)
+	release := make(chan struct{})
+	server.call(func() {
+		server.user_db = slowUserDb{server.user_db.(*InMemoryUserDb), release}
+	})
+	ExpectLoginWithRatingsWorks(c, clients[0], "bert")
+	ExpectLoginWithRatingsWorks(c, clients[1], "ernie")
+
+	SendPacket(clients[0], "CMD", "leaderboard", "")
+	SendPacket(clients[1], "CHAT", "hello there", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "ernie", "hello there", "public")
+	close(release)
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "ernie", "hello there", "public")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "Nobody has played a rated game yet.", "system")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test Matchmaking {{{
+func (s *EndToEndSuite) TestQuickMatch(c *C) {
+	server, clients := SetupServer(c, 4)
+	ExpectLoginWithRatingsWorks(c, clients[0], "bert")
+	ExpectLoginWithRatingsWorks(c, clients[1], "ernie")
+	ExpectLoginWithRatingsWorks(c, clients[2], "grover")
+	ExpectLoginWithAccessWorks(c, clients[3], "oscar")
+	MarkAnnounced(server, "bert", "ernie", "grover", "oscar")
+
+	SendPacket(clients[0], "MATCH_QUEUE", 1, 0)
+	SendPacket(clients[1], "MATCH_QUEUE", 2, 0)
+	SendPacket(clients[2], "MATCH_QUEUE", 1, 0)
+	ExpectPacketSkippingUpdates(c, clients[0], "MATCH_HOST", "Quick match 1", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	ExpectPacketSkippingUpdates(c, clients[2], "MATCH_JOIN", "Quick match 1", "bert", Matching("[0-9a-f]{32}"),
+		"192.168.0.1", "true", "fe80::1", "0")
+	var restricted, tokens []string
+	server.call(func() {
+		restricted = server.relay.(*FakeRelay).restricted
+		tokens = server.relay.(*FakeRelay).joinTokens
+	})
+	c.Assert(restricted, DeepEquals, []string{"Quick match 1"})
+	c.Assert(tokens, HasLen, 1)
+
+	server.GameConnected("Quick match 1")
+	ConnectOnRelay(server, "Quick match 1")
+	SendPacket(clients[1], "GAMES")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAMES", "1", "Quick match 1", "build-25", "SETUP",
+		"", "2", "2", "false", "1v1 quick match", "", "")
+	// Only the matched players may join
+	SendPacket(clients[3], "GAME_CONNECT", "Quick match 1", "")
+	ExpectPacketSkippingUpdates(c, clients[3], "ERROR", "GAME_CONNECT", "GAME_FULL")
+
+	SendPacket(clients[0], "MATCH_QUEUE", 1, 0)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "MATCH_QUEUE", "IN_GAME")
+	SendPacket(clients[1], "MATCH_LEAVE")
+	SendPacket(clients[1], "MATCH_LEAVE")
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "MATCH_LEAVE", "NOT_QUEUED")
+	SendPacket(clients[1], "MATCH_QUEUE", 0, 0)
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "MATCH_QUEUE", "INVALID_PREFERENCES")
+	SendPacket(clients[3], "MATCH_QUEUE", 1, 0)
+	ExpectPacketSkippingUpdates(c, clients[3], "ERROR", "MATCH_QUEUE", "UNSUPPORTED_PROTOCOL")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestQueuedClientsLeavingAreNotMatched(c *C) {
+	server, clients := SetupServer(c, 2)
+	ExpectLoginWithRatingsWorks(c, clients[0], "bert")
+	ExpectLoginWithRatingsWorks(c, clients[1], "ernie")
+
+	SendPacket(clients[0], "MATCH_QUEUE", 1, 0)
+	SendPacket(clients[0], "DISCONNECT", "NORMAL")
+	ExpectClosed(c, clients[0])
+	SendPacket(clients[1], "MATCH_QUEUE", 1, 0)
+	// Packets are handled in order, so the queue is up to date with the reply
+	SendPacket(clients[1], "CLIENTS")
+	ExpectPacketSkippingUpdates(c, clients[1], "CLIENTS", "1", "ernie", "build-25", "", "UNREGISTERED", "")
+
+	var queued, games int
+	server.call(func() {
+		queued = server.matchQueue.Len()
+		games = server.NrGames()
+	})
+	c.Assert(queued, Equals, 1)
+	c.Assert(games, Equals, 0)
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestFailedQuickMatchesKeepTheQueue(c *C) {
+	server, clients := SetupServer(c, 3)
+	ExpectLoginWithRatingsWorks(c, clients[0], "bert")
+	ExpectLoginWithRatingsWorks(c, clients[1], "ernie")
+	ExpectLoginWithRatingsWorks(c, clients[2], "grover")
+	queued := func() []string {
+		var names []string
+		server.call(func() {
+			for _, r := range server.matchQueue.requests {
+				names = append(names, r.client.Name())
+			}
+		})
+		return names
+	}
+	// Packets of different clients are handled in any order
+	queue := func(client FakeConn, teamSize int) {
+		before := len(queued())
+		SendPacket(client, "MATCH_QUEUE", teamSize, 0)
+		for i := 0; i < 100 && len(queued()) == before; i++ {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	server.call(func() {
+		server.relay.(*FakeRelay).broken = true
+	})
+	queue(clients[0], 1)
+	queue(clients[1], 2)
+	SendPacket(clients[2], "MATCH_QUEUE", 1, 0)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "MATCH_QUEUE", "RELAY_ERROR")
+	c.Assert(queued(), DeepEquals, []string{"bert", "ernie", "grover"})
+
+	// The host is not left alone in the game
+	server.call(func() {
+		server.relay.(*FakeRelay).broken = false
+		server.relay.(*FakeRelay).noJoinTokens = true
+	})
+	SendPacket(clients[1], "MATCH_QUEUE", 1, 0)
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "MATCH_QUEUE", "RELAY_ERROR")
+	c.Assert(queued(), DeepEquals, []string{"bert", "ernie", "grover"})
+	var games int
+	server.call(func() {
+		games = server.NrGames()
+		server.relay.(*FakeRelay).noJoinTokens = false
+	})
+	c.Assert(games, Equals, 0)
+
+	SendPacket(clients[2], "MATCH_QUEUE", 1, 0)
+	ExpectPacketSkippingUpdates(c, clients[0], "MATCH_HOST", "Quick match 3", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	ExpectPacketSkippingUpdates(c, clients[1], "MATCH_JOIN", "Quick match 3", "bert", Matching("[0-9a-f]{32}"),
+		"192.168.0.1", "true", "fe80::1", "0")
+	c.Assert(queued(), DeepEquals, []string{"grover"})
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test Tournaments {{{
+func (s *EndToEndSuite) TestTournament(c *C) {
+	server, clients := SetupServer(c, 3)
+	ExpectLoginAsRegisteredWorks(c, clients[0], "SirVer", "123456", "SUPERUSER")
+	ExpectLoginAsRegisteredWorks(c, clients[1], "otto", "ottoiscool", "REGISTERED")
+	ExpectLoginWithRatingsWorks(c, clients[2], "bert")
+	MarkAnnounced(server, "SirVer", "otto", "bert")
+
+	SendPacket(clients[1], "CMD", "tournament", "create knockout Spring Cup")
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "CMD", "DEFICIENT_PERMISSION")
+	SendPacket(clients[0], "CMD", "tournament", "create swiss Spring Cup")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "CMD", "INVALID_FORMAT")
+	SendPacket(clients[0], "CMD", "tournament", "create knockout Spring Cup")
+	for _, client := range clients {
+		ExpectPacketSkippingUpdates(c, client, "CHAT", "", "The sign-up for the tournament Spring Cup has opened.", "system")
+	}
+
+	SendPacket(clients[0], "CMD", "tournament", "signup Spring Cup")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "You signed up for Spring Cup.", "system")
+	SendPacket(clients[1], "CMD", "tournament", "signup Spring Cup")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "You signed up for Spring Cup.", "system")
+	SendPacket(clients[1], "CMD", "tournament", "signup Spring Cup")
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "CMD", "ALREADY_SIGNED_UP")
+	SendPacket(clients[2], "CMD", "tournament", "signup Spring Cup")
+	ExpectPacketSkippingUpdates(c, clients[2], "ERROR", "CMD", "DEFICIENT_PERMISSION")
+	SendPacket(clients[1], "CMD", "tournament", "signup Autumn Cup")
+	ExpectPacketSkippingUpdates(c, clients[1], "ERROR", "CMD", "NO_SUCH_TOURNAMENT")
+
+	// The game for the match is opened right away since both players are
+	// in the lobby
+	SendPacket(clients[0], "CMD", "tournament", "start Spring Cup")
+	for _, client := range clients {
+		ExpectPacketSkippingUpdates(c, client, "CHAT", "", "The tournament Spring Cup has started.", "system")
+	}
+	ExpectPacketSkippingUpdates(c, clients[0], "MATCH_HOST", "Spring Cup: round 1, match 1", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	ExpectPacketSkippingUpdates(c, clients[1], "MATCH_JOIN", "Spring Cup: round 1, match 1", "SirVer", Matching("[0-9a-f]{32}"),
+		"192.168.0.1", "true", "fe80::1", "0")
+
+	SendPacket(clients[2], "CMD", "tournament", "show Spring Cup")
+	ExpectPacketSkippingUpdates(c, clients[2], "CHAT", "", "Spring Cup (knockout): RUNNING", "system")
+	ExpectPacketSkippingUpdates(c, clients[2], "CHAT", "", "Round 1:", "system")
+	ExpectPacketSkippingUpdates(c, clients[2], "CHAT", "", "SirVer vs otto: not played yet", "system")
+
+	server.GameConnected("Spring Cup: round 1, match 1")
+	ConnectOnRelay(server, "Spring Cup: round 1, match 1")
+	SendPacket(clients[0], "GAME_START")
+	ExpectPacketSkippingUpdates(c, clients[0], "GAME_START")
+	SendPacket(clients[0], "GAME_RESULT", "Spring Cup: round 1, match 1", 2, "SirVer", 2, "otto", 1)
+	SendPacket(clients[1], "GAME_RESULT", "Spring Cup: round 1, match 1", 2, "SirVer", 2, "otto", 1)
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "Your rating changed from 1500 to 1484.", "system")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "Your rating changed from 1500 to 1516.", "system")
+	for _, client := range clients[:2] {
+		ExpectPacketSkippingUpdates(c, client, "CHAT", "", "otto won the match of round 1 of Spring Cup.", "system")
+	}
+	for _, client := range clients {
+		ExpectPacketSkippingUpdates(c, client, "CHAT", "", "otto won the tournament Spring Cup!", "system")
+	}
+
+	SendPacket(clients[2], "CMD", "tournament", "list")
+	ExpectPacketSkippingUpdates(c, clients[2], "CHAT", "", "Spring Cup (knockout): FINISHED, 2 players", "system")
+	SendPacket(clients[0], "CMD", "tournament", "cancel Spring Cup")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "CMD", "ALREADY_FINISHED")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestTournamentGamesAreOpenedAgain(c *C) {
+	server, clients := SetupServer(c, 2)
+	ExpectLoginAsRegisteredWorks(c, clients[0], "SirVer", "123456", "SUPERUSER")
+	ExpectLoginAsRegisteredWorks(c, clients[1], "otto", "ottoiscool", "REGISTERED")
+	MarkAnnounced(server, "SirVer", "otto")
+	SendPacket(clients[0], "CMD", "tournament", "create knockout Spring Cup")
+	for _, client := range clients {
+		ExpectPacketSkippingUpdates(c, client, "CHAT", "", "The sign-up for the tournament Spring Cup has opened.", "system")
+	}
+	for _, client := range clients {
+		SendPacket(client, "CMD", "tournament", "signup Spring Cup")
+		ExpectPacketSkippingUpdates(c, client, "CHAT", "", "You signed up for Spring Cup.", "system")
+	}
+
+	// Relay problems are told in the chat
+	server.call(func() {
+		server.relay.(*FakeRelay).broken = true
+	})
+	SendPacket(clients[0], "CMD", "tournament", "start Spring Cup")
+	for _, client := range clients {
+		ExpectPacketSkippingUpdates(c, client, "CHAT", "", "The tournament Spring Cup has started.", "system")
+	}
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "The relay could not open the game Spring Cup: round 1, match 1.", "system")
+
+	server.call(func() {
+		server.relay.(*FakeRelay).broken = false
+	})
+	SendPacket(clients[0], "GAME_DISCONNECT")
+	ExpectPacketSkippingUpdates(c, clients[0], "MATCH_HOST", "Spring Cup: round 1, match 1", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	ExpectPacketSkippingUpdates(c, clients[1], "MATCH_JOIN", "Spring Cup: round 1, match 1", "SirVer", Matching("[0-9a-f]{32}"),
+		"192.168.0.1", "true", "fe80::1", "0")
+
+	// The game is opened again when the relay closes it before it is played
+	server.GameConnected("Spring Cup: round 1, match 1")
+	server.GameClosed("Spring Cup: round 1, match 1")
+	ExpectPacketSkippingUpdates(c, clients[0], "MATCH_HOST", "Spring Cup: round 1, match 1", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	ExpectPacketSkippingUpdates(c, clients[1], "MATCH_JOIN", "Spring Cup: round 1, match 1", "SirVer", Matching("[0-9a-f]{32}"),
+		"192.168.0.1", "true", "fe80::1", "0")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestTournamentDecidedByAdmin(c *C) {
+	server, clients := SetupServer(c, 1)
+	store := NewInMemoryTournamentStore()
+	t := startedTournament(c, "roundrobin", "bert", "ernie")
+	c.Assert(store.SaveTournament(t), IsNil)
+	server.SetTournamentStore(store)
+	c.Assert(server.LoadTournaments(), IsNil)
+
+	ExpectLoginAsRegisteredWorks(c, clients[0], "SirVer", "123456", "SUPERUSER")
+	MarkAnnounced(server, "SirVer")
+	SendPacket(clients[0], "CMD", "tournament", "show Cup")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "Cup (roundrobin): RUNNING", "system")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "Round 1:", "system")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "bert vs ernie: not played yet", "system")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "bert: 0 wins", "system")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "ernie: 0 wins", "system")
+
+	SendPacket(clients[0], "CMD", "tournament", "decide SirVer Cup")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "CMD", "NO_SUCH_MATCH")
+	SendPacket(clients[0], "CMD", "tournament", "decide ernie Cup")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "ernie won the tournament Cup!", "system")
+
+	// The decision has been saved
+	tournaments, err := store.Tournaments()
+	c.Assert(err, IsNil)
+	c.Assert(tournaments[0].State, Equals, TOURNAMENT_FINISHED)
+	c.Assert(tournaments[0].Winner, Equals, "ernie")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Test Friends {{{
+func ExpectLoginWithFriendsWorks(c *C, f FakeConn, name, password, permissions string) {
+	expectRegisteredLoginWorks(c, f, BUILD26, "build-26", name, password, permissions)
+}
+
+func (s *EndToEndSuite) TestFriends(c *C) {
+	server, clients := SetupServer(c, 3)
+	ExpectLoginWithFriendsWorks(c, clients[0], "otto", "ottoiscool", "REGISTERED")
+	ExpectLoginWithFriendsWorks(c, clients[1], "SirVer", "123456", "SUPERUSER")
+	ExpectLoginWithRatingsWorks(c, clients[2], "bert")
+	MarkAnnounced(server, "otto", "SirVer", "bert")
+
+	SendPacket(clients[2], "CMD", "friend", "request otto")
+	ExpectPacketSkippingUpdates(c, clients[2], "ERROR", "CMD", "DEFICIENT_PERMISSION")
+	SendPacket(clients[0], "CMD", "friend", "request otto")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "CMD", "INVALID_CMD_PARAMETERS")
+	SendPacket(clients[0], "CMD", "friend", "request bert")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "CMD", "NO_SUCH_USER")
+	SendPacket(clients[0], "CMD", "friends", "")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "You have not added any friends yet.", "system")
+
+	SendPacket(clients[0], "CMD", "friend", "request SirVer")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "Asked SirVer to be your friend.", "system")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "otto would like to be your friend.", "system")
+	SendPacket(clients[0], "CMD", "friend", "request SirVer")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "CMD", "ALREADY_REQUESTED")
+	SendPacket(clients[0], "CMD", "friend", "accept SirVer")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "CMD", "NO_SUCH_REQUEST")
+	SendPacket(clients[1], "CMD", "friends", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "Friend requests from: otto", "system")
+	SendPacket(clients[1], "CLIENTS", "friends")
+	ExpectPacketSkippingUpdates(c, clients[1], "CLIENTS", "0")
+	SendPacket(clients[1], "CMD", "friend", "accept otto")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "You and otto are friends now.", "system")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "You and SirVer are friends now.", "system")
+	SendPacket(clients[1], "CLIENTS", "friends")
+	ExpectPacketSkippingUpdates(c, clients[1], "CLIENTS", "1", "otto", "build-26", "", "REGISTERED", "1500")
+
+	SendPacket(clients[0], "CLIENTS", "friends")
+	ExpectPacketSkippingUpdates(c, clients[0], "CLIENTS", "1", "SirVer", "build-26", "", "SUPERUSER", "1500")
+	SendPacket(clients[0], "CLIENTS", "enemies")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "CLIENTS", "INVALID_FILTER")
+	SendPacket(clients[2], "CLIENTS")
+	ExpectPacketSkippingUpdates(c, clients[2], "CLIENTS", "3",
+		"otto", "build-26", "", "REGISTERED", "1500",
+		"SirVer", "build-26", "", "SUPERUSER", "1500",
+		"bert", "build-25", "", "UNREGISTERED", "")
+
+	SendPacket(clients[1], "GAME_OPEN", "friendly game", 4, "Crater", false, "", "Autocrat", "", "", "")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "Your friend SirVer has opened the game friendly game.", "system")
+	// Friends are not told about games they may not join
+	SendPacket(clients[1], "GAME_DISCONNECT")
+	SendPacket(clients[1], "GAME_OPEN", "secret game", 4, "Crater", false, "", "Autocrat", "", "", "bert")
+	ExpectPacketSkippingUpdates(c, clients[1], "GAME_OPEN", Matching(".+"), "192.168.0.1", "true", "fe80::1", "0")
+	SendPacket(clients[0], "CMD", "friends", "")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "SirVer: in the game secret game", "system")
+
+	SendPacket(clients[0], "CMD", "friend", "remove SirVer")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "SirVer is no longer your friend.", "system")
+	SendPacket(clients[0], "CMD", "friend", "remove SirVer")
+	ExpectPacketSkippingUpdates(c, clients[0], "ERROR", "CMD", "NOT_FRIENDS")
+	SendPacket(clients[0], "CLIENTS", "friends")
+	ExpectPacketSkippingUpdates(c, clients[0], "CLIENTS", "0")
+	SendPacket(clients[1], "CLIENTS", "friends")
+	ExpectPacketSkippingUpdates(c, clients[1], "CLIENTS", "0")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+func (s *EndToEndSuite) TestFriendsAreToldAboutLogins(c *C) {
+	server, clients := SetupServer(c, 3)
+	server.call(func() {
+		db := server.UserDb().(*InMemoryUserDb)
+		db.AddUser("bert", "bertiscool", REGISTERED)
+		c.Assert(db.RequestFriend("otto", "SirVer"), IsNil)
+		c.Assert(db.AcceptFriend("SirVer", "otto"), IsNil)
+		c.Assert(db.RequestFriend("bert", "otto"), IsNil)
+	})
+	ExpectLoginWithFriendsWorks(c, clients[0], "SirVer", "123456", "SUPERUSER")
+	ExpectLoginWithFriendsWorks(c, clients[1], "otto", "ottoiscool", "REGISTERED")
+	ExpectPacketSkippingUpdates(c, clients[0], "CHAT", "", "Your friend otto is online.", "system")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "Friend requests from: bert", "system")
+
+	// Requesting the friendship of somebody who asked already accepts it
+	SendPacket(clients[1], "CMD", "friend", "request bert")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "You and bert are friends now.", "system")
+	ExpectLoginWithFriendsWorks(c, clients[2], "bert", "bertiscool", "REGISTERED")
+	ExpectPacketSkippingUpdates(c, clients[1], "CHAT", "", "Your friend bert is online.", "system")
+	// SirVer is not friends with bert, so the next packet is the reply
+	MarkAnnounced(server, "SirVer", "otto", "bert")
+	SendPacket(clients[0], "CLIENTS", "friends")
+	ExpectPacketSkippingUpdates(c, clients[0], "CLIENTS", "1", "otto", "build-26", "", "REGISTERED", "1500")
+
+	ExpectServerToShutdownCleanly(c, server)
+}
+
+// }}}
+// Benchmarks {{{
+const benchmarkClients = 5000
+
+// The CLIENTS reply has to fit into a packet, whose length has two bytes, so
+// fewer clients are in the lobby when listing them.
+const benchmarkListedClients = 1000
+
+type discardConn struct{}
+
+func (discardConn) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+func (discardConn) Close() error                { return nil }
+func (discardConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.168.0.0"), Port: 1234}
+}
+
+func newBenchmarkClient(server *Server) *Client {
+	client := newClient(discardConn{}, server.ClientSendQueueSize())
+	go client.writingLoop(server)
+	return client
+}
+
+// benchmarkSetup starts a server with n logged in clients. The clients do not
+// have a connection, so their handlers have to be called directly on the main
+// loop. The server has to be shut down with benchmarkShutdown.
+func benchmarkSetup(c *C, n int) (*Server, []*Client) {
+	log.SetOutput(ioutil.Discard)
+	server := newServer(make(chan ReadWriteCloserWithIp), NewInMemoryDb(), NewIRCBridgerChannels())
+	server.relay = &FakeRelay{}
+	clients := make([]*Client, n)
+	for i := range clients {
+		client := newBenchmarkClient(server)
+		client.protocolVersion = BUILD20
+		client.userName = fmt.Sprintf("user%d", i)
+		client.nonce = fmt.Sprintf("nonce%d", i)
+		client.buildId = "build-20"
+		client.state = CONNECTED
+		client.wasAnnounced = true
+		// Bypass AddClient, announcing is not of interest here.
+		server.clients.Add(client)
+		clients[i] = client
+	}
+	server.start()
+	c.ResetTimer()
+	return server, clients
+}
+
+// benchmarkShutdown stops the server and the writing loops of its clients.
+func benchmarkShutdown(c *C, server *Server) {
+	c.StopTimer()
+	ExpectServerToShutdownCleanly(c, server)
+	log.SetOutput(os.Stderr)
+}
+
+func benchmarkPacket(data ...interface{}) *packet.Packet {
+	pkg, _ := packet.Read(bytes.NewReader(packet.New(data...)))
+	pkg.ReadString()
+	return pkg
+}
+
+func (s *EndToEndSuite) BenchmarkLogin(c *C) {
+	server, _ := benchmarkSetup(c, benchmarkClients)
+	defer benchmarkShutdown(c, server)
+	for i := 0; i < c.N; i++ {
+		server.call(func() {
+			client := newBenchmarkClient(server)
+			client.Handle_LOGIN(server, benchmarkPacket("LOGIN", BUILD20, fmt.Sprintf("new%d", i), "build-20", false, "newnonce"))
+			server.RemoveClient(client, "LEFT")
+			client.Disconnect(server)
+		})
+	}
+}
+
+func (s *EndToEndSuite) BenchmarkPublicChat(c *C) {
+	server, clients := benchmarkSetup(c, benchmarkClients)
+	defer benchmarkShutdown(c, server)
+	for i := 0; i < c.N; i++ {
+		server.call(func() {
+			clients[i%len(clients)].Handle_CHAT(server, benchmarkPacket("CHAT", "hello there", ""))
+		})
+	}
+}
+
+func (s *EndToEndSuite) BenchmarkPrivateChat(c *C) {
+	server, clients := benchmarkSetup(c, benchmarkClients)
+	defer benchmarkShutdown(c, server)
+	for i := 0; i < c.N; i++ {
+		server.call(func() {
+			receiver := clients[(i+1)%len(clients)].Name()
+			clients[i%len(clients)].Handle_CHAT(server, benchmarkPacket("CHAT", "hello there", receiver))
+		})
+	}
+}
+
+func (s *EndToEndSuite) BenchmarkClients(c *C) {
+	server, clients := benchmarkSetup(c, benchmarkListedClients)
+	defer benchmarkShutdown(c, server)
+	for i := 0; i < c.N; i++ {
+		server.call(func() {
+			clients[i%len(clients)].Handle_CLIENTS(server, benchmarkPacket("CLIENTS"))
+		})
 	}
-	ircbridge.Quit()
 }
 
 // }}}
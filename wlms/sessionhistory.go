@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"sort"
+	"time"
+)
+
+// SessionRecord describes the time a user spent in the lobby, from the login
+// until the client has been removed from the server. Times have a resolution
+// of seconds.
+type SessionRecord struct {
+	Name            string
+	Registered      bool
+	BuildId         string
+	ProtocolVersion int
+	// Keyed hash of the IP address, see hashIp
+	IPHash  string
+	Started time.Time
+	// Zero while the session is still open
+	Ended time.Time
+	// Why the client has been removed, see the arguments of
+	// Server.RemoveClient
+	DisconnectReason string
+}
+
+// Duration returns how long the user has been in the lobby or zero if the
+// session is still open.
+func (r SessionRecord) Duration() time.Duration {
+	if r.Ended.IsZero() {
+		return 0
+	}
+	return r.Ended.Sub(r.Started)
+}
+
+// SessionStatistics summarizes the sessions that were open during some time.
+type SessionStatistics struct {
+	NrSessions int
+	// Number of different user names
+	UniqueUsers int
+	// Number of different IP addresses
+	UniqueAddresses int
+	// The most sessions that were open at the same time and when that was
+	// reached first
+	PeakConcurrency int
+	PeakTime        time.Time
+}
+
+// SessionHistory stores the sessions of the users. It is only used on the
+// main loop of the server.
+type SessionHistory interface {
+	// Returns the id to end the session with
+	StartSession(record SessionRecord) (int64, error)
+	EndSession(id int64, ended time.Time, reason string) error
+	// The latest session of the user. The bool is false if there is none.
+	LastSession(name string) (SessionRecord, bool, error)
+	// About the sessions open at some time from from until before to.
+	// Sessions that are still open count until to.
+	Statistics(from, to time.Time) (SessionStatistics, error)
+	Close()
+}
+
+// hashIp hides the IP address of a client. Addresses can only be compared
+// with each other as long as the key stays the same.
+func hashIp(key []byte, ip string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// randomIPHashKey creates a key for hashIp. The hashes of the same address
+// differ between keys.
+func randomIPHashKey() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Unable to create the key for hashing IP addresses: %v", err)
+	}
+	return b
+}
+
+// sessionStatistics computes the statistics from the sessions open during the
+// time. The sessions may be in any order.
+func sessionStatistics(sessions []SessionRecord, from, to time.Time) SessionStatistics {
+	stats := SessionStatistics{NrSessions: len(sessions), PeakTime: from}
+	users := make(map[string]bool)
+	addresses := make(map[string]bool)
+	type change struct {
+		when  int64
+		delta int
+	}
+	var changes []change
+	for _, session := range sessions {
+		users[session.Name] = true
+		addresses[session.IPHash] = true
+		started := session.Started.Unix()
+		if started < from.Unix() {
+			started = from.Unix()
+		}
+		changes = append(changes, change{started, 1})
+		if !session.Ended.IsZero() && session.Ended.Before(to) {
+			changes = append(changes, change{session.Ended.Unix(), -1})
+		}
+	}
+	stats.UniqueUsers = len(users)
+	stats.UniqueAddresses = len(addresses)
+	// A client that reconnects in the same second is not counted twice
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].when != changes[j].when {
+			return changes[i].when < changes[j].when
+		}
+		return changes[i].delta < changes[j].delta
+	})
+	open := 0
+	for _, c := range changes {
+		open += c.delta
+		if open > stats.PeakConcurrency {
+			stats.PeakConcurrency = open
+			stats.PeakTime = time.Unix(c.when, 0)
+		}
+	}
+	return stats
+}
+
+type InMemorySessionHistory struct {
+	sessions []SessionRecord
+	// Most sessions kept, see kInMemoryHistorySize
+	size int
+	// Number of sessions that have been forgotten
+	dropped int64
+}
+
+func NewInMemorySessionHistory() *InMemorySessionHistory {
+	return &InMemorySessionHistory{size: kInMemoryHistorySize}
+}
+
+func (h *InMemorySessionHistory) StartSession(record SessionRecord) (int64, error) {
+	record.Started = fromUnix(toUnix(record.Started))
+	record.Ended = time.Time{}
+	record.DisconnectReason = ""
+	h.sessions = append(h.sessions, record)
+	id := h.dropped + int64(len(h.sessions))
+	if len(h.sessions) > h.size {
+		n := len(h.sessions) - h.size
+		h.sessions = h.sessions[n:]
+		h.dropped += int64(n)
+	}
+	return id, nil
+}
+
+func (h *InMemorySessionHistory) EndSession(id int64, ended time.Time, reason string) error {
+	if id <= h.dropped {
+		// The session has already been forgotten
+		return nil
+	}
+	session := &h.sessions[id-h.dropped-1]
+	session.Ended = fromUnix(toUnix(ended))
+	session.DisconnectReason = reason
+	return nil
+}
+
+func (h *InMemorySessionHistory) LastSession(name string) (SessionRecord, bool, error) {
+	var last SessionRecord
+	found := false
+	for _, session := range h.sessions {
+		if session.Name == name && (!found || !session.Started.Before(last.Started)) {
+			last = session
+			found = true
+		}
+	}
+	return last, found, nil
+}
+
+func (h *InMemorySessionHistory) Statistics(from, to time.Time) (SessionStatistics, error) {
+	var sessions []SessionRecord
+	for _, session := range h.sessions {
+		if session.Started.Before(to) && (session.Ended.IsZero() || !session.Ended.Before(from)) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessionStatistics(sessions, from, to), nil
+}
+
+func (h *InMemorySessionHistory) Close() {
+}
+
+// SqlSessionHistory keeps the sessions in the table wlms_sessions, which is
+// created if it does not exist. Sessions that are still open when the history
+// is opened have been cut short by the server stopping unexpectedly. They are
+// ended at their start with the reason "UNKNOWN".
+type SqlSessionHistory struct {
+	db *sql.DB
+}
+
+var sqliteSessionSchema = []string{
+	`CREATE TABLE IF NOT EXISTS wlms_sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name VARCHAR(255) NOT NULL,
+		registered BOOLEAN NOT NULL,
+		build_id VARCHAR(255) NOT NULL,
+		protocol_version INTEGER NOT NULL,
+		ip_hash VARCHAR(64) NOT NULL,
+		started BIGINT NOT NULL,
+		ended BIGINT NOT NULL,
+		disconnect_reason VARCHAR(64) NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS wlms_sessions_name ON wlms_sessions (name)`,
+	`CREATE INDEX IF NOT EXISTS wlms_sessions_started ON wlms_sessions (started)`,
+}
+
+var mySqlSessionSchema = []string{
+	`CREATE TABLE IF NOT EXISTS wlms_sessions (
+		id INTEGER PRIMARY KEY AUTO_INCREMENT,
+		name VARCHAR(255) NOT NULL,
+		registered BOOLEAN NOT NULL,
+		build_id VARCHAR(255) NOT NULL,
+		protocol_version INTEGER NOT NULL,
+		ip_hash VARCHAR(64) NOT NULL,
+		started BIGINT NOT NULL,
+		ended BIGINT NOT NULL,
+		disconnect_reason VARCHAR(64) NOT NULL,
+		INDEX (name),
+		INDEX (started))`,
+}
+
+func newSqlSessionHistory(db *sql.DB) (*SqlSessionHistory, error) {
+	if _, err := db.Exec("update wlms_sessions set ended = started, disconnect_reason = 'UNKNOWN' where ended = 0"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SqlSessionHistory{db}, nil
+}
+
+// NewSqliteSessionHistory opens the database file, creating it if necessary.
+func NewSqliteSessionHistory(file string) (*SqlSessionHistory, error) {
+	db, err := openHistoryDb("sqlite3", sqliteSource(file), sqliteSessionSchema)
+	if err != nil {
+		return nil, err
+	}
+	return newSqlSessionHistory(db)
+}
+
+// NewMySqlSessionHistory connects to the database like NewMySqlDatabase.
+func NewMySqlSessionHistory(database, user, password, table string) (*SqlSessionHistory, error) {
+	db, err := openHistoryDb(mySqlDriver, mySqlSource(database, user, password, table), mySqlSessionSchema)
+	if err != nil {
+		return nil, err
+	}
+	return newSqlSessionHistory(db)
+}
+
+func (h *SqlSessionHistory) StartSession(record SessionRecord) (int64, error) {
+	result, err := h.db.Exec("insert into wlms_sessions (name, registered, build_id, protocol_version, ip_hash, started, ended, disconnect_reason) values (?, ?, ?, ?, ?, ?, 0, '')",
+		record.Name, record.Registered, record.BuildId, record.ProtocolVersion, record.IPHash, toUnix(record.Started))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (h *SqlSessionHistory) EndSession(id int64, ended time.Time, reason string) error {
+	_, err := h.db.Exec("update wlms_sessions set ended = ?, disconnect_reason = ? where id = ?", toUnix(ended), reason, id)
+	return err
+}
+
+const sessionColumns = "name, registered, build_id, protocol_version, ip_hash, started, ended, disconnect_reason"
+
+func scanSession(rows interface{ Scan(...interface{}) error }) (SessionRecord, error) {
+	var s SessionRecord
+	var started, ended int64
+	err := rows.Scan(&s.Name, &s.Registered, &s.BuildId, &s.ProtocolVersion, &s.IPHash, &started, &ended, &s.DisconnectReason)
+	s.Started, s.Ended = fromUnix(started), fromUnix(ended)
+	return s, err
+}
+
+func (h *SqlSessionHistory) LastSession(name string) (SessionRecord, bool, error) {
+	s, err := scanSession(h.db.QueryRow("select "+sessionColumns+" from wlms_sessions where name = ? "+
+		"order by started desc, id desc limit 1", name))
+	if err == sql.ErrNoRows {
+		return s, false, nil
+	}
+	return s, err == nil, err
+}
+
+func (h *SqlSessionHistory) Statistics(from, to time.Time) (SessionStatistics, error) {
+	rows, err := h.db.Query("select "+sessionColumns+" from wlms_sessions "+
+		"where started < ? and (ended = 0 or ended >= ?)", to.Unix(), from.Unix())
+	if err != nil {
+		return SessionStatistics{}, err
+	}
+	defer rows.Close()
+	var sessions []SessionRecord
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return SessionStatistics{}, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return SessionStatistics{}, err
+	}
+	return sessionStatistics(sessions, from, to), nil
+}
+
+func (h *SqlSessionHistory) Close() {
+	if h.db != nil {
+		h.db.Close()
+		h.db = nil
+	}
+}
+
+// startSession adds the session of the client that has just logged in to the
+// history.
+func (s *Server) startSession(client *Client) {
+	record := SessionRecord{
+		Name:            client.Name(),
+		Registered:      client.Permissions() != UNREGISTERED,
+		BuildId:         client.buildId,
+		ProtocolVersion: client.protocolVersion,
+		IPHash:          hashIp(s.IPHashKey(), client.remoteIp()),
+		Started:         time.Now(),
+	}
+	id, err := s.SessionHistory().StartSession(record)
+	if err != nil {
+		log.Printf("Unable to add the session of %v to the history: %v", client.Name(), err)
+		return
+	}
+	client.session = id
+}
+
+// endSession ends the session of the client in the history. Clients that lost
+// their connection have left when that happened.
+func (s *Server) endSession(client *Client, reason string) {
+	if client.session == 0 {
+		return
+	}
+	ended := time.Now()
+	if client.State() == RECENTLY_DISCONNECTED && !client.disconnected.IsZero() {
+		ended = client.disconnected
+	}
+	if err := s.SessionHistory().EndSession(client.session, ended, reason); err != nil {
+		log.Printf("Unable to end the session of %v in the history: %v", client.Name(), err)
+	}
+	client.session = 0
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+	"path/filepath"
+	"time"
+)
+
+type SessionHistorySuite struct{}
+
+var _ = Suite(&SessionHistorySuite{})
+
+func session(name, ipHash string, started time.Time) SessionRecord {
+	return SessionRecord{Name: name, BuildId: "build-24", ProtocolVersion: BUILD24, IPHash: ipHash, Started: started}
+}
+
+// checkSessionHistory fills the history and checks its queries. All backends
+// have to behave the same.
+func checkSessionHistory(c *C, h SessionHistory) {
+	defer h.Close()
+	bert, err := h.StartSession(session("bert", "a", historyTime(0, 0)))
+	c.Assert(err, IsNil)
+	record := session("ernie", "b", historyTime(0, 1))
+	record.Registered = true
+	ernie, err := h.StartSession(record)
+	c.Assert(err, IsNil)
+	c.Assert(h.EndSession(bert, historyTime(0, 2), "LEFT"), IsNil)
+	c.Assert(h.EndSession(ernie, historyTime(0, 3), "KICKED"), IsNil)
+	bert, err = h.StartSession(session("bert", "a", historyTime(0, 3)))
+	c.Assert(err, IsNil)
+	_, err = h.StartSession(session("oscar", "a", historyTime(1, 0)))
+	c.Assert(err, IsNil)
+	c.Assert(h.EndSession(bert, historyTime(2, 0), "CONNECTION_LOST"), IsNil)
+
+	last, found, err := h.LastSession("ernie")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(last.Registered, Equals, true)
+	c.Assert(last.BuildId, Equals, "build-24")
+	c.Assert(last.ProtocolVersion, Equals, BUILD24)
+	c.Assert(last.IPHash, Equals, "b")
+	c.Assert(last.Started.Equal(historyTime(0, 1)), Equals, true)
+	c.Assert(last.Duration(), Equals, 2*time.Hour)
+	c.Assert(last.DisconnectReason, Equals, "KICKED")
+
+	last, found, err = h.LastSession("bert")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(last.Started.Equal(historyTime(0, 3)), Equals, true)
+	c.Assert(last.Ended.Equal(historyTime(2, 0)), Equals, true)
+	c.Assert(last.DisconnectReason, Equals, "CONNECTION_LOST")
+
+	last, found, err = h.LastSession("oscar")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(last.Ended.IsZero(), Equals, true)
+	c.Assert(last.Duration(), Equals, time.Duration(0))
+
+	_, found, err = h.LastSession("grover")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+
+	stats, err := h.Statistics(historyTime(-1, 0), historyTime(3, 0))
+	c.Assert(err, IsNil)
+	c.Assert(stats.NrSessions, Equals, 4)
+	c.Assert(stats.UniqueUsers, Equals, 3)
+	c.Assert(stats.UniqueAddresses, Equals, 2)
+	c.Assert(stats.PeakConcurrency, Equals, 2)
+	c.Assert(stats.PeakTime.Equal(historyTime(0, 1)), Equals, true)
+
+	// ernie left when bert came back, so they do not count as two users
+	// online at the same time
+	stats, err = h.Statistics(historyTime(0, 3), historyTime(3, 0))
+	c.Assert(err, IsNil)
+	c.Assert(stats.NrSessions, Equals, 3)
+	c.Assert(stats.UniqueUsers, Equals, 3)
+	c.Assert(stats.PeakConcurrency, Equals, 2)
+	c.Assert(stats.PeakTime.Equal(historyTime(1, 0)), Equals, true)
+
+	stats, err = h.Statistics(historyTime(-2, 0), historyTime(-1, 0))
+	c.Assert(err, IsNil)
+	c.Assert(stats.NrSessions, Equals, 0)
+	c.Assert(stats.PeakConcurrency, Equals, 0)
+}
+
+var sessionHistoryTest = backendTest{
+	newInMemory: func() backend {
+		return NewInMemorySessionHistory()
+	},
+	openSqlite: func(file string) (backend, error) {
+		h, err := NewSqliteSessionHistory(file)
+		return h, err
+	},
+	openMySql: func() (backend, error) {
+		h, err := NewMySqlSessionHistory("wlms", "wlms", "secret", "users")
+		return h, err
+	},
+	check: func(c *C, b backend) {
+		checkSessionHistory(c, b.(SessionHistory))
+	},
+	reopened: func(c *C, b backend) {
+		// The session of oscar has been cut short by the server stopping
+		last, found, err := b.(SessionHistory).LastSession("oscar")
+		c.Assert(err, IsNil)
+		c.Assert(found, Equals, true)
+		c.Assert(last.Ended.Equal(historyTime(1, 0)), Equals, true)
+		c.Assert(last.DisconnectReason, Equals, "UNKNOWN")
+	},
+	use: func(c *C, b backend) {
+		h := b.(SessionHistory)
+		id, err := h.StartSession(session("bert", "a", historyTime(0, 0)))
+		c.Assert(err, IsNil)
+		c.Assert(h.EndSession(id, historyTime(0, 1), "LEFT"), IsNil)
+		_, _, err = h.LastSession("bert")
+		c.Assert(err, IsNil)
+		_, err = h.Statistics(historyTime(-1, 0), historyTime(1, 0))
+		c.Assert(err, IsNil)
+	},
+}
+
+func (s *SessionHistorySuite) TestInMemory(c *C) {
+	sessionHistoryTest.checkInMemory(c)
+}
+
+func (s *SessionHistorySuite) TestSqlite(c *C) {
+	sessionHistoryTest.checkSqlite(c)
+}
+
+func (s *SessionHistorySuite) TestMySqlStatements(c *C) {
+	sessionHistoryTest.checkMySql(c)
+}
+
+func (s *SessionHistorySuite) TestInMemoryForgetsOldSessions(c *C) {
+	h := NewInMemorySessionHistory()
+	h.size = 2
+	bert, err := h.StartSession(session("bert", "a", historyTime(0, 0)))
+	c.Assert(err, IsNil)
+	ernie, err := h.StartSession(session("ernie", "a", historyTime(0, 1)))
+	c.Assert(err, IsNil)
+	oscar, err := h.StartSession(session("oscar", "a", historyTime(0, 2)))
+	c.Assert(err, IsNil)
+
+	// Ending a forgotten session is fine
+	c.Assert(h.EndSession(bert, historyTime(0, 3), "CLIENT_LEFT"), IsNil)
+	c.Assert(h.EndSession(ernie, historyTime(0, 3), "CLIENT_LEFT"), IsNil)
+	_, found, err := h.LastSession("bert")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+	last, found, err := h.LastSession("ernie")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(last.DisconnectReason, Equals, "CLIENT_LEFT")
+	last, found, err = h.LastSession("oscar")
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(last.Ended.IsZero(), Equals, true)
+	c.Assert(oscar, Equals, int64(3))
+}
+
+func (s *SessionHistorySuite) TestSharedFile(c *C) {
+	skipWithoutSqlite(c)
+	file := filepath.Join(c.MkDir(), "history.db")
+	games, err := NewSqliteGameHistory(file)
+	c.Assert(err, IsNil)
+	defer games.Close()
+	sessions, err := NewSqliteSessionHistory(file)
+	c.Assert(err, IsNil)
+	defer sessions.Close()
+
+	c.Assert(games.AddGame(GameRecord{Name: "first", Host: "bert", Opened: historyTime(0, 0), Ended: historyTime(0, 1)}), IsNil)
+	_, err = sessions.StartSession(session("bert", "a", historyTime(0, 0)))
+	c.Assert(err, IsNil)
+	stats, err := games.Statistics(historyTime(-1, 0), historyTime(1, 0))
+	c.Assert(err, IsNil)
+	c.Assert(stats.NrGames, Equals, 1)
+}
+
+func (s *SessionHistorySuite) TestHashIp(c *C) {
+	key := []byte("secret")
+	c.Assert(hashIp(key, "192.168.0.1"), HasLen, 64)
+	c.Assert(hashIp(key, "192.168.0.1"), Equals, hashIp(key, "192.168.0.1"))
+	c.Assert(hashIp(key, "192.168.0.1"), Not(Equals), hashIp(key, "192.168.0.2"))
+	c.Assert(hashIp(key, "192.168.0.1"), Not(Equals), hashIp([]byte("other"), "192.168.0.1"))
+}
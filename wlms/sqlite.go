@@ -0,0 +1,9 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// The SQLite driver needs cgo, so it is only built with "-tags sqlite".
+import _ "github.com/mattn/go-sqlite3"
+
+const sqliteSupported = true
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// The states of a tournament
+const (
+	TOURNAMENT_SIGNUP   = "SIGNUP"
+	TOURNAMENT_RUNNING  = "RUNNING"
+	TOURNAMENT_FINISHED = "FINISHED"
+	TOURNAMENT_CANCELED = "CANCELED"
+)
+
+// Tournament is a competition between registered players. In a "knockout"
+// tournament the winners of neighbouring matches meet in the next round
+// until one is left. In a "roundrobin" tournament everybody plays against
+// everybody else once and whoever wins most matches wins.
+type Tournament struct {
+	Name   string
+	Format string
+	State  string
+	// The players in the order they signed up. They are ordered by their
+	// ratings once the tournament starts.
+	Players []string
+	// The current round, starting at 1. 0 during the sign-up.
+	Round   int
+	Matches []*TournamentMatch
+	Winner  string
+}
+
+// TournamentMatch is a match of two players in a round of a tournament.
+type TournamentMatch struct {
+	Round   int
+	Players [2]string
+	// Empty as long as the match has not been decided
+	Winner string
+	// The game opened on the relay for the match. Empty if there is none.
+	Game string `json:"-"`
+}
+
+func NewTournament(name, format string) (*Tournament, error) {
+	if format != "knockout" && format != "roundrobin" {
+		return nil, errors.New("INVALID_FORMAT")
+	}
+	return &Tournament{Name: name, Format: format, State: TOURNAMENT_SIGNUP}, nil
+}
+
+func (t *Tournament) isPlayer(name string) bool {
+	for _, player := range t.Players {
+		if player == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tournament) SignUp(name string) error {
+	if t.State != TOURNAMENT_SIGNUP {
+		return errors.New("SIGNUP_CLOSED")
+	}
+	if t.isPlayer(name) {
+		return errors.New("ALREADY_SIGNED_UP")
+	}
+	t.Players = append(t.Players, name)
+	return nil
+}
+
+func (t *Tournament) Withdraw(name string) error {
+	if t.State != TOURNAMENT_SIGNUP {
+		return errors.New("SIGNUP_CLOSED")
+	}
+	for i, player := range t.Players {
+		if player == name {
+			t.Players = append(t.Players[:i], t.Players[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("NOT_SIGNED_UP")
+}
+
+// Start closes the sign-up and schedules the first round. The players are
+// seeded by their ratings.
+func (t *Tournament) Start(ratings map[string]int) error {
+	if t.State != TOURNAMENT_SIGNUP {
+		return errors.New("ALREADY_STARTED")
+	}
+	if len(t.Players) < 2 {
+		return errors.New("NOT_ENOUGH_PLAYERS")
+	}
+	sort.SliceStable(t.Players, func(i, j int) bool { return ratings[t.Players[i]] > ratings[t.Players[j]] })
+	t.State = TOURNAMENT_RUNNING
+	t.Round = 1
+	if t.Format == "knockout" {
+		t.scheduleFirstKnockoutRound()
+	} else {
+		t.scheduleRoundRobin()
+	}
+	return nil
+}
+
+// scheduleFirstKnockoutRound pairs the best seeds with the worst ones. If the
+// number of players is not a power of two, the best seeds advance without a
+// match.
+func (t *Tournament) scheduleFirstKnockoutRound() {
+	size := 1
+	for size < len(t.Players) {
+		size *= 2
+	}
+	for i := 0; i < size/2; i++ {
+		match := &TournamentMatch{Round: 1, Players: [2]string{t.Players[i], ""}}
+		if opponent := size - 1 - i; opponent < len(t.Players) {
+			match.Players[1] = t.Players[opponent]
+		} else {
+			match.Winner = t.Players[i]
+		}
+		t.Matches = append(t.Matches, match)
+	}
+}
+
+// scheduleRoundRobin schedules all rounds with the circle method. With an odd
+// number of players, somebody sits out each round.
+func (t *Tournament) scheduleRoundRobin() {
+	players := append([]string(nil), t.Players...)
+	if len(players)%2 == 1 {
+		players = append(players, "")
+	}
+	n := len(players)
+	for round := 1; round < n; round++ {
+		for i := 0; i < n/2; i++ {
+			if players[i] != "" && players[n-1-i] != "" {
+				t.Matches = append(t.Matches, &TournamentMatch{Round: round, Players: [2]string{players[i], players[n-1-i]}})
+			}
+		}
+		// Everybody but the first player moves on by one
+		players = append([]string{players[0], players[n-1]}, players[1:n-1]...)
+	}
+}
+
+// CurrentMatches returns the matches of the current round.
+func (t *Tournament) CurrentMatches() []*TournamentMatch {
+	var matches []*TournamentMatch
+	for _, match := range t.Matches {
+		if match.Round == t.Round {
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+// OpenMatchOf returns the undecided match of the player in the current
+// round or nil if there is none.
+func (t *Tournament) OpenMatchOf(player string) *TournamentMatch {
+	if t.State != TOURNAMENT_RUNNING {
+		return nil
+	}
+	for _, match := range t.CurrentMatches() {
+		if match.Winner == "" && (match.Players[0] == player || match.Players[1] == player) {
+			return match
+		}
+	}
+	return nil
+}
+
+// Decide sets the winner of the match and moves on to the next round once
+// all matches of the current one have been decided.
+func (t *Tournament) Decide(match *TournamentMatch, winner string) error {
+	if match.Winner != "" {
+		return errors.New("ALREADY_DECIDED")
+	}
+	if winner != match.Players[0] && winner != match.Players[1] {
+		return errors.New("NOT_IN_MATCH")
+	}
+	match.Winner = winner
+	match.Game = ""
+	for _, m := range t.CurrentMatches() {
+		if m.Winner == "" {
+			return nil
+		}
+	}
+	t.advance()
+	return nil
+}
+
+func (t *Tournament) advance() {
+	current := t.CurrentMatches()
+	if t.Format == "knockout" {
+		if len(current) == 1 {
+			t.finish(current[0].Winner)
+			return
+		}
+		t.Round++
+		for i := 0; i < len(current); i += 2 {
+			t.Matches = append(t.Matches, &TournamentMatch{Round: t.Round, Players: [2]string{current[i].Winner, current[i+1].Winner}})
+		}
+		return
+	}
+	if t.Matches[len(t.Matches)-1].Round > t.Round {
+		t.Round++
+		return
+	}
+	// The better seed wins if players have won the same number of matches
+	wins := t.Wins()
+	winner := t.Players[0]
+	for _, player := range t.Players {
+		if wins[player] > wins[winner] {
+			winner = player
+		}
+	}
+	t.finish(winner)
+}
+
+func (t *Tournament) finish(winner string) {
+	t.State = TOURNAMENT_FINISHED
+	t.Winner = winner
+}
+
+// Wins returns the number of matches each player has won.
+func (t *Tournament) Wins() map[string]int {
+	wins := make(map[string]int)
+	for _, match := range t.Matches {
+		if match.Winner != "" && match.Players[1] != "" {
+			wins[match.Winner]++
+		}
+	}
+	return wins
+}
+
+func (t *Tournament) Cancel() error {
+	if t.State == TOURNAMENT_FINISHED || t.State == TOURNAMENT_CANCELED {
+		return errors.New("ALREADY_FINISHED")
+	}
+	t.State = TOURNAMENT_CANCELED
+	return nil
+}
+
+// TournamentStore keeps the tournaments across restarts. It is only used on
+// the main loop of the server.
+type TournamentStore interface {
+	Tournaments() ([]*Tournament, error)
+	// Adds the tournament or replaces the one with the same name
+	SaveTournament(t *Tournament) error
+	Close()
+}
+
+// InMemoryTournamentStore keeps copies of the tournaments, so they do not
+// change unless they are saved.
+type InMemoryTournamentStore struct {
+	names       []string
+	tournaments map[string][]byte
+}
+
+func NewInMemoryTournamentStore() *InMemoryTournamentStore {
+	return &InMemoryTournamentStore{tournaments: make(map[string][]byte)}
+}
+
+func (st *InMemoryTournamentStore) Tournaments() ([]*Tournament, error) {
+	var tournaments []*Tournament
+	for _, name := range st.names {
+		var t Tournament
+		if err := json.Unmarshal(st.tournaments[name], &t); err != nil {
+			return nil, err
+		}
+		tournaments = append(tournaments, &t)
+	}
+	return tournaments, nil
+}
+
+func (st *InMemoryTournamentStore) SaveTournament(t *Tournament) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if _, ok := st.tournaments[t.Name]; !ok {
+		st.names = append(st.names, t.Name)
+	}
+	st.tournaments[t.Name] = data
+	return nil
+}
+
+func (st *InMemoryTournamentStore) Close() {
+}
+
+// SqlTournamentStore keeps the tournaments as JSON in the table
+// wlms_tournaments, which is created if it does not exist.
+type SqlTournamentStore struct {
+	db *sql.DB
+}
+
+var tournamentSchema = []string{
+	`CREATE TABLE IF NOT EXISTS wlms_tournaments (
+		name VARCHAR(255) PRIMARY KEY,
+		data TEXT NOT NULL)`,
+}
+
+// NewSqliteTournamentStore opens the database file, creating it if necessary.
+func NewSqliteTournamentStore(file string) (*SqlTournamentStore, error) {
+	db, err := openHistoryDb("sqlite3", sqliteSource(file), tournamentSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &SqlTournamentStore{db}, nil
+}
+
+// NewMySqlTournamentStore connects to the database like NewMySqlDatabase.
+func NewMySqlTournamentStore(database, user, password, table string) (*SqlTournamentStore, error) {
+	db, err := openHistoryDb(mySqlDriver, mySqlSource(database, user, password, table), tournamentSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &SqlTournamentStore{db}, nil
+}
+
+func (st *SqlTournamentStore) Tournaments() ([]*Tournament, error) {
+	rows, err := st.db.Query("select data from wlms_tournaments order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tournaments []*Tournament
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var t Tournament
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			return nil, err
+		}
+		tournaments = append(tournaments, &t)
+	}
+	return tournaments, rows.Err()
+}
+
+func (st *SqlTournamentStore) SaveTournament(t *Tournament) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = st.db.Exec("replace into wlms_tournaments (name, data) values (?, ?)", t.Name, string(data))
+	return err
+}
+
+func (st *SqlTournamentStore) Close() {
+	if st.db != nil {
+		st.db.Close()
+		st.db = nil
+	}
+}
+
+// LoadTournaments replaces the tournaments of the server with those of the
+// store.
+func (s *Server) LoadTournaments() error {
+	var err error
+	s.call(func() {
+		var tournaments []*Tournament
+		if tournaments, err = s.TournamentStore().Tournaments(); err != nil {
+			return
+		}
+		s.tournaments = make(map[string]*Tournament)
+		for _, t := range tournaments {
+			s.tournaments[t.Name] = t
+		}
+		s.scheduleTournamentGames()
+	})
+	return err
+}
+
+func (s *Server) saveTournament(t *Tournament) {
+	if err := s.TournamentStore().SaveTournament(t); err != nil {
+		log.Printf("Unable to save tournament '%v': %v", t.Name, err)
+	}
+}
+
+// scheduleTournamentGames opens games for the undecided matches of the
+// current rounds whose players are both in the lobby and not in a game.
+func (s *Server) scheduleTournamentGames() {
+	for _, t := range s.tournaments {
+		if t.State != TOURNAMENT_RUNNING {
+			continue
+		}
+		for i, match := range t.CurrentMatches() {
+			if match.Winner != "" || (match.Game != "" && s.HasGame(match.Game) != nil) {
+				continue
+			}
+			if s.finishedGames[match.Game] != nil {
+				// Its players might still report the result of the last game
+				continue
+			}
+			var players []*Client
+			for _, name := range match.Players {
+				client := s.HasClient(name)
+				if client == nil || client.State() != CONNECTED || client.Game() != nil || client.protocolVersion < BUILD25 {
+					break
+				}
+				players = append(players, client)
+			}
+			if len(players) != 2 {
+				continue
+			}
+			gameName := fmt.Sprintf("%s: round %d, match %d", t.Name, t.Round, i+1)
+			if s.HasGame(gameName) != nil {
+				continue
+			}
+			log.Printf("Opening game '%v' for tournament '%v'", gameName, t.Name)
+			if s.openMatchGame(gameName, players, "Tournament "+t.Name, "") != nil {
+				match.Game = gameName
+			}
+		}
+	}
+}
+
+// tournamentGameRated decides the tournament match that has been played in
+// the game, if any.
+func (s *Server) tournamentGameRated(game *Game, result GameResult) {
+	for _, t := range s.tournaments {
+		if t.State != TOURNAMENT_RUNNING {
+			continue
+		}
+		for _, match := range t.CurrentMatches() {
+			if match.Winner == "" && match.Game == game.Name() {
+				winner := match.Players[0]
+				if result[match.Players[1]] < result[match.Players[0]] {
+					winner = match.Players[1]
+				}
+				s.decideTournamentMatch(t, match, winner)
+				return
+			}
+		}
+	}
+}
+
+// decideTournamentMatch sets the winner of the match, saves the tournament
+// and tells everybody involved.
+func (s *Server) decideTournamentMatch(t *Tournament, match *TournamentMatch, winner string) error {
+	round := t.Round
+	if err := t.Decide(match, winner); err != nil {
+		return err
+	}
+	s.saveTournament(t)
+	for _, name := range match.Players {
+		if client := s.HasClient(name); client != nil {
+			client.SendPacket("CHAT", "", fmt.Sprintf("%s won the match of round %d of %s.", winner, round, t.Name), "system")
+		}
+	}
+	if t.State == TOURNAMENT_FINISHED {
+		s.BroadcastToConnectedClients("CHAT", "", fmt.Sprintf("%s won the tournament %s!", t.Winner, t.Name), "system")
+	} else if t.Round != round {
+		for _, name := range t.Players {
+			if client := s.HasClient(name); client != nil {
+				client.SendPacket("CHAT", "", fmt.Sprintf("Round %d of %s has started.", t.Round, t.Name), "system")
+			}
+		}
+		s.scheduleTournamentGames()
+	}
+	return nil
+}
+
+// tournamentCmd handles "CMD tournament <action> <arguments>". Everybody may
+// list and show tournaments, registered users may sign up and withdraw and
+// admins manage the tournaments.
+func (client *Client) tournamentCmd(server *Server, params string) CmdError {
+	action, args := params, ""
+	if i := strings.Index(params, " "); i >= 0 {
+		action, args = params[:i], params[i+1:]
+	}
+	switch action {
+	case "list":
+		if len(server.tournaments) == 0 {
+			client.SendPacket("CHAT", "", "There are no tournaments.", "system")
+			return nil
+		}
+		var names []string
+		for name := range server.tournaments {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			t := server.tournaments[name]
+			client.SendPacket("CHAT", "", fmt.Sprintf("%s (%s): %s, %d players", t.Name, t.Format, t.State, len(t.Players)), "system")
+		}
+		return nil
+	case "show":
+		t := server.tournaments[args]
+		if t == nil {
+			return CmdPacketError{"NO_SUCH_TOURNAMENT"}
+		}
+		for _, line := range t.describe() {
+			client.SendPacket("CHAT", "", line, "system")
+		}
+		return nil
+	case "signup", "withdraw":
+		if client.permissions != REGISTERED && client.permissions != SUPERUSER {
+			return CmdPacketError{"DEFICIENT_PERMISSION"}
+		}
+		t := server.tournaments[args]
+		if t == nil {
+			return CmdPacketError{"NO_SUCH_TOURNAMENT"}
+		}
+		var err error
+		if action == "signup" {
+			err = t.SignUp(client.Name())
+		} else {
+			err = t.Withdraw(client.Name())
+		}
+		if err != nil {
+			return CmdPacketError{err.Error()}
+		}
+		server.saveTournament(t)
+		if action == "signup" {
+			client.SendPacket("CHAT", "", fmt.Sprintf("You signed up for %s.", t.Name), "system")
+		} else {
+			client.SendPacket("CHAT", "", fmt.Sprintf("You withdrew from %s.", t.Name), "system")
+		}
+		return nil
+	}
+
+	if client.permissions != SUPERUSER {
+		return CmdPacketError{"DEFICIENT_PERMISSION"}
+	}
+
+	switch action {
+	case "create":
+		format, name := args, ""
+		if i := strings.Index(args, " "); i >= 0 {
+			format, name = args[:i], args[i+1:]
+		}
+		if !server.ValidationPolicy().IsValidGameName(name) {
+			return CmdPacketError{"INVALID_CMD_PARAMETERS"}
+		}
+		if server.tournaments[name] != nil {
+			return CmdPacketError{"TOURNAMENT_EXISTS"}
+		}
+		t, err := NewTournament(name, format)
+		if err != nil {
+			return CmdPacketError{err.Error()}
+		}
+		server.tournaments[name] = t
+		server.saveTournament(t)
+		server.BroadcastToConnectedClients("CHAT", "", fmt.Sprintf("The sign-up for the tournament %s has opened.", name), "system")
+	case "start":
+		t := server.tournaments[args]
+		if t == nil {
+			return CmdPacketError{"NO_SUCH_TOURNAMENT"}
+		}
+		ratings := make(map[string]int)
+		for _, player := range t.Players {
+			ratings[player] = server.UserDb().Rating(player).Rating
+		}
+		if err := t.Start(ratings); err != nil {
+			return CmdPacketError{err.Error()}
+		}
+		server.saveTournament(t)
+		server.BroadcastToConnectedClients("CHAT", "", fmt.Sprintf("The tournament %s has started.", t.Name), "system")
+		server.scheduleTournamentGames()
+	case "cancel":
+		t := server.tournaments[args]
+		if t == nil {
+			return CmdPacketError{"NO_SUCH_TOURNAMENT"}
+		}
+		if err := t.Cancel(); err != nil {
+			return CmdPacketError{err.Error()}
+		}
+		server.saveTournament(t)
+		client.SendPacket("CHAT", "", fmt.Sprintf("Canceled the tournament %s.", t.Name), "system")
+	case "decide":
+		// The winner comes first since tournament names may contain spaces
+		winner, name := args, ""
+		if i := strings.Index(args, " "); i >= 0 {
+			winner, name = args[:i], args[i+1:]
+		}
+		t := server.tournaments[name]
+		if t == nil {
+			return CmdPacketError{"NO_SUCH_TOURNAMENT"}
+		}
+		match := t.OpenMatchOf(winner)
+		if match == nil {
+			return CmdPacketError{"NO_SUCH_MATCH"}
+		}
+		if err := server.decideTournamentMatch(t, match, winner); err != nil {
+			return CmdPacketError{err.Error()}
+		}
+	default:
+		return CmdPacketError{"INVALID_CMD_PARAMETERS"}
+	}
+	return nil
+}
+
+// describe returns the lines "CMD tournament show" answers with.
+func (t *Tournament) describe() []string {
+	lines := []string{fmt.Sprintf("%s (%s): %s", t.Name, t.Format, t.State)}
+	switch t.State {
+	case TOURNAMENT_SIGNUP:
+		if len(t.Players) == 0 {
+			lines = append(lines, "Nobody has signed up yet.")
+		} else {
+			lines = append(lines, "Signed up: "+strings.Join(t.Players, ", "))
+		}
+	case TOURNAMENT_RUNNING:
+		lines = append(lines, fmt.Sprintf("Round %d:", t.Round))
+		for _, match := range t.CurrentMatches() {
+			switch {
+			case match.Players[1] == "":
+				lines = append(lines, fmt.Sprintf("%s advances without a match", match.Players[0]))
+			case match.Winner != "":
+				lines = append(lines, fmt.Sprintf("%s vs %s: won by %s", match.Players[0], match.Players[1], match.Winner))
+			default:
+				lines = append(lines, fmt.Sprintf("%s vs %s: not played yet", match.Players[0], match.Players[1]))
+			}
+		}
+	case TOURNAMENT_FINISHED:
+		lines = append(lines, fmt.Sprintf("Won by %s.", t.Winner))
+	}
+	if t.Format == "roundrobin" && t.State != TOURNAMENT_SIGNUP {
+		wins := t.Wins()
+		for _, player := range t.Players {
+			lines = append(lines, fmt.Sprintf("%s: %d wins", player, wins[player]))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type TournamentSuite struct{}
+
+var _ = Suite(&TournamentSuite{})
+
+func matchPlayers(matches []*TournamentMatch) [][2]string {
+	var players [][2]string
+	for _, match := range matches {
+		players = append(players, match.Players)
+	}
+	return players
+}
+
+func startedTournament(c *C, format string, players ...string) *Tournament {
+	t, err := NewTournament("Cup", format)
+	c.Assert(err, IsNil)
+	for _, player := range players {
+		c.Assert(t.SignUp(player), IsNil)
+	}
+	ratings := map[string]int{"bert": 1600, "ernie": 1550, "grover": 1500, "oscar": 1450, "elmo": 1400}
+	c.Assert(t.Start(ratings), IsNil)
+	return t
+}
+
+func (s *TournamentSuite) TestSignUp(c *C) {
+	_, err := NewTournament("Cup", "swiss")
+	c.Assert(err, ErrorMatches, "INVALID_FORMAT")
+	t, err := NewTournament("Cup", "knockout")
+	c.Assert(err, IsNil)
+	c.Assert(t.SignUp("bert"), IsNil)
+	c.Assert(t.SignUp("bert"), ErrorMatches, "ALREADY_SIGNED_UP")
+	c.Assert(t.Start(nil), ErrorMatches, "NOT_ENOUGH_PLAYERS")
+	c.Assert(t.Withdraw("ernie"), ErrorMatches, "NOT_SIGNED_UP")
+	c.Assert(t.SignUp("ernie"), IsNil)
+	c.Assert(t.SignUp("grover"), IsNil)
+	c.Assert(t.Withdraw("ernie"), IsNil)
+	c.Assert(t.Players, DeepEquals, []string{"bert", "grover"})
+
+	c.Assert(t.Start(nil), IsNil)
+	c.Assert(t.Start(nil), ErrorMatches, "ALREADY_STARTED")
+	c.Assert(t.SignUp("ernie"), ErrorMatches, "SIGNUP_CLOSED")
+	c.Assert(t.Withdraw("bert"), ErrorMatches, "SIGNUP_CLOSED")
+}
+
+func (s *TournamentSuite) TestKnockout(c *C) {
+	t := startedTournament(c, "knockout", "elmo", "oscar", "grover", "ernie", "bert")
+	c.Assert(t.Players, DeepEquals, []string{"bert", "ernie", "grover", "oscar", "elmo"})
+	// The three best seeds advance without a match
+	c.Assert(matchPlayers(t.CurrentMatches()), DeepEquals, [][2]string{
+		{"bert", ""}, {"ernie", ""}, {"grover", ""}, {"oscar", "elmo"}})
+	c.Assert(t.OpenMatchOf("bert"), IsNil)
+
+	match := t.OpenMatchOf("elmo")
+	c.Assert(t.Decide(match, "bert"), ErrorMatches, "NOT_IN_MATCH")
+	c.Assert(t.Decide(match, "elmo"), IsNil)
+	c.Assert(t.Decide(match, "oscar"), ErrorMatches, "ALREADY_DECIDED")
+	c.Assert(t.Round, Equals, 2)
+	c.Assert(matchPlayers(t.CurrentMatches()), DeepEquals, [][2]string{{"bert", "ernie"}, {"grover", "elmo"}})
+
+	c.Assert(t.Decide(t.OpenMatchOf("ernie"), "ernie"), IsNil)
+	c.Assert(t.Round, Equals, 2)
+	c.Assert(t.Decide(t.OpenMatchOf("grover"), "elmo"), IsNil)
+	c.Assert(t.Round, Equals, 3)
+	c.Assert(matchPlayers(t.CurrentMatches()), DeepEquals, [][2]string{{"ernie", "elmo"}})
+
+	c.Assert(t.Decide(t.OpenMatchOf("elmo"), "elmo"), IsNil)
+	c.Assert(t.State, Equals, TOURNAMENT_FINISHED)
+	c.Assert(t.Winner, Equals, "elmo")
+	c.Assert(t.OpenMatchOf("elmo"), IsNil)
+	c.Assert(t.Cancel(), ErrorMatches, "ALREADY_FINISHED")
+}
+
+func (s *TournamentSuite) TestRoundRobin(c *C) {
+	t := startedTournament(c, "roundrobin", "oscar", "grover", "ernie", "bert")
+	c.Assert(t.Matches, HasLen, 6)
+	met := make(map[[2]string]bool)
+	for round := 1; round <= 3; round++ {
+		c.Assert(t.Round, Equals, round)
+		matches := t.CurrentMatches()
+		c.Assert(matches, HasLen, 2)
+		for _, match := range matches {
+			c.Assert(met[match.Players], Equals, false)
+			met[match.Players] = true
+			met[[2]string{match.Players[1], match.Players[0]}] = true
+			// The better seed always wins, except oscar against bert
+			winner := betterSeed(t, match)
+			if match.Players == [2]string{"bert", "oscar"} || match.Players == [2]string{"oscar", "bert"} {
+				winner = "oscar"
+			}
+			c.Assert(t.Decide(match, winner), IsNil)
+		}
+	}
+	c.Assert(t.State, Equals, TOURNAMENT_FINISHED)
+	c.Assert(t.Wins(), DeepEquals, map[string]int{"bert": 2, "ernie": 2, "grover": 1, "oscar": 1})
+	// The tie is broken by the seeds
+	c.Assert(t.Winner, Equals, "bert")
+}
+
+// betterSeed returns the player of the match that is seeded higher.
+func betterSeed(t *Tournament, match *TournamentMatch) string {
+	for _, player := range t.Players {
+		if player == match.Players[0] || player == match.Players[1] {
+			return player
+		}
+	}
+	return ""
+}
+
+func (s *TournamentSuite) TestRoundRobinWithOddPlayers(c *C) {
+	t := startedTournament(c, "roundrobin", "grover", "ernie", "bert")
+	c.Assert(t.Matches, HasLen, 3)
+	for round := 1; round <= 3; round++ {
+		c.Assert(t.Round, Equals, round)
+		c.Assert(t.CurrentMatches(), HasLen, 1)
+		match := t.CurrentMatches()[0]
+		c.Assert(t.Decide(match, betterSeed(t, match)), IsNil)
+	}
+	c.Assert(t.State, Equals, TOURNAMENT_FINISHED)
+	c.Assert(t.Wins(), DeepEquals, map[string]int{"bert": 2, "ernie": 1})
+	c.Assert(t.Winner, Equals, "bert")
+}
+
+func checkTournamentStore(c *C, st TournamentStore) {
+	defer st.Close()
+	t := startedTournament(c, "knockout", "bert", "ernie")
+	t.Matches[0].Game = "Cup: round 1, match 1"
+	c.Assert(st.SaveTournament(t), IsNil)
+	c.Assert(t.Decide(t.Matches[0], "ernie"), IsNil)
+	other, err := NewTournament("Another cup", "roundrobin")
+	c.Assert(err, IsNil)
+	c.Assert(st.SaveTournament(other), IsNil)
+
+	tournaments, err := st.Tournaments()
+	c.Assert(err, IsNil)
+	c.Assert(tournaments, HasLen, 2)
+	saved := tournaments[0]
+	if saved.Name != "Cup" {
+		saved = tournaments[1]
+	}
+	// Changes only count once the tournament is saved again
+	c.Assert(saved.State, Equals, TOURNAMENT_RUNNING)
+	c.Assert(saved.Players, DeepEquals, []string{"bert", "ernie"})
+	c.Assert(matchPlayers(saved.Matches), DeepEquals, [][2]string{{"bert", "ernie"}})
+	c.Assert(saved.Matches[0].Winner, Equals, "")
+	// Games do not survive restarts
+	c.Assert(saved.Matches[0].Game, Equals, "")
+
+	c.Assert(st.SaveTournament(t), IsNil)
+	tournaments, err = st.Tournaments()
+	c.Assert(err, IsNil)
+	c.Assert(tournaments, HasLen, 2)
+	for _, saved := range tournaments {
+		if saved.Name == "Cup" {
+			c.Assert(saved.Winner, Equals, "ernie")
+		}
+	}
+}
+
+var tournamentStoreTest = backendTest{
+	newInMemory: func() backend {
+		return NewInMemoryTournamentStore()
+	},
+	openSqlite: func(file string) (backend, error) {
+		st, err := NewSqliteTournamentStore(file)
+		return st, err
+	},
+	openMySql: func() (backend, error) {
+		st, err := NewMySqlTournamentStore("wlms", "wlms", "secret", "users")
+		return st, err
+	},
+	check: func(c *C, b backend) {
+		checkTournamentStore(c, b.(TournamentStore))
+	},
+	reopened: func(c *C, b backend) {
+		tournaments, err := b.(TournamentStore).Tournaments()
+		c.Assert(err, IsNil)
+		c.Assert(tournaments, HasLen, 2)
+	},
+	use: func(c *C, b backend) {
+		st := b.(TournamentStore)
+		t, err := NewTournament("Cup", "knockout")
+		c.Assert(err, IsNil)
+		c.Assert(st.SaveTournament(t), IsNil)
+		_, err = st.Tournaments()
+		c.Assert(err, IsNil)
+	},
+}
+
+func (s *TournamentSuite) TestInMemoryStore(c *C) {
+	tournamentStoreTest.checkInMemory(c)
+}
+
+func (s *TournamentSuite) TestSqliteStore(c *C) {
+	tournamentStoreTest.checkSqlite(c)
+}
+
+func (s *TournamentSuite) TestMySqlStatements(c *C) {
+	tournamentStoreTest.checkMySql(c)
+}
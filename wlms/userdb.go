@@ -10,6 +10,8 @@ import (
 	"io"
 	"log"
 	"crypto/rand"
+	"sort"
+	"sync"
 )
 
 type UserDb interface {
@@ -18,44 +20,78 @@ type UserDb interface {
 	GenerateChallengeResponsePairFromUsername(name string) (string, string, bool)
 	GenerateDowngradedUserNonce(registeredName, assignedName string) string
 	Permissions(name string) Permissions
+	// The rating of a registered user. Users without rated games have
+	// kInitialRating.
+	Rating(name string) PlayerRating
+	SetRating(rating PlayerRating) error
+	// The best rated users that have played rated games
+	Leaderboard(limit int) ([]PlayerRating, error)
+	// Asks the registered user friend to become a friend of name
+	RequestFriend(name, friend string) error
+	// Accepts the request of requester. Fails if there is none.
+	AcceptFriend(name, requester string) error
+	// Ends the friendship or drops the request between the two users, no
+	// matter who asked
+	RemoveFriend(name, other string) error
+	// The friends of the user, sorted by name
+	Friends(name string) ([]string, error)
+	// The users waiting for the user to accept their request, sorted by name
+	FriendRequests(name string) ([]string, error)
 	Close()
 }
 
 type user struct {
 	password    string
 	permissions Permissions
+	rating      int
+	games       int
 }
 
+// A friend request from the first user to the second one
+type friendship [2]string
+
+// InMemoryUserDb keeps the users in memory for local testing. It is locked
+// since the server accesses the users from several goroutines.
 type InMemoryUserDb struct {
+	mutex sync.Mutex
 	users map[string]user
+	// Whether the request has been accepted
+	friendships map[friendship]bool
 }
 
 func NewInMemoryDb() *InMemoryUserDb {
-	return &InMemoryUserDb{make(map[string]user)}
+	return &InMemoryUserDb{users: make(map[string]user), friendships: make(map[friendship]bool)}
 }
 
 func (i *InMemoryUserDb) AddUser(name string, password string, perms Permissions) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
 	h := sha1.New()
 	io.WriteString(h, password)
 	passwordHash := h.Sum(nil)
 
-	i.users[name] = user{hex.EncodeToString(passwordHash), perms}
+	i.users[name] = user{hex.EncodeToString(passwordHash), perms, kInitialRating, 0}
 }
 
-func (i InMemoryUserDb) ContainsName(name string) bool {
+func (i *InMemoryUserDb) ContainsName(name string) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
 	_, ok := i.users[name]
 	return ok
 }
 
-func (i InMemoryUserDb) PasswordCorrect(name, password string) bool {
-	if !i.ContainsName(name) {
+func (i *InMemoryUserDb) PasswordCorrect(name, password string) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	u, ok := i.users[name]
+	if !ok {
 		return false
 	}
 	h := sha1.New()
 	io.WriteString(h, password)
 	passwordHash := h.Sum(nil)
 
-	return i.users[name].password == hex.EncodeToString(passwordHash)
+	return u.password == hex.EncodeToString(passwordHash)
 }
 
 func GenerateChallengeResponsePairFromSecret(passwordHash string) (string, string, bool) {
@@ -75,33 +111,143 @@ func GenerateChallengeResponsePairFromSecret(passwordHash string) (string, strin
 	return challenge, response, true
 }
 
-func (i InMemoryUserDb) GenerateChallengeResponsePairFromUsername(name string) (string, string, bool) {
-	if !i.ContainsName(name) {
+func (i *InMemoryUserDb) GenerateChallengeResponsePairFromUsername(name string) (string, string, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	u, ok := i.users[name]
+	if !ok {
 		return "", "", false
 	}
-	return GenerateChallengeResponsePairFromSecret(i.users[name].password)
+	return GenerateChallengeResponsePairFromSecret(u.password)
 }
 
-func (i InMemoryUserDb) GenerateDowngradedUserNonce(registeredName, assignedName string) string {
-	if !i.ContainsName(registeredName) {
+func (i *InMemoryUserDb) GenerateDowngradedUserNonce(registeredName, assignedName string) string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	u, ok := i.users[registeredName]
+	if !ok {
 		log.Printf("Error: Asked to create nonce for unregistered user")
 		return "unregistered"
 	}
 
 	h := sha1.New()
 	io.WriteString(h, assignedName)
-	io.WriteString(h, i.users[registeredName].password)
+	io.WriteString(h, u.password)
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func (i InMemoryUserDb) Permissions(name string) Permissions {
-	if !i.ContainsName(name) {
+func (i *InMemoryUserDb) Permissions(name string) Permissions {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	u, ok := i.users[name]
+	if !ok {
 		return UNREGISTERED
 	}
-	return i.users[name].permissions
+	return u.permissions
+}
+
+func (i *InMemoryUserDb) Rating(name string) PlayerRating {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	u, ok := i.users[name]
+	if !ok {
+		return PlayerRating{name, kInitialRating, 0}
+	}
+	return PlayerRating{name, u.rating, u.games}
+}
+
+func (i *InMemoryUserDb) SetRating(rating PlayerRating) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	u, ok := i.users[rating.Name]
+	if !ok {
+		return fmt.Errorf("unknown user %v", rating.Name)
+	}
+	u.rating, u.games = rating.Rating, rating.Games
+	i.users[rating.Name] = u
+	return nil
+}
+
+func (i *InMemoryUserDb) Leaderboard(limit int) ([]PlayerRating, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	var leaders []PlayerRating
+	for name, u := range i.users {
+		if u.games > 0 {
+			leaders = append(leaders, PlayerRating{name, u.rating, u.games})
+		}
+	}
+	sort.Slice(leaders, func(a, b int) bool {
+		if leaders[a].Rating != leaders[b].Rating {
+			return leaders[a].Rating > leaders[b].Rating
+		}
+		return leaders[a].Name < leaders[b].Name
+	})
+	if len(leaders) > limit {
+		leaders = leaders[:limit]
+	}
+	return leaders, nil
+}
+
+func (i *InMemoryUserDb) RequestFriend(name, friend string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if _, ok := i.users[friend]; !ok {
+		return fmt.Errorf("unknown user %v", friend)
+	}
+	if _, ok := i.friendships[friendship{name, friend}]; !ok {
+		i.friendships[friendship{name, friend}] = false
+	}
+	return nil
+}
+
+func (i *InMemoryUserDb) AcceptFriend(name, requester string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if _, ok := i.friendships[friendship{requester, name}]; !ok {
+		return fmt.Errorf("no request from %v to %v", requester, name)
+	}
+	i.friendships[friendship{requester, name}] = true
+	return nil
 }
 
-func (i InMemoryUserDb) Close() {
+func (i *InMemoryUserDb) RemoveFriend(name, other string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	delete(i.friendships, friendship{name, other})
+	delete(i.friendships, friendship{other, name})
+	return nil
+}
+
+func (i *InMemoryUserDb) Friends(name string) ([]string, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	var friends []string
+	for f, accepted := range i.friendships {
+		if accepted && f[0] == name {
+			friends = append(friends, f[1])
+		} else if accepted && f[1] == name {
+			friends = append(friends, f[0])
+		}
+	}
+	sort.Strings(friends)
+	return friends, nil
+}
+
+func (i *InMemoryUserDb) FriendRequests(name string) ([]string, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	var requesters []string
+	for f, accepted := range i.friendships {
+		if !accepted && f[1] == name {
+			requesters = append(requesters, f[0])
+		}
+	}
+	sort.Strings(requesters)
+	return requesters, nil
+}
+
+func (i *InMemoryUserDb) Close() {
 }
 
 type SqlDatabase struct {
@@ -117,6 +263,21 @@ func NewMySqlDatabase(database, user, password, table string) *SqlDatabase {
 	if con.Ping() != nil {
 		log.Fatal("Database closed connection immediately.")
 	}
+	if _, err := con.Exec(`CREATE TABLE IF NOT EXISTS wlms_ratings (
+		user_id INTEGER PRIMARY KEY,
+		rating INTEGER NOT NULL,
+		games INTEGER NOT NULL,
+		INDEX (rating))`); err != nil {
+		log.Fatalf("Could not create the table of ratings: %v", err)
+	}
+	if _, err := con.Exec(`CREATE TABLE IF NOT EXISTS wlms_friends (
+		user_id INTEGER NOT NULL,
+		friend_id INTEGER NOT NULL,
+		accepted BOOLEAN NOT NULL,
+		PRIMARY KEY (user_id, friend_id),
+		INDEX (friend_id))`); err != nil {
+		log.Fatalf("Could not create the table of friends: %v", err)
+	}
 	return &SqlDatabase{con}
 }
 
@@ -208,3 +369,120 @@ func (db *SqlDatabase) Permissions(name string) Permissions {
 		return UNREGISTERED
 	}
 }
+
+func (db *SqlDatabase) Rating(name string) PlayerRating {
+	rating := PlayerRating{name, kInitialRating, 0}
+	err := db.db.QueryRow("select r.rating, r.games from wlms_ratings r join auth_user u on u.id = r.user_id where u.username=?", name).Scan(&rating.Rating, &rating.Games)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Unable to read the rating of %v: %v", name, err)
+	}
+	return rating
+}
+
+func (db *SqlDatabase) SetRating(rating PlayerRating) error {
+	id, err := db.userId(rating.Name)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("insert into wlms_ratings (user_id, rating, games) values (?, ?, ?) "+
+		"on duplicate key update rating=values(rating), games=values(games)", id, rating.Rating, rating.Games)
+	return err
+}
+
+func (db *SqlDatabase) Leaderboard(limit int) ([]PlayerRating, error) {
+	rows, err := db.db.Query("select u.username, r.rating, r.games from wlms_ratings r join auth_user u on u.id = r.user_id "+
+		"where r.games > 0 order by r.rating desc, u.username limit ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var leaders []PlayerRating
+	for rows.Next() {
+		var rating PlayerRating
+		if err := rows.Scan(&rating.Name, &rating.Rating, &rating.Games); err != nil {
+			return nil, err
+		}
+		leaders = append(leaders, rating)
+	}
+	return leaders, rows.Err()
+}
+
+func (db *SqlDatabase) userId(name string) (int64, error) {
+	var id int64
+	err := db.db.QueryRow("select id from auth_user where username=?", name).Scan(&id)
+	return id, err
+}
+
+func (db *SqlDatabase) RequestFriend(name, friend string) error {
+	id, err := db.userId(name)
+	if err != nil {
+		return err
+	}
+	friendId, err := db.userId(friend)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("insert into wlms_friends (user_id, friend_id, accepted) values (?, ?, false) "+
+		"on duplicate key update accepted=accepted", id, friendId)
+	return err
+}
+
+func (db *SqlDatabase) AcceptFriend(name, requester string) error {
+	id, err := db.userId(name)
+	if err != nil {
+		return err
+	}
+	requesterId, err := db.userId(requester)
+	if err != nil {
+		return err
+	}
+	var accepted bool
+	if err := db.db.QueryRow("select accepted from wlms_friends where user_id=? and friend_id=?", requesterId, id).Scan(&accepted); err != nil {
+		return err
+	}
+	_, err = db.db.Exec("update wlms_friends set accepted=true where user_id=? and friend_id=?", requesterId, id)
+	return err
+}
+
+func (db *SqlDatabase) RemoveFriend(name, other string) error {
+	id, err := db.userId(name)
+	if err != nil {
+		return err
+	}
+	otherId, err := db.userId(other)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("delete from wlms_friends where (user_id=? and friend_id=?) or (user_id=? and friend_id=?)",
+		id, otherId, otherId, id)
+	return err
+}
+
+func (db *SqlDatabase) queryNames(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (db *SqlDatabase) Friends(name string) ([]string, error) {
+	return db.queryNames("select v.username from wlms_friends f join auth_user u on u.id = f.user_id join auth_user v on v.id = f.friend_id "+
+		"where f.accepted and u.username=? union "+
+		"select u.username from wlms_friends f join auth_user u on u.id = f.user_id join auth_user v on v.id = f.friend_id "+
+		"where f.accepted and v.username=? order by 1", name, name)
+}
+
+func (db *SqlDatabase) FriendRequests(name string) ([]string, error) {
+	return db.queryNames("select u.username from wlms_friends f join auth_user u on u.id = f.user_id join auth_user v on v.id = f.friend_id "+
+		"where not f.accepted and v.username=? order by u.username", name)
+}
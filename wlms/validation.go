@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ValidationPolicy describes which user and game names the server accepts
+// and whether chat messages are filtered. It can be set in the "Validation"
+// section of the configuration file.
+type ValidationPolicy struct {
+	// Allowed length of user and game names, counted in characters.
+	MinNameLength, MaxNameLength         int
+	MinGameNameLength, MaxGameNameLength int
+
+	// Characters allowed in user names in addition to letters and digits.
+	NameCharacters string
+
+	// Names that can not be used by unregistered clients, e.g. the names of
+	// admins or of the IRC bot. Compared case-insensitive.
+	ReservedNames []string
+
+	// Words that must not be part of user or game names. Compared
+	// case-insensitive.
+	Blocklist []string
+
+	// If set, words on the blocklist are masked in chat messages.
+	FilterChat bool
+}
+
+func DefaultValidationPolicy() ValidationPolicy {
+	return ValidationPolicy{
+		MinNameLength:     1,
+		MaxNameLength:     30,
+		MinGameNameLength: 1,
+		MaxGameNameLength: 60,
+		NameCharacters:    "_-.@+",
+		ReservedNames:     []string{"admin", "administrator", "metaserver", "server", "system"},
+	}
+}
+
+// IsValidUserName checks a name that an unregistered client wants to use.
+// Names of registered users are not checked since they are managed by the
+// website.
+func (p ValidationPolicy) IsValidUserName(name string) bool {
+	if !p.hasValidLength(name, p.MinNameLength, p.MaxNameLength) {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(p.NameCharacters, r) {
+			return false
+		}
+	}
+	for _, reserved := range p.ReservedNames {
+		if strings.EqualFold(name, reserved) {
+			return false
+		}
+	}
+	return !p.containsBlockedWord(name)
+}
+
+// IsValidGameName checks the name of a newly opened game.
+func (p ValidationPolicy) IsValidGameName(name string) bool {
+	if !p.hasValidLength(name, p.MinGameNameLength, p.MaxGameNameLength) {
+		return false
+	}
+	if strings.TrimSpace(name) != name {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return !p.containsBlockedWord(name)
+}
+
+// FilterChatMessage replaces all words on the blocklist in the given message
+// with '*'. The message is returned unchanged if FilterChat is not set.
+func (p ValidationPolicy) FilterChatMessage(message string) string {
+	if !p.FilterChat {
+		return message
+	}
+	lower := []rune(strings.ToLower(message))
+	filtered := []rune(message)
+	if len(lower) != len(filtered) {
+		// Lowercasing changed the number of runes. Should not happen for any
+		// sane input, so better leave the message alone than garbling it.
+		return message
+	}
+	for _, word := range p.Blocklist {
+		w := []rune(strings.ToLower(word))
+		if len(w) == 0 {
+			continue
+		}
+		for i := 0; i+len(w) <= len(lower); i++ {
+			if string(lower[i:i+len(w)]) == string(w) {
+				for j := i; j < i+len(w); j++ {
+					filtered[j] = '*'
+				}
+			}
+		}
+	}
+	return string(filtered)
+}
+
+func (p ValidationPolicy) hasValidLength(name string, min, max int) bool {
+	if !utf8.ValidString(name) {
+		return false
+	}
+	length := utf8.RuneCountInString(name)
+	return length >= min && length <= max
+}
+
+func (p ValidationPolicy) containsBlockedWord(name string) bool {
+	lower := strings.ToLower(name)
+	for _, word := range p.Blocklist {
+		if word != "" && strings.Contains(lower, strings.ToLower(word)) {
+			return true
+		}
+	}
+	return false
+}
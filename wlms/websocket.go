@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/widelands/widelands-metaserver/wlms/packet"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The subprotocols of the WebSocket gateway. With "widelands", each binary
+// message carries one packet exactly as it is sent over TCP. With
+// "widelands-json", each text message is a JSON array with the strings of one
+// packet, e.g. ["CHAT","","hello","public"]. Without a subprotocol,
+// "widelands" is used.
+const (
+	kWebSocketProtocol     = "widelands"
+	kWebSocketJSONProtocol = "widelands-json"
+)
+
+// Packets have a two byte length
+const kMaxWebSocketMessageSize = 1 << 16
+
+var errNotBinary = errors.New("expected a binary message")
+
+// WebSocketSettings configures the WebSocket gateway to the lobby. It is
+// disabled without an address.
+type WebSocketSettings struct {
+	Address string
+	// The origins of web pages that may connect, e.g.
+	// "https://www.widelands.org". All origins are allowed if empty.
+	AllowedOrigins []string
+	// Addresses or networks of reverse proxies in front of the gateway, e.g.
+	// "127.0.0.1" or "10.0.0.0/8". The address of a client connecting
+	// through them is taken from the X-Forwarded-For header, so IP bans and
+	// the session history see the client instead of the proxy.
+	TrustedProxies []string
+}
+
+func (w WebSocketSettings) Enabled() bool {
+	return w.Address != ""
+}
+
+func (w WebSocketSettings) isTrustedProxy(ip net.IP) bool {
+	for _, proxy := range w.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client that sent the request. Behind
+// trusted proxies, this is the last address in X-Forwarded-For that has not
+// been added by one of them. Clients can put anything before it.
+func (w WebSocketSettings) clientAddr(r *http.Request) net.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP(host)}
+	if addr.IP == nil || !w.isTrustedProxy(addr.IP) {
+		return addr
+	}
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		addr.IP = ip
+		if !w.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return addr
+}
+
+// webSocketConn lets the server handle a WebSocket connection like a TCP
+// connection. Only the writing loop of the client writes to it.
+type webSocketConn struct {
+	conn *websocket.Conn
+	json bool
+	// See WebSocketSettings.clientAddr
+	remoteAddr net.Addr
+	// The rest of the message that is currently read
+	reader io.Reader
+}
+
+func (w *webSocketConn) Read(p []byte) (int, error) {
+	for {
+		if w.reader == nil {
+			messageType, reader, err := w.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if w.json {
+				if reader, err = jsonToPacket(reader); err != nil {
+					return 0, err
+				}
+			} else if messageType != websocket.BinaryMessage {
+				return 0, errNotBinary
+			}
+			w.reader = reader
+		}
+		n, err := w.reader.Read(p)
+		if err == io.EOF {
+			w.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (w *webSocketConn) Write(p []byte) (int, error) {
+	if !w.json {
+		if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	reader := bytes.NewReader(p)
+	for reader.Len() > 0 {
+		pkg, err := packet.Read(reader)
+		if err != nil {
+			return 0, err
+		}
+		data, err := json.Marshal(pkg.RawData)
+		if err != nil {
+			return 0, err
+		}
+		if err := w.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *webSocketConn) Close() error {
+	return w.conn.Close()
+}
+
+func (w *webSocketConn) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+// jsonToPacket converts a message of the JSON subprotocol into a packet.
+func jsonToPacket(r io.Reader) (io.Reader, error) {
+	var fields []string
+	if err := json.NewDecoder(r).Decode(&fields); err != nil {
+		return nil, err
+	}
+	data := make([]interface{}, len(fields))
+	for i, field := range fields {
+		data[i] = field
+	}
+	return bytes.NewReader(packet.New(data...)), nil
+}
+
+// NewWebSocketHandler returns a handler that upgrades requests to WebSocket
+// connections and passes them to accept, which is Server.accept outside of
+// tests. Connections are closed if accept refuses them.
+func NewWebSocketHandler(accept func(ReadWriteCloserWithIp) bool, settings WebSocketSettings) http.Handler {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{kWebSocketProtocol, kWebSocketJSONProtocol},
+		CheckOrigin: func(r *http.Request) bool {
+			if len(settings.AllowedOrigins) == 0 {
+				return true
+			}
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				// Not a browser
+				return true
+			}
+			if u, err := url.Parse(origin); err == nil {
+				origin = u.Scheme + "://" + u.Host
+			}
+			for _, allowed := range settings.AllowedOrigins {
+				if origin == allowed {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := settings.clientAddr(r)
+		if addr == nil {
+			log.Printf("Refused WebSocket connection from the invalid address %v", r.RemoteAddr)
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader replied with an error already
+			log.Printf("Refused WebSocket connection from %v: %v", r.RemoteAddr, err)
+			return
+		}
+		conn.SetReadLimit(kMaxWebSocketMessageSize)
+		wsConn := &webSocketConn{
+			conn:       conn,
+			json:       conn.Subprotocol() == kWebSocketJSONProtocol,
+			remoteAddr: addr,
+		}
+		if !accept(wsConn) {
+			log.Printf("Refused WebSocket connection from %v: the server has been shut down", r.RemoteAddr)
+			wsConn.Close()
+		}
+	})
+}
@@ -1,29 +1,80 @@
 package main
 
 import (
-	"bufio"
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
 const PING_INTERVAL_S = 90
 
+// QueueStats describes the send queue of a client.
+type QueueStats struct {
+	// Number of commands currently waiting to be sent
+	Queued int
+	// Highest number of waiting commands seen so far
+	MaxQueued int
+	// Number of commands the queue can hold before the client is disconnected
+	Capacity int
+	// Number of commands sent so far
+	Sent uint64
+}
+
 // Structure to bundle the TCP connection with its packet buffer
+// The connection is only read by the goroutine handling the client and only
+// written by the writer goroutine started in New(). The remaining fields are
+// guarded by the mutex.
 type Client struct {
 	// The TCP connection to the client
 	conn net.Conn
 
+	// To read data from the network
+	reader *commandReader
+
+	// A channel for commands to send. If it is full, the client does not keep
+	// up with the game and is disconnected.
+	chan_out chan *Command
+
+	// Time a single write to the client may take
+	writeTimeout time.Duration
+
+	// Closed when the client is disconnected. The writer goroutine then sends
+	// the remaining commands and closes the connection.
+	disconnected   chan bool
+	disconnectOnce sync.Once
+
+	mutex sync.Mutex
+
+	// Whether Disconnect() has already been called
+	isDisconnected bool
+
+	// Whether the client was disconnected since it did not answer a ping in
+	// time. Its connection is probably broken, so it might return.
+	timedOut bool
+
+	// The relay protocol version the client connected with. Only used by the
+	// game while holding its mutex.
+	version uint8
+
+	// The level used to compress what is sent after the welcome. Zero if the
+	// client does not support compression.
+	compressionLevel int
+
 	// The id of this client when refering to him in messages to the host
 	// This id is only unique inside one game
 	id uint8
 
-	// To read data from the network
-	reader *bufio.Reader
+	// The token the client can use to resume its session after losing its
+	// connection. Empty for the host and clients whose protocol version does
+	// not support sessions. Only used by the game while holding its mutex.
+	sessionToken string
 
-	// A channel for commands to send
-	chan_out chan *Command
+	// The join token the client got from the metaserver or an empty string.
+	// Tells the metaserver which user the client is. Only used by the game
+	// while holding its mutex.
+	joinToken string
 
 	// A timer deciding when the next ping will be send
 	pingTimer *time.Timer
@@ -49,14 +100,20 @@ type Client struct {
 	// Can't be calculated on the fly since timeLastPing might already
 	// have been overwritten by the next ping
 	rttLastPing time.Duration
+
+	// Statistics about the send queue
+	maxQueued    int
+	commandsSent uint64
 }
 
-func New(conn net.Conn) *Client {
+func New(conn net.Conn, queueSize int, writeTimeout time.Duration) *Client {
 	client := &Client{
 		conn:            conn,
 		id:              0,
-		reader:          bufio.NewReader(conn),
-		chan_out:        make(chan *Command),
+		reader:          newCommandReader(conn),
+		chan_out:        make(chan *Command, queueSize),
+		writeTimeout:    writeTimeout,
+		disconnected:    make(chan bool),
 		pingTimer:       time.NewTimer(time.Second * 1), // Do the next ping now
 		waitingForPong:  false,
 		lastSendPingSeq: 0,
@@ -64,37 +121,119 @@ func New(conn net.Conn) *Client {
 		timeLastPong:    time.Now(),
 		rttLastPing:     time.Since(time.Now()),
 	}
-	go func() {
-		for {
-			cmd := <-client.chan_out
-			if client.conn == nil {
-				break
-			}
-			client.conn.Write(cmd.GetBytes())
-		}
-	}()
+	go client.writingLoop()
 	go client.pingLoop()
 	return client
 }
 
+// writingLoop sends the queued commands in order. When a write fails or takes
+// too long, the connection is closed so the goroutine reading from the client
+// notices and removes it from its game.
+func (c *Client) writingLoop() {
+	failed := false
+	writer := newCommandWriter(c.conn)
+	welcomed := false
+	write := func(cmd *Command) {
+		if failed {
+			return
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		err := writer.Write(cmd.GetBytes())
+		if err == nil && !welcomed && cmd.GetBytes()[0] == kWelcome {
+			// Everything after the welcome may be compressed
+			welcomed = true
+			if level := c.CompressionLevel(); level != 0 {
+				err = writer.enableCompression(level)
+			}
+		}
+		if err == nil && len(c.chan_out) == 0 {
+			// Nothing more to send for now
+			err = writer.Flush()
+		}
+		if err != nil {
+			log.Printf("Error while sending to client (id=%v): %v", c.Id(), err)
+			failed = true
+			c.conn.Close()
+			return
+		}
+		c.mutex.Lock()
+		c.commandsSent++
+		c.mutex.Unlock()
+	}
+	for {
+		select {
+		case cmd := <-c.chan_out:
+			write(cmd)
+		case <-c.disconnected:
+			for {
+				select {
+				case cmd := <-c.chan_out:
+					write(cmd)
+				default:
+					c.conn.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// enableCompression accepts compressed commands from now on and lets the
+// writer compress what is sent after the welcome. Has to be called by the
+// goroutine reading from the client.
+func (c *Client) enableCompression(level int) {
+	c.mutex.Lock()
+	c.compressionLevel = level
+	c.mutex.Unlock()
+	c.reader.enableCompression()
+}
+
+func (c *Client) CompressionLevel() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.compressionLevel
+}
+
+// ReadCommand reads the code of the next command.
+func (c *Client) ReadCommand() (uint8, error) {
+	return c.reader.ReadCommand()
+}
+
 func (c *Client) ReadUint8() (uint8, error) {
-	b := make([]byte, 1)
-	_, error := io.ReadFull(c.reader, b)
-	return b[0], error
+	return readUint8(c.reader)
 }
 
 func (c *Client) ReadString() (string, error) {
-	str, error := c.reader.ReadString('\000')
-	// Remove final \0
-	if len(str) > 0 {
-		str = str[:len(str)-1]
-	}
-	return str, error
+	return readString(c.reader)
 }
 
 func (c *Client) ReadPacket() ([]byte, error) {
+	return readPacket(c.reader)
+}
+
+func readUint8(reader *commandReader) (uint8, error) {
+	return reader.ReadByte()
+}
+
+func readString(reader *commandReader) (string, error) {
+	var str []byte
+	for {
+		b, error := reader.ReadByte()
+		if error != nil {
+			return string(str), error
+		}
+		// Without final \0
+		if b == 0 {
+			return string(str), nil
+		}
+		str = append(str, b)
+	}
+}
+
+// readPacket reads a packet including its two byte length prefix.
+func readPacket(reader *commandReader) ([]byte, error) {
 	length_bytes := make([]byte, 2)
-	_, error := io.ReadFull(c.reader, length_bytes)
+	_, error := io.ReadFull(reader, length_bytes)
 	if error != nil {
 		return length_bytes, error
 	}
@@ -105,7 +244,7 @@ func (c *Client) ReadPacket() ([]byte, error) {
 	packet := make([]byte, length)
 	packet[0] = length_bytes[0]
 	packet[1] = length_bytes[1]
-	_, error = io.ReadFull(c.reader, packet[2:])
+	_, error = io.ReadFull(reader, packet[2:])
 	// TODO(Notabilis): Think about this (and similar places). The client might be able
 	// to keep the server waiting here. Actually, he can simply keep the connection
 	// idling anyway. Is this a problem? Might be a possibility for DoS.
@@ -114,33 +253,107 @@ func (c *Client) ReadPacket() ([]byte, error) {
 	return packet, error
 }
 
+// Queues the command for sending to the client. Never blocks: Commands for
+// disconnected clients are dropped and clients whose queue is full are
+// disconnected, so a slow client can not stall the game.
 func (c *Client) SendCommand(cmd *Command) {
-	c.chan_out <- cmd
+	select {
+	case <-c.disconnected:
+		return
+	default:
+	}
+	select {
+	case c.chan_out <- cmd:
+		queued := len(c.chan_out)
+		c.mutex.Lock()
+		if queued > c.maxQueued {
+			c.maxQueued = queued
+		}
+		c.mutex.Unlock()
+	default:
+		log.Printf("Client (id=%v) does not keep up with the game, disconnecting", c.Id())
+		c.mutex.Lock()
+		c.isDisconnected = true
+		c.mutex.Unlock()
+		c.closeDisconnected()
+		// Abort a pending write. The reading goroutine then notices as well.
+		c.conn.Close()
+	}
+}
+
+func (c *Client) closeDisconnected() {
+	c.disconnectOnce.Do(func() {
+		close(c.disconnected)
+	})
+}
+
+func (c *Client) QueueStats() QueueStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return QueueStats{
+		Queued:    len(c.chan_out),
+		MaxQueued: c.maxQueued,
+		Capacity:  cap(c.chan_out),
+		Sent:      c.commandsSent,
+	}
+}
+
+func (c *Client) Id() uint8 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.id
+}
+
+func (c *Client) setId(id uint8) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.id = id
+}
+
+// IsDisconnected returns whether the relay disconnected the client on purpose.
+// Clients that did not answer a ping in time were not.
+func (c *Client) IsDisconnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.isDisconnected && !c.timedOut
 }
 
 // Sends a disconnect message and closes the connection
 func (c *Client) Disconnect(reason string) {
-	if c.conn == nil {
+	c.disconnect(reason, false)
+}
+
+// disconnect is like Disconnect. timedOut tells whether the client did not
+// answer a ping in time.
+func (c *Client) disconnect(reason string, timedOut bool) {
+	c.mutex.Lock()
+	if c.isDisconnected {
+		c.mutex.Unlock()
 		return
 	}
-	log.Printf("Disconnecting client (id=%v) because %v\n", c.id, reason)
+	// Since closing the connection indirectly calls this method again,
+	// mark the connection as closed before doing so
+	c.isDisconnected = true
+	c.timedOut = timedOut
+	id := c.id
+	c.mutex.Unlock()
+
+	log.Printf("Disconnecting client (id=%v) because %v\n", id, reason)
 	cmd := NewCommand(kDisconnect)
 	cmd.AppendString(reason)
 	c.SendCommand(cmd)
-	// Since conn.Close() indirectly calls this method again,
-	// mark the connection as closed before calling it
-	conn := c.conn
-	c.conn = nil
-	conn.Close()
+	c.closeDisconnected()
 }
 
 func (c *Client) pingLoop() {
 	for {
-		<-c.pingTimer.C
-		if c.conn == nil {
+		select {
+		case <-c.pingTimer.C:
+		case <-c.disconnected:
 			// Seems we are disconnecting for some reason
-			break
+			return
 		}
+		c.mutex.Lock()
 		if c.waitingForPong == false {
 			// Send the next ping
 			c.waitingForPong = true
@@ -148,6 +361,7 @@ func (c *Client) pingLoop() {
 			c.lastSendPingSeq += 1
 			cmd := NewCommand(kPing)
 			cmd.AppendUInt(c.lastSendPingSeq)
+			c.mutex.Unlock()
 			c.SendCommand(cmd)
 			c.pingTimer.Reset(time.Second * PING_INTERVAL_S)
 		} else {
@@ -155,13 +369,16 @@ func (c *Client) pingLoop() {
 			// In the case of the game host this also takes down the game
 			// by closing the socket -> game will notice it and abort
 			log.Printf("Timeout of client (id=%v), disconnecting", c.id)
-			c.Disconnect("TIMEOUT")
-			break
+			c.mutex.Unlock()
+			c.disconnect("TIMEOUT", true)
+			return
 		}
 	}
 }
 
 func (c *Client) HandlePong(seq uint8) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.waitingForPong = false
 	if seq != c.lastSendPingSeq {
 		// Well, actually the sequence numbers are not that important.
@@ -178,9 +395,13 @@ func (c *Client) HandlePong(seq uint8) {
 }
 
 func (c *Client) TimeLastPong() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.timeLastPong
 }
 
 func (c *Client) RttLastPing() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.rttLastPing
 }
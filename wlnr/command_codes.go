@@ -1,7 +1,20 @@
 package main
 
 const (
-	kRelayProtocolVersion uint8 = 1
+	// The newest version of the relay protocol. Peers that are refused with
+	// WRONG_VERSION fall back to version 1.
+	kRelayProtocolVersion uint8 = 4
+	// Since version 4 larger batches of commands are compressed after kHello
+	// and kWelcome
+	kRelayProtocolVersionCompressed uint8 = 4
+	// Since version 3 clients other than the host get a session token with
+	// kWelcome and can resume their session with it
+	kRelayProtocolVersionSessions uint8 = 3
+	// Since version 2 clients are told with kHostAway and kHostReturned when
+	// the host lost its connection
+	kRelayProtocolVersionHostAway uint8 = 2
+	// The oldest supported version
+	kRelayProtocolVersionOldest uint8 = 1
 
 	// The commands used in the protocol
 	// The names match the names in the Widelands sources
@@ -15,12 +28,40 @@ const (
 	kPong                  uint8 = 5
 	kRoundTripTimeRequest  uint8 = 6
 	kRoundTripTimeResponse uint8 = 7
+	// A batch of compressed commands, see compression.go. Since version 4
+	kCompressed uint8 = 8
 	// host
 	kConnectClient    uint8 = 11
 	kDisconnectClient uint8 = 12
 	kToClients        uint8 = 13
 	kFromClient       uint8 = 14
+	// Marks a client as observer. It gets all broadcasts of the host, starting
+	// with the ones since the last catch-up point
+	kAddObserver uint8 = 15
+	// A packet for all observers, preceded by flags
+	kBroadcast uint8 = 16
+	// Removes a client from the game, followed by its id and flags. The host
+	// gets a kDisconnectClient for it
+	kKickClient uint8 = 17
 	// client
 	kToHost   uint8 = 21
 	kFromHost uint8 = 22
+	// The connection to the host has been lost. Messages to the host are kept
+	// until it returns or the game is closed. Since version 2
+	kHostAway uint8 = 23
+	// The host is back, followed by the messages it missed. Since version 2
+	kHostReturned uint8 = 24
+)
+
+// Flags of kBroadcast
+const (
+	// The packet starts the data an observer needs to join the running game,
+	// e.g. a savegame. Earlier broadcasts are not sent to observers added later
+	kBroadcastCatchUp uint8 = 1
+)
+
+// Flags of kKickClient
+const (
+	// The user of the client may not join the game again
+	kKickBan uint8 = 1
 )
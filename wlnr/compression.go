@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+Compression of the relay protocol (version 4 and later)
+
+Game traffic mostly consists of small commands sent one at a time, which
+deflate can only make larger. So commands are sent as in version 1 and only
+batches of commands that are sent together and are large enough are
+compressed. Such a batch is sent as
+
+	kCompressed
+	uvarint             size of the uncompressed commands
+	uvarint             size of the compressed data
+	bytes               compressed data
+
+The compressed data of all batches of a connection form one deflate stream
+with a sync flush after each batch, so later batches refer to earlier ones.
+Each batch contains whole commands. The host and clients may send batches
+after their kHello, the relay sends them after its kWelcome.
+*/
+
+const (
+	// Batches smaller than this are sent without compression
+	kCompressionThreshold = 128
+
+	// Commands are collected until a batch has this size
+	kMaxBatchSize = 32 << 10
+
+	// Larger batches are refused when reading
+	kMaxUncompressedSize = 1 << 20
+
+	// The size of the deflate window
+	kCompressionHistory = 32 << 10
+)
+
+var ErrInvalidCompressedData = errors.New("invalid compressed data")
+
+// commandReader reads the commands of a connection. With compression enabled,
+// compressed batches are unpacked by ReadCommand() and their commands are read
+// before continuing with the connection.
+type commandReader struct {
+	conn *bufio.Reader
+
+	compressed bool
+
+	// Unpacked commands that have not been read yet
+	pending []byte
+
+	// Created for the first compressed batch. Each batch is decompressed on
+	// its own with the output of the earlier batches as dictionary.
+	decompressor io.ReadCloser
+	history      []byte
+}
+
+func newCommandReader(r io.Reader) *commandReader {
+	return &commandReader{conn: bufio.NewReader(r)}
+}
+
+// enableCompression accepts compressed batches from now on.
+func (r *commandReader) enableCompression() {
+	r.compressed = true
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	return r.conn.Read(p)
+}
+
+func (r *commandReader) ReadByte() (byte, error) {
+	if len(r.pending) > 0 {
+		b := r.pending[0]
+		r.pending = r.pending[1:]
+		return b, nil
+	}
+	return r.conn.ReadByte()
+}
+
+// ReadCommand reads the code of the next command. Has to be called at the
+// start of each command since compressed batches start there.
+func (r *commandReader) ReadCommand() (uint8, error) {
+	for {
+		cmd, err := r.ReadByte()
+		if err != nil || cmd != kCompressed || !r.compressed {
+			return cmd, err
+		}
+		if err := r.readBatch(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *commandReader) readBatch() error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	compressedSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if size > kMaxUncompressedSize || compressedSize > kMaxUncompressedSize {
+		return ErrInvalidCompressedData
+	}
+	data := make([]byte, compressedSize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if r.decompressor == nil {
+		r.decompressor = flate.NewReaderDict(bytes.NewReader(data), r.history)
+	} else if err := r.decompressor.(flate.Resetter).Reset(bytes.NewReader(data), r.history); err != nil {
+		return err
+	}
+	// The sync flush at the end of the batch is not read, the next batch
+	// starts with a new block anyway
+	commands := make([]byte, size)
+	if _, err := io.ReadFull(r.decompressor, commands); err != nil {
+		return ErrInvalidCompressedData
+	}
+	r.history = appendHistory(r.history, commands)
+	r.pending = append(commands, r.pending...)
+	return nil
+}
+
+// appendHistory keeps the end of the data that fits into the deflate window.
+func appendHistory(history, data []byte) []byte {
+	history = append(history, data...)
+	if len(history) > kCompressionHistory {
+		history = append([]byte(nil), history[len(history)-kCompressionHistory:]...)
+	}
+	return history
+}
+
+// commandWriter collects commands and writes them as batches. With a
+// compression level, batches that are large enough are compressed.
+type commandWriter struct {
+	conn  io.Writer
+	level int
+	batch []byte
+
+	// Created for the first batch to compress
+	compressor *flate.Writer
+	compressed bytes.Buffer
+}
+
+func newCommandWriter(w io.Writer) *commandWriter {
+	return &commandWriter{conn: w}
+}
+
+// enableCompression compresses large batches with the given level from now
+// on. Commands written before are flushed without compression.
+func (w *commandWriter) enableCompression(level int) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	w.level = level
+	return nil
+}
+
+// Write adds the command to the batch. Writes the batch if it got large.
+func (w *commandWriter) Write(cmd []byte) error {
+	w.batch = append(w.batch, cmd...)
+	if len(w.batch) >= kMaxBatchSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush writes the batch.
+func (w *commandWriter) Flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	batch := w.batch
+	w.batch = w.batch[:0]
+	if w.level == 0 || len(batch) < kCompressionThreshold {
+		_, err := w.conn.Write(batch)
+		return err
+	}
+	if w.compressor == nil {
+		compressor, err := flate.NewWriter(&w.compressed, w.level)
+		if err != nil {
+			return err
+		}
+		w.compressor = compressor
+	}
+	w.compressed.Reset()
+	if _, err := w.compressor.Write(batch); err != nil {
+		return err
+	}
+	if err := w.compressor.Flush(); err != nil {
+		return err
+	}
+	header := appendUvarint([]byte{kCompressed}, uint64(len(batch)))
+	header = appendUvarint(header, uint64(w.compressed.Len()))
+	_, err := w.conn.Write(append(header, w.compressed.Bytes()...))
+	return err
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+var benchmarkRecording = flag.String("benchmark-recording", "", "Recording of a Widelands game used by the compression benchmarks instead of generated traffic")
+
+// compressedPeer talks to the relay using the compressed protocol after it
+// got its welcome.
+type compressedPeer struct {
+	conn   net.Conn
+	reader *commandReader
+	writer *commandWriter
+}
+
+func newCompressedPeer(conn net.Conn) *compressedPeer {
+	peer := &compressedPeer{
+		conn:   conn,
+		reader: newCommandReader(conn),
+		writer: newCommandWriter(conn),
+	}
+	peer.reader.enableCompression()
+	peer.writer.enableCompression(flate.BestSpeed)
+	return peer
+}
+
+func (p *compressedPeer) send(data ...byte) {
+	p.writer.Write(data)
+	p.writer.Flush()
+}
+
+// expectBytes expects a command, which might have been compressed.
+func (p *compressedPeer) expectBytes(c *C, expected ...byte) {
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	cmd, err := p.reader.ReadCommand()
+	c.Assert(err, IsNil)
+	got := make([]byte, len(expected)-1)
+	_, err = io.ReadFull(p.reader, got)
+	c.Assert(err, IsNil)
+	c.Assert(append([]byte{cmd}, got...), DeepEquals, expected)
+}
+
+func expectCompressedWelcome(c *C, conn net.Conn, name string) {
+	expectBytes(c, conn, append([]byte{kWelcome, kRelayProtocolVersion}, append([]byte(name), 0)...)...)
+}
+
+func (s *RelaySuite) TestCompressedAndUncompressedPeers(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	hostConn := connectWithVersion(server, "game", "pwd", kRelayProtocolVersion)
+	// The hello and welcome are not compressed
+	expectCompressedWelcome(c, hostConn, "game")
+	host := newCompressedPeer(hostConn)
+
+	old := connect(server, "game", "")
+	host.expectBytes(c, kConnectClient, 2)
+	expectWelcome(c, old, "game")
+	newConn := connectWithVersion(server, "game", "", kRelayProtocolVersion)
+	host.expectBytes(c, kConnectClient, 3)
+	expectCompressedWelcome(c, newConn, "game")
+	// The session token
+	_, err := io.ReadFull(newConn, make([]byte, 33))
+	c.Assert(err, IsNil)
+	client := newCompressedPeer(newConn)
+
+	// Large packets are compressed for the new client only
+	packet := append([]byte{0, 202}, bytes.Repeat([]byte{'x'}, 200)...)
+	host.send(append([]byte{kToClients, 2, 3, 0}, packet...)...)
+	expectBytes(c, old, append([]byte{kFromHost}, packet...)...)
+	client.expectBytes(c, append([]byte{kFromHost}, packet...)...)
+
+	send(old, kToHost, 0, 3, 'a')
+	host.expectBytes(c, kFromClient, 2, 0, 3, 'a')
+	client.send(kToHost, 0, 3, 'b')
+	host.expectBytes(c, kFromClient, 3, 0, 3, 'b')
+
+	client.send(kDisconnect, 'N', 'O', 'R', 'M', 'A', 'L', 0)
+	host.expectBytes(c, kDisconnectClient, 3)
+	client.expectBytes(c, append([]byte{kDisconnect}, []byte("NORMAL\x00")...)...)
+}
+
+func (s *RelaySuite) TestCompressedClientReturns(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	conn := connectWithVersion(server, "game", "", kRelayProtocolVersion)
+	expectBytes(c, host, kConnectClient, 2)
+	expectCompressedWelcome(c, conn, "game")
+	token := make([]byte, 33)
+	_, err := io.ReadFull(conn, token)
+	c.Assert(err, IsNil)
+
+	conn.Close()
+	waitForAwayClient(c, server.findGame("game"))
+	send(host, kToClients, 2, 0, 0, 3, 'x')
+
+	// Returning with the uncompressed protocol works as well
+	client := connectWithVersion(server, "game", string(token[:32]), kRelayProtocolVersionSessions)
+	expectBytes(c, client, append([]byte{kWelcome, kRelayProtocolVersionSessions}, append([]byte("game\x00"), token...)...)...)
+	expectBytes(c, client, kFromHost, 0, 3, 'x')
+}
+
+func (s *RelaySuite) TestUnsupportedVersions(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	conn := connectWithVersion(server, "game", "pwd", kRelayProtocolVersion+1)
+	expectDisconnect(c, conn, "WRONG_VERSION")
+	conn = connectWithVersion(server, "game", "pwd", 0)
+	expectDisconnect(c, conn, "WRONG_VERSION")
+
+	// Without compression, clients have to fall back to an older version
+	server.compressionLevel = 0
+	conn = connectWithVersion(server, "game", "pwd", kRelayProtocolVersion)
+	expectDisconnect(c, conn, "WRONG_VERSION")
+	conn = connect(server, "game", "pwd")
+	expectWelcome(c, conn, "game")
+}
+
+func (s *RelaySuite) TestOnlyLargeBatchesAreCompressed(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	conn := connectWithVersion(server, "game", "", kRelayProtocolVersion)
+	expectBytes(c, host, kConnectClient, 2)
+	expectCompressedWelcome(c, conn, "game")
+	_, err := io.ReadFull(conn, make([]byte, 33))
+	c.Assert(err, IsNil)
+
+	send(host, kToClients, 2, 0, 0, 4, 'a', 'b')
+	expectBytes(c, conn, kFromHost, 0, 4, 'a', 'b')
+
+	packet := append([]byte{4, 4}, bytes.Repeat([]byte("map data "), 114)...)
+	send(host, append([]byte{kToClients, 2, 0}, packet...)...)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reader := newCommandReader(conn)
+	header, err := reader.ReadByte()
+	c.Assert(err, IsNil)
+	c.Assert(header, Equals, kCompressed)
+	size, err := binary.ReadUvarint(reader)
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, uint64(len(packet)+1))
+	compressedSize, err := binary.ReadUvarint(reader)
+	c.Assert(err, IsNil)
+	c.Assert(compressedSize < size/4, Equals, true, Commentf("%v of %v bytes", compressedSize, size))
+}
+
+func (s *RelaySuite) TestCommandReaderAndWriter(c *C) {
+	random := rand.New(rand.NewSource(1))
+	var sent [][]byte
+	var buffer bytes.Buffer
+	writer := newCommandWriter(&buffer)
+	c.Assert(writer.enableCompression(flate.BestSpeed), IsNil)
+	// Enough batches to use up the history several times, with repetitions
+	// that refer to earlier batches
+	for len(sent) < 2000 {
+		cmd := []byte{kFromHost}
+		if len(sent) > 0 && random.Intn(2) == 0 {
+			cmd = sent[random.Intn(len(sent))]
+		} else {
+			cmd = append(cmd, make([]byte, 1+random.Intn(300))...)
+			random.Read(cmd[1:])
+		}
+		sent = append(sent, cmd)
+		c.Assert(writer.Write(cmd), IsNil)
+		if random.Intn(5) == 0 {
+			c.Assert(writer.Flush(), IsNil)
+		}
+	}
+	c.Assert(writer.Flush(), IsNil)
+
+	reader := newCommandReader(&buffer)
+	reader.enableCompression()
+	for i, cmd := range sent {
+		code, err := reader.ReadCommand()
+		c.Assert(err, IsNil)
+		c.Assert(code, Equals, cmd[0], Commentf("command %v", i))
+		got := make([]byte, len(cmd)-1)
+		_, err = io.ReadFull(reader, got)
+		c.Assert(err, IsNil)
+		c.Assert(got, DeepEquals, cmd[1:], Commentf("command %v", i))
+	}
+	_, err := reader.ReadCommand()
+	c.Assert(err, Equals, io.EOF)
+
+	// Without compression, kCompressed is an ordinary byte
+	reader = newCommandReader(bytes.NewReader([]byte{kCompressed, 200}))
+	code, err := reader.ReadCommand()
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, kCompressed)
+
+	reader = newCommandReader(bytes.NewReader([]byte{kCompressed, 10, 3, 1, 2, 3}))
+	reader.enableCompression()
+	_, err = reader.ReadCommand()
+	c.Assert(err, Equals, ErrInvalidCompressedData)
+}
+
+// Compression benchmarks. They show the bandwidth saved and the CPU needed
+// for the traffic of a recorded game when run with
+// -benchmark-recording=<file>. Otherwise traffic resembling a Widelands game
+// is generated: the transfer of the map, time updates and player commands
+// from the host, player commands and random sync reports from the clients and
+// some chat.
+
+// benchmarkTraffic returns the commands each connection of a game receives.
+func benchmarkTraffic(b *testing.B) [][][]byte {
+	if *benchmarkRecording == "" {
+		return generatedTraffic()
+	}
+	_, records, err := LoadRecording([]string{*benchmarkRecording})
+	if err != nil {
+		b.Fatal(err)
+	}
+	streams := make(map[uint8][][]byte)
+	observers := make(map[uint8]bool)
+	toClient := func(id uint8, packet []byte) {
+		streams[id] = append(streams[id], append([]byte{kFromHost}, packet...))
+	}
+	for _, record := range records {
+		switch record.Type {
+		case kRecordToHost:
+			streams[ID_HOST] = append(streams[ID_HOST], append([]byte{kFromClient, record.Ids[0]}, record.Packet...))
+		case kRecordToClients:
+			for _, id := range record.Ids {
+				toClient(id, record.Packet)
+			}
+		case kRecordObserver:
+			observers[record.Ids[0]] = true
+		case kRecordBroadcast:
+			for id := range observers {
+				toClient(id, record.Packet)
+			}
+		}
+	}
+	var traffic [][][]byte
+	for _, stream := range streams {
+		traffic = append(traffic, stream)
+	}
+	return traffic
+}
+
+func generatedTraffic() [][][]byte {
+	const nClients = 3
+	random := rand.New(rand.NewSource(1))
+	packet := func(data ...byte) []byte {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(data)+2))
+		return append(length, data...)
+	}
+	uint32Bytes := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	playerCommand := func(gameTime uint32) []byte {
+		data := append([]byte{7}, uint32Bytes(gameTime)...)
+		// Command type, player, object serial and coordinates
+		data = append(data, byte(random.Intn(20)), byte(1+random.Intn(nClients)))
+		data = append(data, uint32Bytes(uint32(1000+random.Intn(5000)))...)
+		return append(data, byte(random.Intn(64)), byte(random.Intn(64)))
+	}
+	traffic := make([][][]byte, nClients+1)
+	toClients := func(p []byte) {
+		for i := 1; i <= nClients; i++ {
+			traffic[i] = append(traffic[i], append([]byte{kFromHost}, p...))
+		}
+	}
+	// The map is sent in parts before the game starts. Map files consist of
+	// many similar entries.
+	var mapFile []byte
+	for len(mapFile) < 200<<10 {
+		mapFile = append(mapFile, fmt.Sprintf("[%v]\nterrain=\"%v\"\nresources=%v\n", len(mapFile), []string{"meadow", "water", "mountain", "desert"}[random.Intn(4)], random.Intn(20))...)
+	}
+	for part := 0; part*4096 < len(mapFile); part++ {
+		end := (part + 1) * 4096
+		if end > len(mapFile) {
+			end = len(mapFile)
+		}
+		toClients(packet(append([]byte{21}, mapFile[part*4096:end]...)...))
+	}
+	for gameTime := uint32(0); gameTime < 10*60*1000; gameTime += 250 {
+		toClients(packet(append([]byte{3}, uint32Bytes(gameTime)...)...))
+		if random.Intn(4) == 0 {
+			client := byte(2 + random.Intn(nClients))
+			cmd := playerCommand(gameTime)
+			traffic[0] = append(traffic[0], append([]byte{kFromClient, client}, packet(cmd...)...))
+			toClients(packet(cmd...))
+		}
+		if gameTime%5000 == 0 {
+			for i := 0; i < nClients; i++ {
+				report := append([]byte{10}, uint32Bytes(gameTime)...)
+				hash := make([]byte, 16)
+				random.Read(hash)
+				report = append(report, hash...)
+				traffic[0] = append(traffic[0], append([]byte{kFromClient, byte(2 + i)}, packet(report...)...))
+			}
+		}
+		if random.Intn(200) == 0 {
+			toClients(packet(append([]byte{11}, []byte("Player 2: anyone up for a rematch?\x00")...)...))
+		}
+	}
+	return traffic
+}
+
+func trafficSize(traffic [][][]byte) int64 {
+	size := 0
+	for _, stream := range traffic {
+		for _, cmd := range stream {
+			size += len(cmd)
+		}
+	}
+	return int64(size)
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// compressTraffic writes each stream with its own commandWriter and returns
+// the size of what was written. Flushes after the given number of commands,
+// like the relay does when there is nothing else to send.
+func compressTraffic(traffic [][][]byte, level, batch int, out func(int) io.Writer) int64 {
+	size := int64(0)
+	for i, stream := range traffic {
+		counter := &countingWriter{}
+		writer := newCommandWriter(io.MultiWriter(counter, out(i)))
+		writer.enableCompression(level)
+		for j, cmd := range stream {
+			writer.Write(cmd)
+			if (j+1)%batch == 0 {
+				writer.Flush()
+			}
+		}
+		writer.Flush()
+		size += counter.n
+	}
+	return size
+}
+
+func benchmarkCompression(b *testing.B, level, batch int) {
+	traffic := benchmarkTraffic(b)
+	raw := trafficSize(traffic)
+	b.SetBytes(raw)
+	b.ResetTimer()
+	compressed := int64(0)
+	for i := 0; i < b.N; i++ {
+		compressed = compressTraffic(traffic, level, batch, func(int) io.Writer { return ioutil.Discard })
+	}
+	b.ReportMetric(float64(compressed)/float64(raw), "ratio")
+}
+
+// Flushing after each command is the worst case, when commands are sent
+// slower than the connection allows. Only file transfers are compressed then.
+func BenchmarkCompressionBestSpeed(b *testing.B) {
+	benchmarkCompression(b, flate.BestSpeed, 1)
+}
+
+func BenchmarkCompressionDefault(b *testing.B) {
+	benchmarkCompression(b, flate.DefaultCompression, 1)
+}
+
+func BenchmarkCompressionHuffmanOnly(b *testing.B) {
+	benchmarkCompression(b, flate.HuffmanOnly, 1)
+}
+
+func BenchmarkCompressionBestSpeedBatched(b *testing.B) {
+	benchmarkCompression(b, flate.BestSpeed, 10)
+}
+
+func BenchmarkDecompression(b *testing.B) {
+	traffic := benchmarkTraffic(b)
+	buffers := make([]bytes.Buffer, len(traffic))
+	compressTraffic(traffic, flate.BestSpeed, 10, func(i int) io.Writer { return &buffers[i] })
+	b.SetBytes(trafficSize(traffic))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range buffers {
+			reader := newCommandReader(bytes.NewReader(buffers[j].Bytes()))
+			reader.enableCompression()
+			// Uncompressed data is read byte by byte, unpacked batches are
+			// dropped
+			for {
+				if _, err := reader.ReadCommand(); err != nil {
+					break
+				}
+				reader.pending = reader.pending[:0]
+			}
+		}
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"container/list"
-	"io"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
 	"math"
+	"sync"
 	"time"
 )
 
@@ -14,19 +16,70 @@ const ID_HOST = 1
 // The used protocol version is not known since the host has not yet connected
 const VERSION_UNKNOWN = 0
 
+// gameVersion returns the version of the protocol between host and clients
+// that is used with the given relay protocol version. Relay protocol versions
+// that only change how the relay talks to its peers map to the same version,
+// so hosts and clients using them can play together.
+func gameVersion(version uint8) uint8 {
+	if version > kRelayProtocolVersionOldest {
+		return kRelayProtocolVersionOldest
+	}
+	return version
+}
+
+// A client whose connection got lost. Its slot is kept for some time, so it
+// can return with its session token and keep its id.
+type awayClient struct {
+	id uint8
+
+	// The join token the client used, see Client.joinToken
+	joinToken string
+
+	// Commands of the host to the client, sent when it returns
+	buffer []*Command
+
+	// Removes the client from the game for good when it does not return
+	timer *time.Timer
+}
+
+// The fields of a game are guarded by its mutex. The mutex is never held while
+// calling the server or waiting for the network, except for handing commands
+// to the writer goroutines of the clients and queueing notifications for the
+// metaserver.
 type Game struct {
+	mutex sync.Mutex
+
 	// The connection (net.Conn most likely) that let us talk to the game host
 	host *Client
 
-	// Game clients and observers. For the relay there is not difference
-	// between them
+	// Whether the connection to the host has been lost and we are waiting for
+	// it to return. Commands to the host are kept in hostBuffer meanwhile.
+	hostAway      bool
+	hostBuffer    []*Command
+	hostAwayTimer *time.Timer
+
+	// Game clients and observers. For the relay the only difference is that
+	// observers get the broadcasts of the host
 	clients *list.List
 
+	// Clients that lost their connection, by their session token
+	awayClients map[string]*awayClient
+
+	// The ids of the clients the host marked as observers. They get the
+	// broadcasts of the host.
+	observers map[uint8]bool
+
+	// The broadcasts since the last catch-up point, sent to observers added
+	// later. Dropped until the next catch-up point when they get too large.
+	catchUp        []*Command
+	catchUpSize    int
+	catchUpDropped bool
+
 	// The id the next client will get assigned
 	nextClientId uint8
 
-	// The protocol version used for communication. Set on connect of the host
-	// and has to be the same for all clients.
+	// The protocol version used by the host. Set on connect of the host and
+	// clients need one with the same gameVersion().
 	// This has to be specific for a game since there might be a newer
 	// version in trunk than in the latest release
 	protocolVersion uint8
@@ -39,25 +92,45 @@ type Game struct {
 	// he really is the host
 	hostPassword string
 
+	// Whether clients need a join token from the metaserver. Each token lets
+	// one client join. Games become restricted when the host bans a client,
+	// since the metaserver gives no token to banned users.
+	restricted bool
+	joinTokens map[string]bool
+
+	// The session tokens of kicked clients, so they can not return
+	kicked map[string]bool
+
 	// A reference of the server since we have to tell him when we shut down
 	server *Server
 
 	// Whether we are currently shutting down
 	currentlyShuttingDown bool
+
+	// Records the relayed packets if recording is enabled for the game
+	recorder *Recorder
 }
 
-func NewGame(name, password string, server *Server) *Game {
+func NewGame(name, password string, restricted bool, server *Server) *Game {
 	game := &Game{
 		host:                  nil,
 		clients:               list.New(),
+		awayClients:           make(map[string]*awayClient),
+		observers:             make(map[uint8]bool),
 		nextClientId:          ID_HOST + 1,
 		protocolVersion:       VERSION_UNKNOWN,
 		gameName:              name,
 		hostPassword:          password,
+		restricted:            restricted,
+		joinTokens:            make(map[string]bool),
+		kicked:                make(map[string]bool),
 		server:                server,
 		currentlyShuttingDown: false,
 	}
-	time.AfterFunc(30 * time.Second, func() { server.RemoveGameIfNoHostIsConnected(name) })
+	time.AfterFunc(server.HostConnectTimeout(), func() { server.RemoveGameIfNoHostIsConnected(name) })
+	if server.RecordingPolicy().AllGames {
+		game.StartRecording()
+	}
 	return game
 }
 
@@ -65,92 +138,748 @@ func (game *Game) Name() string {
 	return game.gameName
 }
 
+// Host returns the host of the game or nil if it is not connected.
+func (game *Game) Host() *Client {
+	game.mutex.Lock()
+	defer game.mutex.Unlock()
+	return game.host
+}
+
+// StartRecording starts recording the game unless it is recorded already.
+// Returns false if recording is disabled or did not work.
+func (game *Game) StartRecording() bool {
+	policy := game.server.RecordingPolicy()
+	if !policy.Enabled() {
+		return false
+	}
+	game.mutex.Lock()
+	defer game.mutex.Unlock()
+	if game.currentlyShuttingDown {
+		return false
+	}
+	if game.recorder != nil {
+		return true
+	}
+	recorder, err := NewRecorder(policy, game.gameName)
+	if err != nil {
+		log.Printf("Unable to record game '%v': %v", game.gameName, err)
+		return false
+	}
+	game.recorder = recorder
+	// Start with who is already there
+	if game.host != nil {
+		recorder.Connected(ID_HOST)
+	}
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		recorder.Connected(e.Value.(*Client).Id())
+	}
+	return true
+}
+
+// AddJoinToken allows one client to join the game with the given token. In
+// games that are not restricted the token tells the metaserver which user
+// the client is.
+func (game *Game) AddJoinToken(token string) {
+	game.mutex.Lock()
+	defer game.mutex.Unlock()
+	game.joinTokens[token] = true
+}
+
+// recording returns the recorder of the game or nil if it is not recorded.
+func (game *Game) recording() *Recorder {
+	game.mutex.Lock()
+	defer game.mutex.Unlock()
+	return game.recorder
+}
+
+// closeIfNoHost marks the game as shutting down if no host has connected to
+// it yet. Returns whether the game has been closed.
+func (game *Game) closeIfNoHost() bool {
+	game.mutex.Lock()
+	defer game.mutex.Unlock()
+	if game.host != nil || game.hostAway || game.currentlyShuttingDown {
+		return false
+	}
+	game.currentlyShuttingDown = true
+	return true
+}
+
 func (game *Game) Shutdown() {
+	game.mutex.Lock()
+	game.shutdownLocked()
+}
+
+// shutdownLocked is like Shutdown but has to be called with the mutex held.
+// Releases it.
+func (game *Game) shutdownLocked() {
 	if game.currentlyShuttingDown == true {
+		game.mutex.Unlock()
 		return
 	}
 	game.currentlyShuttingDown = true
+	host := game.host
+	game.host = nil
+	if game.hostAway {
+		game.hostAwayTimer.Stop()
+		game.hostAway = false
+		game.hostBuffer = nil
+	}
+	var clients []*Client
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		clients = append(clients, e.Value.(*Client))
+	}
+	game.clients.Init()
+	var awayIds []uint8
+	for token, away := range game.awayClients {
+		away.timer.Stop()
+		awayIds = append(awayIds, away.id)
+		delete(game.awayClients, token)
+	}
+	game.observers = make(map[uint8]bool)
+	game.catchUp = nil
+	recorder := game.recorder
+	game.recorder = nil
+	game.mutex.Unlock()
+	recorder.Close()
+
 	log.Printf("Shutting down game '%v'\n", game.gameName)
-	for game.clients.Len() > 0 {
-		game.DisconnectClient(game.clients.Front().Value.(*Client), "NORMAL")
+	if host != nil {
+		for _, id := range awayIds {
+			cmd := NewCommand(kDisconnectClient)
+			cmd.AppendUInt(id)
+			host.SendCommand(cmd)
+		}
+	}
+	for _, client := range clients {
+		if host != nil {
+			cmd := NewCommand(kDisconnectClient)
+			cmd.AppendUInt(client.Id())
+			host.SendCommand(cmd)
+		}
+		client.Disconnect("NORMAL")
+	}
+	if host != nil {
+		host.Disconnect("NORMAL")
 	}
-	game.DisconnectClient(game.host, "NORMAL")
 	game.server.RemoveGameObject(game)
 }
 
 func (game *Game) addClient(client *Client, version uint8, password string) {
-	if game.host == nil {
+	game.mutex.Lock()
+	if game.currentlyShuttingDown {
+		game.mutex.Unlock()
+		client.Disconnect("GAME_UNKNOWN")
+		return
+	}
+	if (game.host != nil || game.hostAway) && password == game.hostPassword {
+		game.hostReturned(client, version)
+		return
+	}
+	if game.host == nil && !game.hostAway {
 		// First connection to this game / no host yet
 		if password != game.hostPassword {
+			game.mutex.Unlock()
 			client.Disconnect("NO_HOST")
 			return
 		}
 		game.protocolVersion = version
 		game.host = client
-		game.host.id = ID_HOST
-		go game.handleHostMessages()
-		// Send message to metaserver
+		client.setId(ID_HOST)
+		game.recorder.Connected(ID_HOST)
+		// Send the welcome while holding the mutex so it arrives before the
+		// first kConnectClient
+		client.SendCommand(newWelcome(version, game.gameName, ""))
+		// Tell the metaserver before any client joins
 		game.server.GameConnected(game.Name())
+		game.mutex.Unlock()
+		go game.handleHostMessages(client)
 		log.Printf("Accepted new host (id=%v) with protocol version %v for game '%v'", ID_HOST, version, game.Name())
 	} else {
 		// A normal client
-		if game.protocolVersion != version {
+		if gameVersion(game.protocolVersion) != gameVersion(version) {
+			game.mutex.Unlock()
 			client.Disconnect("WRONG_VERSION")
 			return
 		}
+		if game.kicked[password] {
+			game.mutex.Unlock()
+			client.Disconnect("KICKED")
+			return
+		}
+		if away, ok := game.awayClients[password]; ok && version >= kRelayProtocolVersionSessions {
+			// Clients present their session token instead of a password
+			game.clientReturned(client, version, password, away)
+			return
+		}
+		if old := game.getClientWithSessionLocked(password); old != nil && version >= kRelayProtocolVersionSessions {
+			// We did not notice yet that the old connection broke
+			game.clientTookOver(client, version, old)
+			return
+		}
+		// Clients present their join token instead of a password
+		if game.joinTokens[password] {
+			delete(game.joinTokens, password)
+			client.joinToken = password
+		} else if game.restricted {
+			game.mutex.Unlock()
+			log.Printf("Refused client without valid join token for game '%v'", game.Name())
+			client.Disconnect("NOT_AUTHORIZED")
+			return
+		}
 		if game.nextClientId >= 250 {
+			game.mutex.Unlock()
 			// Avoid overflow of uint8 id
 			log.Printf("Too many clients in game %v, disconnecting new client", game.Name())
 			client.Disconnect("NORMAL")
 			return
 		}
-		client.id = game.nextClientId
+		id := game.nextClientId
+		client.setId(id)
+		client.version = version
 		game.nextClientId = game.nextClientId + 1
+		if version >= kRelayProtocolVersionSessions {
+			client.sessionToken = newSessionToken()
+		}
 		game.clients.PushBack(client)
-		go game.handleClientMessages(client)
+		game.recorder.Connected(id)
+		if client.joinToken != "" {
+			game.server.ClientConnected(game.gameName, client.joinToken)
+		}
 		cmd := NewCommand(kConnectClient)
-		cmd.AppendUInt(client.id)
-		game.host.SendCommand(cmd)
-		log.Printf("Accepted new client (id=%v) with protocol version %v for game '%v'", client.id, version, game.Name())
+		cmd.AppendUInt(id)
+		if !game.sendToHostLocked(cmd) {
+			// Also disconnects the new client
+			game.hostBufferFull()
+			return
+		}
+		// Send the welcome while holding the mutex so it arrives before a
+		// possible kHostAway or kHostReturned
+		client.SendCommand(newWelcome(version, game.gameName, client.sessionToken))
+		if game.hostAway && version >= kRelayProtocolVersionHostAway {
+			client.SendCommand(NewCommand(kHostAway))
+		}
+		game.mutex.Unlock()
+		go game.handleClientMessages(client)
+		log.Printf("Accepted new client (id=%v) with protocol version %v for game '%v'", id, version, game.Name())
 	}
+}
+
+// newWelcome creates the welcome message. Clients other than the host get the
+// token they can use to resume their session after losing the connection if
+// their protocol version supports it.
+func newWelcome(version uint8, name, sessionToken string) *Command {
 	cmd := NewCommand(kWelcome)
-	cmd.AppendUInt(game.protocolVersion)
-	cmd.AppendString(game.gameName)
-	client.SendCommand(cmd)
+	cmd.AppendUInt(version)
+	cmd.AppendString(name)
+	if sessionToken != "" {
+		cmd.AppendString(sessionToken)
+	}
+	return cmd
+}
+
+func newSessionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Unable to create session token: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// hostReturned accepts the host back after its connection got lost. The host
+// gets all commands it missed and the clients are told that it is back. If we
+// did not notice yet that the old connection broke, it is closed.
+// Has to be called with the mutex held, releases it.
+func (game *Game) hostReturned(host *Client, version uint8) {
+	if gameVersion(version) != gameVersion(game.protocolVersion) {
+		game.mutex.Unlock()
+		host.Disconnect("WRONG_VERSION")
+		return
+	}
+	old := game.host
+	wasAway := game.hostAway
+	if wasAway {
+		game.hostAwayTimer.Stop()
+		game.hostAway = false
+	} else {
+		game.recorder.Disconnected(ID_HOST)
+	}
+	game.host = host
+	host.setId(ID_HOST)
+	game.recorder.Connected(ID_HOST)
+	host.SendCommand(newWelcome(version, game.gameName, ""))
+	for _, cmd := range game.hostBuffer {
+		host.SendCommand(cmd)
+	}
+	nMissed := len(game.hostBuffer)
+	game.hostBuffer = nil
+	if wasAway {
+		// The clients were not told that the host was away otherwise
+		game.sendHostStatusLocked(kHostReturned)
+	}
+	game.mutex.Unlock()
+	if old != nil {
+		old.Disconnect("NORMAL")
+	}
+	go game.handleHostMessages(host)
+	log.Printf("Host of game '%v' returned, forwarded %v missed commands", game.Name(), nMissed)
+}
+
+// hostConnectionLost keeps the game open for some time after the connection
+// to the host broke, so the host can return.
+func (game *Game) hostConnectionLost(host *Client) {
+	game.mutex.Lock()
+	if game.host != host || game.currentlyShuttingDown {
+		game.mutex.Unlock()
+		host.Disconnect("NORMAL")
+		return
+	}
+	game.host = nil
+	game.hostAway = true
+	game.hostBuffer = nil
+	game.recorder.Disconnected(ID_HOST)
+	game.hostAwayTimer = time.AfterFunc(game.server.HostReconnectTimeout(), game.hostReconnectTimedOut)
+	game.sendHostStatusLocked(kHostAway)
+	game.mutex.Unlock()
+	host.Disconnect("NORMAL")
+	log.Printf("Lost connection to host of game '%v', waiting for it to return", game.Name())
 }
 
-func (game *Game) getClient(id uint8) *Client {
+// sendHostStatusLocked sends kHostAway or kHostReturned to the clients whose
+// protocol version knows them. Has to be called with the mutex held.
+func (game *Game) sendHostStatusLocked(command uint8) {
 	for e := game.clients.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Client).id == id {
+		if client := e.Value.(*Client); client.version >= kRelayProtocolVersionHostAway {
+			client.SendCommand(NewCommand(command))
+		}
+	}
+}
+
+func (game *Game) hostReconnectTimedOut() {
+	game.mutex.Lock()
+	if !game.hostAway || game.currentlyShuttingDown {
+		game.mutex.Unlock()
+		return
+	}
+	log.Printf("Host of game '%v' did not return", game.Name())
+	game.shutdownLocked()
+}
+
+// hostBufferFull closes the game since the host missed too much to continue.
+// Has to be called with the mutex held, releases it.
+func (game *Game) hostBufferFull() {
+	log.Printf("Too many commands for the host of game '%v' while it is away", game.Name())
+	game.shutdownLocked()
+}
+
+// sendToHost sends the command to the host. While the host is away the
+// command is kept until it returns.
+func (game *Game) sendToHost(cmd *Command) {
+	game.mutex.Lock()
+	if !game.sendToHostLocked(cmd) {
+		game.hostBufferFull()
+		return
+	}
+	game.mutex.Unlock()
+}
+
+// sendToHostLocked is like sendToHost but has to be called with the mutex
+// held. Returns false if the buffer for the host is full and the game has to
+// be closed.
+func (game *Game) sendToHostLocked(cmd *Command) bool {
+	if game.host != nil {
+		game.host.SendCommand(cmd)
+		return true
+	}
+	if !game.hostAway {
+		// The game is shutting down
+		return true
+	}
+	if len(game.hostBuffer) >= game.server.HostBufferSize() {
+		return false
+	}
+	game.hostBuffer = append(game.hostBuffer, cmd)
+	return true
+}
+
+// getClientLocked returns the connected client with the given id or nil. Has
+// to be called with the mutex held.
+func (game *Game) getClientLocked(id uint8) *Client {
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Client).Id() == id {
 			return e.Value.(*Client)
 		}
 	}
 	return nil
 }
 
+// getClientWithSessionLocked returns the connected client with the given
+// session token or nil. Has to be called with the mutex held.
+func (game *Game) getClientWithSessionLocked(token string) *Client {
+	if token == "" {
+		return nil
+	}
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Client).sessionToken == token {
+			return e.Value.(*Client)
+		}
+	}
+	return nil
+}
+
+// clientReturned lets a client that lost its connection take over its old
+// slot. It gets all commands it missed while the host does not notice.
+// Has to be called with the mutex held, releases it.
+func (game *Game) clientReturned(client *Client, version uint8, token string, away *awayClient) {
+	away.timer.Stop()
+	delete(game.awayClients, token)
+	game.resumeSessionLocked(client, version, token, away.id, away.joinToken, away.buffer)
+	game.mutex.Unlock()
+	go game.handleClientMessages(client)
+	log.Printf("Client (id=%v) returned to game '%v', forwarded %v missed commands", away.id, game.Name(), len(away.buffer))
+}
+
+// clientTookOver lets a client that reconnected before we noticed that its
+// old connection broke take over the slot of the old connection, which is
+// closed. The host does not notice. Has to be called with the mutex held,
+// releases it.
+func (game *Game) clientTookOver(client *Client, version uint8, old *Client) {
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Client) == old {
+			game.clients.Remove(e)
+			break
+		}
+	}
+	id := old.Id()
+	game.recorder.Disconnected(id)
+	game.resumeSessionLocked(client, version, old.sessionToken, id, old.joinToken, nil)
+	game.mutex.Unlock()
+	old.Disconnect("NORMAL")
+	go game.handleClientMessages(client)
+	log.Printf("Client (id=%v) of game '%v' reconnected, closing its old connection", id, game.Name())
+}
+
+// resumeSessionLocked gives the client the slot with the given id and sends
+// it the commands it missed. Has to be called with the mutex held.
+func (game *Game) resumeSessionLocked(client *Client, version uint8, token string, id uint8, joinToken string, missed []*Command) {
+	client.setId(id)
+	client.version = version
+	client.sessionToken = token
+	client.joinToken = joinToken
+	game.clients.PushBack(client)
+	game.recorder.Connected(id)
+	client.SendCommand(newWelcome(version, game.gameName, token))
+	for _, cmd := range missed {
+		client.SendCommand(cmd)
+	}
+	if game.hostAway {
+		client.SendCommand(NewCommand(kHostAway))
+	}
+}
+
+// clientConnectionLost keeps the slot of the client for some time after its
+// connection broke, so it can return.
+func (game *Game) clientConnectionLost(client *Client) {
+	if client.IsDisconnected() {
+		// We closed the connection on purpose
+		game.DisconnectClient(client, "NORMAL")
+		return
+	}
+	game.mutex.Lock()
+	if client.sessionToken == "" {
+		// Clients of older protocol versions can not return
+		game.mutex.Unlock()
+		game.DisconnectClient(client, "NORMAL")
+		return
+	}
+	found := false
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Client) == client {
+			game.clients.Remove(e)
+			found = true
+			break
+		}
+	}
+	if !found {
+		game.mutex.Unlock()
+		client.Disconnect("NORMAL")
+		return
+	}
+	token := client.sessionToken
+	away := &awayClient{id: client.Id(), joinToken: client.joinToken}
+	game.recorder.Disconnected(away.id)
+	away.timer = time.AfterFunc(game.server.ClientReconnectTimeout(), func() { game.clientReconnectTimedOut(token) })
+	game.awayClients[token] = away
+	game.mutex.Unlock()
+	client.Disconnect("NORMAL")
+	log.Printf("Lost connection to client (id=%v) of game '%v', waiting for it to return", away.id, game.Name())
+}
+
+func (game *Game) clientReconnectTimedOut(token string) {
+	game.mutex.Lock()
+	if _, ok := game.awayClients[token]; !ok {
+		game.mutex.Unlock()
+		return
+	}
+	log.Printf("Client (id=%v) of game '%v' did not return", game.awayClients[token].id, game.Name())
+	if !game.removeAwayClientLocked(token) {
+		game.hostBufferFull()
+		return
+	}
+	game.mutex.Unlock()
+}
+
+// removeAwayClientLocked removes the slot of a client that is away and tells
+// the host that the client is gone. Has to be called with the mutex held.
+// Returns false if the buffer for the host is full and the game has to be
+// closed.
+func (game *Game) removeAwayClientLocked(token string) bool {
+	away := game.awayClients[token]
+	away.timer.Stop()
+	delete(game.awayClients, token)
+	delete(game.observers, away.id)
+	if away.joinToken != "" {
+		game.server.ClientDisconnected(game.gameName, away.joinToken)
+	}
+	cmd := NewCommand(kDisconnectClient)
+	cmd.AppendUInt(away.id)
+	return game.sendToHostLocked(cmd)
+}
+
+// sendToClients sends the command to the clients with the given ids. Commands
+// to clients that are away are kept until they return.
+func (game *Game) sendToClients(ids []uint8, cmd *Command) {
+	game.mutex.Lock()
+	if !game.sendToClientsLocked(ids, cmd) {
+		game.hostBufferFull()
+		return
+	}
+	game.mutex.Unlock()
+}
+
+// sendToClientsLocked is like sendToClients but has to be called with the
+// mutex held. Returns false if the buffer for the host is full and the game
+// has to be closed.
+func (game *Game) sendToClientsLocked(ids []uint8, cmd *Command) bool {
+	var tooSlow []string
+	for _, id := range ids {
+		if client := game.getClientLocked(id); client != nil {
+			client.SendCommand(cmd)
+			continue
+		}
+		// Ids of clients that left for good are ignored. The host might not
+		// know yet that they are gone.
+		for token, away := range game.awayClients {
+			if away.id != id {
+				continue
+			}
+			if len(away.buffer) >= game.server.ClientBufferSize() {
+				tooSlow = append(tooSlow, token)
+			} else {
+				away.buffer = append(away.buffer, cmd)
+			}
+		}
+	}
+	for _, token := range tooSlow {
+		log.Printf("Client (id=%v) of game '%v' missed too much, removing it", game.awayClients[token].id, game.Name())
+		if !game.removeAwayClientLocked(token) {
+			return false
+		}
+	}
+	return true
+}
+
+// isInGameLocked returns whether the client with the given id is connected or
+// away. Has to be called with the mutex held.
+func (game *Game) isInGameLocked(id uint8) bool {
+	if game.getClientLocked(id) != nil {
+		return true
+	}
+	for _, away := range game.awayClients {
+		if away.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// addObserver marks the client as observer and sends it the broadcasts since
+// the last catch-up point, so the host does not have to.
+func (game *Game) addObserver(id uint8) {
+	game.mutex.Lock()
+	if game.observers[id] || !game.isInGameLocked(id) {
+		game.mutex.Unlock()
+		return
+	}
+	game.observers[id] = true
+	if game.catchUpDropped {
+		log.Printf("Catch-up data of game '%v' is missing for observer (id=%v)", game.Name(), id)
+	}
+	if len(game.catchUp) > 0 {
+		// As one command, so a long catch-up does not fill the send queue
+		catchUp := &Command{}
+		for _, cmd := range game.catchUp {
+			catchUp.AppendBytes(cmd.GetBytes())
+		}
+		if !game.sendToClientsLocked([]uint8{id}, catchUp) {
+			game.hostBufferFull()
+			return
+		}
+	}
+	game.mutex.Unlock()
+	log.Printf("Client (id=%v) of game '%v' is an observer now", id, game.Name())
+}
+
+// broadcast sends the command to all observers and keeps it for the ones added
+// later.
+func (game *Game) broadcast(flags uint8, cmd *Command) {
+	game.mutex.Lock()
+	if flags&kBroadcastCatchUp != 0 {
+		game.catchUp = nil
+		game.catchUpSize = 0
+		game.catchUpDropped = false
+	}
+	if !game.catchUpDropped {
+		game.catchUpSize += len(cmd.GetBytes())
+		if game.catchUpSize > game.server.CatchUpSize() {
+			log.Printf("Catch-up data of game '%v' exceeds %v bytes, dropping it", game.Name(), game.server.CatchUpSize())
+			game.catchUp = nil
+			game.catchUpDropped = true
+		} else {
+			game.catchUp = append(game.catchUp, cmd)
+		}
+	}
+	var ids []uint8
+	for id := range game.observers {
+		ids = append(ids, id)
+	}
+	if !game.sendToClientsLocked(ids, cmd) {
+		game.hostBufferFull()
+		return
+	}
+	game.mutex.Unlock()
+}
+
+// kickClient removes the client with the given id for good, whether it is
+// connected or away. Its session token becomes invalid. The metaserver is
+// told about it instead of a ClientDisconnected, so it can keep a banned
+// user from joining again.
+func (game *Game) kickClient(id uint8, ban bool) {
+	game.mutex.Lock()
+	client := game.getClientLocked(id)
+	var joinToken string
+	if client != nil {
+		for e := game.clients.Front(); e != nil; e = e.Next() {
+			if e.Value.(*Client) == client {
+				game.clients.Remove(e)
+				break
+			}
+		}
+		joinToken = client.joinToken
+		if client.sessionToken != "" {
+			game.kicked[client.sessionToken] = true
+		}
+		game.recorder.Disconnected(id)
+	} else {
+		found := false
+		for token, away := range game.awayClients {
+			if away.id == id {
+				away.timer.Stop()
+				delete(game.awayClients, token)
+				joinToken = away.joinToken
+				game.kicked[token] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			game.mutex.Unlock()
+			return
+		}
+	}
+	delete(game.observers, id)
+	if ban {
+		// Otherwise the user could join again without a join token
+		game.restricted = true
+	}
+	if joinToken != "" {
+		game.server.ClientKicked(game.gameName, joinToken, ban)
+	}
+	cmd := NewCommand(kDisconnectClient)
+	cmd.AppendUInt(id)
+	if !game.sendToHostLocked(cmd) {
+		game.hostBufferFull()
+	} else {
+		game.mutex.Unlock()
+	}
+	if client != nil {
+		client.Disconnect("KICKED")
+	}
+	log.Printf("Host of game '%v' kicked client (id=%v), ban=%v", game.Name(), id, ban)
+	if ban {
+		log.Printf("Game '%v' only accepts clients with a join token from now on", game.Name())
+	}
+}
+
+// QueueStats returns the statistics of the send queues of the host and all
+// clients by their id.
+func (game *Game) QueueStats() map[uint8]QueueStats {
+	game.mutex.Lock()
+	var clients []*Client
+	if game.host != nil {
+		clients = append(clients, game.host)
+	}
+	for e := game.clients.Front(); e != nil; e = e.Next() {
+		clients = append(clients, e.Value.(*Client))
+	}
+	game.mutex.Unlock()
+
+	stats := make(map[uint8]QueueStats)
+	for _, client := range clients {
+		stats[client.Id()] = client.QueueStats()
+	}
+	return stats
+}
+
 func (game *Game) DisconnectClient(client *Client, reason string) {
 	if client == nil {
 		return
-	} else if game.host == client {
-		game.host.Disconnect(reason)
+	}
+	game.mutex.Lock()
+	if game.host == client {
 		game.host = nil
+		game.recorder.Disconnected(ID_HOST)
+		game.mutex.Unlock()
+		client.Disconnect(reason)
 		// Admittedly: Shutting down the game is hard. But when the host is sending
 		// trash or becomes disconnected there is nothing we can do anyway
 		game.Shutdown()
 		return
 	}
+	found := false
 	for e := game.clients.Front(); e != nil; e = e.Next() {
 		if e.Value.(*Client) == client {
-			if game.host != nil {
-				cmd := NewCommand(kDisconnectClient)
-				cmd.AppendUInt(client.id)
-				game.host.SendCommand(cmd)
-			}
-			client.Disconnect(reason)
 			game.clients.Remove(e)
+			found = true
 			break
 		}
 	}
+	if !found {
+		game.mutex.Unlock()
+		return
+	}
+	game.recorder.Disconnected(client.Id())
+	delete(game.observers, client.Id())
+	if client.joinToken != "" {
+		game.server.ClientDisconnected(game.gameName, client.joinToken)
+	}
+	cmd := NewCommand(kDisconnectClient)
+	cmd.AppendUInt(client.Id())
+	if !game.sendToHostLocked(cmd) {
+		game.hostBufferFull()
+	} else {
+		game.mutex.Unlock()
+	}
+	client.Disconnect(reason)
 }
 
 func (game *Game) handlePong(client *Client) {
@@ -165,43 +894,37 @@ func (game *Game) handlePong(client *Client) {
 func (game *Game) addClientRTT(cmd *Command, client *Client) {
 	rtt_ms := client.RttLastPing() / time.Millisecond
 	time_s := time.Since(client.TimeLastPong()).Seconds()
-	cmd.AppendUInt(client.id)
+	cmd.AppendUInt(client.Id())
 	cmd.AppendUInt(uint8(math.Min(float64(rtt_ms), 255)))
 	cmd.AppendUInt(uint8(math.Min(time_s, 255)))
 }
 
 func (game *Game) sendRTTs(receiver *Client) {
-	cmd := NewCommand(kRoundTripTimeResponse)
-	// Count how many non-nil clients we have
-	client_count := 0
+	var clients []*Client
+	game.mutex.Lock()
 	if game.host != nil {
-		client_count++
+		clients = append(clients, game.host)
 	}
 	for e := game.clients.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Client) != nil {
-			client_count++
-		}
-	}
-	cmd.AppendUInt(uint8(client_count))
-	if game.host != nil {
-		game.addClientRTT(cmd, game.host)
+		clients = append(clients, e.Value.(*Client))
 	}
-	for e := game.clients.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Client) != nil {
-			game.addClientRTT(cmd, e.Value.(*Client))
-		}
+	game.mutex.Unlock()
+
+	cmd := NewCommand(kRoundTripTimeResponse)
+	cmd.AppendUInt(uint8(len(clients)))
+	for _, client := range clients {
+		game.addClientRTT(cmd, client)
 	}
 	receiver.SendCommand(cmd)
 }
+
 func (game *Game) handleClientMessages(client *Client) {
 	for {
 		// Read for ever until an error occurres or we receive a disconnect
-		command, err := client.ReadUint8()
-		if err == io.EOF {
-			game.DisconnectClient(client, "NORMAL")
-			return
-		} else if err != nil {
-			game.DisconnectClient(client, "PROTOCOL_VIOLATION")
+		command, err := client.ReadCommand()
+		if err != nil {
+			// The client might come back, so keep its slot for now
+			game.clientConnectionLost(client)
 			return
 		}
 		switch command {
@@ -211,16 +934,11 @@ func (game *Game) handleClientMessages(client *Client) {
 				game.DisconnectClient(client, "PROTOCOL_VIOLATION")
 				return
 			}
-			if client == nil {
-				game.DisconnectClient(game.host, "INVALID_ID")
-			}
-			// TODO(Notabilis): This line might be a problem when there is no host temporarily.
-			// Also, what if the old connection is replaced by a new host a few seconds later?
-			// We will probably lose packets this way. :/
+			game.recording().ToHost(client.Id(), packet)
 			cmd := NewCommand(kFromClient)
-			cmd.AppendUInt(client.id)
+			cmd.AppendUInt(client.Id())
 			cmd.AppendBytes(packet)
-			game.host.SendCommand(cmd)
+			game.sendToHost(cmd)
 		case kDisconnect:
 			// Read but ignore the reason
 			client.ReadString()
@@ -235,60 +953,88 @@ func (game *Game) handleClientMessages(client *Client) {
 	}
 }
 
-func (game *Game) handleHostMessages() {
+// handleHostMessages reads the messages of the host. Only this goroutine reads
+// from the connection of the host.
+func (game *Game) handleHostMessages(host *Client) {
 	for {
 		// Read for ever until an error occurs or we receive a disconnect
-		if game.host == nil {
-			// host is nil: Disconnect induced by some other code
+		if game.Host() != host {
+			// Disconnect induced by some other code
 			return
 		}
-		command, err := game.host.ReadUint8()
+		command, err := host.ReadCommand()
 		if err != nil {
-			if err == io.EOF {
-				game.DisconnectClient(game.host, "NORMAL")
-			} else {
-				game.DisconnectClient(game.host, "PROTOCOL_VIOLATION")
-			}
+			// The host might come back, so keep the game open for now
+			game.hostConnectionLost(host)
 			return
 		}
 		switch command {
 		case kToClients:
-			var destinations []*Client
+			var destinations []uint8
 			for {
-				id, err := game.host.ReadUint8()
+				id, err := host.ReadUint8()
 				if err != nil {
-					game.DisconnectClient(game.host, "PROTOCOL_VIOLATION")
+					game.DisconnectClient(host, "PROTOCOL_VIOLATION")
 					return
 				}
 				if id == 0 {
 					break
 				}
-				client := game.getClient(id)
-				if client != nil {
-					// Should always be the case but might not be due to
-					// network delays (host did not receive our message yet)
-					destinations = append(destinations, client)
-				}
+				destinations = append(destinations, id)
 			}
-			packet, err := game.host.ReadPacket()
+			packet, err := host.ReadPacket()
 			if err != nil {
-				game.DisconnectClient(game.host, "PROTOCOL_VIOLATION")
+				game.DisconnectClient(host, "PROTOCOL_VIOLATION")
 				return
 			}
+			game.recording().ToClients(destinations, packet)
 			cmd := NewCommand(kFromHost)
 			cmd.AppendBytes(packet)
-			for _, client := range destinations {
-				client.SendCommand(cmd)
+			game.sendToClients(destinations, cmd)
+		case kAddObserver:
+			id, err := host.ReadUint8()
+			if err != nil {
+				game.DisconnectClient(host, "PROTOCOL_VIOLATION")
+				return
+			}
+			game.recording().Observer(id)
+			game.addObserver(id)
+		case kBroadcast:
+			flags, err := host.ReadUint8()
+			if err != nil {
+				game.DisconnectClient(host, "PROTOCOL_VIOLATION")
+				return
+			}
+			packet, err := host.ReadPacket()
+			if err != nil {
+				game.DisconnectClient(host, "PROTOCOL_VIOLATION")
+				return
+			}
+			game.recording().Broadcast(flags, packet)
+			cmd := NewCommand(kFromHost)
+			cmd.AppendBytes(packet)
+			game.broadcast(flags, cmd)
+		case kKickClient:
+			id, err := host.ReadUint8()
+			if err != nil {
+				game.DisconnectClient(host, "PROTOCOL_VIOLATION")
+				return
+			}
+			flags, err := host.ReadUint8()
+			if err != nil {
+				game.DisconnectClient(host, "PROTOCOL_VIOLATION")
+				return
 			}
+			game.kickClient(id, flags&kKickBan != 0)
 		case kDisconnect:
 			// Read but ignore
-			game.host.ReadString()
-			game.DisconnectClient(game.host, "NORMAL")
+			host.ReadString()
+			game.DisconnectClient(host, "NORMAL")
 			return
 		case kPong:
-			game.handlePong(game.host)
+			game.handlePong(host)
 		case kRoundTripTimeRequest:
-			game.sendRTTs(game.host)
+			game.sendRTTs(host)
 		}
 	}
 }
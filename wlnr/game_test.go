@@ -0,0 +1,926 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/widelands/widelands-metaserver/tlsconfig"
+	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type RelaySuite struct{}
+
+var _ = Suite(&RelaySuite{})
+
+type FakeWlms struct {
+	// GameClosed waits until this is closed if it is set, like the
+	// metaserver does while it waits for a RemoveGame to return
+	blockGameClosed chan bool
+
+	mutex     sync.Mutex
+	connected []string
+	closed    []string
+	joined    []string
+	left      []string
+	kicked    []string
+	banned    []string
+}
+
+func (w *FakeWlms) GameConnected(name string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.connected = append(w.connected, name)
+}
+
+func (w *FakeWlms) GameClosed(name string) {
+	if w.blockGameClosed != nil {
+		<-w.blockGameClosed
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.closed = append(w.closed, name)
+}
+
+func (w *FakeWlms) ClientConnected(name, token string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.joined = append(w.joined, token)
+}
+
+func (w *FakeWlms) ClientDisconnected(name, token string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.left = append(w.left, token)
+}
+
+func (w *FakeWlms) ClientKicked(name, token string, ban bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.kicked = append(w.kicked, token)
+	if ban {
+		w.banned = append(w.banned, token)
+	}
+}
+
+func (w *FakeWlms) CloseConnection() {
+}
+
+func (w *FakeWlms) Connected() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]string(nil), w.connected...)
+}
+
+func (w *FakeWlms) Closed() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]string(nil), w.closed...)
+}
+
+// Clients returns the join tokens of the clients that joined and of the ones
+// that left.
+func (w *FakeWlms) Clients() ([]string, []string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]string(nil), w.joined...), append([]string(nil), w.left...)
+}
+
+// Kicked returns the join tokens of the kicked and of the banned clients.
+func (w *FakeWlms) Kicked() ([]string, []string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]string(nil), w.kicked...), append([]string(nil), w.banned...)
+}
+
+func setupServer() (*Server, *FakeWlms) {
+	log.SetFlags(log.Lshortfile)
+	wlms := &FakeWlms{}
+	server := newServer(make(chan net.Conn))
+	server.wlms = wlms
+	return server, wlms
+}
+
+// flushNotifications waits until the notifications queued so far have been
+// passed to the metaserver.
+func flushNotifications(server *Server) {
+	done := make(chan bool)
+	server.notify(func() { close(done) })
+	<-done
+}
+
+// notified waits until the metaserver has been told about n games, e.g. with
+// wlms.Closed, and returns them.
+func notified(server *Server, games func() []string, n int) []string {
+	for i := 0; i < 1000; i++ {
+		flushNotifications(server)
+		if names := games(); len(names) >= n {
+			return names
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return games()
+}
+
+// connect opens a connection to the relay and says hello to the given game
+// using the oldest protocol version.
+func connect(server *Server, name, password string) net.Conn {
+	return connectWithVersion(server, name, password, kRelayProtocolVersionOldest)
+}
+
+// connectWithSessions is like connect but uses the newest protocol version,
+// so clients get a session token. The commands of the tests are too small to
+// be compressed.
+func connectWithSessions(server *Server, name, password string) net.Conn {
+	return connectWithVersion(server, name, password, kRelayProtocolVersion)
+}
+
+func connectWithVersion(server *Server, name, password string, version uint8) net.Conn {
+	relaySide, clientSide := net.Pipe()
+	go server.dealWithNewConnection(New(relaySide, server.clientQueueSize, server.clientWriteTimeout))
+	cmd := NewCommand(kHello)
+	cmd.AppendUInt(version)
+	cmd.AppendString(name)
+	cmd.AppendString(password)
+	clientSide.Write(cmd.GetBytes())
+	return clientSide
+}
+
+func send(conn net.Conn, data ...byte) {
+	conn.Write(data)
+}
+
+func expectBytes(c *C, conn net.Conn, expected ...byte) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, len(expected))
+	_, err := io.ReadFull(conn, got)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, expected)
+}
+
+func expectWelcome(c *C, conn net.Conn, name string) {
+	expectBytes(c, conn, append([]byte{kWelcome, kRelayProtocolVersionOldest}, append([]byte(name), 0)...)...)
+}
+
+// expectClientWelcome expects the welcome for a client other than the host
+// that connected with the newest protocol version and returns its session
+// token.
+func expectClientWelcome(c *C, conn net.Conn, name string) string {
+	expectBytes(c, conn, append([]byte{kWelcome, kRelayProtocolVersion}, append([]byte(name), 0)...)...)
+	token := make([]byte, 33)
+	_, err := io.ReadFull(conn, token)
+	c.Assert(err, IsNil)
+	c.Assert(token[32], Equals, byte(0))
+	return string(token[:32])
+}
+
+func expectDisconnect(c *C, conn net.Conn, reason string) {
+	expectBytes(c, conn, append([]byte{kDisconnect}, append([]byte(reason), 0)...)...)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+}
+
+// drain reads everything sent over the connection until it is closed.
+func drain(conn net.Conn, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(ioutil.Discard, conn)
+	}()
+}
+
+func waitTimeout(c *C, wg *sync.WaitGroup) {
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("Timeout while waiting for connections")
+	}
+}
+
+func (s *RelaySuite) TestHostAndClientExchange(c *C) {
+	server, wlms := setupServer()
+	c.Assert(server.CreateGame("game", "pwd", false), Equals, true)
+	c.Assert(server.CreateGame("game", "pwd", false), Equals, false)
+
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	c.Assert(notified(server, wlms.Connected, 1), DeepEquals, []string{"game"})
+
+	client := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	expectWelcome(c, client, "game")
+
+	send(client, kToHost, 0, 4, 'a', 'b')
+	expectBytes(c, host, kFromClient, 2, 0, 4, 'a', 'b')
+
+	send(host, kToClients, 2, 0, 0, 3, 'x')
+	expectBytes(c, client, kFromHost, 0, 3, 'x')
+
+	send(client, kDisconnect, 'N', 'O', 'R', 'M', 'A', 'L', 0)
+	expectBytes(c, host, kDisconnectClient, 2)
+	expectDisconnect(c, client, "NORMAL")
+
+	c.Assert(server.RemoveGame("game"), Equals, true)
+	expectDisconnect(c, host, "NORMAL")
+	c.Assert(server.Games(), HasLen, 0)
+	c.Assert(notified(server, wlms.Closed, 1), DeepEquals, []string{"game"})
+}
+
+func (s *RelaySuite) TestRemoveGameDoesNotWaitForMetaserver(c *C) {
+	server, wlms := setupServer()
+	wlms.blockGameClosed = make(chan bool)
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+
+	removed := make(chan bool)
+	go func() { removed <- server.RemoveGame("game") }()
+	select {
+	case ok := <-removed:
+		c.Assert(ok, Equals, true)
+	case <-time.After(time.Second):
+		c.Fatal("RemoveGame waits for the metaserver")
+	}
+	expectDisconnect(c, host, "NORMAL")
+	close(wlms.blockGameClosed)
+	c.Assert(notified(server, wlms.Closed, 1), DeepEquals, []string{"game"})
+}
+
+func (s *RelaySuite) TestWrongHostPassword(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+
+	host := connect(server, "game", "wrong")
+	expectDisconnect(c, host, "NO_HOST")
+
+	host = connect(server, "othergame", "pwd")
+	expectDisconnect(c, host, "GAME_UNKNOWN")
+}
+
+func (s *RelaySuite) TestRestrictedGame(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", true)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+
+	client := connect(server, "game", "")
+	expectDisconnect(c, client, "NOT_AUTHORIZED")
+	client = connect(server, "game", "guessed")
+	expectDisconnect(c, client, "NOT_AUTHORIZED")
+
+	c.Assert(server.AddJoinToken("game", "token"), Equals, true)
+	c.Assert(server.AddJoinToken("othergame", "token"), Equals, false)
+	client = connectWithSessions(server, "game", "token")
+	expectBytes(c, host, kConnectClient, 2)
+	session := expectClientWelcome(c, client, "game")
+
+	// Each token lets only one client join
+	other := connect(server, "game", "token")
+	expectDisconnect(c, other, "NOT_AUTHORIZED")
+
+	// The session token still works
+	client.Close()
+	waitForAwayClient(c, server.findGame("game"))
+	client = connectWithSessions(server, "game", session)
+	c.Assert(expectClientWelcome(c, client, "game"), Equals, session)
+}
+
+func (s *RelaySuite) TestHostKicksClients(c *C) {
+	server, wlms := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	server.AddJoinToken("game", "first")
+	server.AddJoinToken("game", "second")
+	first := connectWithSessions(server, "game", "first")
+	expectBytes(c, host, kConnectClient, 2)
+	firstSession := expectClientWelcome(c, first, "game")
+	second := connectWithSessions(server, "game", "second")
+	expectBytes(c, host, kConnectClient, 3)
+	secondSession := expectClientWelcome(c, second, "game")
+	// Without a join token, e.g. an older client
+	third := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 4)
+	expectWelcome(c, third, "game")
+
+	send(host, kKickClient, 2, kKickBan)
+	expectBytes(c, host, kDisconnectClient, 2)
+	expectDisconnect(c, first, "KICKED")
+	first = connectWithSessions(server, "game", firstSession)
+	expectDisconnect(c, first, "KICKED")
+	// After a ban, clients need a join token
+	first = connect(server, "game", "")
+	expectDisconnect(c, first, "NOT_AUTHORIZED")
+
+	// Clients that are away can be kicked as well
+	second.Close()
+	waitForAwayClient(c, server.findGame("game"))
+	send(host, kKickClient, 3, 0)
+	expectBytes(c, host, kDisconnectClient, 3)
+	second = connectWithSessions(server, "game", secondSession)
+	expectDisconnect(c, second, "KICKED")
+
+	// Unknown ids are ignored
+	send(host, kKickClient, 9, kKickBan)
+	send(host, kKickClient, 4, kKickBan)
+	expectBytes(c, host, kDisconnectClient, 4)
+	expectDisconnect(c, third, "KICKED")
+
+	// The metaserver only learns about clients with a join token
+	flushNotifications(server)
+	kicked, banned := wlms.Kicked()
+	c.Assert(kicked, DeepEquals, []string{"first", "second"})
+	c.Assert(banned, DeepEquals, []string{"first"})
+}
+
+func (s *RelaySuite) TestClientsAreReported(c *C) {
+	server, wlms := setupServer()
+	server.clientReconnectTimeout = 5 * time.Millisecond
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	server.AddJoinToken("game", "first")
+	server.AddJoinToken("game", "second")
+	first := connect(server, "game", "first")
+	expectBytes(c, host, kConnectClient, 2)
+	expectWelcome(c, first, "game")
+	second := connect(server, "game", "second")
+	expectBytes(c, host, kConnectClient, 3)
+	expectWelcome(c, second, "game")
+	// Without a join token, e.g. an older client
+	third := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 4)
+	expectWelcome(c, third, "game")
+	flushNotifications(server)
+	joined, left := wlms.Clients()
+	c.Assert(joined, DeepEquals, []string{"first", "second"})
+	c.Assert(left, HasLen, 0)
+
+	send(first, kDisconnect, 'N', 'O', 'R', 'M', 'A', 'L', 0)
+	expectBytes(c, host, kDisconnectClient, 2)
+	// A client that does not return leaves as well
+	second.Close()
+	expectBytes(c, host, kDisconnectClient, 3)
+	third.Close()
+	expectBytes(c, host, kDisconnectClient, 4)
+	flushNotifications(server)
+	joined, left = wlms.Clients()
+	c.Assert(joined, DeepEquals, []string{"first", "second"})
+	c.Assert(left, DeepEquals, []string{"first", "second"})
+}
+
+func (s *RelaySuite) TestGameWithoutHostIsRemoved(c *C) {
+	server, wlms := setupServer()
+	server.hostConnectTimeout = 5 * time.Millisecond
+	server.CreateGame("game", "pwd", false)
+
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(server.Games(), HasLen, 0)
+	c.Assert(notified(server, wlms.Closed, 1), DeepEquals, []string{"game"})
+
+	host := connect(server, "game", "pwd")
+	expectDisconnect(c, host, "GAME_UNKNOWN")
+}
+
+func (s *RelaySuite) TestHostDisconnectEndsGame(c *C) {
+	server, wlms := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	expectWelcome(c, client, "game")
+
+	send(host, kDisconnect, 'N', 'O', 'R', 'M', 'A', 'L', 0)
+	expectDisconnect(c, client, "NORMAL")
+	c.Assert(server.Games(), HasLen, 0)
+	c.Assert(notified(server, wlms.Closed, 1), DeepEquals, []string{"game"})
+}
+
+func (s *RelaySuite) TestHostReturns(c *C) {
+	server, wlms := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connectWithSessions(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	expectClientWelcome(c, client, "game")
+	// Clients of older versions do not learn that the host is away
+	old := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 3)
+	expectWelcome(c, old, "game")
+
+	host.Close()
+	expectBytes(c, client, kHostAway)
+
+	// Messages to the host are kept while it is away
+	send(client, kToHost, 0, 3, 'a')
+	late := connectWithSessions(server, "game", "")
+	expectClientWelcome(c, late, "game")
+	expectBytes(c, late, kHostAway)
+	send(client, kToHost, 0, 3, 'b')
+
+	host = connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	expectBytes(c, host, kFromClient, 2, 0, 3, 'a')
+	expectBytes(c, host, kConnectClient, 4)
+	expectBytes(c, host, kFromClient, 2, 0, 3, 'b')
+	expectBytes(c, client, kHostReturned)
+	expectBytes(c, late, kHostReturned)
+
+	send(host, kToClients, 2, 3, 4, 0, 0, 3, 'x')
+	expectBytes(c, client, kFromHost, 0, 3, 'x')
+	expectBytes(c, old, kFromHost, 0, 3, 'x')
+	expectBytes(c, late, kFromHost, 0, 3, 'x')
+	send(client, kToHost, 0, 3, 'c')
+	expectBytes(c, host, kFromClient, 2, 0, 3, 'c')
+
+	c.Assert(server.Games(), HasLen, 1)
+	flushNotifications(server)
+	c.Assert(wlms.Closed(), HasLen, 0)
+}
+
+func (s *RelaySuite) TestHostTakesOverTheGame(c *C) {
+	server, wlms := setupServer()
+	server.CreateGame("game", "pwd", false)
+	old := connect(server, "game", "pwd")
+	expectWelcome(c, old, "game")
+	client := connectWithSessions(server, "game", "")
+	expectBytes(c, old, kConnectClient, 2)
+	expectClientWelcome(c, client, "game")
+
+	// The host reconnects before the relay noticed that the old connection
+	// broke
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	expectDisconnect(c, old, "NORMAL")
+
+	// The clients do not notice anything
+	send(client, kToHost, 0, 3, 'a')
+	expectBytes(c, host, kFromClient, 2, 0, 3, 'a')
+	send(host, kToClients, 2, 0, 0, 3, 'x')
+	expectBytes(c, client, kFromHost, 0, 3, 'x')
+	c.Assert(server.Games(), HasLen, 1)
+	flushNotifications(server)
+	c.Assert(wlms.Closed(), HasLen, 0)
+}
+
+func (s *RelaySuite) TestHostDoesNotReturn(c *C) {
+	server, wlms := setupServer()
+	server.hostReconnectTimeout = 10 * time.Millisecond
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connectWithSessions(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	expectClientWelcome(c, client, "game")
+
+	host.Close()
+	expectBytes(c, client, kHostAway)
+	expectDisconnect(c, client, "NORMAL")
+	c.Assert(server.Games(), HasLen, 0)
+	c.Assert(notified(server, wlms.Closed, 1), DeepEquals, []string{"game"})
+
+	host = connect(server, "game", "pwd")
+	expectDisconnect(c, host, "GAME_UNKNOWN")
+}
+
+func (s *RelaySuite) TestHostMissesTooMuch(c *C) {
+	server, _ := setupServer()
+	server.hostBufferSize = 3
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connectWithSessions(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	expectClientWelcome(c, client, "game")
+
+	host.Close()
+	expectBytes(c, client, kHostAway)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		send(client, kToHost, 0, 3, byte(i))
+	}
+	drain(client, &wg)
+	waitTimeout(c, &wg)
+	// The game is removed right after disconnecting the clients
+	for i := 0; i < 100 && len(server.Games()) != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(server.Games(), HasLen, 0)
+}
+
+// waitForAwayClient waits till the relay noticed that the connection to the
+// client got lost. Data sent before is lost with the connection.
+func waitForAwayClient(c *C, game *Game) {
+	for i := 0; i < 1000; i++ {
+		game.mutex.Lock()
+		n := len(game.awayClients)
+		game.mutex.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Fatal("Relay did not notice the lost connection")
+}
+
+func (s *RelaySuite) TestClientReturns(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connectWithSessions(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	token := expectClientWelcome(c, client, "game")
+
+	client.Close()
+	waitForAwayClient(c, server.findGame("game"))
+	// Messages to the client are kept while it is away
+	send(host, kToClients, 2, 0, 0, 3, 'x')
+	send(host, kToClients, 2, 0, 0, 3, 'y')
+
+	client = connectWithSessions(server, "game", token)
+	c.Assert(expectClientWelcome(c, client, "game"), Equals, token)
+	expectBytes(c, client, kFromHost, 0, 3, 'x')
+	expectBytes(c, client, kFromHost, 0, 3, 'y')
+
+	// The host does not notice anything and the client keeps its id
+	send(client, kToHost, 0, 3, 'a')
+	expectBytes(c, host, kFromClient, 2, 0, 3, 'a')
+	send(host, kToClients, 2, 0, 0, 3, 'z')
+	expectBytes(c, client, kFromHost, 0, 3, 'z')
+}
+
+func (s *RelaySuite) TestClientTakesOverItsSession(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	old := connectWithSessions(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	token := expectClientWelcome(c, old, "game")
+
+	// The client reconnects before the relay noticed that the old
+	// connection broke
+	client := connectWithSessions(server, "game", token)
+	c.Assert(expectClientWelcome(c, client, "game"), Equals, token)
+	expectDisconnect(c, old, "NORMAL")
+
+	// The host does not notice anything and the client keeps its id
+	send(client, kToHost, 0, 3, 'a')
+	expectBytes(c, host, kFromClient, 2, 0, 3, 'a')
+	send(host, kToClients, 2, 0, 0, 3, 'x')
+	expectBytes(c, client, kFromHost, 0, 3, 'x')
+}
+
+func (s *RelaySuite) TestClientReturnsAfterTimeout(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connectWithSessions(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	token := expectClientWelcome(c, client, "game")
+
+	// Like the ping loop does when the client does not answer
+	game := server.findGame("game")
+	game.mutex.Lock()
+	timedOut := game.getClientLocked(2)
+	game.mutex.Unlock()
+	timedOut.disconnect("TIMEOUT", true)
+	expectDisconnect(c, client, "TIMEOUT")
+	waitForAwayClient(c, game)
+	send(host, kToClients, 2, 0, 0, 3, 'x')
+
+	client = connectWithSessions(server, "game", token)
+	c.Assert(expectClientWelcome(c, client, "game"), Equals, token)
+	expectBytes(c, client, kFromHost, 0, 3, 'x')
+	send(client, kToHost, 0, 3, 'a')
+	expectBytes(c, host, kFromClient, 2, 0, 3, 'a')
+}
+
+func (s *RelaySuite) TestClientDoesNotReturn(c *C) {
+	server, _ := setupServer()
+	server.clientReconnectTimeout = 10 * time.Millisecond
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connectWithSessions(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	token := expectClientWelcome(c, client, "game")
+
+	client.Close()
+	expectBytes(c, host, kDisconnectClient, 2)
+
+	// The token is no longer valid, so this is a new client
+	client = connectWithSessions(server, "game", token)
+	expectBytes(c, host, kConnectClient, 3)
+	c.Assert(expectClientWelcome(c, client, "game"), Not(Equals), token)
+}
+
+func (s *RelaySuite) TestClientMissesTooMuch(c *C) {
+	server, _ := setupServer()
+	server.clientBufferSize = 2
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connectWithSessions(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	expectClientWelcome(c, client, "game")
+
+	client.Close()
+	waitForAwayClient(c, server.findGame("game"))
+	for i := 0; i < 3; i++ {
+		send(host, kToClients, 2, 0, 0, 3, byte(i))
+	}
+	expectBytes(c, host, kDisconnectClient, 2)
+}
+
+func (s *RelaySuite) TestOldClientsCanNotReturn(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	// Clients of version 1 get no session token
+	expectBytes(c, client, kWelcome, kRelayProtocolVersionOldest, 'g', 'a', 'm', 'e', 0)
+	send(client, kToHost, 0, 3, 'a')
+	expectBytes(c, host, kFromClient, 2, 0, 3, 'a')
+
+	// So the host learns right away that they left
+	client.Close()
+	expectBytes(c, host, kDisconnectClient, 2)
+}
+
+// expectClosed reads everything the relay still sends and expects the
+// connection to be closed then.
+func expectClosed(c *C, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.Copy(ioutil.Discard, conn)
+	c.Assert(err, IsNil)
+}
+
+func (s *RelaySuite) TestSlowClientIsDisconnected(c *C) {
+	server, _ := setupServer()
+	server.clientQueueSize = 5
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+
+	// This client never reads what is sent to it
+	slow := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	fast := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 3)
+	expectWelcome(c, fast, "game")
+
+	// The host is not blocked by the slow client and the fast one gets
+	// everything in order
+	for i := 0; i < 20; i++ {
+		send(host, kToClients, 2, 3, 0, 0, 3, byte(i))
+		expectBytes(c, fast, kFromHost, 0, 3, byte(i))
+	}
+	expectBytes(c, host, kDisconnectClient, 2)
+	expectClosed(c, slow)
+
+	stats := server.findGame("game").QueueStats()
+	c.Assert(stats, HasLen, 2)
+	c.Check(stats[ID_HOST].Capacity, Equals, 5)
+	c.Check(stats[3].Sent >= 20, Equals, true)
+	c.Check(stats[3].MaxQueued >= 1, Equals, true)
+	c.Check(stats[3].MaxQueued <= 5, Equals, true)
+}
+
+func (s *RelaySuite) TestClientWriteTimeout(c *C) {
+	server, _ := setupServer()
+	server.clientWriteTimeout = 10 * time.Millisecond
+	server.clientReconnectTimeout = 10 * time.Millisecond
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+
+	// Sending the welcome message times out. The client does not return.
+	slow := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	expectBytes(c, host, kDisconnectClient, 2)
+	expectClosed(c, slow)
+}
+
+// Run with -race to make sure the game state is only touched by one goroutine
+// at a time.
+func (s *RelaySuite) TestConcurrentJoinsLeavesAndTraffic(c *C) {
+	const nClients = 20
+	server, wlms := setupServer()
+	server.CreateGame("game", "pwd", false)
+
+	var connections sync.WaitGroup
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	drain(host, &connections)
+
+	// The host keeps sending to all clients, including ones that did not
+	// join yet or already left.
+	stopHost := make(chan bool)
+	hostDone := make(chan bool)
+	go func() {
+		defer close(hostDone)
+		for i := 0; ; i++ {
+			select {
+			case <-stopHost:
+				return
+			default:
+			}
+			data := []byte{kToClients}
+			for id := 2; id < 2+nClients; id++ {
+				data = append(data, byte(id))
+			}
+			data = append(data, 0, 0, 3, byte(i))
+			if _, err := host.Write(data); err != nil {
+				return
+			}
+			if _, err := host.Write([]byte{kRoundTripTimeRequest}); err != nil {
+				return
+			}
+		}
+	}()
+
+	var clients sync.WaitGroup
+	for i := 0; i < nClients; i++ {
+		clients.Add(1)
+		go func(i int) {
+			defer clients.Done()
+			client := connect(server, "game", "")
+			drain(client, &connections)
+			for j := 0; j < 50; j++ {
+				client.Write([]byte{kToHost, 0, 4, byte(i), byte(j)})
+				if j%10 == 0 {
+					client.Write([]byte{kRoundTripTimeRequest})
+					client.Write([]byte{kPong, byte(j)})
+				}
+			}
+			if i%2 == 0 {
+				client.Write(append([]byte{kDisconnect}, []byte(fmt.Sprintf("BYE%d", i))...))
+				client.Write([]byte{0})
+			} else {
+				client.Close()
+			}
+		}(i)
+	}
+	waitTimeout(c, &clients)
+	close(stopHost)
+	<-hostDone
+
+	c.Assert(server.RemoveGame("game"), Equals, true)
+	waitTimeout(c, &connections)
+	c.Assert(server.Games(), HasLen, 0)
+	c.Assert(notified(server, wlms.Closed, 1), DeepEquals, []string{"game"})
+}
+
+// joinClient connects a client to the game and returns it after the host
+// learned about it.
+func joinClient(c *C, server *Server, host net.Conn, id uint8) net.Conn {
+	client := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, id)
+	expectWelcome(c, client, "game")
+	return client
+}
+
+func (s *RelaySuite) TestBroadcastToObservers(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	player := joinClient(c, server, host, 2)
+	observer := joinClient(c, server, host, 3)
+
+	send(host, kAddObserver, 3)
+	send(host, kBroadcast, kBroadcastCatchUp, 0, 3, 'a')
+	expectBytes(c, observer, kFromHost, 0, 3, 'a')
+	send(host, kBroadcast, 0, 0, 3, 'b')
+	expectBytes(c, observer, kFromHost, 0, 3, 'b')
+
+	// Late observers catch up without the host sending anything again
+	late := joinClient(c, server, host, 4)
+	send(host, kAddObserver, 4)
+	// Adding twice does not repeat the catch-up
+	send(host, kAddObserver, 4)
+	expectBytes(c, late, kFromHost, 0, 3, 'a', kFromHost, 0, 3, 'b')
+	send(host, kBroadcast, 0, 0, 3, 'c')
+	expectBytes(c, observer, kFromHost, 0, 3, 'c')
+	expectBytes(c, late, kFromHost, 0, 3, 'c')
+
+	// A new catch-up point replaces the old catch-up data
+	send(host, kBroadcast, kBroadcastCatchUp, 0, 3, 'd')
+	expectBytes(c, observer, kFromHost, 0, 3, 'd')
+	expectBytes(c, late, kFromHost, 0, 3, 'd')
+	latest := joinClient(c, server, host, 5)
+	send(host, kAddObserver, 5)
+	expectBytes(c, latest, kFromHost, 0, 3, 'd')
+
+	// Players get no broadcasts, only what is sent to them
+	send(host, kToClients, 2, 0, 0, 3, 'x')
+	expectBytes(c, player, kFromHost, 0, 3, 'x')
+
+	// Observers that left do not get anything
+	send(late, kDisconnect, 'N', 'O', 'R', 'M', 'A', 'L', 0)
+	expectBytes(c, host, kDisconnectClient, 4)
+	expectDisconnect(c, late, "NORMAL")
+	game := server.findGame("game")
+	game.mutex.Lock()
+	c.Assert(game.observers, DeepEquals, map[uint8]bool{3: true, 5: true})
+	game.mutex.Unlock()
+}
+
+func (s *RelaySuite) TestCatchUpTooLarge(c *C) {
+	server, _ := setupServer()
+	server.catchUpSize = 10
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	observer := joinClient(c, server, host, 2)
+	send(host, kAddObserver, 2)
+
+	send(host, kBroadcast, kBroadcastCatchUp, 0, 3, 'a')
+	send(host, kBroadcast, 0, 0, 3, 'b')
+	send(host, kBroadcast, 0, 0, 3, 'c')
+	expectBytes(c, observer, kFromHost, 0, 3, 'a', kFromHost, 0, 3, 'b', kFromHost, 0, 3, 'c')
+
+	// The catch-up data got too large and is dropped until the next
+	// catch-up point
+	late := joinClient(c, server, host, 3)
+	send(host, kAddObserver, 3)
+	send(host, kBroadcast, 0, 0, 3, 'd')
+	expectBytes(c, late, kFromHost, 0, 3, 'd')
+	send(host, kBroadcast, kBroadcastCatchUp, 0, 3, 'e')
+	expectBytes(c, late, kFromHost, 0, 3, 'e')
+	latest := joinClient(c, server, host, 4)
+	send(host, kAddObserver, 4)
+	expectBytes(c, latest, kFromHost, 0, 3, 'e')
+}
+
+func (s *RelaySuite) TestAwayObserverCatchesUp(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	send(host, kBroadcast, kBroadcastCatchUp, 0, 3, 'a')
+	observer := connectWithSessions(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	token := expectClientWelcome(c, observer, "game")
+
+	observer.Close()
+	waitForAwayClient(c, server.findGame("game"))
+	send(host, kAddObserver, 2)
+	send(host, kBroadcast, 0, 0, 3, 'b')
+
+	observer = connectWithSessions(server, "game", token)
+	expectClientWelcome(c, observer, "game")
+	expectBytes(c, observer, kFromHost, 0, 3, 'a', kFromHost, 0, 3, 'b')
+}
+
+func (s *RelaySuite) TestTLSConnections(c *C) {
+	dir := c.MkDir()
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	c.Assert(tlsconfig.WriteSelfSignedCertificate(certFile, keyFile, "127.0.0.1"), IsNil)
+	ln, err := tlsconfig.Listen("127.0.0.1:0", certFile, keyFile)
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	C := make(chan net.Conn)
+	server := newServer(C)
+	server.wlms = &FakeWlms{}
+	go acceptConnections(ln, C)
+	go server.mainLoop()
+
+	server.CreateGame("game", "pwd", false)
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	cmd := NewCommand(kHello)
+	cmd.AppendUInt(kRelayProtocolVersionOldest)
+	cmd.AppendString("game")
+	cmd.AppendString("pwd")
+	send(conn, cmd.GetBytes()...)
+	expectWelcome(c, conn, "game")
+
+	client := connect(server, "game", "")
+	expectBytes(c, conn, kConnectClient, 2)
+	expectWelcome(c, client, "game")
+	send(conn, kToClients, 2, 0, 0, 3, 'x')
+	expectBytes(c, client, kFromHost, 0, 3, 'x')
+}
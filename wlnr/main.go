@@ -1,5 +1,114 @@
 package main
 
+import (
+	"compress/flate"
+	"flag"
+	"fmt"
+	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
+	"log"
+	"net"
+	"net/rpc/jsonrpc"
+	"os"
+	"time"
+)
+
+// TLSSettings configures the TLS listener that is offered next to the
+// plaintext port. TLS is disabled without a certificate. The certificate is
+// reloaded when its files change.
+type TLSSettings struct {
+	// PEM files of the certificate and its key
+	Certificate, Key string
+	Address          string
+}
+
+func (t TLSSettings) Enabled() bool {
+	return t.Certificate != ""
+}
+
 func main() {
-	RunServer()
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if !runReplay(os.Args[2:]) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	recording := DefaultRecordingPolicy()
+	flag.StringVar(&recording.Directory, "recordings", "", "Directory to write recordings of games to. Recording is disabled if empty.")
+	flag.BoolVar(&recording.AllGames, "record-all", false, "Record all games, not only the ones an admin asked for.")
+	flag.Int64Var(&recording.MaxFileSize, "recording-file-size", recording.MaxFileSize, "Size in bytes after which a new recording file is started.")
+	flag.IntVar(&recording.MaxFiles, "recording-files", recording.MaxFiles, "Number of recording files to keep. 0 keeps all.")
+	flag.DurationVar(&recording.MaxAge, "recording-max-age", recording.MaxAge, "Age after which recording files are removed. 0 keeps them forever.")
+	var tls TLSSettings
+	flag.StringVar(&tls.Certificate, "tls-cert", "", "PEM file with the certificate for TLS connections. TLS is disabled if empty.")
+	flag.StringVar(&tls.Key, "tls-key", "", "PEM file with the key of the TLS certificate.")
+	flag.StringVar(&tls.Address, "tls-address", ":7400", "Address to listen on for TLS connections.")
+	compressionLevel := flag.Int("compression-level", flate.BestSpeed, "Deflate level (1-9) for clients supporting compression. 0 disables compression.")
+	flag.Parse()
+	if *compressionLevel < 0 || *compressionLevel > flate.BestCompression {
+		log.Fatalf("Invalid compression level %v", *compressionLevel)
+	}
+
+	RunServer(recording, *compressionLevel, tls)
+}
+
+// runReplay plays a recorded game against a running relay. Returns whether
+// the relay behaved as recorded.
+func runReplay(args []string) bool {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	relay := flags.String("relay", "localhost:7397", "Address of the relay to replay the game on.")
+	rpcAddress := flags.String("rpc", "localhost:7398", "RPC address of the relay, used to create the game. If empty, the game has to exist already.")
+	gameName := flags.String("game", "", "Name of the game on the relay. Defaults to the recorded name followed by \" (replay)\".")
+	password := flags.String("password", "", "Host password of the game. Defaults to a random one when creating the game.")
+	speed := flags.Float64("speed", 1, "How many times faster than recorded to replay. 0 replays as fast as possible.")
+	timeout := flags.Duration("timeout", 10*time.Second, "Time the relay has to deliver a packet.")
+	version := flags.Uint("protocol", uint(kRelayProtocolVersion), "Relay protocol version used by the host and clients.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v replay [flags] <recording files>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	header, records, err := LoadRecording(flags.Args())
+	if err != nil {
+		log.Fatalf("Unable to load recording: %v", err)
+	}
+	if *gameName == "" {
+		*gameName = header.GameName + " (replay)"
+	}
+	if *rpcAddress != "" {
+		if *password == "" {
+			*password = newSessionToken()
+		}
+		relayRPC, err := jsonrpc.Dial("tcp", *rpcAddress)
+		if err != nil {
+			log.Fatalf("Unable to connect to relay: %v", err)
+		}
+		defer relayRPC.Close()
+		data := relayinterface.GameData{
+			Name:     *gameName,
+			Password: *password,
+		}
+		var success bool
+		if err := relayRPC.Call("ServerRPCMethods.NewGame", data, &success); err != nil {
+			log.Fatalf("Unable to create game '%v': %v", *gameName, err)
+		}
+		defer relayRPC.Call("ServerRPCMethods.RemoveGame", data, &success)
+	}
+
+	log.Printf("Replaying %v records of game '%v' recorded at %v as '%v'", len(records), header.GameName, header.Start, *gameName)
+	dial := func() (net.Conn, error) {
+		return net.DialTimeout("tcp", *relay, *timeout)
+	}
+	options := ReplayOptions{Speed: *speed, Timeout: *timeout, Version: uint8(*version)}
+	if err := Replay(records, dial, *gameName, *password, options); err != nil {
+		log.Printf("Replay failed: %v", err)
+		return false
+	}
+	log.Printf("Replay finished without differences")
+	return true
 }
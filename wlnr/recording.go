@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Recordings of relayed games are used to reproduce desyncs and network problems
+reported by players. A recording consists of one or more files, a new one is
+started when the current file reaches the size limit.
+
+Each file starts with a header:
+	"WLRR"              magic
+	uint8               format version (kRecordingVersion). Version 1 has no
+	                    kRecordBroadcast records.
+	uvarint + bytes     name of the game
+	int64 (big endian)  start of the recording in nanoseconds since the epoch
+	uvarint             number of the file within the recording, starting at 0
+
+followed by records:
+	uint8               type of the record
+	uvarint             microseconds since the previous record, or since the
+	                    start of the recording for the first record of a file
+	...                 data depending on the type:
+	kRecordToHost:            uint8 id of the sending client,
+	                          uvarint + bytes of the packet
+	kRecordToClients:         uvarint number of receivers, uint8 id of each,
+	                          uvarint + bytes of the packet
+	kRecordConnected:         uint8 id of the client, ID_HOST for the host
+	kRecordDisconnected:      uint8 id of the client, ID_HOST for the host
+	kRecordObserver:          uint8 id of the client the host made an observer
+	kRecordBroadcast:         uint8 flags, uvarint + bytes of the packet
+
+Packets are stored as returned by Client.ReadPacket(), i.e. including their
+length prefix.
+*/
+
+const (
+	kRecordingMagic           = "WLRR"
+	kRecordingVersion   uint8 = 2
+	kRecordingExtension       = ".wlrr"
+
+	kRecordToHost       uint8 = 1
+	kRecordToClients    uint8 = 2
+	kRecordConnected    uint8 = 3
+	kRecordDisconnected uint8 = 4
+	kRecordObserver     uint8 = 5
+	kRecordBroadcast    uint8 = 6
+)
+
+// RecordingPolicy describes which games are recorded and how long recordings
+// are kept.
+type RecordingPolicy struct {
+	// Directory the recordings are written to. Recording is disabled if empty.
+	Directory string
+
+	// Whether all games are recorded. Otherwise only games that an admin asked
+	// for are recorded.
+	AllGames bool
+
+	// Size in bytes after which a new file is started
+	MaxFileSize int64
+
+	// Number of files that are kept. The oldest are removed first. Zero keeps
+	// all files.
+	MaxFiles int
+
+	// Age after which files are removed. Zero keeps all files.
+	MaxAge time.Duration
+
+	// Time records are buffered before they are written to the file, so only
+	// that much is lost if the relay crashes. Zero writes each record at once.
+	FlushInterval time.Duration
+}
+
+func DefaultRecordingPolicy() RecordingPolicy {
+	return RecordingPolicy{
+		MaxFileSize:   64 << 20,
+		MaxFiles:      1000,
+		MaxAge:        30 * 24 * time.Hour,
+		FlushInterval: time.Second,
+	}
+}
+
+func (p RecordingPolicy) Enabled() bool {
+	return p.Directory != ""
+}
+
+// Recorder writes the recording of one game. All methods can be called
+// concurrently and on a nil Recorder, in which case they do nothing.
+type Recorder struct {
+	mutex    sync.Mutex
+	policy   RecordingPolicy
+	gameName string
+	start    time.Time
+
+	// Time of the last record in the current file
+	last time.Time
+
+	// Number of the current file
+	part   int
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+
+	// Flushes the writer some time after the first record that has not been
+	// written to the file yet. Nil if there is none.
+	flushTimer *time.Timer
+
+	// Set after an error or Close(). Nothing is recorded afterwards.
+	stopped bool
+}
+
+// NewRecorder starts recording the game with the given name.
+func NewRecorder(policy RecordingPolicy, gameName string) (*Recorder, error) {
+	if err := os.MkdirAll(policy.Directory, 0755); err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		policy:   policy,
+		gameName: gameName,
+		start:    time.Now(),
+	}
+	if err := r.openFile(); err != nil {
+		return nil, err
+	}
+	log.Printf("Recording game '%v' to %v", gameName, r.file.Name())
+	return r, nil
+}
+
+// recordingFileName returns a file name that identifies the game, the start of
+// the recording and the number of the file.
+func recordingFileName(gameName string, start time.Time, part int) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, gameName)
+	return fmt.Sprintf("%v-%v-%03d%v", name, start.UTC().Format("20060102-150405.000000000"), part, kRecordingExtension)
+}
+
+func (r *Recorder) openFile() error {
+	path := filepath.Join(r.policy.Directory, recordingFileName(r.gameName, r.start, r.part))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.writer = bufio.NewWriter(file)
+	r.size = 0
+	r.last = r.start
+
+	header := []byte(kRecordingMagic)
+	header = append(header, kRecordingVersion)
+	header = appendBytes(header, []byte(r.gameName))
+	header = appendInt64(header, r.start.UnixNano())
+	header = appendUvarint(header, uint64(r.part))
+	return r.write(header)
+}
+
+func (r *Recorder) write(data []byte) error {
+	n, err := r.writer.Write(data)
+	r.size += int64(n)
+	return err
+}
+
+func (r *Recorder) closeFile() error {
+	if r.flushTimer != nil {
+		r.flushTimer.Stop()
+		r.flushTimer = nil
+	}
+	err := r.writer.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	removeOldRecordings(r.policy)
+	return err
+}
+
+// record writes one record. Starts a new file if the current one is too large.
+func (r *Recorder) record(recordType uint8, data []byte) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		return
+	}
+	now := time.Now()
+	record := []byte{recordType}
+	record = appendUvarint(record, uint64(now.Sub(r.last)/time.Microsecond))
+	record = append(record, data...)
+	r.last = now
+
+	err := r.write(record)
+	if err == nil && r.policy.MaxFileSize > 0 && r.size >= r.policy.MaxFileSize {
+		err = r.closeFile()
+		if err == nil {
+			r.part++
+			err = r.openFile()
+		}
+	} else if err == nil && r.policy.FlushInterval <= 0 {
+		err = r.writer.Flush()
+	} else if err == nil && r.flushTimer == nil {
+		r.flushTimer = time.AfterFunc(r.policy.FlushInterval, r.flush)
+	}
+	if err != nil {
+		r.stopLocked(err)
+	}
+}
+
+// flush writes the buffered records to the file.
+func (r *Recorder) flush() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		return
+	}
+	r.flushTimer = nil
+	if err := r.writer.Flush(); err != nil {
+		r.stopLocked(err)
+	}
+}
+
+// stopLocked stops recording after an error. Has to be called with the mutex
+// held.
+func (r *Recorder) stopLocked(err error) {
+	log.Printf("Error while recording game '%v', stopping: %v", r.gameName, err)
+	r.stopped = true
+	if r.flushTimer != nil {
+		r.flushTimer.Stop()
+		r.flushTimer = nil
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+}
+
+// ToHost records a packet sent by a client to the host.
+func (r *Recorder) ToHost(id uint8, packet []byte) {
+	r.record(kRecordToHost, appendBytes([]byte{id}, packet))
+}
+
+// ToClients records a packet sent by the host to the given clients.
+func (r *Recorder) ToClients(ids []uint8, packet []byte) {
+	data := appendUvarint(nil, uint64(len(ids)))
+	data = append(data, ids...)
+	r.record(kRecordToClients, appendBytes(data, packet))
+}
+
+// Connected records that the host or a client connected to the game.
+func (r *Recorder) Connected(id uint8) {
+	r.record(kRecordConnected, []byte{id})
+}
+
+// Disconnected records that the host or a client left the game.
+func (r *Recorder) Disconnected(id uint8) {
+	r.record(kRecordDisconnected, []byte{id})
+}
+
+// Observer records that the host made a client an observer.
+func (r *Recorder) Observer(id uint8) {
+	r.record(kRecordObserver, []byte{id})
+}
+
+// Broadcast records a packet sent by the host to all observers.
+func (r *Recorder) Broadcast(flags uint8, packet []byte) {
+	r.record(kRecordBroadcast, appendBytes([]byte{flags}, packet))
+}
+
+// Close finishes the recording.
+func (r *Recorder) Close() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+	if err := r.closeFile(); err != nil {
+		log.Printf("Error while finishing recording of game '%v': %v", r.gameName, err)
+	}
+}
+
+func appendUvarint(data []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(data, b[:n]...)
+}
+
+func appendBytes(data, bytes []byte) []byte {
+	data = appendUvarint(data, uint64(len(bytes)))
+	return append(data, bytes...)
+}
+
+func appendInt64(data []byte, v int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	return append(data, b[:]...)
+}
+
+// removeOldRecordings removes the files that are too old or exceed the
+// number of files to keep.
+func removeOldRecordings(policy RecordingPolicy) {
+	paths, err := filepath.Glob(filepath.Join(policy.Directory, "*"+kRecordingExtension))
+	if err != nil {
+		return
+	}
+	type recording struct {
+		path    string
+		modTime time.Time
+	}
+	var recordings []recording
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, recording{path, info.ModTime()})
+	}
+	// Newest first
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].modTime.After(recordings[j].modTime)
+	})
+	for i, rec := range recordings {
+		tooMany := policy.MaxFiles > 0 && i >= policy.MaxFiles
+		tooOld := policy.MaxAge > 0 && time.Since(rec.modTime) > policy.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(rec.path); err != nil {
+			log.Printf("Unable to remove old recording: %v", err)
+		}
+	}
+}
+
+// RecordingHeader is the header of a recording file.
+type RecordingHeader struct {
+	GameName string
+	Start    time.Time
+	Part     int
+}
+
+// Record is one entry of a recording.
+type Record struct {
+	Type uint8
+	// Time since the start of the recording
+	Time time.Duration
+	// The sending client for kRecordToHost, the receivers for
+	// kRecordToClients or the client that (dis)connected or became an
+	// observer
+	Ids    []uint8
+	Packet []byte
+	// The flags of kRecordBroadcast
+	Flags uint8
+}
+
+// RecordingReader reads the records of a recording file.
+type RecordingReader struct {
+	Header RecordingHeader
+	reader *bufio.Reader
+	time   time.Duration
+}
+
+var ErrInvalidRecording = errors.New("invalid recording")
+
+// NewRecordingReader reads the header of a recording file.
+func NewRecordingReader(r io.Reader) (*RecordingReader, error) {
+	reader := &RecordingReader{reader: bufio.NewReader(r)}
+	magic := make([]byte, len(kRecordingMagic)+1)
+	if _, err := io.ReadFull(reader.reader, magic); err != nil {
+		return nil, err
+	}
+	if string(magic[:len(kRecordingMagic)]) != kRecordingMagic {
+		return nil, ErrInvalidRecording
+	}
+	// Older recordings only lack some types of records
+	if version := magic[len(kRecordingMagic)]; version < 1 || version > kRecordingVersion {
+		return nil, fmt.Errorf("unsupported recording version %v", version)
+	}
+	name, err := reader.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	var start [8]byte
+	if _, err := io.ReadFull(reader.reader, start[:]); err != nil {
+		return nil, err
+	}
+	part, err := binary.ReadUvarint(reader.reader)
+	if err != nil {
+		return nil, err
+	}
+	reader.Header = RecordingHeader{
+		GameName: string(name),
+		Start:    time.Unix(0, int64(binary.BigEndian.Uint64(start[:]))),
+		Part:     int(part),
+	}
+	return reader, nil
+}
+
+func (r *RecordingReader) readBytes() ([]byte, error) {
+	length, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > 1<<20 {
+		return nil, ErrInvalidRecording
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r.reader, data)
+	return data, err
+}
+
+// Next returns the next record. Returns io.EOF at the end of the file.
+func (r *RecordingReader) Next() (*Record, error) {
+	recordType, err := r.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	delta, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	r.time += time.Duration(delta) * time.Microsecond
+	record := &Record{Type: recordType, Time: r.time}
+	switch recordType {
+	case kRecordToHost:
+		id, err := r.reader.ReadByte()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		record.Ids = []uint8{id}
+		if record.Packet, err = r.readBytes(); err != nil {
+			return nil, unexpected(err)
+		}
+	case kRecordToClients:
+		n, err := binary.ReadUvarint(r.reader)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if n > 255 {
+			return nil, ErrInvalidRecording
+		}
+		record.Ids = make([]uint8, n)
+		if _, err := io.ReadFull(r.reader, record.Ids); err != nil {
+			return nil, unexpected(err)
+		}
+		if record.Packet, err = r.readBytes(); err != nil {
+			return nil, unexpected(err)
+		}
+	case kRecordConnected, kRecordDisconnected, kRecordObserver:
+		id, err := r.reader.ReadByte()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		record.Ids = []uint8{id}
+	case kRecordBroadcast:
+		if record.Flags, err = r.reader.ReadByte(); err != nil {
+			return nil, unexpected(err)
+		}
+		if record.Packet, err = r.readBytes(); err != nil {
+			return nil, unexpected(err)
+		}
+	default:
+		return nil, ErrInvalidRecording
+	}
+	return record, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	. "gopkg.in/check.v1"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// readRecording returns all records of the given recording file.
+func readRecording(c *C, path string) (RecordingHeader, []*Record) {
+	file, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer file.Close()
+	reader, err := NewRecordingReader(file)
+	c.Assert(err, IsNil)
+	var records []*Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		records = append(records, record)
+	}
+	return reader.Header, records
+}
+
+func recordingFiles(c *C, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+kRecordingExtension))
+	c.Assert(err, IsNil)
+	sort.Strings(paths)
+	return paths
+}
+
+func (s *RelaySuite) TestRecordGame(c *C) {
+	server, _ := setupServer()
+	server.recordingPolicy.Directory = c.MkDir()
+	server.CreateGame("game", "pwd", false)
+	c.Assert(server.RecordGame("game"), Equals, true)
+	c.Assert(server.RecordGame("othergame"), Equals, false)
+
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	expectWelcome(c, client, "game")
+
+	send(client, kToHost, 0, 4, 'a', 'b')
+	expectBytes(c, host, kFromClient, 2, 0, 4, 'a', 'b')
+	send(host, kToClients, 2, 0, 0, 3, 'x')
+	expectBytes(c, client, kFromHost, 0, 3, 'x')
+	send(client, kDisconnect, 'N', 'O', 'R', 'M', 'A', 'L', 0)
+	expectBytes(c, host, kDisconnectClient, 2)
+	server.RemoveGame("game")
+
+	paths := recordingFiles(c, server.recordingPolicy.Directory)
+	c.Assert(paths, HasLen, 1)
+	header, records := readRecording(c, paths[0])
+	c.Check(header.GameName, Equals, "game")
+	c.Check(header.Part, Equals, 0)
+	c.Check(time.Since(header.Start) < time.Minute, Equals, true)
+
+	c.Assert(records, HasLen, 5)
+	expected := []Record{
+		{Type: kRecordConnected, Ids: []uint8{ID_HOST}},
+		{Type: kRecordConnected, Ids: []uint8{2}},
+		{Type: kRecordToHost, Ids: []uint8{2}, Packet: []byte{0, 4, 'a', 'b'}},
+		{Type: kRecordToClients, Ids: []uint8{2}, Packet: []byte{0, 3, 'x'}},
+		{Type: kRecordDisconnected, Ids: []uint8{2}},
+	}
+	for i, record := range records {
+		c.Check(record.Type, Equals, expected[i].Type)
+		c.Check(record.Ids, DeepEquals, expected[i].Ids)
+		c.Check(record.Packet, DeepEquals, expected[i].Packet)
+		if i > 0 {
+			c.Check(record.Time >= records[i-1].Time, Equals, true)
+		}
+	}
+}
+
+func (s *RelaySuite) TestRecordingDisabled(c *C) {
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	c.Assert(server.RecordGame("game"), Equals, false)
+}
+
+func (s *RelaySuite) TestRecordAllGames(c *C) {
+	server, _ := setupServer()
+	server.recordingPolicy.Directory = c.MkDir()
+	server.recordingPolicy.AllGames = true
+	server.CreateGame("game one", "pwd", false)
+	server.CreateGame("game/two", "pwd", false)
+	server.RemoveGame("game one")
+	server.RemoveGame("game/two")
+
+	paths := recordingFiles(c, server.recordingPolicy.Directory)
+	c.Assert(paths, HasLen, 2)
+	names := []string{}
+	for _, path := range paths {
+		header, records := readRecording(c, path)
+		names = append(names, header.GameName)
+		c.Check(records, HasLen, 0)
+	}
+	sort.Strings(names)
+	c.Assert(names, DeepEquals, []string{"game one", "game/two"})
+}
+
+func (s *RelaySuite) TestRecordingRotationAndRetention(c *C) {
+	policy := DefaultRecordingPolicy()
+	policy.Directory = c.MkDir()
+	policy.MaxFileSize = 100
+	policy.MaxFiles = 3
+
+	// A recording of another game that is too old to be kept
+	old := filepath.Join(policy.Directory, "old"+kRecordingExtension)
+	c.Assert(os.WriteFile(old, nil, 0644), IsNil)
+	c.Assert(os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)), IsNil)
+	policy.MaxAge = time.Minute
+
+	recorder, err := NewRecorder(policy, "game")
+	c.Assert(err, IsNil)
+	for i := 0; i < 50; i++ {
+		recorder.ToHost(2, []byte{0, 3, byte(i)})
+	}
+	recorder.Close()
+	// Nothing is recorded after closing
+	recorder.ToHost(2, []byte{0, 3, 0})
+
+	_, err = os.Stat(old)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	paths := recordingFiles(c, policy.Directory)
+	c.Assert(paths, HasLen, 3)
+
+	// The newest files are kept and continue each other
+	last, part := -1, -1
+	for i, path := range paths {
+		header, records := readRecording(c, path)
+		c.Check(header.GameName, Equals, "game")
+		c.Assert(len(records) > 0, Equals, true)
+		if i == 0 {
+			c.Check(header.Part > 0, Equals, true)
+			last = int(records[0].Packet[2]) - 1
+		} else {
+			c.Check(header.Part, Equals, part+1)
+		}
+		part = header.Part
+		for _, record := range records {
+			c.Check(int(record.Packet[2]), Equals, last+1)
+			last = int(record.Packet[2])
+		}
+	}
+	c.Assert(last, Equals, 49)
+}
+
+func (s *RelaySuite) TestRecordingIsFlushed(c *C) {
+	policy := DefaultRecordingPolicy()
+	policy.Directory = c.MkDir()
+	policy.FlushInterval = 10 * time.Millisecond
+	recorder, err := NewRecorder(policy, "game")
+	c.Assert(err, IsNil)
+	defer recorder.Close()
+	recorder.Connected(ID_HOST)
+	recorder.ToHost(2, []byte{0, 3, 'a'})
+
+	// The records reach the file while the game is still running, so they
+	// are kept if the relay crashes
+	paths := recordingFiles(c, policy.Directory)
+	c.Assert(paths, HasLen, 1)
+	var records []*Record
+	for i := 0; i < 100 && len(records) < 2; i++ {
+		time.Sleep(time.Millisecond)
+		_, records, err = LoadRecording(paths)
+	}
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[1].Packet, DeepEquals, []byte{0, 3, 'a'})
+}
+
+func (s *RelaySuite) TestRecordingWithNilRecorder(c *C) {
+	var recorder *Recorder
+	recorder.ToHost(2, []byte{0, 2})
+	recorder.ToClients([]uint8{2, 3}, []byte{0, 2})
+	recorder.Connected(2)
+	recorder.Disconnected(2)
+	recorder.Close()
+}
+
+func (s *RelaySuite) TestRecordingVersions(c *C) {
+	header := func(version uint8) []byte {
+		data := append([]byte(kRecordingMagic), version, 4)
+		data = append(data, "game"...)
+		return append(data, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	}
+	// Recordings without broadcasts can still be read
+	for _, version := range []uint8{1, kRecordingVersion} {
+		reader, err := NewRecordingReader(bytes.NewReader(header(version)))
+		c.Assert(err, IsNil)
+		c.Assert(reader.Header.GameName, Equals, "game")
+	}
+	for _, version := range []uint8{0, kRecordingVersion + 1} {
+		_, err := NewRecordingReader(bytes.NewReader(header(version)))
+		c.Assert(err, ErrorMatches, "unsupported recording version .*")
+	}
+}
@@ -13,12 +13,19 @@ type ServerStatus struct {
 type Client interface {
 	// Open a new game on the relay with the given name.
 	// The given password protects the host-position in the new game.
+	// Clients of a restricted game have to present a join token.
 	// Fails if there is no relay or the game already exists.
-	CreateGame(name string, password string) bool
+	CreateGame(name string, password string, restricted bool) bool
+	// Allows one client to join the restricted game with the given token.
+	// Fails if there is no game with this name.
+	AddJoinToken(name string, token string) bool
 	// Closes the game on the relay, removing all state of it
 	// and closing all network connections.
 	// Fails if there is no game with this name.
 	RemoveGame(name string) bool
+	// Starts recording the relayed traffic of the game.
+	// Fails if there is no game with this name or recording is disabled.
+	RecordGame(name string) bool
 	// Closes connection to the relay.
 	CloseConnection()
 }
@@ -30,6 +37,14 @@ type ClientCallback interface {
 	GameConnected(name string)
 	// The relay notifies that the game with the given name has been closed on the relay.
 	GameClosed(name string)
+	// The relay notifies that the client with the given join token joined the game.
+	ClientConnected(name string, token string)
+	// The relay notifies that the client with the given join token left the game for good.
+	// Clients that lost their connection are still in the game until they do not return.
+	ClientDisconnected(name string, token string)
+	// The relay notifies that the host kicked the client with the given join token.
+	// Banned clients may not join the game again.
+	ClientKicked(name string, token string, ban bool)
 	// Request the current status, e.g., number of active users and games.
 	Status() *ServerStatus
 }
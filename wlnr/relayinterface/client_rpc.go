@@ -1,17 +1,26 @@
 package relayinterface
 
 import (
+	"errors"
 	"log"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
+	"sync"
 	"time"
 )
 
+// Time a call to the relay may take before it fails. The metaserver waits
+// for some calls on its main loop.
+const kCallTimeout = 5 * time.Second
+
 // ClientRPC is an internal struct which implements relayinterface.Client
-// over a RPC connection.
+// over a RPC connection. Its methods can be called from several goroutines
+// at once.
 type ClientRPC struct {
 	callback ClientCallback
+	// Guards relay, which is replaced when reconnecting
+	mutex    sync.Mutex
 	relay    *rpc.Client
 	listener net.Listener
 }
@@ -46,19 +55,27 @@ func NewClientRPC(callback ClientCallback) Client {
 		client: client,
 	}
 
-	rpc.Register(clientMethods)
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(clientMethods)
+
+	go serveRPC(rpcServer, rpcLn)
 
-	go func() {
-		for {
-			conn, err := rpcLn.Accept()
-			if err != nil {
+	return client
+}
+
+// serveRPC answers calls on the connections of the listener until it is
+// closed.
+func serveRPC(rpcServer *rpc.Server, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				continue
 			}
-			go jsonrpc.ServeConn(conn)
+			return
 		}
-	}()
-
-	return client
+		go rpcServer.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
 }
 
 // Open connection to relay server
@@ -76,24 +93,35 @@ func (client *ClientRPC) connect() bool {
 // CloseConnection terminates the connection to the relay server.
 func (client *ClientRPC) CloseConnection() {
 	client.listener.Close()
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.relay.Close()
 }
 
-// CreateGame tells the relay server to start a game with the given name.
-// The host position in the game is protected by the given password
-func (client *ClientRPC) CreateGame(name string, hostPassword string) bool {
-	// Tell relay to host game
-	success := false
-	data := GameData{
-		Name:     name,
-		Password: hostPassword,
-	}
+// Calls a method on the relay and returns its result. Reconnects once if the
+// connection is broken. Fails if the relay does not answer in time.
+func (client *ClientRPC) callServerMethod(action string, data GameData) bool {
 	for i := 0; i < 2; i++ {
-		err := client.relay.Call("ServerRPCMethods.NewGame", data, &success)
+		client.mutex.Lock()
+		relay := client.relay
+		client.mutex.Unlock()
+		success := false
+		var err error
+		select {
+		case call := <-relay.Go("ServerRPCMethods."+action, data, &success, make(chan *rpc.Call, 1)).Done:
+			err = call.Error
+		case <-time.After(kCallTimeout):
+			err = errors.New("the relay did not answer in time")
+		}
 		if err == nil {
-			break
+			return success
 		}
 		if err == rpc.ErrShutdown {
-			if !client.connect() {
+			client.mutex.Lock()
+			// Another call might have reconnected already
+			reconnected := client.relay != relay || client.connect()
+			client.mutex.Unlock()
+			if !reconnected {
 				log.Printf("ClientRPC: Lost connection to relay and are unable to reconnect")
 				return false
 			}
@@ -103,33 +131,47 @@ func (client *ClientRPC) CreateGame(name string, hostPassword string) bool {
 			return false
 		}
 	}
-	return success
+	return false
+}
+
+// CreateGame tells the relay server to start a game with the given name.
+// The host position in the game is protected by the given password
+func (client *ClientRPC) CreateGame(name string, hostPassword string, restricted bool) bool {
+	// Tell relay to host game
+	data := GameData{
+		Name:       name,
+		Password:   hostPassword,
+		Restricted: restricted,
+	}
+	return client.callServerMethod("NewGame", data)
 }
 
 func (client *ClientRPC) RemoveGame(name string) bool {
 	// Tell relay to remove game
-	success := false
 	data := GameData{
 		Name:     name,
 		Password: "",
 	}
-	for i := 0; i < 2; i++ {
-		err := client.relay.Call("ServerRPCMethods.RemoveGame", data, &success)
-		if err == nil {
-			break
-		}
-		if err == rpc.ErrShutdown {
-			if !client.connect() {
-				log.Printf("ClientRPC: Lost connection to relay and are unable to reconnect")
-				return false
-			}
-			log.Printf("ClientRPC: Lost connection to relay but was able to reconnect")
-		} else {
-			log.Printf("ClientRPC  error: %v", err)
-			return false
-		}
+	return client.callServerMethod("RemoveGame", data)
+}
+
+// RecordGame tells the relay server to record the game with the given name.
+func (client *ClientRPC) RecordGame(name string) bool {
+	data := GameData{
+		Name:     name,
+		Password: "",
+	}
+	return client.callServerMethod("RecordGame", data)
+}
+
+// AddJoinToken tells the relay server that one client may join the
+// restricted game with the given token.
+func (client *ClientRPC) AddJoinToken(name string, token string) bool {
+	data := GameData{
+		Name:  name,
+		Token: token,
 	}
-	return success
+	return client.callServerMethod("AddJoinToken", data)
 }
 
 // GameConnected is called by the relay over rpc when a host connected to a game.
@@ -144,7 +186,25 @@ func (client *ClientRPCMethods) GameClosed(in *GameData, response *bool) (err er
 	return nil
 }
 
-// GameClosed is called by the relay over rpc when a game has ended.
+// ClientConnected is called by the relay over rpc when a client joined a game.
+func (client *ClientRPCMethods) ClientConnected(in *GameData, response *bool) (err error) {
+	client.client.callback.ClientConnected(in.Name, in.Token)
+	return nil
+}
+
+// ClientDisconnected is called by the relay over rpc when a client left a game.
+func (client *ClientRPCMethods) ClientDisconnected(in *GameData, response *bool) (err error) {
+	client.client.callback.ClientDisconnected(in.Name, in.Token)
+	return nil
+}
+
+// ClientKicked is called by the relay over rpc when a host kicked a client.
+func (client *ClientRPCMethods) ClientKicked(in *GameData, response *bool) (err error) {
+	client.client.callback.ClientKicked(in.Name, in.Token, in.Banned)
+	return nil
+}
+
+// Status is called by the relay over rpc to request the current status.
 func (client *ClientRPCMethods) Status(in *string, response *ServerStatus) (err error) {
 	*response = *client.client.callback.Status()
 	return nil
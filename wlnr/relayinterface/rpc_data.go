@@ -4,6 +4,12 @@ package relayinterface
 type GameData struct {
 	Name     string
 	Password string
+	// Whether clients need a join token. Only used by NewGame.
+	Restricted bool
+	// Only used by AddJoinToken and the notifications about clients
+	Token string
+	// Whether the kicked client is banned. Only used by ClientKicked.
+	Banned bool
 }
 
 /*
@@ -21,8 +27,18 @@ WLMS					WLNR			Client
   <- ClientRPCMethod.GameConnected (name) -
 
  *announce game as open*
+	<-------------- GAME_CONNECT (name) --------------------
+ - ServerRPCMethod.AddJoinToken (name, token) -->
+ (only for restricted games)
+	-------- GAME_CONNECT (token, ip) ------------------->
+		                  <- CONNECT (name, token) -
 						* setup game *
 			...
+ <- ClientRPCMethod.ClientConnected (name, token) -
+ <- ClientRPCMethod.ClientDisconnected (name, token) -
+ <- ClientRPCMethod.ClientKicked (name, token) -
+ (for clients with a join token)
+			...
  <- GAME_STARTED (?) -----------------------------
  *announce game as running*
 			...
@@ -7,6 +7,14 @@ type Server interface {
 	GameConnected(name string)
 	// Notify metaserver that a game has ended.
 	GameClosed(name string)
+	// Notify metaserver that the client with the given join token joined a game.
+	ClientConnected(name string, token string)
+	// Notify metaserver that the client with the given join token left a game
+	// for good.
+	ClientDisconnected(name string, token string)
+	// Notify metaserver that the host kicked the client with the given join
+	// token from the game and whether it is banned.
+	ClientKicked(name string, token string, ban bool)
 	// Closes the connection to metaserver.
 	CloseConnection()
 }
@@ -14,6 +22,8 @@ type Server interface {
 // ServerCallback contains methods that are called when
 // the metaserver sends a command.
 type ServerCallback interface {
-	CreateGame(name string, password string) bool
+	CreateGame(name string, password string, restricted bool) bool
+	AddJoinToken(name string, token string) bool
 	RemoveGame(name string) bool
+	RecordGame(name string) bool
 }
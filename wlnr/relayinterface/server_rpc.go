@@ -38,22 +38,18 @@ func NewServerRPC(callback ServerCallback) Server {
 	serverMethods := &ServerRPCMethods{
 		server: server,
 	}
-	rpc.Register(serverMethods)
+	// Each server has its own methods, so there can be more than one in a
+	// process
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(serverMethods)
 	l, e := net.Listen("tcp", ":7398")
 	if e != nil {
 		log.Printf("Unable to listen on rpc port: %v", e)
+		return server
 	}
 	server.listener = l
 
-	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				continue
-			}
-			go jsonrpc.ServeConn(conn)
-		}
-	}()
+	go serveRPC(rpcServer, l)
 
 	return server
 }
@@ -73,12 +69,14 @@ func (server *ServerRPC) connect() bool {
 
 // CloseConnection terminates the connection to the metaserver.
 func (server *ServerRPC) CloseConnection() {
-	server.listener.Close()
+	if server.listener != nil {
+		server.listener.Close()
+	}
 }
 
 // Calls a method on the rpc client.
 // (Re-)Connects to the client if currently not connected or the connection is broken.
-func (server *ServerRPC) callClientMethod(action, gameName string) {
+func (server *ServerRPC) callClientMethod(action string, data GameData) {
 	if server.client == nil {
 		// Probably there never was a connection, try to create one now
 		// Isn't done in the constructor since we have a circular dependency between
@@ -88,9 +86,6 @@ func (server *ServerRPC) callClientMethod(action, gameName string) {
 		}
 	}
 	var ignored bool
-	data := GameData{
-		Name: gameName,
-	}
 	for i := 0; i < 2; i++ {
 		err := server.client.Call("ClientRPCMethods."+action, data, &ignored)
 		if err == nil {
@@ -113,18 +108,33 @@ func (server *ServerRPC) callClientMethod(action, gameName string) {
 // GameConnected informs the metaserver that a host connected to a game.
 func (server *ServerRPC) GameConnected(name string) {
 	// Tell the metaserver about it
-	server.callClientMethod("GameConnected", name)
+	server.callClientMethod("GameConnected", GameData{Name: name})
 }
 
 // GameClosed informs the metaserver that a game has ended.
 func (server *ServerRPC) GameClosed(name string) {
-	server.callClientMethod("GameClosed", name)
+	server.callClientMethod("GameClosed", GameData{Name: name})
+}
+
+// ClientConnected informs the metaserver that a client joined a game.
+func (server *ServerRPC) ClientConnected(name string, token string) {
+	server.callClientMethod("ClientConnected", GameData{Name: name, Token: token})
+}
+
+// ClientDisconnected informs the metaserver that a client left a game.
+func (server *ServerRPC) ClientDisconnected(name string, token string) {
+	server.callClientMethod("ClientDisconnected", GameData{Name: name, Token: token})
+}
+
+// ClientKicked informs the metaserver that a host kicked a client.
+func (server *ServerRPC) ClientKicked(name string, token string, ban bool) {
+	server.callClientMethod("ClientKicked", GameData{Name: name, Token: token, Banned: ban})
 }
 
 // NewGame is called by the rpc server when the metaserver wants to start a new game.
 // Calls the respective method of the ServerCallback given on construction.
 func (serverM *ServerRPCMethods) NewGame(in *GameData, success *bool) error {
-	ret := serverM.server.callback.CreateGame(in.Name, in.Password)
+	ret := serverM.server.callback.CreateGame(in.Name, in.Password, in.Restricted)
 	if ret != true {
 		return errors.New("Game already exists")
 	}
@@ -142,3 +152,26 @@ func (serverM *ServerRPCMethods) RemoveGame(in *GameData, success *bool) error {
 	*success = true
 	return nil
 }
+
+// RecordGame is called by the rpc server when the metaserver wants a game to be recorded.
+// Calls the respective method of the ServerCallback given on construction.
+func (serverM *ServerRPCMethods) RecordGame(in *GameData, success *bool) error {
+	ret := serverM.server.callback.RecordGame(in.Name)
+	if ret != true {
+		return errors.New("Unable to record game")
+	}
+	*success = true
+	return nil
+}
+
+// AddJoinToken is called by the rpc server when the metaserver allows a client
+// to join a restricted game.
+// Calls the respective method of the ServerCallback given on construction.
+func (serverM *ServerRPCMethods) AddJoinToken(in *GameData, success *bool) error {
+	ret := serverM.server.callback.AddJoinToken(in.Name, in.Token)
+	if ret != true {
+		return errors.New("Game does not exist")
+	}
+	*success = true
+	return nil
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+A replay plays a recorded game against a relay to regression test it or to
+reproduce a reported problem without running Widelands. The replay connects
+as the host and as each client and sends the recorded packets in the recorded
+order. After every step it waits until the relay delivered what it should
+have, so the replay fails on the first difference.
+
+Broadcasts are kept for observers added later like the relay does, assuming
+the catch-up data of the relay is large enough.
+
+Lost connections are told apart from players leaving by looking ahead in the
+recording: when the host or a client connects again later, its connection is
+closed without saying goodbye so it can return, otherwise it disconnects.
+*/
+
+// How often the relay is asked whether it noticed a lost connection
+const kReplayPollInterval = 10 * time.Millisecond
+
+type ReplayOptions struct {
+	// How many times faster than recorded the game is replayed. Zero replays
+	// it as fast as the relay allows.
+	Speed float64
+
+	// Time the relay has to deliver a packet before the replay fails
+	Timeout time.Duration
+
+	// The relay protocol version used by the peers. Zero uses the newest.
+	Version uint8
+}
+
+// LoadRecording reads all files of one recording and returns its header and
+// its records in order. The first file of the recording is required since it
+// contains who is connected.
+func LoadRecording(paths []string) (RecordingHeader, []*Record, error) {
+	type part struct {
+		header  RecordingHeader
+		records []*Record
+	}
+	var parts []part
+	for _, path := range paths {
+		header, records, err := loadRecordingFile(path)
+		if err != nil {
+			return RecordingHeader{}, nil, fmt.Errorf("%v: %v", path, err)
+		}
+		parts = append(parts, part{header, records})
+	}
+	if len(parts) == 0 {
+		return RecordingHeader{}, nil, errors.New("no recording files given")
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].header.Part < parts[j].header.Part
+	})
+	var records []*Record
+	for i, p := range parts {
+		if p.header.GameName != parts[0].header.GameName || !p.header.Start.Equal(parts[0].header.Start) {
+			return RecordingHeader{}, nil, errors.New("the files belong to different recordings")
+		}
+		if p.header.Part != i {
+			return RecordingHeader{}, nil, fmt.Errorf("file %v of the recording is missing", i)
+		}
+		records = append(records, p.records...)
+	}
+	return parts[0].header, records, nil
+}
+
+func loadRecordingFile(path string) (RecordingHeader, []*Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return RecordingHeader{}, nil, err
+	}
+	defer file.Close()
+	reader, err := NewRecordingReader(file)
+	if err != nil {
+		return RecordingHeader{}, nil, err
+	}
+	var records []*Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return reader.Header, records, nil
+		}
+		if err != nil {
+			return RecordingHeader{}, nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// A message received from the relay. Also used for the messages a peer
+// expects, with the recorded ids of the clients.
+type relayMessage struct {
+	command uint8
+	// The client of kConnectClient, kDisconnectClient and kFromClient or the
+	// sequence number of kPing
+	id uint8
+	// The clients listed in kRoundTripTimeResponse
+	ids    []uint8
+	packet []byte
+	// The game name of kWelcome or the reason of kDisconnect
+	text string
+	// The session token of kWelcome for clients other than the host, since
+	// protocol version 3
+	token string
+}
+
+func (m *relayMessage) String() string {
+	return fmt.Sprintf("command %v (id=%v, packet=%v)", m.command, m.id, m.packet)
+}
+
+// readRelayMessage reads a message the relay sends to the host or a client.
+// withToken tells whether kWelcome is followed by a session token.
+func readRelayMessage(reader *commandReader, withToken bool) (*relayMessage, error) {
+	command, err := reader.ReadCommand()
+	if err != nil {
+		return nil, err
+	}
+	msg := &relayMessage{command: command}
+	switch command {
+	case kWelcome:
+		if _, err = readUint8(reader); err == nil {
+			msg.text, err = readString(reader)
+		}
+		if err == nil && withToken {
+			msg.token, err = readString(reader)
+		}
+	case kDisconnect:
+		msg.text, err = readString(reader)
+	case kPing, kConnectClient, kDisconnectClient:
+		msg.id, err = readUint8(reader)
+	case kRoundTripTimeResponse:
+		var n uint8
+		n, err = readUint8(reader)
+		for i := 0; err == nil && i < int(n); i++ {
+			// Id, round trip time and time since the last pong
+			entry := make([]byte, 3)
+			_, err = io.ReadFull(reader, entry)
+			msg.ids = append(msg.ids, entry[0])
+		}
+	case kFromClient:
+		if msg.id, err = readUint8(reader); err == nil {
+			msg.packet, err = readPacket(reader)
+		}
+	case kFromHost:
+		msg.packet, err = readPacket(reader)
+	case kHostAway, kHostReturned:
+	default:
+		err = fmt.Errorf("unknown command %v", command)
+	}
+	return msg, err
+}
+
+const (
+	peerConnected = iota
+	// The connection has been closed, the peer returns later on
+	peerAway
+	// The peer left the game
+	peerGone
+)
+
+// The host or a client played by the replay.
+type replayPeer struct {
+	// The id of the peer in the recording
+	recordedId uint8
+	state      int
+	conn       net.Conn
+
+	// Messages received on the current connection, closed with it
+	incoming chan *relayMessage
+
+	// The messages the peer still has to receive
+	expected []*relayMessage
+
+	sessionToken string
+	observer     bool
+
+	// Guards the connection for writing, since pings are answered by the
+	// reading goroutine
+	sendMutex sync.Mutex
+	writer    *commandWriter
+}
+
+func (p *replayPeer) String() string {
+	if p.recordedId == ID_HOST {
+		return "host"
+	}
+	return fmt.Sprintf("client %v", p.recordedId)
+}
+
+func (p *replayPeer) send(cmd *Command) error {
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+	if err := p.writer.Write(cmd.GetBytes()); err != nil {
+		return err
+	}
+	return p.writer.Flush()
+}
+
+func (p *replayPeer) setConnection(conn net.Conn) {
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+	p.conn = conn
+	p.writer = newCommandWriter(conn)
+}
+
+// startCompression compresses what is sent from now on.
+func (p *replayPeer) startCompression() {
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+	p.writer.enableCompression(flate.BestSpeed)
+}
+
+type replayer struct {
+	dial     func() (net.Conn, error)
+	gameName string
+	password string
+	options  ReplayOptions
+
+	// The peers by their id in the recording
+	peers map[uint8]*replayPeer
+
+	// The ids the relay assigned to the clients by their id in the recording.
+	// They differ when the recording did not start with the game.
+	ids map[uint8]uint8
+
+	// The broadcasts since the last catch-up point
+	catchUp [][]byte
+}
+
+// Replay plays the recorded game on a relay. Each call of dial has to return a
+// new connection to the relay, which has to know the game with the given name
+// and host password. Returns an error on the first difference to the
+// recording.
+func Replay(records []*Record, dial func() (net.Conn, error), gameName, password string, options ReplayOptions) error {
+	r := &replayer{
+		dial:     dial,
+		gameName: gameName,
+		password: password,
+		options:  options,
+		peers:    make(map[uint8]*replayPeer),
+		ids:      make(map[uint8]uint8),
+	}
+	defer r.closeConnections()
+	if r.options.Version == 0 {
+		r.options.Version = kRelayProtocolVersion
+	}
+
+	returning := returningPeers(records)
+	start := time.Now()
+	for i, record := range records {
+		if options.Speed > 0 {
+			due := time.Duration(float64(record.Time) / options.Speed)
+			if wait := due - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		err := r.play(record, returning[i])
+		if err == nil {
+			err = r.settle()
+		}
+		if err != nil {
+			return fmt.Errorf("record %v at %v: %v", i, record.Time, err)
+		}
+	}
+	return nil
+}
+
+// returningPeers returns for each record whether it is a kRecordDisconnected
+// whose peer connects again later on.
+func returningPeers(records []*Record) []bool {
+	returning := make([]bool, len(records))
+	connectsAgain := make(map[uint8]bool)
+	for i := len(records) - 1; i >= 0; i-- {
+		switch records[i].Type {
+		case kRecordConnected:
+			connectsAgain[records[i].Ids[0]] = true
+		case kRecordDisconnected:
+			returning[i] = connectsAgain[records[i].Ids[0]]
+			connectsAgain[records[i].Ids[0]] = false
+		}
+	}
+	return returning
+}
+
+func (r *replayer) host() *replayPeer {
+	host := r.peers[ID_HOST]
+	if host == nil || host.state == peerGone {
+		return nil
+	}
+	return host
+}
+
+// connectedPeer returns the peer with the given recorded id or an error if it
+// is not connected.
+func (r *replayer) connectedPeer(id uint8) (*replayPeer, error) {
+	peer := r.peers[id]
+	if peer == nil || peer.state != peerConnected {
+		return nil, fmt.Errorf("the recording uses id %v which is not connected", id)
+	}
+	return peer, nil
+}
+
+// expect adds a message the peer has to receive. Peers that left do not
+// receive anything.
+func (r *replayer) expect(peer *replayPeer, msg *relayMessage) {
+	if peer != nil && peer.state != peerGone {
+		peer.expected = append(peer.expected, msg)
+	}
+}
+
+func (r *replayer) play(record *Record, returning bool) error {
+	switch record.Type {
+	case kRecordConnected:
+		return r.connect(record.Ids[0])
+	case kRecordDisconnected:
+		peer, err := r.connectedPeer(record.Ids[0])
+		if err != nil {
+			return err
+		}
+		if returning {
+			peer.conn.Close()
+			peer.state = peerAway
+			return r.awaitLost(peer)
+		}
+		return r.leave(peer)
+	case kRecordToHost:
+		peer, err := r.connectedPeer(record.Ids[0])
+		if err != nil {
+			return err
+		}
+		r.expect(r.host(), &relayMessage{command: kFromClient, id: peer.recordedId, packet: record.Packet})
+		cmd := NewCommand(kToHost)
+		cmd.AppendBytes(record.Packet)
+		return peer.send(cmd)
+	case kRecordToClients:
+		host, err := r.connectedPeer(ID_HOST)
+		if err != nil {
+			return err
+		}
+		cmd := NewCommand(kToClients)
+		for _, id := range record.Ids {
+			// Clients unknown to the relay are left out, their ids might be
+			// assigned to others
+			if assigned, ok := r.ids[id]; ok {
+				cmd.AppendUInt(assigned)
+			}
+			if peer := r.peers[id]; peer != nil && id != ID_HOST {
+				r.expect(peer, &relayMessage{command: kFromHost, packet: record.Packet})
+			}
+		}
+		cmd.AppendUInt(0)
+		cmd.AppendBytes(record.Packet)
+		return host.send(cmd)
+	case kRecordObserver:
+		host, err := r.connectedPeer(ID_HOST)
+		if err != nil {
+			return err
+		}
+		id := record.Ids[0]
+		assigned, ok := r.ids[id]
+		if !ok {
+			return nil
+		}
+		if peer := r.peers[id]; peer != nil && peer.state != peerGone && !peer.observer {
+			peer.observer = true
+			for _, packet := range r.catchUp {
+				r.expect(peer, &relayMessage{command: kFromHost, packet: packet})
+			}
+		}
+		cmd := NewCommand(kAddObserver)
+		cmd.AppendUInt(assigned)
+		return host.send(cmd)
+	case kRecordBroadcast:
+		host, err := r.connectedPeer(ID_HOST)
+		if err != nil {
+			return err
+		}
+		if record.Flags&kBroadcastCatchUp != 0 {
+			r.catchUp = nil
+		}
+		r.catchUp = append(r.catchUp, record.Packet)
+		for _, peer := range r.peers {
+			if peer.observer {
+				r.expect(peer, &relayMessage{command: kFromHost, packet: record.Packet})
+			}
+		}
+		cmd := NewCommand(kBroadcast)
+		cmd.AppendUInt(record.Flags)
+		cmd.AppendBytes(record.Packet)
+		return host.send(cmd)
+	}
+	return fmt.Errorf("unknown record type %v", record.Type)
+}
+
+// connect connects a new peer or lets an away peer return.
+func (r *replayer) connect(id uint8) error {
+	peer := r.peers[id]
+	if peer != nil && peer.state == peerConnected {
+		return fmt.Errorf("%v connects twice", peer)
+	}
+	if peer == nil || peer.state == peerGone {
+		peer = &replayPeer{recordedId: id}
+		r.peers[id] = peer
+		if id != ID_HOST {
+			r.expect(r.host(), &relayMessage{command: kConnectClient, id: id})
+		}
+	}
+	password := peer.sessionToken
+	if id == ID_HOST {
+		password = r.password
+	}
+
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	peer.setConnection(conn)
+	peer.state = peerConnected
+	incoming := make(chan *relayMessage, 4096)
+	peer.incoming = incoming
+	compressed := r.options.Version >= kRelayProtocolVersionCompressed
+	go peer.readMessages(newCommandReader(conn), r.options.Version, incoming)
+
+	cmd := NewCommand(kHello)
+	cmd.AppendUInt(r.options.Version)
+	cmd.AppendString(r.gameName)
+	cmd.AppendString(password)
+	if err := peer.send(cmd); err != nil {
+		return err
+	}
+	if compressed {
+		peer.startCompression()
+	}
+	msg, err := r.receive(peer)
+	if err != nil {
+		return err
+	}
+	if msg.command == kDisconnect {
+		return fmt.Errorf("the relay refused %v: %v", peer, msg.text)
+	}
+	if msg.command != kWelcome {
+		return fmt.Errorf("%v got %v instead of the welcome", peer, msg)
+	}
+	if id != ID_HOST && peer.sessionToken != "" && msg.token != peer.sessionToken {
+		return fmt.Errorf("%v did not get its session back", peer)
+	}
+	peer.sessionToken = msg.token
+	if id == ID_HOST {
+		r.ids[ID_HOST] = ID_HOST
+	}
+	return nil
+}
+
+// readMessages hands the messages from the relay to the replay and answers
+// pings on its own. With compression, the relay compresses what it sends
+// after the welcome.
+func (p *replayPeer) readMessages(reader *commandReader, version uint8, incoming chan *relayMessage) {
+	defer close(incoming)
+	compressed := version >= kRelayProtocolVersionCompressed
+	withToken := p.recordedId != ID_HOST && version >= kRelayProtocolVersionSessions
+	for {
+		msg, err := readRelayMessage(reader, withToken)
+		if err != nil {
+			return
+		}
+		if msg.command == kWelcome && compressed {
+			reader.enableCompression()
+		}
+		if msg.command == kPing {
+			cmd := NewCommand(kPong)
+			cmd.AppendUInt(msg.id)
+			p.send(cmd)
+			continue
+		}
+		incoming <- msg
+	}
+}
+
+// leave disconnects the peer for good. When the host leaves, the game is over.
+func (r *replayer) leave(peer *replayPeer) error {
+	cmd := NewCommand(kDisconnect)
+	cmd.AppendString("NORMAL")
+	if err := peer.send(cmd); err != nil {
+		return err
+	}
+	peer.state = peerGone
+	peer.expected = nil
+	if peer.recordedId == ID_HOST {
+		for _, other := range r.peers {
+			other.state = peerGone
+			other.expected = nil
+		}
+		return nil
+	}
+	r.expect(r.host(), &relayMessage{command: kDisconnectClient, id: peer.recordedId})
+	return nil
+}
+
+// awaitLost waits until the relay noticed that the connection of the peer is
+// lost, so it takes the peer back when it returns. The relay only lists
+// connected peers in its round trip times, so another peer asks for them.
+func (r *replayer) awaitLost(lost *replayPeer) error {
+	assigned, known := r.ids[lost.recordedId]
+	var observer *replayPeer
+	for _, peer := range r.peers {
+		if peer.state == peerConnected {
+			observer = peer
+			break
+		}
+	}
+	if !known || observer == nil {
+		// Nobody to ask, so give the relay some time
+		time.Sleep(kReplayPollInterval * 10)
+		return nil
+	}
+	deadline := time.Now().Add(r.options.Timeout)
+	for {
+		if err := observer.send(NewCommand(kRoundTripTimeRequest)); err != nil {
+			return err
+		}
+		var response *relayMessage
+		for response == nil {
+			msg, err := r.receive(observer)
+			if err != nil {
+				return err
+			}
+			if msg.command == kRoundTripTimeResponse {
+				response = msg
+			} else if err := r.handle(observer, msg); err != nil {
+				return err
+			}
+		}
+		if bytes.IndexByte(response.ids, assigned) < 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the relay did not notice that %v lost its connection", lost)
+		}
+		time.Sleep(kReplayPollInterval)
+	}
+}
+
+// receive returns the next message for the peer.
+func (r *replayer) receive(peer *replayPeer) (*relayMessage, error) {
+	select {
+	case msg, ok := <-peer.incoming:
+		if !ok {
+			return nil, fmt.Errorf("the relay closed the connection of %v", peer)
+		}
+		return msg, nil
+	case <-time.After(r.options.Timeout):
+		return nil, fmt.Errorf("timeout while waiting for a message to %v", peer)
+	}
+}
+
+// settle waits until all connected peers received what they expect.
+func (r *replayer) settle() error {
+	for _, peer := range r.peers {
+		for peer.state == peerConnected && len(peer.expected) > 0 {
+			msg, err := r.receive(peer)
+			if err != nil {
+				return err
+			}
+			if err := r.handle(peer, msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handle checks a message received by the peer against what it expects.
+func (r *replayer) handle(peer *replayPeer, msg *relayMessage) error {
+	switch msg.command {
+	case kHostAway, kHostReturned, kRoundTripTimeResponse:
+		return nil
+	case kDisconnect:
+		return fmt.Errorf("the relay disconnected %v: %v", peer, msg.text)
+	case kConnectClient, kDisconnectClient, kFromClient, kFromHost:
+	default:
+		return fmt.Errorf("%v got unexpected %v", peer, msg)
+	}
+	if len(peer.expected) == 0 {
+		return fmt.Errorf("%v got unexpected %v", peer, msg)
+	}
+	expected := peer.expected[0]
+	matches := msg.command == expected.command && bytes.Equal(msg.packet, expected.packet)
+	if matches && msg.command != kFromHost {
+		if assigned, ok := r.ids[expected.id]; ok {
+			matches = msg.id == assigned
+		} else if msg.command == kConnectClient {
+			r.ids[expected.id] = msg.id
+		} else {
+			matches = false
+		}
+	}
+	if !matches {
+		return fmt.Errorf("%v got %v instead of %v", peer, msg, expected)
+	}
+	peer.expected = peer.expected[1:]
+	return nil
+}
+
+func (r *replayer) closeConnections() {
+	for _, peer := range r.peers {
+		if peer.conn != nil {
+			peer.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+	"net"
+	"strings"
+	"time"
+)
+
+// dialer returns a function that connects to the server like a real
+// connection would.
+func dialer(server *Server) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		relaySide, replaySide := net.Pipe()
+		go server.dealWithNewConnection(New(relaySide, server.clientQueueSize, server.clientWriteTimeout))
+		return replaySide, nil
+	}
+}
+
+func replayOptions() ReplayOptions {
+	return ReplayOptions{Timeout: time.Second}
+}
+
+// waitForGamesToEnd waits till the relay has shut down its games, which
+// closes their recordings. Replay returns before that happens.
+func waitForGamesToEnd(c *C, server *Server) {
+	for i := 0; i < 100 && len(server.Games()) != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(server.Games(), HasLen, 0)
+}
+
+// recordedGame returns the records of the only recording of the server.
+func recordedGame(c *C, server *Server) []*Record {
+	header, records, err := LoadRecording(recordingFiles(c, server.recordingPolicy.Directory))
+	c.Assert(err, IsNil)
+	c.Assert(header.Part, Equals, 0)
+	return records
+}
+
+func checkSameRecords(c *C, got, expected []*Record) {
+	c.Assert(got, HasLen, len(expected))
+	for i := range got {
+		c.Check(got[i].Type, Equals, expected[i].Type, Commentf("record %v", i))
+		c.Check(got[i].Ids, DeepEquals, expected[i].Ids, Commentf("record %v", i))
+		c.Check(got[i].Packet, DeepEquals, expected[i].Packet, Commentf("record %v", i))
+	}
+}
+
+func (s *RelaySuite) TestReplayRecordedGame(c *C) {
+	server, _ := setupServer()
+	server.recordingPolicy.Directory = c.MkDir()
+	server.recordingPolicy.AllGames = true
+	server.CreateGame("game", "pwd", false)
+	host := connect(server, "game", "pwd")
+	expectWelcome(c, host, "game")
+	client := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 2)
+	expectWelcome(c, client, "game")
+	other := connect(server, "game", "")
+	expectBytes(c, host, kConnectClient, 3)
+	expectWelcome(c, other, "game")
+
+	send(client, kToHost, 0, 4, 'a', 'b')
+	expectBytes(c, host, kFromClient, 2, 0, 4, 'a', 'b')
+	send(host, kToClients, 2, 3, 0, 0, 3, 'x')
+	expectBytes(c, client, kFromHost, 0, 3, 'x')
+	expectBytes(c, other, kFromHost, 0, 3, 'x')
+	send(other, kDisconnect, 'N', 'O', 'R', 'M', 'A', 'L', 0)
+	expectBytes(c, host, kDisconnectClient, 3)
+	send(host, kToClients, 2, 0, 0, 3, 'y')
+	expectBytes(c, client, kFromHost, 0, 3, 'y')
+	send(host, kDisconnect, 'N', 'O', 'R', 'M', 'A', 'L', 0)
+	expectBytes(c, client, kDisconnect)
+	records := recordedGame(c, server)
+	c.Assert(records, HasLen, 8)
+
+	// Replay it on another relay, which records it as well
+	replayServer, _ := setupServer()
+	replayServer.recordingPolicy.Directory = c.MkDir()
+	replayServer.recordingPolicy.AllGames = true
+	replayServer.CreateGame("game (replay)", "other", false)
+	err := Replay(records, dialer(replayServer), "game (replay)", "other", replayOptions())
+	c.Assert(err, IsNil)
+	waitForGamesToEnd(c, replayServer)
+	checkSameRecords(c, recordedGame(c, replayServer), records)
+}
+
+func (s *RelaySuite) TestReplayLostConnections(c *C) {
+	ms := time.Millisecond
+	records := []*Record{
+		{Type: kRecordConnected, Ids: []uint8{ID_HOST}},
+		{Type: kRecordConnected, Ids: []uint8{2}},
+		{Type: kRecordToHost, Time: 10 * ms, Ids: []uint8{2}, Packet: []byte{0, 3, 1}},
+		{Type: kRecordDisconnected, Time: 20 * ms, Ids: []uint8{2}},
+		{Type: kRecordToClients, Time: 30 * ms, Ids: []uint8{2}, Packet: []byte{0, 3, 2}},
+		{Type: kRecordConnected, Time: 40 * ms, Ids: []uint8{2}},
+		{Type: kRecordDisconnected, Time: 50 * ms, Ids: []uint8{ID_HOST}},
+		{Type: kRecordToHost, Time: 60 * ms, Ids: []uint8{2}, Packet: []byte{0, 3, 3}},
+		{Type: kRecordConnected, Time: 70 * ms, Ids: []uint8{3}},
+		{Type: kRecordConnected, Time: 80 * ms, Ids: []uint8{ID_HOST}},
+		{Type: kRecordToClients, Time: 90 * ms, Ids: []uint8{2, 3}, Packet: []byte{0, 3, 4}},
+		{Type: kRecordDisconnected, Time: 100 * ms, Ids: []uint8{2}},
+		{Type: kRecordDisconnected, Time: 100 * ms, Ids: []uint8{ID_HOST}},
+	}
+	server, _ := setupServer()
+	server.recordingPolicy.Directory = c.MkDir()
+	server.recordingPolicy.AllGames = true
+	server.CreateGame("game", "pwd", false)
+
+	options := replayOptions()
+	options.Speed = 2
+	start := time.Now()
+	c.Assert(Replay(records, dialer(server), "game", "pwd", options), IsNil)
+	c.Assert(time.Since(start) >= 50*ms, Equals, true)
+	waitForGamesToEnd(c, server)
+	checkSameRecords(c, recordedGame(c, server), records)
+}
+
+func (s *RelaySuite) TestReplayDetectsDifferences(c *C) {
+	records := []*Record{
+		{Type: kRecordConnected, Ids: []uint8{ID_HOST}},
+		{Type: kRecordConnected, Ids: []uint8{2}},
+		{Type: kRecordDisconnected, Ids: []uint8{2}},
+		{Type: kRecordToClients, Ids: []uint8{2}, Packet: []byte{0, 3, 1}},
+		{Type: kRecordConnected, Ids: []uint8{2}},
+	}
+	server, _ := setupServer()
+	server.CreateGame("game", "pwd", false)
+	err := Replay(records, dialer(server), "game", "wrong", replayOptions())
+	c.Assert(err, ErrorMatches, ".*the relay refused host: NO_HOST")
+
+	// The relay does not keep anything for the client, so it does not get
+	// its slot back
+	server.clientBufferSize = 0
+	err = Replay(records, dialer(server), "game", "pwd", replayOptions())
+	c.Assert(err, NotNil)
+	c.Assert(strings.HasPrefix(err.Error(), "record 4 "), Equals, true, Commentf("%v", err))
+}
+
+func (s *RelaySuite) TestLoadRecordingParts(c *C) {
+	policy := DefaultRecordingPolicy()
+	policy.Directory = c.MkDir()
+	policy.MaxFileSize = 50
+	recorder, err := NewRecorder(policy, "game")
+	c.Assert(err, IsNil)
+	recorder.Connected(ID_HOST)
+	for i := 0; i < 20; i++ {
+		recorder.ToClients([]uint8{2}, []byte{0, 3, byte(i)})
+	}
+	recorder.Close()
+	paths := recordingFiles(c, policy.Directory)
+	c.Assert(len(paths) > 2, Equals, true)
+
+	// The order of the files does not matter
+	reversed := make([]string, len(paths))
+	for i, path := range paths {
+		reversed[len(paths)-1-i] = path
+	}
+	header, records, err := LoadRecording(reversed)
+	c.Assert(err, IsNil)
+	c.Assert(header.GameName, Equals, "game")
+	c.Assert(records, HasLen, 21)
+	for i, record := range records[1:] {
+		c.Assert(record.Packet[2], Equals, byte(i))
+	}
+
+	_, _, err = LoadRecording(paths[1:])
+	c.Assert(err, ErrorMatches, "file 0 of the recording is missing")
+	_, _, err = LoadRecording(append(paths[:1:1], paths[2:]...))
+	c.Assert(err, ErrorMatches, "file 1 of the recording is missing")
+	_, _, err = LoadRecording(nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *RelaySuite) TestReplayObservers(c *C) {
+	records := []*Record{
+		{Type: kRecordConnected, Ids: []uint8{ID_HOST}},
+		{Type: kRecordConnected, Ids: []uint8{2}},
+		{Type: kRecordObserver, Ids: []uint8{2}},
+		{Type: kRecordBroadcast, Flags: kBroadcastCatchUp, Packet: []byte{0, 3, 1}},
+		{Type: kRecordBroadcast, Packet: []byte{0, 3, 2}},
+		{Type: kRecordConnected, Ids: []uint8{3}},
+		{Type: kRecordObserver, Ids: []uint8{3}},
+		{Type: kRecordBroadcast, Packet: []byte{0, 3, 3}},
+		{Type: kRecordDisconnected, Ids: []uint8{ID_HOST}},
+	}
+	server, _ := setupServer()
+	server.recordingPolicy.Directory = c.MkDir()
+	server.recordingPolicy.AllGames = true
+	server.CreateGame("game", "pwd", false)
+	c.Assert(Replay(records, dialer(server), "game", "pwd", replayOptions()), IsNil)
+	recorded := recordedGame(c, server)
+	checkSameRecords(c, recorded, records)
+	c.Assert(recorded[3].Flags, Equals, kBroadcastCatchUp)
+	c.Assert(recorded[4].Flags, Equals, uint8(0))
+
+	// Without catch-up data the late observer misses the first broadcasts
+	server.catchUpSize = 0
+	server.CreateGame("game", "pwd", false)
+	options := replayOptions()
+	options.Timeout = 50 * time.Millisecond
+	err := Replay(records, dialer(server), "game", "pwd", options)
+	c.Assert(err, ErrorMatches, "record 6 .*timeout while waiting for a message to client 3")
+}
@@ -1,21 +1,127 @@
 package main
 
 import (
+	"compress/flate"
 	"container/list"
+	"github.com/widelands/widelands-metaserver/tlsconfig"
 	"github.com/widelands/widelands-metaserver/wlnr/relayinterface"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type Server struct {
 	acceptedConnections chan net.Conn
 	shutdownServer      chan bool
 	serverHasShutdown   chan bool
-	games               *list.List
 	wlms                relayinterface.Server
+
+	// Time the host has to connect to a newly created game
+	hostConnectTimeout time.Duration
+
+	// Time the host has to reconnect after losing its connection before the
+	// game is closed
+	hostReconnectTimeout time.Duration
+
+	// Number of commands to the host that are kept while it is away
+	hostBufferSize int
+
+	// Time a client has to reconnect after losing its connection before it
+	// is removed from its game
+	clientReconnectTimeout time.Duration
+
+	// Number of commands to a client that are kept while it is away
+	clientBufferSize int
+
+	// Number of commands that can wait for being sent to a client before it
+	// is considered too slow and disconnected
+	clientQueueSize int
+
+	// Time a single write to a client may take before it is disconnected
+	clientWriteTimeout time.Duration
+
+	// Number of bytes of broadcasts that are kept per game for observers
+	// joining later
+	catchUpSize int
+
+	// The deflate level used for clients supporting compression. Zero
+	// disables compression, so clients have to use the uncompressed protocol.
+	compressionLevel int
+
+	// Interval in which statistics about the send queues are logged
+	statsInterval time.Duration
+
+	// Which games are recorded and where
+	recordingPolicy RecordingPolicy
+
+	// Guards games. Games are only accessed while holding it, their methods are
+	// called after releasing it.
+	mutex sync.Mutex
+	games *list.List
+
+	// Notifications about games and their clients for the metaserver. Games
+	// queue them while holding their mutex, so they keep their order, and
+	// sendNotifications passes them on. The metaserver may wait for us while
+	// it is told about them, e.g. when it removes a game.
+	notificationsMutex sync.Mutex
+	notifications      []func()
+	notificationsAdded chan bool
+}
+
+func newServer(acceptedConnections chan net.Conn) *Server {
+	s := &Server{
+		acceptedConnections:    acceptedConnections,
+		shutdownServer:         make(chan bool),
+		serverHasShutdown:      make(chan bool),
+		games:                  list.New(),
+		wlms:                   nil,
+		hostConnectTimeout:     30 * time.Second,
+		hostReconnectTimeout:   60 * time.Second,
+		hostBufferSize:         4096,
+		clientReconnectTimeout: 60 * time.Second,
+		clientBufferSize:       4096,
+		clientQueueSize:        1024,
+		clientWriteTimeout:     30 * time.Second,
+		catchUpSize:            16 << 20,
+		compressionLevel:       flate.BestSpeed,
+		statsInterval:          10 * time.Minute,
+		recordingPolicy:        DefaultRecordingPolicy(),
+		notificationsAdded:     make(chan bool, 1),
+	}
+	go s.sendNotifications()
+	return s
+}
+
+func (s *Server) HostConnectTimeout() time.Duration {
+	return s.hostConnectTimeout
+}
+
+func (s *Server) HostReconnectTimeout() time.Duration {
+	return s.hostReconnectTimeout
+}
+
+func (s *Server) HostBufferSize() int {
+	return s.hostBufferSize
+}
+
+func (s *Server) ClientReconnectTimeout() time.Duration {
+	return s.clientReconnectTimeout
+}
+
+func (s *Server) ClientBufferSize() int {
+	return s.clientBufferSize
+}
+
+func (s *Server) CatchUpSize() int {
+	return s.catchUpSize
+}
+
+func (s *Server) RecordingPolicy() RecordingPolicy {
+	return s.recordingPolicy
 }
 
 func (s *Server) InitiateShutdown() error {
@@ -27,8 +133,22 @@ func (s *Server) WaitTillShutdown() {
 	<-s.serverHasShutdown
 }
 
-func (s *Server) CreateGame(name, password string) bool {
+// findGame returns the game with the given name or nil.
+func (s *Server) findGame(name string) *Game {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for e := s.games.Front(); e != nil; e = e.Next() {
+		game := e.Value.(*Game)
+		if game.Name() == name {
+			return game
+		}
+	}
+	return nil
+}
 
+func (s *Server) CreateGame(name, password string, restricted bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	// Check if the game already exists
 	for e := s.games.Front(); e != nil; e = e.Next() {
 		game := e.Value.(*Game)
@@ -38,54 +158,163 @@ func (s *Server) CreateGame(name, password string) bool {
 		}
 	}
 	// It does not, add it
-	game := NewGame(name, password, s)
+	game := NewGame(name, password, restricted, s)
 	log.Printf("Created game '%v'", name)
 	s.games.PushBack(game)
 	return true
 }
 
 func (s *Server) RemoveGame(name string) bool {
-	for e := s.games.Front(); e != nil; e = e.Next() {
-		g := e.Value.(*Game)
-		if g.Name() == name {
-			log.Printf("Removing game '%v' as told by metaserver", name)
-			g.Shutdown()
-			return true
+	g := s.findGame(name)
+	if g == nil {
+		log.Printf("Error: Did not find game '%v' to remove as told by metaserver", name)
+		return false
+	}
+	log.Printf("Removing game '%v' as told by metaserver", name)
+	g.Shutdown()
+	return true
+}
+
+// RecordGame starts recording the game with the given name as told by the
+// metaserver.
+func (s *Server) RecordGame(name string) bool {
+	g := s.findGame(name)
+	if g == nil {
+		log.Printf("Error: Did not find game '%v' to record as told by metaserver", name)
+		return false
+	}
+	return g.StartRecording()
+}
+
+// AddJoinToken allows one client to join the restricted game with the given
+// name as told by the metaserver.
+func (s *Server) AddJoinToken(name, token string) bool {
+	g := s.findGame(name)
+	if g == nil {
+		log.Printf("Error: Did not find game '%v' to add a join token to as told by metaserver", name)
+		return false
+	}
+	g.AddJoinToken(token)
+	return true
+}
+
+// notify queues a notification for the metaserver. Does not block.
+func (s *Server) notify(notification func()) {
+	s.notificationsMutex.Lock()
+	s.notifications = append(s.notifications, notification)
+	s.notificationsMutex.Unlock()
+	select {
+	case s.notificationsAdded <- true:
+	default:
+	}
+}
+
+// sendNotifications passes the queued notifications to the metaserver.
+func (s *Server) sendNotifications() {
+	for range s.notificationsAdded {
+		s.notificationsMutex.Lock()
+		notifications := s.notifications
+		s.notifications = nil
+		s.notificationsMutex.Unlock()
+		for _, notification := range notifications {
+			notification()
 		}
 	}
-	log.Printf("Error: Did not find game '%v' to remove as told by metaserver", name)
-	return false
 }
 
+// ClientConnected tells the metaserver that the client with the given join
+// token joined the game.
+func (s *Server) ClientConnected(name, token string) {
+	s.notify(func() { s.wlms.ClientConnected(name, token) })
+}
+
+// ClientDisconnected tells the metaserver that the client with the given join
+// token left the game for good.
+func (s *Server) ClientDisconnected(name, token string) {
+	s.notify(func() { s.wlms.ClientDisconnected(name, token) })
+}
+
+// ClientKicked tells the metaserver that the host of the game removed the
+// client with the given join token.
+func (s *Server) ClientKicked(name, token string, ban bool) {
+	s.notify(func() { s.wlms.ClientKicked(name, token, ban) })
+}
+
+// GameConnected tells the metaserver that the host connected to the game.
 func (s *Server) GameConnected(name string) {
-	s.wlms.GameConnected(name)
+	s.notify(func() { s.wlms.GameConnected(name) })
 }
 
 // Search for a game with the given name. If it exists but no host is connected, remove it
 func (s *Server) RemoveGameIfNoHostIsConnected(name string) {
-	for e := s.games.Front(); e != nil; e = e.Next() {
-		g := e.Value.(*Game)
-		if g.Name() == name && g.host == nil {
-			log.Printf("Removing game '%v' since no host connected to it", name)
-			s.wlms.GameClosed(name)
-			s.games.Remove(e)
-			return
-		}
+	g := s.findGame(name)
+	if g == nil || !g.closeIfNoHost() {
+		return
 	}
+	log.Printf("Removing game '%v' since no host connected to it", name)
+	s.RemoveGameObject(g)
 }
 
 func (s *Server) RemoveGameObject(game *Game) {
+	s.mutex.Lock()
+	found := false
 	for e := s.games.Front(); e != nil; e = e.Next() {
 		if e.Value.(*Game) == game {
-			s.wlms.GameClosed(game.Name())
 			s.games.Remove(e)
-			return
+			found = true
+			break
+		}
+	}
+	s.mutex.Unlock()
+	if !found {
+		log.Printf("Error: Did not find game '%v' to remove!", game.Name())
+		return
+	}
+	// Queued, since the metaserver might wait for us to remove the game
+	s.notify(func() { s.wlms.GameClosed(game.Name()) })
+}
+
+// logQueueStats logs the fullest send queue of each game.
+func (s *Server) logQueueStats() {
+	for _, game := range s.Games() {
+		var fullest QueueStats
+		fullestId := uint8(0)
+		for id, stats := range game.QueueStats() {
+			if fullestId == 0 || stats.MaxQueued > fullest.MaxQueued {
+				fullest = stats
+				fullestId = id
+			}
+		}
+		if fullestId == 0 {
+			continue
+		}
+		log.Printf("Game '%v': Fullest send queue is of client (id=%v) with %v/%v commands, at most %v, %v sent",
+			game.Name(), fullestId, fullest.Queued, fullest.Capacity, fullest.MaxQueued, fullest.Sent)
+	}
+}
+
+// Games returns all games of the server.
+func (s *Server) Games() []*Game {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var games []*Game
+	for e := s.games.Front(); e != nil; e = e.Next() {
+		games = append(games, e.Value.(*Game))
+	}
+	return games
+}
+
+func acceptConnections(ln net.Listener, C chan net.Conn) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			break
 		}
+		C <- conn
 	}
-	log.Printf("Error: Did not find game '%v' to remove!", game.Name())
 }
 
-func RunServer() {
+func RunServer(recording RecordingPolicy, compressionLevel int, tls TLSSettings) {
 	ln, err := net.Listen("tcp", ":7397")
 	if err != nil {
 		log.Fatal(err)
@@ -93,22 +322,23 @@ func RunServer() {
 	defer ln.Close()
 
 	C := make(chan net.Conn)
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				break
-			}
-			C <- conn
+	go acceptConnections(ln, C)
+
+	if tls.Enabled() {
+		tlsLn, err := tlsconfig.Listen(tls.Address, tls.Certificate, tls.Key)
+		if err != nil {
+			log.Fatalf("Unable to listen for TLS connections: %v", err)
 		}
-	}()
+		defer tlsLn.Close()
+		log.Printf("Accepting TLS connections on %v", tls.Address)
+		go acceptConnections(tlsLn, C)
+	}
 
-	server := &Server{
-		acceptedConnections: C,
-		shutdownServer:      make(chan bool),
-		serverHasShutdown:   make(chan bool),
-		games:               list.New(),
-		wlms:                nil,
+	server := newServer(C)
+	server.recordingPolicy = recording
+	server.compressionLevel = compressionLevel
+	if recording.Enabled() {
+		removeOldRecordings(recording)
 	}
 	server.wlms = relayinterface.NewServerRPC(server)
 	defer server.wlms.CloseConnection()
@@ -130,18 +360,21 @@ func RunServer() {
 }
 
 func (s *Server) mainLoop() {
+	statsTicker := time.NewTicker(s.statsInterval)
+	defer statsTicker.Stop()
 	for {
 		select {
 		case conn, ok := <-s.acceptedConnections:
 			if !ok {
 				return
 			}
-			go s.dealWithNewConnection(New(conn))
+			go s.dealWithNewConnection(New(conn, s.clientQueueSize, s.clientWriteTimeout))
+		case <-statsTicker.C:
+			s.logQueueStats()
 		case <-s.shutdownServer:
-			for s.games.Len() > 0 {
-				e := s.games.Front()
-				e.Value.(*Game).Shutdown()
+			for _, game := range s.Games() {
 				// Game removes itself
+				game.Shutdown()
 			}
 			close(s.acceptedConnections)
 			s.serverHasShutdown <- true
@@ -161,7 +394,8 @@ func (s *Server) dealWithNewConnection(client *Client) {
 		client.Disconnect("PROTOCOL_VIOLATION")
 		return
 	}
-	if version != kRelayProtocolVersion {
+	if version < kRelayProtocolVersionOldest || version > kRelayProtocolVersion ||
+		(version >= kRelayProtocolVersionCompressed && s.compressionLevel == 0) {
 		client.Disconnect("WRONG_VERSION")
 		return
 	}
@@ -176,13 +410,13 @@ func (s *Server) dealWithNewConnection(client *Client) {
 		client.Disconnect("PROTOCOL_VIOLATION")
 		return
 	}
+	if version >= kRelayProtocolVersionCompressed {
+		client.enableCompression(s.compressionLevel)
+	}
 	// The game will handle the client
-	for e := s.games.Front(); e != nil; e = e.Next() {
-		game := e.Value.(*Game)
-		if game.Name() == name {
-			game.addClient(client, version, password)
-			return
-		}
+	if game := s.findGame(name); game != nil {
+		game.addClient(client, version, password)
+		return
 	}
 	// Matching game not found, close connection
 	client.Disconnect("GAME_UNKNOWN")